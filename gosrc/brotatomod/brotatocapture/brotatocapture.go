@@ -0,0 +1,189 @@
+package brotatocapture
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/errutil"
+)
+
+// format of a capture file is:
+// - magic "BXCP" (4 bytes)
+// - capture format version (uint16)
+// - (for each record)
+// -- received timestamp (int64 microsecond epoch)
+// -- protocol version the body was read with (uint16)
+// -- body length (uint32)
+// -- body (variable [uint8, ...]) - decompressed, exactly what the BrotatoMessageReader was given
+
+// magic first bytes of every capture file.
+var magic = [4]byte{'B', 'X', 'C', 'P'}
+
+// FormatVersion current capture format version.
+const FormatVersion uint16 = 1
+
+const (
+	fileHeaderSize   = 6
+	recordHeaderSize = 14
+)
+
+// MaxBodySize largest record body the reader accepts, anything larger is treated as a corrupt length.
+const MaxBodySize = 1 << 26
+
+// ErrInvalidCapture file is not a capture, or is from a newer format version.
+var ErrInvalidCapture = errors.New("invalid capture file")
+
+// Record one message body as received by the server.
+type Record struct {
+	// Timestamp time the body was received.
+	Timestamp brotatomodtypes.MicroTime
+	// ProtocolVersion version the session had negotiated, needed to read Body.
+	ProtocolVersion brotatomodtypes.ProtocolVersion
+	// Body raw message body.
+	Body []byte
+	// Offset of the first body byte from the start of the capture file. Only set when read.
+	Offset int64
+}
+
+// Writer appends records to a capture. The file header is written before the first record.
+type Writer struct {
+	w             io.Writer
+	headerWritten bool
+	buf           []byte
+}
+
+// NewWriter writer for a new capture. Use NewAppendWriter to add to a capture which already has records.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w:   w,
+		buf: make([]byte, 0, recordHeaderSize),
+	}
+}
+
+// NewAppendWriter writer for a capture which already has its file header, e.g. a file opened with O_APPEND.
+// An empty file still gets a header.
+func NewAppendWriter(w io.Writer, size int64) *Writer {
+	cw := NewWriter(w)
+	cw.headerWritten = size > 0
+
+	return cw
+}
+
+// WriteRecord writes the record header and body in a single Write so concurrent appends to the same file can't interleave.
+func (cw *Writer) WriteRecord(record Record) error {
+	cw.buf = cw.buf[:0]
+
+	if !cw.headerWritten {
+		cw.buf = append(cw.buf, magic[:]...)
+		cw.buf = binary.LittleEndian.AppendUint16(cw.buf, FormatVersion)
+	}
+
+	cw.buf = binary.LittleEndian.AppendUint64(cw.buf, uint64(record.Timestamp))
+	cw.buf = binary.LittleEndian.AppendUint16(cw.buf, uint16(record.ProtocolVersion))
+	cw.buf = binary.LittleEndian.AppendUint32(cw.buf, uint32(len(record.Body)))
+	cw.buf = append(cw.buf, record.Body...)
+
+	_, err := cw.w.Write(cw.buf)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+	cw.headerWritten = true
+
+	return nil
+}
+
+// Reader reads records from a capture.
+type Reader struct {
+	r             io.Reader
+	headerRead    bool
+	offset        int64
+	headerBuf     [recordHeaderSize]byte
+	formatVersion uint16
+}
+
+// NewReader
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// FormatVersion of the capture being read. Zero until the first record is read.
+func (cr *Reader) FormatVersion() uint16 {
+	return cr.formatVersion
+}
+
+// ReadRecord next record, io.EOF once there are none left. A capture cut off part way through a record returns io.ErrUnexpectedEOF.
+func (cr *Reader) ReadRecord() (Record, error) {
+	if !cr.headerRead {
+		err := cr.readFileHeader()
+		if err != nil {
+			return Record{}, err
+		}
+	}
+
+	_, err := io.ReadFull(cr.r, cr.headerBuf[:])
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return Record{}, io.EOF
+		}
+
+		return Record{}, errutil.NewStackError(fmt.Errorf("record header at offset %d: %w", cr.offset, err))
+	}
+	cr.offset += recordHeaderSize
+
+	record := Record{
+		Timestamp:       brotatomodtypes.MicroTime(binary.LittleEndian.Uint64(cr.headerBuf[0:8])),
+		ProtocolVersion: brotatomodtypes.ProtocolVersion(binary.LittleEndian.Uint16(cr.headerBuf[8:10])),
+		Offset:          cr.offset,
+	}
+
+	bodyLen := binary.LittleEndian.Uint32(cr.headerBuf[10:14])
+	if bodyLen > MaxBodySize {
+		return Record{}, errutil.NewStackError(fmt.Errorf("%w: record body length (%d) at offset %d", ErrInvalidCapture, bodyLen, cr.offset-4))
+	}
+
+	record.Body = make([]byte, bodyLen)
+
+	n, err := io.ReadFull(cr.r, record.Body)
+	cr.offset += int64(n)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return Record{}, errutil.NewStackError(fmt.Errorf("record body at offset %d: %w", record.Offset, err))
+	}
+
+	return record, nil
+}
+
+// readFileHeader
+func (cr *Reader) readFileHeader() error {
+	buf := cr.headerBuf[:fileHeaderSize]
+
+	_, err := io.ReadFull(cr.r, buf)
+	if err != nil {
+		// nothing was ever captured
+		if errors.Is(err, io.EOF) {
+			return io.EOF
+		}
+
+		return errutil.NewStackError(fmt.Errorf("%w: %w", ErrInvalidCapture, err))
+	}
+
+	if [4]byte(buf[:4]) != magic {
+		return errutil.NewStackError(fmt.Errorf("%w: bad magic", ErrInvalidCapture))
+	}
+
+	cr.formatVersion = binary.LittleEndian.Uint16(buf[4:6])
+	if cr.formatVersion == 0 || cr.formatVersion > FormatVersion {
+		return errutil.NewStackError(fmt.Errorf("%w: unsupported format version (%d)", ErrInvalidCapture, cr.formatVersion))
+	}
+
+	cr.headerRead = true
+	cr.offset = fileHeaderSize
+
+	return nil
+}
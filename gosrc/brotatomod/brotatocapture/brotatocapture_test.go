@@ -0,0 +1,80 @@
+package brotatocapture
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapture(t *testing.T) {
+	nowTimestamp := brotatomodtypes.MicroTimeFromTime(time.Now())
+
+	records := []Record{
+		{Timestamp: nowTimestamp, ProtocolVersion: brotatomodtypes.ProtocolVersionFramed, Body: []byte{1, 2, 3}},
+		{Timestamp: nowTimestamp + 1000, ProtocolVersion: brotatomodtypes.ProtocolVersionFramed, Body: []byte{}},
+		{Timestamp: nowTimestamp + 2000, ProtocolVersion: brotatomodtypes.ProtocolVersionLegacy, Body: []byte{4, 5}},
+	}
+
+	t.Run("TestRoundTrip", func(t *testing.T) {
+		asserter := require.New(t)
+
+		w := bytes.NewBuffer(nil)
+		cw := NewWriter(w)
+		for _, record := range records[:2] {
+			asserter.NoError(cw.WriteRecord(record))
+		}
+
+		// appending to the existing capture must not write a second header
+		cw = NewAppendWriter(w, int64(w.Len()))
+		asserter.NoError(cw.WriteRecord(records[2]))
+
+		cr := NewReader(bytes.NewReader(w.Bytes()))
+
+		offset := int64(fileHeaderSize)
+		for _, expected := range records {
+			record, err := cr.ReadRecord()
+			asserter.NoError(err)
+
+			offset += recordHeaderSize
+			asserter.Equal(expected.Timestamp, record.Timestamp)
+			asserter.Equal(expected.ProtocolVersion, record.ProtocolVersion)
+			asserter.Equal(expected.Body, record.Body)
+			asserter.Equal(offset, record.Offset)
+			asserter.Equal(expected.Body, w.Bytes()[record.Offset:record.Offset+int64(len(record.Body))])
+
+			offset += int64(len(record.Body))
+		}
+
+		_, err := cr.ReadRecord()
+		asserter.ErrorIs(err, io.EOF)
+		asserter.Equal(FormatVersion, cr.FormatVersion())
+	})
+
+	t.Run("TestEmpty", func(t *testing.T) {
+		asserter := require.New(t)
+
+		_, err := NewReader(bytes.NewReader(nil)).ReadRecord()
+		asserter.ErrorIs(err, io.EOF)
+	})
+
+	t.Run("TestTruncated", func(t *testing.T) {
+		asserter := require.New(t)
+
+		w := bytes.NewBuffer(nil)
+		asserter.NoError(NewWriter(w).WriteRecord(records[0]))
+
+		_, err := NewReader(bytes.NewReader(w.Bytes()[:w.Len()-1])).ReadRecord()
+		asserter.ErrorIs(err, io.ErrUnexpectedEOF)
+	})
+
+	t.Run("TestInvalid", func(t *testing.T) {
+		asserter := require.New(t)
+
+		_, err := NewReader(bytes.NewReader([]byte("not a capture"))).ReadRecord()
+		asserter.ErrorIs(err, ErrInvalidCapture)
+	})
+}
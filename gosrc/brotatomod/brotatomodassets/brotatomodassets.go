@@ -0,0 +1,22 @@
+package brotatomodassets
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// modFiles the Godot mod tree. Dot files (ex. the local connect-config .gitignore) are excluded by embed.
+//
+//go:embed mod
+var modFiles embed.FS
+
+// ModFS mod tree rooted at the directory containing mods-unpacked, same layout as the mod zip.
+func ModFS() fs.FS {
+	modFS, err := fs.Sub(modFiles, "mod")
+	if err != nil {
+		// only fails on an invalid path which is constant
+		panic(err)
+	}
+
+	return modFS
+}
@@ -3,7 +3,6 @@ extends Node
 
 # type headers for binary data
 # used to tell the server what data types we are working with
-# TODO: add types with more depth
 # TODO: improve space usage by making strings and ints use correct amount of bytes to represent the number
 
 # represents any utf-8 encoded portion of data
@@ -18,6 +17,30 @@ const SERIAL_TYPE_INT64 = 0xd3
 
 const SERIAL_TYPE_FLOAT32 = 0xca
 
+# below types are only sent when the server negotiated the extended_serial_types capability
+const SERIAL_TYPE_UINT8 = 0xcc
+const SERIAL_TYPE_UINT16 = 0xcd
+const SERIAL_TYPE_UINT32 = 0xce
+const SERIAL_TYPE_UINT64 = 0xcf
+
+const SERIAL_TYPE_FLOAT64 = 0xcb
+
+# single byte - 0 or 1
+const SERIAL_TYPE_BOOL = 0xc3
+
+# key was removed - no value bytes follow
+const SERIAL_TYPE_REMOVED = 0xc0
+
+# below types are only sent when the server negotiated the nested_serial_types capability
+# both are followed by a uint32 byte length like strings, then a uint16 element count
+# array elements are SERIAL_TYPE (uint8) then the value bytes
+# map entries are key string length (uint16), key string, SERIAL_TYPE (uint8) then the value bytes
+const SERIAL_TYPE_ARRAY = 0xdd
+const SERIAL_TYPE_MAP = 0xde
+
+# values nested deeper than this are skipped - the server rejects anything deeper
+const MAX_NESTED_DEPTH = 16
+
 const MESSAGE_DICT_MAPPING_HEADER = 0xdf
 
 # stores dictionary keys' (strings) mappings to a [$keyMapping: PoolByteArray, $data_type: SERIAL_TYPE] pair
@@ -28,16 +51,50 @@ var _key_counter: int = 0
 # by using 2 bytes per key, we can have a max of 65,535 distinct keys
 var _key_counter_max: int = 1 << 31
 
+# set when the server supports the extended_serial_types capability. Otherwise bools are sent as ints,
+# floats as float32 and removed keys are skipped
+var extended_types: bool = false
+
+# set when the server supports the nested_serial_types capability. Otherwise arrays and dictionaries are skipped
+var nested_types: bool = false
+
 static func serial_type_for_int(val: int)->int:
-	if -(1 << 7) <= val and val <= (1 << 7):
+	if -(1 << 7) <= val and val < (1 << 7):
 		return SERIAL_TYPE_INT8
-	if -(1 << 15) <= val and val <= (1 << 15):
+	if -(1 << 15) <= val and val < (1 << 15):
 		return SERIAL_TYPE_INT16
-	if -(1 << 31) <= val and val <= (1 << 31):
+	if -(1 << 31) <= val and val < (1 << 31):
 		return SERIAL_TYPE_INT32
 	
 	return SERIAL_TYPE_INT64
 
+# returns SERIAL_TYPE for the value or 0 if it can't be sent
+func serial_type_for_value(val)->int:
+	match typeof(val):
+		TYPE_INT:
+			return serial_type_for_int(val)
+		TYPE_REAL:
+			if extended_types:
+				return SERIAL_TYPE_FLOAT64
+			return SERIAL_TYPE_FLOAT32
+		TYPE_STRING:
+			return SERIAL_TYPE_STRING
+		TYPE_BOOL:
+			if extended_types:
+				return SERIAL_TYPE_BOOL
+			return SERIAL_TYPE_INT8
+		TYPE_NIL:
+			if extended_types:
+				return SERIAL_TYPE_REMOVED
+		TYPE_ARRAY:
+			if nested_types:
+				return SERIAL_TYPE_ARRAY
+		TYPE_DICTIONARY:
+			if nested_types:
+				return SERIAL_TYPE_MAP
+	
+	return 0
+
 # need to clear this on new session start
 func clear():
 	_key_counter = 0
@@ -52,16 +109,9 @@ func _get_mapping_for_key(key: String, value):
 	if _key_counter >= _key_counter_max:
 		return ["Key count overflow - too many distinct dict keys"]
 	
-	var serial_type: int
-	match typeof(value):
-		TYPE_INT:
-			serial_type = serial_type_for_int(value)
-		TYPE_REAL:
-			serial_type = SERIAL_TYPE_FLOAT32
-		TYPE_STRING:
-			serial_type = SERIAL_TYPE_STRING
-		_:
-			return ["Unknown type given"]
+	var serial_type: int = serial_type_for_value(value)
+	if not serial_type:
+		return ["Unknown type given"]
 	
 	var item = [_key_counter, serial_type]
 	_dict_key_mapping_dict[key] = item.duplicate()
@@ -81,7 +131,7 @@ func _get_mapping_for_key(key: String, value):
 # - amount of key-value pairs (uint16)
 # - (for each key in dict)
 # -- $key_mappings[key] (uint16)
-# -- value bytes (variable - either uintx or [uint32 {length}, uint8, uint8, ...]
+# -- value bytes (variable - either uintx, nothing for removed keys or [uint32 {length}, uint8, uint8, ...]
 # TODO: make this more efficient by pre-allocating the arrays
 func encode_dict(dict: Dictionary) -> PoolByteArray:
 	var header_buf = StreamPeerBuffer.new()
@@ -100,6 +150,10 @@ func encode_dict(dict: Dictionary) -> PoolByteArray:
 			continue
 		
 		var val = dict[key]
+		# removed keys can't be expressed without the extended types
+		if typeof(val) == TYPE_NIL and not extended_types:
+			continue
+		
 		var res = _get_mapping_for_key(key, val)
 		
 		if res[0]:
@@ -111,17 +165,8 @@ func encode_dict(dict: Dictionary) -> PoolByteArray:
 		var key_mapping = res[2]
 		var serial_type = res[3]
 		
-		# check to see if the type changed (hits for larger ints)
-		var val_serial_type: int
-		match typeof(val):
-			TYPE_INT:
-				val_serial_type = serial_type_for_int(val)
-			TYPE_STRING:
-				val_serial_type = SERIAL_TYPE_STRING
-			TYPE_REAL:
-				val_serial_type = SERIAL_TYPE_FLOAT32
-			_:
-				pass
+		# check to see if the type changed (hits for larger ints and removed keys)
+		var val_serial_type: int = serial_type_for_value(val)
 		if not val_serial_type:
 			continue
 		
@@ -186,13 +231,18 @@ static func _write_key_mapping_to_header(buf: StreamPeerBuffer, key: String, key
 # appends below to given buf
 # -- $key_mappings[key] (uint16)
 # -- value bytes (variable - either uint32 or [uint32 {length}, uint8, uint8, ...]
-static func _write_key_value_pair(buf: StreamPeerBuffer, key_mapping: int, value, value_serial_type: int)->int:
-	var error: int = 0
+func _write_key_value_pair(buf: StreamPeerBuffer, key_mapping: int, value, value_serial_type: int)->int:
 	buf.put_16(key_mapping)
 	
+	return _write_value(buf, value, value_serial_type, 1)
+
+# appends the value bytes for the SERIAL_TYPE to given buf
+func _write_value(buf: StreamPeerBuffer, value, value_serial_type: int, depth: int)->int:
+	var error: int = 0
 	match value_serial_type:
 		SERIAL_TYPE_INT8:
-			buf.put_8(value)
+			# bools are sent as int8 without the extended types
+			buf.put_8(int(value))
 		SERIAL_TYPE_INT16:
 			buf.put_16(value)
 		SERIAL_TYPE_INT32:
@@ -201,13 +251,67 @@ static func _write_key_value_pair(buf: StreamPeerBuffer, key_mapping: int, value
 			buf.put_64(value)
 		SERIAL_TYPE_FLOAT32:
 			buf.put_float(value)
+		SERIAL_TYPE_FLOAT64:
+			buf.put_double(value)
+		SERIAL_TYPE_BOOL:
+			buf.put_u8(1 if value else 0)
+		SERIAL_TYPE_REMOVED:
+			pass
 		SERIAL_TYPE_STRING:
 			# for strings - its int32 for length then string content
-			buf.put_32(value.length())
-			error = buf.put_data(value.to_utf8())
+			var value_bytes: PoolByteArray = value.to_utf8()
+			buf.put_32(value_bytes.size())
+			error = buf.put_data(value_bytes)
+		SERIAL_TYPE_ARRAY, SERIAL_TYPE_MAP:
+			error = _write_nested(buf, value, value_serial_type, depth)
 	
 	return error
 
+# appends below to given buf
+# - byte length (uint32)
+# - element count (uint16)
+# - (for each element)
+# -- (maps only) key string length (uint16)
+# -- (maps only) key string (variable [uint8, ...])
+# -- SERIAL_TYPE (uint8)
+# -- value bytes
+# elements with types that can't be sent are skipped
+func _write_nested(buf: StreamPeerBuffer, value, value_serial_type: int, depth: int)->int:
+	var nested_buf = StreamPeerBuffer.new()
+	nested_buf.put_u16(0)
+	
+	var is_map = value_serial_type == SERIAL_TYPE_MAP
+	var keys = value.keys() if is_map else range(value.size())
+	
+	var count = 0
+	for key in keys:
+		var element = value[key]
+		var element_serial_type = serial_type_for_value(element)
+		if not element_serial_type:
+			continue
+		if (element_serial_type == SERIAL_TYPE_ARRAY or element_serial_type == SERIAL_TYPE_MAP) and depth >= MAX_NESTED_DEPTH:
+			continue
+		
+		if is_map:
+			var key_bytes: PoolByteArray = str(key).to_utf8()
+			nested_buf.put_u16(key_bytes.size())
+			var _error = nested_buf.put_data(key_bytes)
+		nested_buf.put_u8(element_serial_type)
+		
+		var error = _write_value(nested_buf, element, element_serial_type, depth + 1)
+		if error != OK:
+			return error
+		
+		count = count + 1
+	
+	nested_buf.seek(0)
+	nested_buf.put_u16(count)
+	
+	var nested_bytes = nested_buf.data_array
+	buf.put_u32(nested_bytes.size())
+	
+	return buf.put_data(nested_bytes)
+
 static func int16_bytes(v: int)->Array:
 	var b1 = v & 0xFF
 	var b2 = (v >> 8) & 0xFF
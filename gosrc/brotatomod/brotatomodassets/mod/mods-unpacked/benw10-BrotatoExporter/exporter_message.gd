@@ -3,10 +3,18 @@ extends Node
 func _ready():
 	pass
 
+# wire format version sent when authenticating - server replies with the version to use
+const PROTOCOL_VERSION_LEGACY = 1
+# each message is prefixed with its length and CRC32 - see write_frame_to_buf
+const PROTOCOL_VERSION_FRAMED = 2
+const PROTOCOL_VERSION = PROTOCOL_VERSION_FRAMED
+
 # iota at home
 const MESSAGE_TYPE_KEEP_ALIVE = 0
 const MESSAGE_TYPE_TIME_SERIES_FULL = MESSAGE_TYPE_KEEP_ALIVE+1
 const MESSAGE_TYPE_TIME_SERIES_DIFF = MESSAGE_TYPE_TIME_SERIES_FULL+1
+# server forgets every key mapping - send after clearing the dict serializer
+const MESSAGE_TYPE_MAPPING_RESET = MESSAGE_TYPE_TIME_SERIES_DIFF+1
 
 const MESSAGE_REASON_NONE = 0
 const MESSAGE_REASON_SHOP_ENTERED = MESSAGE_REASON_NONE + 1
@@ -21,6 +29,12 @@ static func make_keep_alive_message()->Dictionary:
 		"message_timestamp": _get_time_microseconds(),
 		"message_reason": MESSAGE_REASON_POLL,
 	}
+static func make_mapping_reset_message()->Dictionary:
+	return {
+		"message_type": MESSAGE_TYPE_MAPPING_RESET,
+		"message_timestamp": _get_time_microseconds(),
+		"message_reason": MESSAGE_REASON_NONE,
+	}
 # dict encoder should implement `encode_dict(dict: Dictionary)`
 static func make_time_series_full_message(dict_encoder, msg_reason: int, diff_dict: Dictionary) -> Dictionary:
 	return {
@@ -63,3 +77,42 @@ static func write_to_buf(msg: Dictionary, buf: StreamPeer)->int:
 	#print("Message Content - ", message_content_buf)
 	var error: int = buf.put_data(msg["message_content_buf"])
 	return error
+
+# copy the message to the buffer wrapped in a frame so the server can skip it if it arrives corrupt
+# format is -
+# - message length (uint32)
+# - CRC32 (IEEE) of the message bytes (uint32)
+# - write_to_buf output
+static func write_frame_to_buf(msg: Dictionary, buf: StreamPeer, crc32_table: Array)->int:
+	var msg_buf = StreamPeerBuffer.new()
+	var error: int = write_to_buf(msg, msg_buf)
+	if error != OK:
+		return error
+	
+	var msg_bytes: PoolByteArray = msg_buf.data_array
+	buf.put_u32(msg_bytes.size())
+	buf.put_u32(crc32(msg_bytes, crc32_table))
+	
+	return buf.put_data(msg_bytes)
+
+# lookup table for crc32 - build once and reuse
+static func make_crc32_table()->Array:
+	var table = []
+	table.resize(256)
+	for i in range(256):
+		var c: int = i
+		for _j in range(8):
+			if c & 1:
+				c = 0xEDB88320 ^ (c >> 1)
+			else:
+				c = c >> 1
+		table[i] = c
+	
+	return table
+
+static func crc32(data: PoolByteArray, table: Array)->int:
+	var crc: int = 0xFFFFFFFF
+	for b in data:
+		crc = table[(crc ^ b) & 0xFF] ^ (crc >> 8)
+	
+	return crc ^ 0xFFFFFFFF
@@ -0,0 +1,535 @@
+class_name ModExporter
+extends Node
+
+var ExporterMessage = preload("res://mods-unpacked/benw10-BrotatoExporter/exporter_message.gd")
+
+signal authenticated()
+signal error(err, code)
+signal connected()
+signal disconnected()
+# server lost the key mappings - caller should clear the dict serializer and send a mapping reset then the full state
+signal mapping_reset_required()
+
+# public fields and methods
+# must set before attempting to do anything
+var auth_token: String
+# optional features to ask the server for when authenticating
+var requested_capabilities: Array = []
+# optional private CA the server's cert is signed by. HTTPClient in Godot 3 can't be given a CA, so only the websocket uses it
+var trusted_ca_cert: X509Certificate = null
+
+# negotiated with the server on authentication
+var protocol_version: int = ExporterMessage.PROTOCOL_VERSION_LEGACY
+var capabilities: Array = []
+
+func has_capability(capability: String) -> bool:
+	return capabilities.has(capability)
+
+func conn_ready() -> bool:
+	return _conn_ready
+
+# should implement `write_to_buf(buf: StreamPeerBuffer)`
+func enqueue_message(msg):
+	# circle back around if we overflow 1000 messages - will overwrite the oldest messages first
+	if _message_queue.size() >= _MAX_MESSAGES && _message_queue_idx >= _MAX_MESSAGES-1:
+		_message_queue_idx = 0
+	elif _message_queue.size() <= _message_queue_idx:
+		_message_queue.append_array(_empty_array.duplicate())
+
+	_message_queue[_message_queue_idx] = msg
+	_message_queue_idx = _message_queue_idx + 1
+	
+static func status_str(v: int) -> String:
+	match v:
+		HTTPClient.STATUS_DISCONNECTED:
+			return "STATUS_DISCONNECTED"
+		HTTPClient.STATUS_RESOLVING:
+			return "STATUS_RESOLVING"
+		HTTPClient.STATUS_CANT_RESOLVE:
+			return "STATUS_CANT_RESOLVE"
+		HTTPClient.STATUS_CONNECTING:
+			return "STATUS_CONNECTING"
+		HTTPClient.STATUS_CANT_CONNECT:
+			return "STATUS_CANT_CONNECT"
+		HTTPClient.STATUS_CONNECTED:
+			return "STATUS_CONNECTED"
+		HTTPClient.STATUS_REQUESTING:
+			return "STATUS_REQUESTING"
+		HTTPClient.STATUS_BODY:
+			return "STATUS_BODY"
+		HTTPClient.STATUS_CONNECTION_ERROR:
+			return "STATUS_CONNECTION_ERROR"
+		HTTPClient.STATUS_SSL_HANDSHAKE_ERROR:
+			return "STATUS_SSL_HANDSHAKE_ERROR"
+	return ""
+	
+func connect_to_host(host: String, port: int, use_https: bool = false, verify_host: bool = false) -> void:
+	_authenticated = false
+	_host = host
+	_port = port
+	_use_https = use_https
+	_verify_host = verify_host
+	_ws_disabled = false
+	_close_ingest_websocket()
+	# Reset status so we can tell if it changes to error again.
+	_status = _client.STATUS_DISCONNECTED
+	var error: int = _client.connect_to_host(host, port, use_https, verify_host)
+	if error != OK:
+		emit_signal("error", "Error connecting to host", error)
+		return
+	
+# private fields and methods
+# 4 seconds so we dont timeout
+const _MAX_POLL_FREQ = 4000
+var _poll_freq: int = 1000
+
+const _MAX_MESSAGES: int = 1000
+
+var _status: int = 0
+
+var _client: HTTPClient = HTTPClient.new()
+
+var _last_frame_processed_ticks: int = 0
+
+var _body_buf: StreamPeerBuffer = StreamPeerBuffer.new()
+
+func _ready() -> void:
+	_status = _client.get_status()
+	_last_frame_processed_ticks = Time.get_ticks_msec() - _poll_freq
+	_body_buf.resize(1024)
+	
+	var _error_exited_tree = self.connect("tree_exited", self, "_on_tree_exited")
+
+var _empty_array: Array = [null, null, null, null, null, null, null, null, null, null]
+
+# array of ExporterMessages
+var _message_queue: Array = _empty_array.duplicate()
+var _message_queue_idx: int = 0
+
+var _crc32_table: Array = ExporterMessage.make_crc32_table()
+
+var _conn_ready: bool = false
+var _authenticated: bool = false
+
+var _session_token: String
+var _session_token_exp_ticks: int
+
+const _AUTH_REQ: int = 1
+const _POST_MESSAGE_REQ: int = _AUTH_REQ + 1
+
+const _AUTH_ENDPOINT: String = "/api/auth/authenticate"
+const _POST_MESSAGE_ENDPOINT: String = "/api/message/post"
+
+var _in_req: int = 0
+
+var _host: String
+var _port: int
+var _use_https: bool
+var _verify_host: bool
+
+const _INGEST_ENDPOINT: String = "/api/message/ingest"
+# stop sending and let the queue build up if the server falls this far behind
+const _MAX_UNACKED: int = 10
+# server closes the ingest websocket with this once the session token expires
+const _WS_CLOSE_SESSION_EXPIRED: int = 1008
+
+# ingest websocket, used instead of posting the queue once connected
+var _ws: WebSocketClient = null
+var _ws_ready: bool = false
+# set if the websocket could not connect, e.g. a proxy in between drops upgrades - posting still works
+var _ws_disabled: bool = false
+var _ws_sent_seq: int = 0
+var _ws_acked_seq: int = 0
+var _ws_close_code: int = 0
+
+const CONNECTION_ERROR = 5
+
+# smaller bodies aren't worth compressing
+const _COMPRESS_MIN_SIZE: int = 512
+
+func _process(_delta: float) -> void:
+	var _error: int = _client.poll()
+	if _ws:
+		_ws.poll()
+
+	var new_status: int = _client.get_status()
+	if new_status != _status:
+		_status = new_status
+		match _status:
+			_client.STATUS_DISCONNECTED:
+				emit_signal("disconnected")
+				_conn_ready = false
+			_client.STATUS_CONNECTED:
+				if !_conn_ready:
+					emit_signal("connected")
+				_conn_ready = true
+			_client.STATUS_CONNECTION_ERROR, _client.STATUS_CANT_RESOLVE, _client.STATUS_CANT_CONNECT, _client.STATUS_SSL_HANDSHAKE_ERROR:
+				_conn_ready = false
+				emit_signal("error", "Socket in error state - " + status_str(_status), CONNECTION_ERROR)
+	
+	if !_conn_ready:
+		return
+				
+	var in_req_res = _handle_in_request()
+	if !in_req_res:
+		return
+
+	var now_ticks = Time.get_ticks_msec()
+
+	# check or send every second
+	# allows messages to queue up or authentication calls to be throttled
+	if now_ticks - _last_frame_processed_ticks < _poll_freq:
+		return
+
+	if !_authenticated:
+		_error = _start_authenticate()
+	else:
+		enqueue_message(ExporterMessage.make_keep_alive_message())
+		if _ws_ready:
+			_error = _send_queue_ingest_websocket()
+		else:
+			_error = _start_send_queue()
+	# do backoff on error
+	if _error != OK:
+		_poll_freq = _poll_freq * 2
+		if _poll_freq > _MAX_POLL_FREQ:
+			_poll_freq = _MAX_POLL_FREQ
+	
+	_last_frame_processed_ticks = now_ticks
+	
+# returns whether to continue or not
+# handles behavior while doing a request
+# returns [err: Error, should_continue: bool]
+func _handle_in_request() -> bool:
+	var _error: int = 0
+	if _status == _client.STATUS_BODY:
+		var chunk = _client.read_response_body_chunk()
+		_error = _body_buf.put_data(chunk)
+		return false
+
+	if _status != _client.STATUS_CONNECTED:
+		return false
+
+	if _in_req == _POST_MESSAGE_REQ:
+		_in_req = 0
+		
+		var resp_code = _client.get_response_code()
+		# messages in the queue were encoded with mappings the server doesn't have - drop them and start over
+		if resp_code == 409:
+			_body_buf.clear()
+			_message_queue = _empty_array.duplicate()
+			_message_queue_idx = 0
+			emit_signal("mapping_reset_required")
+			return false
+		
+		if resp_code > 400 && resp_code < 410:
+			_authenticated = false
+		
+		if resp_code != 200:
+			emit_signal("error", "Queue POST returned non 200 response - " + _body_buf.data_array.get_string_from_utf8(), resp_code)
+			_poll_freq = _poll_freq * 2
+			if _poll_freq > _MAX_POLL_FREQ:
+				_poll_freq = _MAX_POLL_FREQ
+				
+			_body_buf.clear()
+			
+			if resp_code == 500:
+				_message_queue = _empty_array.duplicate()
+				_message_queue_idx = 0
+		
+			return false
+		
+		_log_failed_frames()
+		_body_buf.clear()
+		# clear queue only after req succeeded
+		_message_queue = _empty_array.duplicate()
+		_message_queue_idx = 0
+		
+		# on success clear backoff
+		_poll_freq = 1000
+
+	if _in_req == _AUTH_REQ:
+		_in_req = 0
+		
+		var resp_code = _client.get_response_code()
+		if resp_code != 200:
+			emit_signal("error", "Auth GET returned non 200 response - " + String(resp_code), 1)
+			_body_buf.clear()
+			_poll_freq = _poll_freq * 2
+			if _poll_freq > _MAX_POLL_FREQ:
+				_poll_freq = _MAX_POLL_FREQ
+
+			return false
+		
+		_body_buf.big_endian = false
+		_body_buf.seek(0) # since we appended a bunch of data we will be at the end
+		# microsecond UTC Unix Epoch
+		var session_token_exp: int = _body_buf.get_64()
+		# calculate microseconds until
+		var now_seconds: float = Time.get_unix_time_from_system()
+		# convert to milliseconds for ms ticks
+		_session_token_exp_ticks = int(session_token_exp/1000) - int(now_seconds * 1000)
+		var token_len: int = _body_buf.get_16()
+		
+		var session_token_res = _body_buf.get_data(token_len)
+		if session_token_res[0] != OK:
+			emit_signal("error", "Failed to get token - " + String(resp_code), 1)
+			_body_buf.clear()
+			_poll_freq = _poll_freq * 2
+			if _poll_freq > _MAX_POLL_FREQ:
+				_poll_freq = _MAX_POLL_FREQ
+	
+			return false
+		_session_token = PoolByteArray(session_token_res[1]).get_string_from_utf8()
+		if not _session_token || _session_token.length() < 1:
+			emit_signal("error", "Failed to get parse token - " + String(resp_code), 1)
+			return false
+		
+		_read_negotiated_protocol()
+		
+		_authenticated = true
+
+		_body_buf.clear()
+		
+		# on success clear backoff
+		_poll_freq = 1000
+		# once we authenticate emit signal so that callers know a new session started
+		emit_signal("authenticated")
+		
+		if has_capability("ingest_websocket") and !_ws_disabled:
+			_start_ingest_websocket()
+	return true
+	
+# framed versions respond with the frames the server had to skip - those messages are lost so just log them
+func _log_failed_frames():
+	if protocol_version < ExporterMessage.PROTOCOL_VERSION_FRAMED or _body_buf.get_position() < 1:
+		return
+	
+	var res = JSON.parse(_body_buf.data_array.get_string_from_utf8())
+	if res.error != OK or typeof(res.result) != TYPE_DICTIONARY:
+		return
+	
+	_print_failed_frames(res.result)
+
+func _print_failed_frames(result: Dictionary):
+	var failed_frames = result.get("failed_frames", [])
+	if typeof(failed_frames) != TYPE_ARRAY:
+		return
+	for failed_frame in failed_frames:
+		print("Server skipped frame - ", JSON.print(failed_frame))
+
+# reads below from the auth response following the token - servers from before versioning send nothing
+# - negotiated protocol version (uint16)
+# - capability count (uint8)
+# - (for each capability)
+# -- capability length (uint8)
+# -- capability string (variable [uint8, ...])
+func _read_negotiated_protocol():
+	protocol_version = ExporterMessage.PROTOCOL_VERSION_LEGACY
+	capabilities = []
+	
+	if _body_buf.get_available_bytes() < 3:
+		return
+	
+	var version: int = _body_buf.get_u16()
+	if version > 0:
+		protocol_version = version
+	
+	var capability_count: int = _body_buf.get_u8()
+	for _i in range(capability_count):
+		var capability_len: int = _body_buf.get_u8()
+		var capability_res = _body_buf.get_data(capability_len)
+		if capability_res[0] != OK:
+			return
+		capabilities.append(PoolByteArray(capability_res[1]).get_string_from_utf8())
+
+# writes below to the auth request body
+# - protocol version (uint16)
+# - capability count (uint8)
+# - (for each capability)
+# -- capability length (uint8)
+# -- capability string (variable [uint8, ...])
+func _make_authenticate_body() -> PoolByteArray:
+	var buf = StreamPeerBuffer.new()
+	buf.put_u16(ExporterMessage.PROTOCOL_VERSION)
+	buf.put_u8(requested_capabilities.size())
+	for capability in requested_capabilities:
+		var capability_bytes: PoolByteArray = capability.to_utf8()
+		buf.put_u8(capability_bytes.size())
+		var _error = buf.put_data(capability_bytes)
+	
+	return buf.data_array
+
+func _start_authenticate() -> int:
+	if not auth_token || _in_req != 0:
+		return 1
+	
+	var headers = [
+		"Content-Type: application/octet-stream",
+		"Authorization: Bearer " + auth_token
+	]
+	
+	var error: int = _client.request_raw(HTTPClient.METHOD_POST, _AUTH_ENDPOINT, headers, _make_authenticate_body())
+	if error != OK:
+		emit_signal("error", "Error making request - " + status_str(_status), error)
+		return 1
+
+	_in_req = _AUTH_REQ
+
+	return 0
+
+func _write_queue_to_buf(buf: StreamPeerBuffer) -> int:
+	for msg in _message_queue:
+		if not msg:
+			continue
+		var error: int
+		if protocol_version >= ExporterMessage.PROTOCOL_VERSION_FRAMED:
+			error = ExporterMessage.write_frame_to_buf(msg, buf, _crc32_table)
+		else:
+			error = ExporterMessage.write_to_buf(msg, buf)
+		if error != OK:
+			emit_signal("error", "Error writing to stream", error)
+			return 1
+	return 0
+
+func _start_send_queue() -> int:
+	if !_authenticated || _in_req != 0:
+		return 0
+
+	var _buf: StreamPeerBuffer = StreamPeerBuffer.new()
+	if _write_queue_to_buf(_buf) != OK:
+		return 1
+			
+	if _buf.data_array.size() < 1:
+		return 0
+
+	var headers = [
+		"Content-Type: application/octet-stream",
+		"Authorization: JWT " + _session_token
+	]
+	
+	var body: PoolByteArray = _buf.data_array
+	if has_capability("compressed_body") and body.size() >= _COMPRESS_MIN_SIZE:
+		body = body.compress(File.COMPRESSION_GZIP)
+		headers.append("Content-Encoding: gzip")
+
+	var error: int = _client.request_raw(HTTPClient.METHOD_POST, _POST_MESSAGE_ENDPOINT, headers, body)
+	if error != OK:
+		emit_signal("error", "Error making request - " + status_str(_status), error)
+		return 1
+
+	_in_req = _POST_MESSAGE_REQ
+	
+	return 0
+
+func _start_ingest_websocket():
+	_close_ingest_websocket()
+	
+	_ws = WebSocketClient.new()
+	_ws.verify_ssl = _verify_host
+	if trusted_ca_cert:
+		_ws.trusted_ssl_certificate = trusted_ca_cert
+		_ws.verify_ssl = true
+	var _error: int = _ws.connect("connection_established", self, "_on_ingest_websocket_established")
+	_error = _ws.connect("connection_closed", self, "_on_ingest_websocket_closed")
+	_error = _ws.connect("connection_error", self, "_on_ingest_websocket_error")
+	_error = _ws.connect("server_close_request", self, "_on_ingest_websocket_close_request")
+	_error = _ws.connect("data_received", self, "_on_ingest_websocket_data")
+	
+	var scheme: String = "ws://"
+	if _use_https:
+		scheme = "wss://"
+	var url: String = "%s%s:%d%s" % [scheme, _host, _port, _INGEST_ENDPOINT]
+	
+	var headers = PoolStringArray(["Authorization: JWT " + _session_token])
+	_error = _ws.connect_to_url(url, PoolStringArray(), false, headers)
+	if _error != OK:
+		print("Ingest websocket failed to connect, posting messages instead - ", _error)
+		_ws = null
+		_ws_disabled = true
+
+func _close_ingest_websocket():
+	_ws_ready = false
+	_ws_sent_seq = 0
+	_ws_acked_seq = 0
+	_ws_close_code = 0
+	if _ws:
+		_ws.disconnect_from_host()
+		_ws = null
+
+func _on_ingest_websocket_established(_protocol: String):
+	_ws_ready = true
+
+func _on_ingest_websocket_error():
+	print("Ingest websocket failed to connect, posting messages instead")
+	_ws_disabled = true
+	_close_ingest_websocket()
+
+func _on_ingest_websocket_close_request(code: int, reason: String):
+	_ws_close_code = code
+	print("Ingest websocket closed by server - (%d) %s" % [code, reason])
+
+# anything sent but not acked is lost - if that included new key mappings the server will ask for the full state
+func _on_ingest_websocket_closed(_was_clean: bool):
+	var session_expired: bool = _ws_close_code == _WS_CLOSE_SESSION_EXPIRED
+	_close_ingest_websocket()
+	# post until the next authentication reopens the websocket
+	if session_expired:
+		_authenticated = false
+
+func _on_ingest_websocket_data():
+	var packet: PoolByteArray = _ws.get_peer(1).get_packet()
+	var res = JSON.parse(packet.get_string_from_utf8())
+	if res.error != OK or typeof(res.result) != TYPE_DICTIONARY:
+		return
+	
+	var seq: int = int(res.result.get("seq", 0))
+	if seq > _ws_acked_seq:
+		_ws_acked_seq = seq
+	
+	match res.result.get("type", ""):
+		"ack":
+			_print_failed_frames(res.result)
+			# on success clear backoff
+			_poll_freq = 1000
+		"resend_full_state":
+			# messages in the queue were encoded with mappings the server doesn't have - drop them and start over
+			_message_queue = _empty_array.duplicate()
+			_message_queue_idx = 0
+			emit_signal("mapping_reset_required")
+		"error":
+			var error_detail = res.result.get("error", {})
+			if typeof(error_detail) != TYPE_DICTIONARY:
+				error_detail = {}
+			print("Server failed to read message (%d) - (%s) %s" % [seq, error_detail.get("code", ""), error_detail.get("message", "")])
+
+func _send_queue_ingest_websocket() -> int:
+	# an in flight post has to land first or the key mappings could arrive out of order
+	if !_authenticated || _in_req != 0:
+		return 0
+	if _ws_sent_seq - _ws_acked_seq >= _MAX_UNACKED:
+		return 1
+	
+	var _buf: StreamPeerBuffer = StreamPeerBuffer.new()
+	if _write_queue_to_buf(_buf) != OK:
+		return 1
+	
+	if _buf.data_array.size() < 1:
+		return 0
+	
+	var peer: WebSocketPeer = _ws.get_peer(1)
+	peer.set_write_mode(WebSocketPeer.WRITE_MODE_BINARY)
+	var error: int = peer.put_packet(_buf.data_array)
+	if error != OK:
+		emit_signal("error", "Error sending on ingest websocket", error)
+		return 1
+	
+	_ws_sent_seq = _ws_sent_seq + 1
+	_message_queue = _empty_array.duplicate()
+	_message_queue_idx = 0
+	
+	return 0
+
+func _on_tree_exiting():
+	_close_ingest_websocket()
+	_client.close()
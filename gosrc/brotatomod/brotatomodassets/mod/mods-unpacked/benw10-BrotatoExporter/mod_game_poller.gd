@@ -16,6 +16,12 @@ var _game_poll_timer: Timer
 
 const _default_game_poll_dur = 2
 
+# only these keys are sent nested - the rest of the nested data is mostly noise
+const NESTED_KEYS = ["weapons", "items"]
+
+# set when the server supports the nested_serial_types capability
+var nested_types: bool = false
+
 func _ready():
 	var _error: int = 0
 	_game_poll_timer = Timer.new()
@@ -112,12 +118,14 @@ func _get_stat_diff(player_index: int)->Dictionary:
 			
 			for effects_key in _cur_effects:
 				_put_diff(effects_key, diff, _last_effects, _cur_effects, "effects_")
+			_put_removed(diff, _last_effects, _cur_effects, "effects_")
 			
 			_last_effects = _cur_effects
 			
 			continue
 		
 		_put_diff(key, diff, _last_stats, _cur_stats)
+	_put_removed(diff, _last_stats, _cur_stats)
 	
 	_last_stats = _cur_stats
 
@@ -128,13 +136,65 @@ func _put_diff(key: String, diff: Dictionary, last_dict: Dictionary, cur_dict: D
 	if last_dict:
 		last = last_dict.get(key, null)
 	var cur = cur_dict[key]
-	# don't recurse into the random stuff for now - most of the useful stuff
-	# is at this level anyways
+	# only recurse into NESTED_KEYS - most of the useful stuff is at this level anyways
 	match typeof(cur):
-		TYPE_STRING, TYPE_INT, TYPE_REAL:
+		TYPE_STRING, TYPE_INT, TYPE_REAL, TYPE_BOOL:
 			pass
+		TYPE_ARRAY:
+			if not _is_nested_key(key):
+				return
+			# arrays are always sent whole
+			if typeof(last) != TYPE_ARRAY or hash(last) != hash(cur):
+				diff[diff_prefix+key] = cur.duplicate(true)
+			return
+		TYPE_DICTIONARY:
+			if not _is_nested_key(key):
+				return
+			if typeof(last) != TYPE_DICTIONARY:
+				diff[diff_prefix+key] = cur.duplicate(true)
+				return
+			var nested_diff = _get_nested_diff(last, cur)
+			if nested_diff.size() > 0:
+				diff[diff_prefix+key] = nested_diff
+			return
 		_:
 			return
 
-	if last != cur:
+	if typeof(last) != typeof(cur) or last != cur:
 		diff[diff_prefix+key] = cur
+
+func _is_nested_key(key: String)->bool:
+	return nested_types and NESTED_KEYS.has(key)
+
+# changed entries of cur - dictionaries are diffed recursively and removed entries are put as null.
+# the server merges this into the last value it has
+func _get_nested_diff(last: Dictionary, cur: Dictionary)->Dictionary:
+	var nested_diff = Dictionary()
+	for key in cur:
+		var last_val = last.get(key, null)
+		var cur_val = cur[key]
+		if typeof(last_val) == TYPE_DICTIONARY and typeof(cur_val) == TYPE_DICTIONARY:
+			var child_diff = _get_nested_diff(last_val, cur_val)
+			if child_diff.size() > 0:
+				nested_diff[key] = child_diff
+		elif typeof(last_val) != typeof(cur_val) or hash(last_val) != hash(cur_val):
+			nested_diff[key] = cur_val
+	for key in last:
+		if not cur.has(key):
+			nested_diff[key] = null
+	
+	return nested_diff
+
+# keys which were sent last poll but are gone now are put as null so the server can drop them
+func _put_removed(diff: Dictionary, last_dict: Dictionary, cur_dict: Dictionary, diff_prefix: String = ""):
+	if not last_dict:
+		return
+	for key in last_dict:
+		if key == "effects" or cur_dict.has(key):
+			continue
+		match typeof(last_dict[key]):
+			TYPE_STRING, TYPE_INT, TYPE_REAL, TYPE_BOOL:
+				diff[diff_prefix+key] = null
+			TYPE_ARRAY, TYPE_DICTIONARY:
+				if _is_nested_key(key):
+					diff[diff_prefix+key] = null
@@ -9,6 +9,8 @@ const LOG_INFO = "BrotatoExporter"
 
 const MOD_ID = "benw10-BrotatoExporter"
 const _USER_CONFIG_NAME = "connect-user"
+# X509Certificate can only be loaded from a file
+const _CA_CERT_PATH = "user://benw10-BrotatoExporter-ca.crt"
 
 var _mod_exporter
 var _conn_ready: bool = false
@@ -54,8 +56,11 @@ func _ready():
 	_error = _mod_exporter.connect("connected", self, "_on_mod_exporter_connect")
 	_error = _mod_exporter.connect("disconnected", self, "_on_mod_exporter_disconnect")
 	_error = _mod_exporter.connect("authenticated", self, "_on_mod_exporter_authenticated")
+	_error = _mod_exporter.connect("mapping_reset_required", self, "_on_mod_exporter_mapping_reset_required")
 
 	_mod_exporter.auth_token = _config_data["server_connection"]["auth_token"]
+	_mod_exporter.trusted_ca_cert = _load_ca_cert(_config_data["server_connection"].get("ca_cert", ""))
+	_mod_exporter.requested_capabilities = ["extended_serial_types", "nested_serial_types", "compressed_body", "ingest_websocket"]
 	_connect_exporter()
 
 	add_child(_mod_exporter)
@@ -84,7 +89,39 @@ func _on_mod_exporter_err(err_str: String, err_code: int):
 # worry about
 func _on_mod_exporter_authenticated():
 	_dict_serializer.clear()
+	_dict_serializer.extended_types = _mod_exporter.has_capability("extended_serial_types")
+	_dict_serializer.nested_types = _mod_exporter.has_capability("nested_serial_types")
+	_game_poller.nested_types = _dict_serializer.nested_types
 	
+# server lost our key mappings - start over and resend everything
+func _on_mod_exporter_mapping_reset_required():
+	ModLoaderLog.info("Server requested key mapping reset", LOG_INFO)
+	_dict_serializer.clear()
+	_mod_exporter.enqueue_message(ExporterMessage.make_mapping_reset_message())
+	
+	if not _game_poller._in_run:
+		return
+	var full_dict = _game_poller.full_stat_dict(0)
+	_mod_exporter.enqueue_message(ExporterMessage.make_time_series_full_message(_dict_serializer, ExporterMessage.MESSAGE_REASON_CONNECT, full_dict))
+	
+func _load_ca_cert(ca_cert_pem: String) -> X509Certificate:
+	if ca_cert_pem == "":
+		return null
+	var ca_file = File.new()
+	var error: int = ca_file.open(_CA_CERT_PATH, File.WRITE)
+	if error != OK:
+		ModLoaderLog.info("Failed to write the CA cert - code (%d)" % error, LOG_INFO)
+		return null
+	ca_file.store_string(ca_cert_pem)
+	ca_file.close()
+	
+	var ca_cert = X509Certificate.new()
+	error = ca_cert.load(_CA_CERT_PATH)
+	if error != OK:
+		ModLoaderLog.info("Invalid CA cert in config - code (%d)" % error, LOG_INFO)
+		return null
+	return ca_cert
+
 func _connect_exporter():
 	_dict_serializer.clear()
 	var conn_dict = _config_data["server_connection"]
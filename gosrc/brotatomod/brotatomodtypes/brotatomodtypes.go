@@ -21,9 +21,144 @@ const (
 	SerialTypeInt32 SerialType = 0xd2
 	SerialTypeInt64 SerialType = 0xd3
 
+	SerialTypeUint8  SerialType = 0xcc
+	SerialTypeUint16 SerialType = 0xcd
+	SerialTypeUint32 SerialType = 0xce
+	SerialTypeUint64 SerialType = 0xcf
+
 	SerialTypeFloat32 SerialType = 0xca
+	SerialTypeFloat64 SerialType = 0xcb
+
+	// SerialTypeBool single byte, 0 for false and anything else for true.
+	SerialTypeBool SerialType = 0xc3
+
+	// SerialTypeRemoved marks a key as no longer present. Has no value bytes.
+	// A key is re-mapped to this type to remove it and re-mapped to its value type when it comes back.
+	SerialTypeRemoved SerialType = 0xc0
+
+	// SerialTypeArray list of self-typed elements. Length prefixed like strings, see AppendArrayValue for the layout.
+	SerialTypeArray SerialType = 0xdd
+	// SerialTypeMap string keyed self-typed elements. Length prefixed like strings, see AppendMapValue for the layout.
+	SerialTypeMap SerialType = 0xde
 )
 
+// String use to get Enum name.
+func (st SerialType) String() string {
+	switch st {
+	case SerialTypeString:
+		return "String"
+	case SerialTypeInt8:
+		return "Int8"
+	case SerialTypeInt16:
+		return "Int16"
+	case SerialTypeInt32:
+		return "Int32"
+	case SerialTypeInt64:
+		return "Int64"
+	case SerialTypeUint8:
+		return "Uint8"
+	case SerialTypeUint16:
+		return "Uint16"
+	case SerialTypeUint32:
+		return "Uint32"
+	case SerialTypeUint64:
+		return "Uint64"
+	case SerialTypeFloat32:
+		return "Float32"
+	case SerialTypeFloat64:
+		return "Float64"
+	case SerialTypeBool:
+		return "Bool"
+	case SerialTypeRemoved:
+		return "Removed"
+	case SerialTypeArray:
+		return "Array"
+	case SerialTypeMap:
+		return "Map"
+	default:
+		return "Unknown"
+	}
+}
+
+// Size amount of value bytes following the key for the type. -1 for variable length types and types the server does not know.
+func (st SerialType) Size() int {
+	switch st {
+	case SerialTypeRemoved:
+		return 0
+	case SerialTypeInt8, SerialTypeUint8, SerialTypeBool:
+		return 1
+	case SerialTypeInt16, SerialTypeUint16:
+		return 2
+	case SerialTypeInt32, SerialTypeUint32, SerialTypeFloat32:
+		return 4
+	case SerialTypeInt64, SerialTypeUint64, SerialTypeFloat64:
+		return 8
+	default:
+		return -1
+	}
+}
+
+// Variable whether the value bytes are prefixed with a uint32 length.
+func (st SerialType) Variable() bool {
+	switch st {
+	case SerialTypeString, SerialTypeArray, SerialTypeMap:
+		return true
+	default:
+		return false
+	}
+}
+
+// Valid use to check that SerialType is an enum.
+func (st SerialType) Valid() bool {
+	return st.Variable() || st.Size() >= 0
+}
+
+// CapabilityExtendedSerialTypes mod may send bool, float64, unsigned ints and removed keys.
+// The server always reads them, the capability only tells the mod the server is new enough to.
+const CapabilityExtendedSerialTypes Capability = "extended_serial_types"
+
+// ProtocolVersion version of the ingest wire format. Negotiated when the mod authenticates and fixed for the session.
+type ProtocolVersion uint16
+
+const (
+	// ProtocolVersionLegacy format used by mods which do not send a version when authenticating.
+	// Messages are concatenated one after the other with no framing.
+	ProtocolVersionLegacy ProtocolVersion = 1
+	// ProtocolVersionFramed each message is wrapped in a frame with its length and a CRC32 of the message bytes,
+	// so a corrupt message can be skipped without losing the rest of the body.
+	ProtocolVersionFramed ProtocolVersion = 2
+
+	// ProtocolVersionMin oldest version the server still reads.
+	ProtocolVersionMin = ProtocolVersionLegacy
+	// ProtocolVersionMax newest version the server reads.
+	ProtocolVersionMax = ProtocolVersionFramed
+)
+
+// Valid use to check that the version is one the server can read.
+func (pv ProtocolVersion) Valid() bool {
+	return pv >= ProtocolVersionMin && pv <= ProtocolVersionMax
+}
+
+// Capability optional feature the mod and server agree on at authentication, independent of the protocol version.
+type Capability string
+
+// CapabilityNestedSerialTypes mod may send arrays and maps. Map values in diff messages are merged into the previous value.
+const CapabilityNestedSerialTypes Capability = "nested_serial_types"
+
+// CapabilityCompressedBody server decodes gzip and zstd message bodies sent with a Content-Encoding header.
+const CapabilityCompressedBody Capability = "compressed_body"
+
+// CapabilityIngestWebsocket mod may stream message bodies over /api/message/ingest instead of posting each one.
+const CapabilityIngestWebsocket Capability = "ingest_websocket"
+
+// SupportedCapabilities every capability the server will agree to if requested.
+var SupportedCapabilities = []Capability{
+	CapabilityExtendedSerialTypes,
+	CapabilityNestedSerialTypes,
+	CapabilityCompressedBody,
+	CapabilityIngestWebsocket,
+}
+
 // MessageDictMappingHeader is a single byte for dict mapping start.
 const MessageDictMappingHeader uint8 = 0xdf
 
@@ -39,6 +174,8 @@ func (mt MessageType) String() string {
 		return "TimeSeriesFull"
 	case MessageTypeTimeSeriesDiff:
 		return "TimeSeriesDiff"
+	case MessageTypeMappingReset:
+		return "MappingReset"
 	default:
 		return "Unknown"
 	}
@@ -47,7 +184,17 @@ func (mt MessageType) String() string {
 // Valid use to check that MessageType is an enum.
 func (mt MessageType) Valid() bool {
 	switch mt {
-	case MessageTypeKeepAlive, MessageTypeTimeSeriesFull, MessageTypeTimeSeriesDiff:
+	case MessageTypeKeepAlive, MessageTypeTimeSeriesFull, MessageTypeTimeSeriesDiff, MessageTypeMappingReset:
+		return true
+	default:
+		return false
+	}
+}
+
+// HasBody whether messages of this type are followed by a dict.
+func (mt MessageType) HasBody() bool {
+	switch mt {
+	case MessageTypeTimeSeriesFull, MessageTypeTimeSeriesDiff:
 		return true
 	default:
 		return false
@@ -61,6 +208,9 @@ const (
 	MessageTypeTimeSeriesFull
 	// MessageTypeTimeSeriesDiff message sent periodically throughout the run while in waves and shops. Contains only the changes since the last message.
 	MessageTypeTimeSeriesDiff
+	// MessageTypeMappingReset tells the reader to forget every key mapping. The mod sends it after starting its own mapping
+	// over, usually when the server responds that it does not know a key. Has no body.
+	MessageTypeMappingReset
 )
 
 // MessageReason single byte representing the game event that triggered the message.
@@ -158,40 +308,85 @@ func (dkv DictKeyValue) String() string {
 	case SerialTypeInt8:
 		val = int8(dkv.Value[0])
 	case SerialTypeInt16:
-		val = binary.LittleEndian.Uint16(dkv.Value)
+		val = int16(binary.LittleEndian.Uint16(dkv.Value))
 	case SerialTypeInt32:
-		val = binary.LittleEndian.Uint32(dkv.Value)
+		val = int32(binary.LittleEndian.Uint32(dkv.Value))
 	case SerialTypeInt64:
+		val = int64(binary.LittleEndian.Uint64(dkv.Value))
+	case SerialTypeUint8:
+		val = dkv.Value[0]
+	case SerialTypeUint16:
+		val = binary.LittleEndian.Uint16(dkv.Value)
+	case SerialTypeUint32:
+		val = binary.LittleEndian.Uint32(dkv.Value)
+	case SerialTypeUint64:
 		val = binary.LittleEndian.Uint64(dkv.Value)
 	case SerialTypeFloat32:
 		val = math.Float32frombits(binary.LittleEndian.Uint32(dkv.Value))
+	case SerialTypeFloat64:
+		val = math.Float64frombits(binary.LittleEndian.Uint64(dkv.Value))
+	case SerialTypeBool:
+		val = dkv.Value[0] != 0
+	case SerialTypeRemoved:
+		return "<removed>"
+	case SerialTypeArray, SerialTypeMap:
+		return string(dkv.AppendJSON(nil))
 	}
 
 	return fmt.Sprintf("%v", val)
 }
 
+// Removed whether the key-value marks the key as removed.
+func (dkv DictKeyValue) Removed() bool {
+	return dkv.SerialType == SerialTypeRemoved
+}
+
 // AppendJSON appends the JSON representation of the value to the provided byte slice.
+// Removed keys, non-finite floats and malformed nested values are written as null. Removed map entries are left out.
 func (dkv DictKeyValue) AppendJSON(bts []byte) []byte {
 	switch dkv.SerialType {
 	case SerialTypeString:
-		bts = append(bts, '"')
-		bts = append(bts, dkv.Value...)
-		bts = append(bts, '"')
+		bts = appendJSONString(bts, dkv.Value)
 	case SerialTypeInt8:
-		bts = strconv.AppendInt(bts, int64(dkv.Value[0]), 10)
+		bts = strconv.AppendInt(bts, int64(int8(dkv.Value[0])), 10)
 	case SerialTypeInt16:
-		bts = strconv.AppendInt(bts, int64(binary.LittleEndian.Uint16(dkv.Value)), 10)
+		bts = strconv.AppendInt(bts, int64(int16(binary.LittleEndian.Uint16(dkv.Value))), 10)
 	case SerialTypeInt32:
-		bts = strconv.AppendInt(bts, int64(binary.LittleEndian.Uint32(dkv.Value)), 10)
+		bts = strconv.AppendInt(bts, int64(int32(binary.LittleEndian.Uint32(dkv.Value))), 10)
 	case SerialTypeInt64:
 		bts = strconv.AppendInt(bts, int64(binary.LittleEndian.Uint64(dkv.Value)), 10)
+	case SerialTypeUint8:
+		bts = strconv.AppendUint(bts, uint64(dkv.Value[0]), 10)
+	case SerialTypeUint16:
+		bts = strconv.AppendUint(bts, uint64(binary.LittleEndian.Uint16(dkv.Value)), 10)
+	case SerialTypeUint32:
+		bts = strconv.AppendUint(bts, uint64(binary.LittleEndian.Uint32(dkv.Value)), 10)
+	case SerialTypeUint64:
+		bts = strconv.AppendUint(bts, binary.LittleEndian.Uint64(dkv.Value), 10)
 	case SerialTypeFloat32:
-		bts = strconv.AppendFloat(bts, float64(math.Float32frombits(binary.LittleEndian.Uint32(dkv.Value))), 'f', -1, 32)
+		bts = appendJSONFloat(bts, float64(math.Float32frombits(binary.LittleEndian.Uint32(dkv.Value))), 32)
+	case SerialTypeFloat64:
+		bts = appendJSONFloat(bts, math.Float64frombits(binary.LittleEndian.Uint64(dkv.Value)), 64)
+	case SerialTypeBool:
+		bts = strconv.AppendBool(bts, dkv.Value[0] != 0)
+	case SerialTypeRemoved:
+		bts = append(bts, "null"...)
+	case SerialTypeArray, SerialTypeMap:
+		bts = appendNestedJSON(bts, dkv)
 	}
 
 	return bts
 }
 
+// appendJSONFloat JSON has no representation for NaN or infinities.
+func appendJSONFloat(bts []byte, f float64, bitSize int) []byte {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return append(bts, "null"...)
+	}
+
+	return strconv.AppendFloat(bts, f, 'f', -1, bitSize)
+}
+
 // DictReader interface for reading values from a message "body".
 type DictReader interface {
 	ReadNextKeyValue() (DictKeyValue, error)
@@ -211,4 +406,6 @@ type ModConfigConnectionData struct {
 	HTTPS      bool   `json:"https"`
 	VerifyHost bool   `json:"verify_host"`
 	AuthToken  string `json:"auth_token"`
+	// CACert PEM of a private CA to trust for the server's cert, ex. the server's self-signed one. Empty trusts the usual roots.
+	CACert string `json:"ca_cert,omitempty"`
 }
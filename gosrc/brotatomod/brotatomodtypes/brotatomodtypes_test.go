@@ -0,0 +1,151 @@
+package brotatomodtypes
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDictKeyValueAppendJSON(t *testing.T) {
+	type testCase struct {
+		name     string
+		kv       DictKeyValue
+		expected string
+	}
+
+	tcs := []testCase{
+		{
+			name:     "string",
+			kv:       DictKeyValue{SerialType: SerialTypeString, Value: []byte("character_crazy")},
+			expected: `"character_crazy"`,
+		},
+		{
+			name:     "negative int8",
+			kv:       DictKeyValue{SerialType: SerialTypeInt8, Value: []byte{0xff}},
+			expected: "-1",
+		},
+		{
+			name:     "negative int16",
+			kv:       DictKeyValue{SerialType: SerialTypeInt16, Value: binary.LittleEndian.AppendUint16(nil, uint16(0xffdc))},
+			expected: "-36",
+		},
+		{
+			name:     "negative int32",
+			kv:       DictKeyValue{SerialType: SerialTypeInt32, Value: binary.LittleEndian.AppendUint32(nil, math.MaxUint32)},
+			expected: "-1",
+		},
+		{
+			name:     "uint64",
+			kv:       DictKeyValue{SerialType: SerialTypeUint64, Value: binary.LittleEndian.AppendUint64(nil, math.MaxUint64)},
+			expected: "18446744073709551615",
+		},
+		{
+			name:     "uint8",
+			kv:       DictKeyValue{SerialType: SerialTypeUint8, Value: []byte{0xff}},
+			expected: "255",
+		},
+		{
+			name:     "float64",
+			kv:       DictKeyValue{SerialType: SerialTypeFloat64, Value: binary.LittleEndian.AppendUint64(nil, math.Float64bits(1234567890.123))},
+			expected: "1234567890.123",
+		},
+		{
+			name:     "float32 NaN",
+			kv:       DictKeyValue{SerialType: SerialTypeFloat32, Value: binary.LittleEndian.AppendUint32(nil, math.Float32bits(float32(math.NaN())))},
+			expected: "null",
+		},
+		{
+			name:     "bool",
+			kv:       DictKeyValue{SerialType: SerialTypeBool, Value: []byte{1}},
+			expected: "true",
+		},
+		{
+			name:     "removed",
+			kv:       DictKeyValue{SerialType: SerialTypeRemoved},
+			expected: "null",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := require.New(t)
+
+			asserter.Equal(tc.expected, string(tc.kv.AppendJSON(nil)))
+		})
+	}
+}
+
+func TestNestedValue(t *testing.T) {
+	newMap := func(entries ...DictKeyValue) DictKeyValue {
+		return DictKeyValue{SerialType: SerialTypeMap, Value: AppendMapValue(nil, entries)}
+	}
+	newInt8 := func(key string, v int8) DictKeyValue {
+		return DictKeyValue{MappedKey: key, SerialType: SerialTypeInt8, Value: []byte{byte(v)}}
+	}
+	newString := func(key string, v string) DictKeyValue {
+		return DictKeyValue{MappedKey: key, SerialType: SerialTypeString, Value: []byte(v)}
+	}
+
+	t.Run("TestAppendJSON", func(t *testing.T) {
+		asserter := require.New(t)
+
+		weapon := newMap(newString("id", "weapon_\"knife\"_1"), newInt8("tier", -1))
+		weapons := DictKeyValue{SerialType: SerialTypeArray, Value: AppendArrayValue(nil, []DictKeyValue{weapon, newInt8("", 3)})}
+		items := newMap(newInt8("item_coupon", 1), DictKeyValue{MappedKey: "item_bag", SerialType: SerialTypeRemoved})
+
+		asserter.NoError(weapons.Validate())
+		asserter.Equal(`[{"id":"weapon_\"knife\"_1","tier":-1},3]`, string(weapons.AppendJSON(nil)))
+		asserter.Equal(`{"item_coupon":1}`, string(items.AppendJSON(nil)))
+	})
+
+	t.Run("TestAppendMergedJSON", func(t *testing.T) {
+		asserter := require.New(t)
+
+		prev := []byte(`{"item_bag":1,"item_coupon":2,"weapon":{"id":"weapon_knife_1","tier":0},"list":[1,2]}`)
+
+		weaponDiff := newMap(newInt8("tier", 1))
+		weaponDiff.MappedKey = "weapon"
+		list := DictKeyValue{MappedKey: "list", SerialType: SerialTypeArray, Value: AppendArrayValue(nil, []DictKeyValue{newInt8("", 3)})}
+
+		diff := newMap(
+			DictKeyValue{MappedKey: "item_bag", SerialType: SerialTypeRemoved},
+			newInt8("item_axe", 1),
+			weaponDiff,
+			list,
+		)
+
+		asserter.Equal(
+			`{"item_axe":1,"item_coupon":2,"list":[3],"weapon":{"id":"weapon_knife_1","tier":1}}`,
+			string(diff.AppendMergedJSON(nil, prev)),
+		)
+
+		// nothing to merge into
+		asserter.Equal(`{"item_axe":1,"weapon":{"tier":1},"list":[3]}`, string(diff.AppendMergedJSON(nil, []byte(`[1]`))))
+	})
+
+	t.Run("TestMalformed", func(t *testing.T) {
+		asserter := require.New(t)
+
+		truncated := newMap(newString("id", "weapon_knife_1"))
+		truncated.Value = truncated.Value[:len(truncated.Value)-1]
+		asserter.Error(truncated.Validate())
+		asserter.Equal("null", string(truncated.AppendJSON(nil)))
+
+		unknownType := DictKeyValue{SerialType: SerialTypeArray, Value: []byte{1, 0, 0x01}}
+		asserter.Error(unknownType.Validate())
+
+		trailing := DictKeyValue{SerialType: SerialTypeArray, Value: []byte{0, 0, 0x01}}
+		asserter.Error(trailing.Validate())
+
+		deep := newInt8("", 1)
+		for i := 0; i < MaxNestedDepth; i++ {
+			deep = DictKeyValue{SerialType: SerialTypeArray, Value: AppendArrayValue(nil, []DictKeyValue{deep})}
+		}
+		asserter.NoError(deep.Validate())
+
+		deep = DictKeyValue{SerialType: SerialTypeArray, Value: AppendArrayValue(nil, []DictKeyValue{deep})}
+		asserter.Error(deep.Validate())
+	})
+}
@@ -0,0 +1,266 @@
+package brotatomodtypes
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+
+	"github.com/benw10-1/brotato-exporter/errutil"
+)
+
+// MaxNestedDepth deepest arrays and maps may be nested inside one another.
+const MaxNestedDepth = 16
+
+// AppendArrayValue appends the value bytes of an array holding elements. Element keys are ignored.
+//
+// Format of the array:
+// - element count (uint16)
+// - (for each element)
+// -- SERIAL_TYPE (uint8)
+// -- value bytes (variable - either SerialType.Size() bytes or [uint32 {length}, uint8, uint8, ...] for variable types)
+func AppendArrayValue(bts []byte, elements []DictKeyValue) []byte {
+	bts = binary.LittleEndian.AppendUint16(bts, uint16(len(elements)))
+	for _, element := range elements {
+		bts = appendElement(bts, element)
+	}
+
+	return bts
+}
+
+// AppendMapValue appends the value bytes of a map holding entries keyed by their MappedKey.
+//
+// Format of the map:
+// - entry count (uint16)
+// - (for each entry)
+// -- key string length (uint16)
+// -- key string (variable [uint8, ...])
+// -- SERIAL_TYPE (uint8)
+// -- value bytes (variable - either SerialType.Size() bytes or [uint32 {length}, uint8, uint8, ...] for variable types)
+func AppendMapValue(bts []byte, entries []DictKeyValue) []byte {
+	bts = binary.LittleEndian.AppendUint16(bts, uint16(len(entries)))
+	for _, entry := range entries {
+		bts = binary.LittleEndian.AppendUint16(bts, uint16(len(entry.MappedKey)))
+		bts = append(bts, entry.MappedKey...)
+		bts = appendElement(bts, entry)
+	}
+
+	return bts
+}
+
+// appendElement type byte followed by the value, length prefixed for variable types.
+func appendElement(bts []byte, element DictKeyValue) []byte {
+	bts = append(bts, byte(element.SerialType))
+	if element.SerialType.Variable() {
+		bts = binary.LittleEndian.AppendUint32(bts, uint32(len(element.Value)))
+	}
+
+	return append(bts, element.Value...)
+}
+
+// Elements parses the elements of an array or map value. Map entries have MappedKey set to their key.
+// Element values share memory with dkv.Value.
+func (dkv DictKeyValue) Elements() ([]DictKeyValue, error) {
+	isMap := dkv.SerialType == SerialTypeMap
+	if !isMap && dkv.SerialType != SerialTypeArray {
+		return nil, errutil.NewStackErrorf("serial type 0x%x is not nested", uint8(dkv.SerialType))
+	}
+
+	bts := dkv.Value
+	if len(bts) < 2 {
+		return nil, errutil.NewStackError("nested value missing element count")
+	}
+
+	count := int(binary.LittleEndian.Uint16(bts))
+	bts = bts[2:]
+
+	elements := make([]DictKeyValue, 0, count)
+	for i := 0; i < count; i++ {
+		element := DictKeyValue{}
+
+		if isMap {
+			if len(bts) < 2 {
+				return nil, errutil.NewStackErrorf("map entry %d missing key length", i)
+			}
+
+			keyLength := int(binary.LittleEndian.Uint16(bts))
+			bts = bts[2:]
+			if len(bts) < keyLength {
+				return nil, errutil.NewStackErrorf("map entry %d key truncated", i)
+			}
+
+			element.MappedKey = string(bts[:keyLength])
+			bts = bts[keyLength:]
+		}
+
+		if len(bts) < 1 {
+			return nil, errutil.NewStackErrorf("element %d missing serial type", i)
+		}
+
+		element.SerialType = SerialType(bts[0])
+		bts = bts[1:]
+
+		size := element.SerialType.Size()
+		if element.SerialType.Variable() {
+			if len(bts) < 4 {
+				return nil, errutil.NewStackErrorf("element %d missing length", i)
+			}
+
+			size = int(binary.LittleEndian.Uint32(bts))
+			bts = bts[4:]
+		} else if size < 0 {
+			return nil, errutil.NewStackErrorf("element %d has unknown serial type 0x%x", i, uint8(element.SerialType))
+		}
+
+		if len(bts) < size {
+			return nil, errutil.NewStackErrorf("element %d value truncated", i)
+		}
+
+		element.Value = bts[:size:size]
+		bts = bts[size:]
+
+		elements = append(elements, element)
+	}
+
+	if len(bts) != 0 {
+		return nil, errutil.NewStackErrorf("%d trailing bytes after nested elements", len(bts))
+	}
+
+	return elements, nil
+}
+
+// Validate checks that array and map values are well formed all the way down and no deeper than MaxNestedDepth.
+// Other types are always valid.
+func (dkv DictKeyValue) Validate() error {
+	return dkv.validate(1)
+}
+
+// validate
+func (dkv DictKeyValue) validate(depth int) error {
+	if dkv.SerialType != SerialTypeArray && dkv.SerialType != SerialTypeMap {
+		return nil
+	}
+
+	if depth > MaxNestedDepth {
+		return errutil.NewStackErrorf("nested deeper than %d", MaxNestedDepth)
+	}
+
+	elements, err := dkv.Elements()
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	for _, element := range elements {
+		err = element.validate(depth + 1)
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+	}
+
+	return nil
+}
+
+// appendNestedJSON JSON array or object for the nested value, removed map entries are left out.
+func appendNestedJSON(bts []byte, dkv DictKeyValue) []byte {
+	elements, err := dkv.Elements()
+	if err != nil {
+		return append(bts, "null"...)
+	}
+
+	if dkv.SerialType == SerialTypeArray {
+		bts = append(bts, '[')
+		for i, element := range elements {
+			if i > 0 {
+				bts = append(bts, ',')
+			}
+			bts = element.AppendJSON(bts)
+		}
+
+		return append(bts, ']')
+	}
+
+	bts = append(bts, '{')
+	first := true
+	for _, element := range elements {
+		if element.Removed() {
+			continue
+		}
+
+		if !first {
+			bts = append(bts, ',')
+		}
+		first = false
+
+		bts = appendJSONString(bts, []byte(element.MappedKey))
+		bts = append(bts, ':')
+		bts = element.AppendJSON(bts)
+	}
+
+	return append(bts, '}')
+}
+
+// AppendMergedJSON appends the JSON representation of the value applied on top of prev, the last JSON value of the same key.
+// Maps are merged into a prev object entry by entry, recursively, with removed entries deleted. Everything else,
+// including arrays, replaces prev whole. Merged objects are written with sorted keys.
+func (dkv DictKeyValue) AppendMergedJSON(bts []byte, prev json.RawMessage) []byte {
+	if dkv.SerialType != SerialTypeMap || len(prev) == 0 || prev[0] != '{' {
+		return dkv.AppendJSON(bts)
+	}
+
+	prevMap := make(map[string]json.RawMessage)
+	err := json.Unmarshal(prev, &prevMap)
+	if err != nil {
+		return dkv.AppendJSON(bts)
+	}
+
+	entries, err := dkv.Elements()
+	if err != nil {
+		return append(bts, "null"...)
+	}
+
+	for _, entry := range entries {
+		if entry.Removed() {
+			delete(prevMap, entry.MappedKey)
+			continue
+		}
+
+		prevMap[entry.MappedKey] = entry.AppendMergedJSON(nil, prevMap[entry.MappedKey])
+	}
+
+	keys := make([]string, 0, len(prevMap))
+	for key := range prevMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	bts = append(bts, '{')
+	for i, key := range keys {
+		if i > 0 {
+			bts = append(bts, ',')
+		}
+
+		bts = appendJSONString(bts, []byte(key))
+		bts = append(bts, ':')
+		bts = append(bts, prevMap[key]...)
+	}
+
+	return append(bts, '}')
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString quoted JSON string. Only quotes, backslashes and control characters need escaping, the rest is valid utf-8 as is.
+func appendJSONString(bts []byte, s []byte) []byte {
+	bts = append(bts, '"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			bts = append(bts, '\\', c)
+		case c < 0x20:
+			bts = append(bts, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+		default:
+			bts = append(bts, c)
+		}
+	}
+
+	return append(bts, '"')
+}
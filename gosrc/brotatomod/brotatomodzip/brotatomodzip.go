@@ -0,0 +1,160 @@
+package brotatomodzip
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/errutil"
+)
+
+// ModID directory name of the mod inside of mods-unpacked.
+const ModID = "benw10-BrotatoExporter"
+
+// ConfigFilePath slash separated path of the connect config relative to the mod root.
+const ConfigFilePath = ModDir + "/connect-config.json"
+
+// zipModTime fixed modified time for every zip entry so the same mod files and config always produce the same bytes.
+var zipModTime = time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// WriteConfig writes the JSON representation of the config to w.
+func WriteConfig(w io.Writer, config brotatomodtypes.ModConfig) error {
+	err := json.NewEncoder(w).Encode(config)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	return nil
+}
+
+// WriteConfigFile writes the JSON representation of the config to a file at path, creating parent directories as needed.
+func WriteConfigFile(path string, config brotatomodtypes.ModConfig) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	configFile, err := os.Create(path)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+	defer configFile.Close()
+
+	err = WriteConfig(configFile, config)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	return nil
+}
+
+// WriteModZip zips every file in modFS to w with the given config rendered at ConfigFilePath.
+// Any connect config already present in modFS is replaced so the source tree is never modified.
+// The mod is checked with CheckManifest first. Output is deterministic for the same modFS and config.
+func WriteModZip(w io.Writer, modFS fs.FS, config brotatomodtypes.ModConfig) error {
+	_, err := CheckManifest(modFS)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	zipWriter := zip.NewWriter(w)
+
+	// WalkDir visits in lexical order
+	err = fs.WalkDir(modFS, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+
+		if path == "." || path == ConfigFilePath {
+			return nil
+		}
+
+		if d.IsDir() {
+			_, err = zipWriter.CreateHeader(newFileHeader(path+"/", fs.ModeDir|0755))
+			if err != nil {
+				return errutil.NewStackError(err)
+			}
+
+			return nil
+		}
+
+		file, err := modFS.Open(path)
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+		defer file.Close()
+
+		f, err := zipWriter.CreateHeader(newFileHeader(path, 0644))
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+
+		_, err = io.Copy(f, file)
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	f, err := zipWriter.CreateHeader(newFileHeader(ConfigFilePath, 0644))
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	err = WriteConfig(f, config)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	err = zipWriter.Close()
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	return nil
+}
+
+// newFileHeader header with fixed metadata so nothing about the host leaks into the zip.
+func newFileHeader(name string, mode fs.FileMode) *zip.FileHeader {
+	header := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: zipModTime,
+	}
+	if mode.IsDir() {
+		header.Method = zip.Store
+	}
+	header.SetMode(mode)
+
+	return header
+}
+
+// WriteModZipFile writes the zipped mod to a file at path, creating parent directories as needed.
+func WriteModZipFile(path string, modFS fs.FS, config brotatomodtypes.ModConfig) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	zipFile, err := os.Create(path)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+	defer zipFile.Close()
+
+	err = WriteModZip(zipFile, modFS, config)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	return nil
+}
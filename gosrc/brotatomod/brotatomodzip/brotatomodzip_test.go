@@ -0,0 +1,136 @@
+package brotatomodzip
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"testing/fstest"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodassets"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestModFS minimal mod tree which passes CheckManifest.
+func newTestModFS() fstest.MapFS {
+	modFS := fstest.MapFS{
+		ModDir + "/manifest.json": &fstest.MapFile{Data: []byte(`{"name": "BrotatoExporter", "namespace": "benw10", "version_number": "1.2.3"}`)},
+	}
+
+	for _, requiredFile := range RequiredFiles {
+		if requiredFile == "manifest.json" {
+			continue
+		}
+
+		modFS[ModDir+"/"+requiredFile] = &fstest.MapFile{Data: []byte("extends Node")}
+	}
+
+	return modFS
+}
+
+func TestWriteModZip(t *testing.T) {
+	asserter := require.New(t)
+
+	modFS := newTestModFS()
+	// stale config from a dev checkout should never make it into the zip
+	modFS[ConfigFilePath] = &fstest.MapFile{Data: []byte(`{"enabled": false}`)}
+
+	config := brotatomodtypes.ModConfig{
+		Enabled: true,
+		ConnectionData: brotatomodtypes.ModConfigConnectionData{
+			Host:      "example.com",
+			Port:      443,
+			HTTPS:     true,
+			AuthToken: "token",
+		},
+	}
+
+	buf := bytes.NewBuffer(nil)
+
+	err := WriteModZip(buf, modFS, config)
+	asserter.NoError(err)
+
+	zipReader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	asserter.NoError(err)
+
+	fileMap := make(map[string][]byte)
+	configCount := 0
+	for _, f := range zipReader.File {
+		rc, err := f.Open()
+		asserter.NoError(err)
+
+		data, err := io.ReadAll(rc)
+		asserter.NoError(err)
+		asserter.NoError(rc.Close())
+
+		if f.Name == ConfigFilePath {
+			configCount++
+		}
+
+		fileMap[f.Name] = data
+	}
+
+	asserter.Equal(1, configCount)
+	asserter.Equal([]byte("extends Node"), fileMap[ModDir+"/mod_main.gd"])
+	asserter.Contains(fileMap, ModDir+"/")
+
+	resConfig := brotatomodtypes.ModConfig{}
+	err = json.Unmarshal(fileMap[ConfigFilePath], &resConfig)
+	asserter.NoError(err)
+
+	asserter.Equal(config, resConfig)
+
+	// same input, same bytes
+	buf2 := bytes.NewBuffer(nil)
+
+	err = WriteModZip(buf2, modFS, config)
+	asserter.NoError(err)
+
+	asserter.Equal(buf.Bytes(), buf2.Bytes())
+}
+
+func TestCheckManifest(t *testing.T) {
+	t.Run("TestEmbedded", func(t *testing.T) {
+		asserter := require.New(t)
+
+		manifest, err := CheckManifest(brotatomodassets.ModFS())
+		asserter.NoError(err)
+
+		asserter.NotEmpty(manifest.VersionNumber)
+	})
+
+	t.Run("TestInvalidVersion", func(t *testing.T) {
+		asserter := require.New(t)
+
+		modFS := newTestModFS()
+		modFS[ModDir+"/manifest.json"] = &fstest.MapFile{Data: []byte(`{"name": "BrotatoExporter", "namespace": "benw10", "version_number": "latest"}`)}
+
+		_, err := CheckManifest(modFS)
+		asserter.Error(err)
+	})
+
+	t.Run("TestWrongModID", func(t *testing.T) {
+		asserter := require.New(t)
+
+		modFS := newTestModFS()
+		modFS[ModDir+"/manifest.json"] = &fstest.MapFile{Data: []byte(`{"name": "Other", "namespace": "benw10", "version_number": "1.0.0"}`)}
+
+		_, err := CheckManifest(modFS)
+		asserter.Error(err)
+	})
+
+	t.Run("TestMissingFile", func(t *testing.T) {
+		asserter := require.New(t)
+
+		modFS := newTestModFS()
+		delete(modFS, ModDir+"/mod_exporter.gd")
+
+		_, err := CheckManifest(modFS)
+		asserter.Error(err)
+
+		err = WriteModZip(io.Discard, modFS, brotatomodtypes.ModConfig{})
+		asserter.Error(err)
+	})
+}
@@ -0,0 +1,68 @@
+package brotatomodzip
+
+import (
+	"encoding/json"
+	"io/fs"
+	"regexp"
+
+	"github.com/benw10-1/brotato-exporter/errutil"
+)
+
+// ModDir slash separated path of the mod directory relative to the mod root.
+const ModDir = "mods-unpacked/" + ModID
+
+// RequiredFiles files relative to ModDir which the mod cannot load without.
+var RequiredFiles = []string{
+	"manifest.json",
+	"mod_main.gd",
+	"mod_exporter.gd",
+	"mod_game_poller.gd",
+	"exporter_message.gd",
+	"exporter_dict_serializer.gd",
+}
+
+var versionRegexp = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+
+// Manifest subset of the mod loader manifest.json we care about.
+type Manifest struct {
+	Name          string `json:"name"`
+	Namespace     string `json:"namespace"`
+	VersionNumber string `json:"version_number"`
+}
+
+// CheckManifest validates that modFS holds a loadable mod - the manifest matches ModID, has a semantic version
+// and all RequiredFiles are present.
+func CheckManifest(modFS fs.FS) (Manifest, error) {
+	manifest := Manifest{}
+
+	manifestBytes, err := fs.ReadFile(modFS, ModDir+"/manifest.json")
+	if err != nil {
+		return manifest, errutil.NewStackError(err)
+	}
+
+	err = json.Unmarshal(manifestBytes, &manifest)
+	if err != nil {
+		return manifest, errutil.NewStackError(err)
+	}
+
+	if manifest.Namespace+"-"+manifest.Name != ModID {
+		return manifest, errutil.NewStackErrorf("manifest mod ID (%s-%s) does not match (%s)", manifest.Namespace, manifest.Name, ModID)
+	}
+
+	if !versionRegexp.MatchString(manifest.VersionNumber) {
+		return manifest, errutil.NewStackErrorf("manifest version_number (%s) is not in major.minor.patch format", manifest.VersionNumber)
+	}
+
+	for _, requiredFile := range RequiredFiles {
+		info, err := fs.Stat(modFS, ModDir+"/"+requiredFile)
+		if err != nil {
+			return manifest, errutil.NewStackErrorf("missing required mod file (%s): %v", requiredFile, err)
+		}
+
+		if info.IsDir() {
+			return manifest, errutil.NewStackErrorf("required mod file (%s) is a directory", requiredFile)
+		}
+	}
+
+	return manifest, nil
+}
@@ -86,7 +86,7 @@ var zeroDictKeyVal = brotatomodtypes.DictKeyValue{}
 // - amount of key-value pairs (uint16)
 // - (for each key in dict)
 // -- $key_mappings[key] (uint16)
-// -- value bytes (variable - either uintx or [uint32 {length}, uint8, uint8, ...]
+// -- value bytes (variable - either SerialType.Size() bytes or [uint32 {length}, uint8, uint8, ...] for strings, arrays and maps)
 func (dr *BrotatoDictReader) ReadNextKeyValue() (brotatomodtypes.DictKeyValue, error) {
 	if dr.closed {
 		return zeroDictKeyVal, errutil.NewStackError("reader is closed")
@@ -110,58 +110,51 @@ func (dr *BrotatoDictReader) ReadNextKeyValue() (brotatomodtypes.DictKeyValue, e
 
 	mappedVal, ok := dr.dictMappingMap[key]
 	if !ok {
-		return zeroDictKeyVal, errutil.NewStackError(fmt.Sprintf("key not found in dict mapping - %d", key))
+		return zeroDictKeyVal, errutil.NewStackError(fmt.Errorf("%w - %d", ErrKeyNotMapped, key))
 	}
 
 	var valueBytes []byte
-	switch mappedVal.serialType {
-	case brotatomodtypes.SerialTypeString:
+	switch size := mappedVal.serialType.Size(); {
+	case mappedVal.serialType.Variable():
 		length, err := dr.serialReader.readUint32()
 		if err != nil {
 			return zeroDictKeyVal, errutil.NewStackError(err)
 		}
 
-		valueBytes, err = dr.serialReader.readBytes(int(length))
-		if err != nil {
-			return zeroDictKeyVal, errutil.NewStackError(err)
-		}
-	case brotatomodtypes.SerialTypeInt8:
-		valueBytes, err = dr.serialReader.readBytes(1)
-		if err != nil {
-			return zeroDictKeyVal, errutil.NewStackError(err)
-		}
-	case brotatomodtypes.SerialTypeInt16:
-		valueBytes, err = dr.serialReader.readBytes(2)
-		if err != nil {
-			return zeroDictKeyVal, errutil.NewStackError(err)
-		}
-	case brotatomodtypes.SerialTypeInt32:
-		valueBytes, err = dr.serialReader.readBytes(4)
-		if err != nil {
-			return zeroDictKeyVal, errutil.NewStackError(err)
+		// empty strings have no content bytes
+		if length > 0 {
+			valueBytes, err = dr.serialReader.readBytes(int(length))
+			if err != nil {
+				return zeroDictKeyVal, errutil.NewStackError(err)
+			}
 		}
-	case brotatomodtypes.SerialTypeInt64:
-		valueBytes, err = dr.serialReader.readBytes(8)
-		if err != nil {
-			return zeroDictKeyVal, errutil.NewStackError(err)
-		}
-	case brotatomodtypes.SerialTypeFloat32:
-		valueBytes, err = dr.serialReader.readBytes(4)
+	case size == 0:
+		// removed keys have no value
+	case size > 0:
+		valueBytes, err = dr.serialReader.readBytes(size)
 		if err != nil {
 			return zeroDictKeyVal, errutil.NewStackError(err)
 		}
 	default:
-		return zeroDictKeyVal, errors.New("unknown serial type")
+		return zeroDictKeyVal, errutil.NewStackErrorf("unknown serial type 0x%x for key (%s)", uint8(mappedVal.serialType), mappedVal.value)
 	}
 
-	dr.readCount++
-
-	return brotatomodtypes.DictKeyValue{
+	kv := brotatomodtypes.DictKeyValue{
 		Key:        key,
 		SerialType: mappedVal.serialType,
 		MappedKey:  mappedVal.value,
 		Value:      valueBytes,
-	}, nil
+	}
+
+	// catch malformed nested values here instead of while rendering them
+	err = kv.Validate()
+	if err != nil {
+		return zeroDictKeyVal, errutil.NewStackErrorf("invalid nested value for key (%s): %v", mappedVal.value, err)
+	}
+
+	dr.readCount++
+
+	return kv, nil
 }
 
 // Size returns the number of key-value pairs in the dict.
@@ -251,3 +244,38 @@ func (mdr *MapDictReader) ReadNextKeyValue() (brotatomodtypes.DictKeyValue, erro
 func (mdr *MapDictReader) Size() int {
 	return len(mdr.keyList)
 }
+
+// SliceDictReader key-values which were already read. Unlike BrotatoDictReader the values stay valid.
+type SliceDictReader struct {
+	keyValues []brotatomodtypes.DictKeyValue
+	curIdx    int
+}
+
+// NewSliceDictReader
+func NewSliceDictReader(keyValues []brotatomodtypes.DictKeyValue) *SliceDictReader {
+	return &SliceDictReader{
+		keyValues: keyValues,
+	}
+}
+
+// ReadNextKeyValue
+func (sdr *SliceDictReader) ReadNextKeyValue() (brotatomodtypes.DictKeyValue, error) {
+	if sdr.curIdx >= len(sdr.keyValues) {
+		return brotatomodtypes.DictKeyValue{}, io.EOF
+	}
+
+	kv := sdr.keyValues[sdr.curIdx]
+	sdr.curIdx++
+
+	return kv, nil
+}
+
+// Size
+func (sdr *SliceDictReader) Size() int {
+	return len(sdr.keyValues)
+}
+
+// KeyValues every key-value, including ones already read.
+func (sdr *SliceDictReader) KeyValues() []brotatomodtypes.DictKeyValue {
+	return sdr.keyValues
+}
@@ -23,6 +23,11 @@ func NewDictWriter(serialWriter *BrotatoSerialWriter) *BrotatoDictWriter {
 	}
 }
 
+// Reset forget every key mapping, the next dict sends all of its keys in the header again.
+func (dw *BrotatoDictWriter) Reset() {
+	dw.keyMappings = make(map[string]brotatomodtypes.DictKeyValue)
+}
+
 // EncodeDict
 func (dw *BrotatoDictWriter) EncodeDict(dict brotatomodtypes.DictReader) error {
 	headerBuf := make([]byte, 0, 1024)
@@ -44,26 +49,29 @@ func (dw *BrotatoDictWriter) EncodeDict(dict brotatomodtypes.DictReader) error {
 		}
 
 		mapped, ok := dw.keyMappings[kv.MappedKey]
-		if ok {
-			bodyBuf = binary.LittleEndian.AppendUint16(bodyBuf, mapped.Key)
-			bodyBuf = append(bodyBuf, mapped.Value...)
-			continue
+		// same as the mod - keys whose type changed are re-sent in the header under the same mapping
+		if !ok || mapped.SerialType != kv.SerialType {
+			if !ok {
+				mapped.Key = uint16(kvIdx)
+				kvIdx++
+			}
+			mapped.MappedKey = kv.MappedKey
+			mapped.SerialType = kv.SerialType
+
+			dw.keyMappings[kv.MappedKey] = mapped
+			newCount++
+
+			headerBuf = binary.LittleEndian.AppendUint16(headerBuf, mapped.Key)
+			headerBuf = append(headerBuf, byte(mapped.SerialType))
+			headerBuf = binary.LittleEndian.AppendUint16(headerBuf, uint16(len(mapped.MappedKey)))
+			headerBuf = append(headerBuf, []byte(mapped.MappedKey)...)
 		}
 
-		mapped = brotatomodtypes.DictKeyValue{
-			Key:        uint16(kvIdx),
-			MappedKey:  kv.MappedKey,
-			SerialType: kv.SerialType,
-			Value:      kv.Value,
+		bodyBuf = binary.LittleEndian.AppendUint16(bodyBuf, mapped.Key)
+		if kv.SerialType.Variable() {
+			bodyBuf = binary.LittleEndian.AppendUint32(bodyBuf, uint32(len(kv.Value)))
 		}
-		dw.keyMappings[kv.MappedKey] = mapped
-		kvIdx++
-		newCount++
-
-		headerBuf = binary.LittleEndian.AppendUint16(headerBuf, mapped.Key)
-		headerBuf = append(headerBuf, byte(mapped.SerialType))
-		headerBuf = binary.LittleEndian.AppendUint16(headerBuf, uint16(len(mapped.MappedKey)))
-		headerBuf = append(headerBuf, []byte(mapped.MappedKey)...)
+		bodyBuf = append(bodyBuf, kv.Value...)
 	}
 
 	binary.LittleEndian.PutUint16(headerBuf[1:], uint16(newCount))
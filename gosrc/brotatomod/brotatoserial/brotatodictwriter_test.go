@@ -39,6 +39,40 @@ func TestDictWriter(t *testing.T) {
 				"key3": 4,
 			},
 		},
+		{
+			name: "extended",
+			dict: map[string]interface{}{
+				"key":  true,
+				"key1": false,
+				"key2": float64(1 << 60),
+				"key3": uint8(200),
+				"key4": uint16(60000),
+				"key5": uint32(4000000000),
+				"key6": uint64(1 << 63),
+				"key7": removedValue{},
+				"key8": "",
+			},
+		},
+		{
+			name: "nested",
+			dict: map[string]interface{}{
+				"weapons": []interface{}{
+					map[string]interface{}{
+						"id":   "weapon_knife_1",
+						"tier": int8(0),
+						"stats": map[string]interface{}{
+							"damage":    int16(6),
+							"crit_mult": float32(2),
+						},
+					},
+				},
+				"items": map[string]interface{}{
+					"item_coupon": int8(1),
+					"item_bag":    removedValue{},
+				},
+				"empty": []interface{}{},
+			},
+		},
 		{
 			name: "mixed",
 			dict: map[string]interface{}{
@@ -80,6 +114,7 @@ func TestDictWriter(t *testing.T) {
 			resDr, err := NewDictReader(resSerialReader, map[uint16]dictMapping{})
 			asserter.NoError(err)
 
+			readCount := 0
 			for {
 				kv, err := resDr.ReadNextKeyValue()
 				if err != nil {
@@ -94,12 +129,92 @@ func TestDictWriter(t *testing.T) {
 				asserter.True(ok)
 
 				asserter.Equal(expectedKV.SerialType, kv.SerialType)
-				asserter.Equal(expectedKV.Value, kv.Value)
+				// compare as strings so empty and nil values are equal
+				asserter.Equal(string(expectedKV.Value), string(kv.Value))
+				readCount++
 			}
+
+			asserter.Equal(len(kvMap), readCount)
 		})
 	}
 }
 
+func TestDictWriterMapped(t *testing.T) {
+	asserter := require.New(t)
+
+	first := map[string]interface{}{
+		"key":  "value",
+		"key1": 1,
+		"key2": "value2",
+	}
+	// key changes type, key1 keeps its type with a new value and key2 keeps both
+	second := map[string]interface{}{
+		"key":  2,
+		"key1": 3,
+		"key2": "value2",
+	}
+
+	w := bytes.NewBuffer(nil)
+	dw := NewDictWriter(NewSerialWriter(w))
+
+	dictMappingMap := map[uint16]dictMapping{}
+	keyMapping := map[string]uint16{}
+	for i, dict := range []map[string]interface{}{first, second} {
+		kvMap := make(map[string]brotatomodtypes.DictKeyValue)
+		for k, v := range dict {
+			kv, err := newKeyValue(k, v)
+			asserter.NoError(err)
+
+			kvMap[k] = kv
+		}
+
+		err := dw.EncodeDict(NewMapDictReader(kvMap))
+		asserter.NoError(err)
+
+		newCount := binary.LittleEndian.Uint16(w.Bytes()[1:])
+		if i == 0 {
+			asserter.Equal(uint16(len(first)), newCount)
+		} else {
+			// only the retyped key is sent in the header again
+			asserter.Equal(uint16(1), newCount)
+		}
+
+		resDr, err := NewDictReader(NewSerialReader(w, make([]byte, 0, 1024)), dictMappingMap)
+		asserter.NoError(err)
+
+		readCount := 0
+		for {
+			kv, err := resDr.ReadNextKeyValue()
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+
+				asserter.NoError(err)
+			}
+
+			expectedKV, ok := kvMap[kv.MappedKey]
+			asserter.True(ok)
+
+			asserter.Equal(expectedKV.SerialType, kv.SerialType)
+			asserter.Equal(expectedKV.Value, kv.Value)
+			readCount++
+
+			if i == 0 {
+				keyMapping[kv.MappedKey] = kv.Key
+			} else {
+				asserter.Equal(keyMapping[kv.MappedKey], kv.Key)
+			}
+		}
+
+		asserter.Equal(len(dict), readCount)
+		asserter.Zero(w.Len())
+	}
+}
+
+// removedValue use as a value in test dicts to mark the key removed.
+type removedValue struct{}
+
 func newKeyValue(key string, value interface{}) (brotatomodtypes.DictKeyValue, error) {
 	kv := brotatomodtypes.DictKeyValue{
 		MappedKey: key,
@@ -121,8 +236,17 @@ func newKeyValue(key string, value interface{}) (brotatomodtypes.DictKeyValue, e
 		kv.SerialType = brotatomodtypes.SerialTypeInt64
 		kv.Value = binary.LittleEndian.AppendUint64(nil, uint64(v))
 	case uint:
-		kv.SerialType = brotatomodtypes.SerialTypeInt64
+		kv.SerialType = brotatomodtypes.SerialTypeUint64
 		kv.Value = binary.LittleEndian.AppendUint64(nil, uint64(v))
+	case uint64:
+		kv.SerialType = brotatomodtypes.SerialTypeUint64
+		kv.Value = binary.LittleEndian.AppendUint64(nil, v)
+	case uint32:
+		kv.SerialType = brotatomodtypes.SerialTypeUint32
+		kv.Value = binary.LittleEndian.AppendUint32(nil, v)
+	case uint16:
+		kv.SerialType = brotatomodtypes.SerialTypeUint16
+		kv.Value = binary.LittleEndian.AppendUint16(nil, v)
 	case int64:
 		kv.SerialType = brotatomodtypes.SerialTypeInt64
 		kv.Value = binary.LittleEndian.AppendUint64(nil, uint64(v))
@@ -135,12 +259,49 @@ func newKeyValue(key string, value interface{}) (brotatomodtypes.DictKeyValue, e
 	case int8:
 		kv.SerialType = brotatomodtypes.SerialTypeInt8
 		kv.Value = []byte{byte(v)}
-	case byte:
-		kv.SerialType = brotatomodtypes.SerialTypeInt8
+	case uint8:
+		kv.SerialType = brotatomodtypes.SerialTypeUint8
 		kv.Value = []byte{v}
 	case float32:
 		kv.SerialType = brotatomodtypes.SerialTypeFloat32
 		kv.Value = binary.LittleEndian.AppendUint32(nil, math.Float32bits(v))
+	case float64:
+		kv.SerialType = brotatomodtypes.SerialTypeFloat64
+		kv.Value = binary.LittleEndian.AppendUint64(nil, math.Float64bits(v))
+	case bool:
+		kv.SerialType = brotatomodtypes.SerialTypeBool
+		kv.Value = []byte{0}
+		if v {
+			kv.Value[0] = 1
+		}
+	case removedValue:
+		kv.SerialType = brotatomodtypes.SerialTypeRemoved
+	case []interface{}:
+		elements := make([]brotatomodtypes.DictKeyValue, 0, len(v))
+		for _, elementValue := range v {
+			element, err := newKeyValue("", elementValue)
+			if err != nil {
+				return kv, errutil.NewStackError(err)
+			}
+
+			elements = append(elements, element)
+		}
+
+		kv.SerialType = brotatomodtypes.SerialTypeArray
+		kv.Value = brotatomodtypes.AppendArrayValue(nil, elements)
+	case map[string]interface{}:
+		entries := make([]brotatomodtypes.DictKeyValue, 0, len(v))
+		for entryKey, entryValue := range v {
+			entry, err := newKeyValue(entryKey, entryValue)
+			if err != nil {
+				return kv, errutil.NewStackError(err)
+			}
+
+			entries = append(entries, entry)
+		}
+
+		kv.SerialType = brotatomodtypes.SerialTypeMap
+		kv.Value = brotatomodtypes.AppendMapValue(nil, entries)
 
 	default:
 		return kv, errutil.NewStackErrorf("unsupported value type %T", value)
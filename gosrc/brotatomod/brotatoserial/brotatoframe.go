@@ -0,0 +1,38 @@
+package brotatoserial
+
+import (
+	"errors"
+	"fmt"
+)
+
+// frameHeaderSize payload length (uint32) followed by the CRC32 of the payload (uint32).
+const frameHeaderSize = 8
+
+// MaxFrameSize largest frame payload the reader accepts. A larger length can't be trusted to skip over, so it ends the body.
+const MaxFrameSize = 1 << 24
+
+// ErrFrameChecksum frame payload did not match its CRC32.
+var ErrFrameChecksum = errors.New("frame checksum mismatch")
+
+// FrameError a single frame could not be read. The reader has already moved past the frame and the session's key mappings
+// are unchanged, so reading can continue with the next frame.
+type FrameError struct {
+	// Index of the frame in the current body, starting at 0.
+	Index int
+	// Offset of the frame header in bytes from the start of the current body.
+	Offset int64
+	// ErrOffset where in the current body reading the frame failed. For a payload that doesn't parse this is inside the payload.
+	ErrOffset int64
+	// Err cause of the failure.
+	Err error
+}
+
+// Error
+func (fe *FrameError) Error() string {
+	return fmt.Sprintf("frame %d at offset %d: %v", fe.Index, fe.Offset, fe.Err)
+}
+
+// Unwrap
+func (fe *FrameError) Unwrap() error {
+	return fe.Err
+}
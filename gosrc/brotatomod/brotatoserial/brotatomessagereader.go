@@ -1,7 +1,12 @@
 package brotatoserial
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"io"
+	"maps"
 
 	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
 	"github.com/benw10-1/brotato-exporter/errutil"
@@ -20,26 +25,219 @@ type BrotatoMessageReader struct {
 	serialReader *BrotatoSerialReader
 	// convert key header
 	dictMappingMap map[uint16]dictMapping
+
+	protocolVersion brotatomodtypes.ProtocolVersion
+
+	// frameReader reads the payload of the current frame, only used for framed versions.
+	frameReader *BrotatoSerialReader
+	// frameBytesReader underlying reader of frameReader.
+	frameBytesReader *bytes.Reader
+	// frameIndex index of the next frame in the current body.
+	frameIndex int
+	// frameOffset offset of the next frame in the current body.
+	frameOffset int64
 }
 
-// NewMessageReader
+// NewMessageReader reader for mods which did not negotiate a protocol version.
 func NewMessageReader(underlyingReader io.Reader, buf []byte) *BrotatoMessageReader {
+	return NewVersionedMessageReader(brotatomodtypes.ProtocolVersionLegacy, underlyingReader, buf)
+}
+
+// NewVersionedMessageReader reader for the negotiated protocol version. An unsupported version is only reported once reading.
+func NewVersionedMessageReader(protocolVersion brotatomodtypes.ProtocolVersion, underlyingReader io.Reader, buf []byte) *BrotatoMessageReader {
 	serialReader := NewSerialReader(underlyingReader, buf)
 
+	frameBytesReader := bytes.NewReader(nil)
+
 	return &BrotatoMessageReader{
-		dictMappingMap: make(map[uint16]dictMapping),
-		serialReader:   serialReader,
+		dictMappingMap:   make(map[uint16]dictMapping),
+		serialReader:     serialReader,
+		protocolVersion:  protocolVersion,
+		frameReader:      NewSerialReader(frameBytesReader, nil),
+		frameBytesReader: frameBytesReader,
 	}
 }
 
-// SetReader
+// SetReader start reading a new body. Frame indexes and offsets are relative to the start of the body.
 func (mr *BrotatoMessageReader) SetReader(underlyingReader io.Reader) {
 	mr.serialReader.SetReader(underlyingReader)
+	mr.frameIndex = 0
+	mr.frameOffset = 0
+}
+
+// Offset bytes of the current body read so far. Points at where reading failed after a legacy message fails,
+// framed versions report that in FrameError.ErrOffset instead.
+func (mr *BrotatoMessageReader) Offset() int64 {
+	return mr.serialReader.Offset()
+}
+
+// ProtocolVersion
+func (mr *BrotatoMessageReader) ProtocolVersion() brotatomodtypes.ProtocolVersion {
+	return mr.protocolVersion
+}
+
+// Reset forget every key mapping. Use when the mod is known to start its mapping over.
+func (mr *BrotatoMessageReader) Reset() {
+	mr.dictMappingMap = make(map[uint16]dictMapping)
 }
 
 // ReadNextMessage
 func (mr *BrotatoMessageReader) ReadNextMessage() (brotatomodtypes.ExporterMessage, error) {
-	messageTypeByte, err := mr.serialReader.readUint8()
+	switch mr.protocolVersion {
+	case brotatomodtypes.ProtocolVersionLegacy:
+		return readMessage(mr.serialReader, mr.dictMappingMap)
+	case brotatomodtypes.ProtocolVersionFramed:
+		return mr.readFramedMessage()
+	default:
+		return brotatomodtypes.ExporterMessage{}, errutil.NewStackError(unsupportedProtocolVersionError(mr.protocolVersion))
+	}
+}
+
+// readFramedMessage reads the next frame. A frame which fails its checksum or does not parse is returned as a *FrameError
+// without touching the key mappings, any other error means the rest of the body can't be read.
+//
+// Format of the frame:
+// - payload length (uint32)
+// - CRC32 (IEEE) of the payload (uint32)
+// - payload (variable - exactly one message in the legacy format)
+func (mr *BrotatoMessageReader) readFramedMessage() (brotatomodtypes.ExporterMessage, error) {
+	frameErr := &FrameError{
+		Index:  mr.frameIndex,
+		Offset: mr.frameOffset,
+	}
+	mr.frameIndex++
+
+	length, err := mr.serialReader.readUint32()
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			frameErr.Err = err
+			frameErr.ErrOffset = mr.serialReader.Offset()
+			return brotatomodtypes.ExporterMessage{}, errutil.NewStackError(frameErr)
+		}
+
+		return brotatomodtypes.ExporterMessage{}, errutil.NewStackError(err)
+	}
+
+	if length > MaxFrameSize {
+		return brotatomodtypes.ExporterMessage{}, errutil.NewStackErrorf("frame %d at offset %d is %d bytes, more than the max of %d", frameErr.Index, frameErr.Offset, length, MaxFrameSize)
+	}
+
+	checksum, err := mr.serialReader.readUint32()
+	if err != nil {
+		frameErr.Err = io.ErrUnexpectedEOF
+		frameErr.ErrOffset = mr.serialReader.Offset()
+		return brotatomodtypes.ExporterMessage{}, errutil.NewStackError(frameErr)
+	}
+
+	var payload []byte
+	if length > 0 {
+		payload, err = mr.serialReader.readBytes(int(length))
+		if err != nil {
+			frameErr.Err = io.ErrUnexpectedEOF
+			frameErr.ErrOffset = mr.serialReader.Offset()
+			return brotatomodtypes.ExporterMessage{}, errutil.NewStackError(frameErr)
+		}
+	}
+	mr.frameOffset += frameHeaderSize + int64(length)
+
+	if crc32.ChecksumIEEE(payload) != checksum {
+		frameErr.Err = ErrFrameChecksum
+		frameErr.ErrOffset = frameErr.Offset
+		return brotatomodtypes.ExporterMessage{}, errutil.NewStackError(frameErr)
+	}
+
+	// mappings are only copied for frames which change them, so a frame which fails part way through can't leave half
+	// of its mappings behind
+	stagedMappingMap := mr.dictMappingMap
+	if payloadChangesMappings(payload) {
+		stagedMappingMap = maps.Clone(mr.dictMappingMap)
+	}
+
+	msg, err := mr.readFramePayload(payload, stagedMappingMap)
+	if err != nil {
+		frameErr.Err = err
+		frameErr.ErrOffset = frameErr.Offset + frameHeaderSize + mr.frameReader.Offset()
+		return brotatomodtypes.ExporterMessage{}, errutil.NewStackError(frameErr)
+	}
+
+	mr.dictMappingMap = stagedMappingMap
+
+	return msg, nil
+}
+
+// readFramePayload reads the whole payload, every key-value included, using dictMappingMap. The body is returned as a
+// SliceDictReader with values of their own, the payload is only valid until the next frame.
+func (mr *BrotatoMessageReader) readFramePayload(payload []byte, dictMappingMap map[uint16]dictMapping) (brotatomodtypes.ExporterMessage, error) {
+	mr.frameBytesReader.Reset(payload)
+	mr.frameReader.SetReader(mr.frameBytesReader)
+
+	msg, err := readMessage(mr.frameReader, dictMappingMap)
+	if err != nil {
+		return brotatomodtypes.ExporterMessage{}, errutil.NewStackError(err)
+	}
+
+	if msg.MessageBody != nil {
+		keyValues := make([]brotatomodtypes.DictKeyValue, 0, msg.MessageBody.Size())
+		// values can't take up more than the payload, so appending never moves the ones already copied
+		valueBuf := make([]byte, 0, len(payload))
+		for {
+			kv, err := msg.MessageBody.ReadNextKeyValue()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return brotatomodtypes.ExporterMessage{}, errutil.NewStackError(err)
+			}
+
+			if kv.Value != nil {
+				valueStart := len(valueBuf)
+				valueBuf = append(valueBuf, kv.Value...)
+				kv.Value = valueBuf[valueStart:len(valueBuf):len(valueBuf)]
+			}
+			keyValues = append(keyValues, kv)
+		}
+
+		msg.MessageBody = NewSliceDictReader(keyValues)
+	}
+
+	if mr.frameBytesReader.Len() > 0 {
+		return brotatomodtypes.ExporterMessage{}, errutil.NewStackErrorf("%d trailing bytes after message", mr.frameBytesReader.Len())
+	}
+
+	return msg, nil
+}
+
+// payloadChangesMappings whether the message in payload resets the key mappings or its dict adds new ones. Only looks at
+// the headers, see readMessage and readMessageDictMapping for the format.
+func payloadChangesMappings(payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+
+	messageType := brotatomodtypes.MessageType(payload[0])
+	if messageType == brotatomodtypes.MessageTypeMappingReset {
+		return true
+	}
+
+	if !messageType.HasBody() || len(payload) < newKeyCountOffset+2 {
+		return false
+	}
+
+	return binary.LittleEndian.Uint16(payload[newKeyCountOffset:]) > 0
+}
+
+// newKeyCountOffset offset of a message's new key count, after the message type, reason, timestamp and dict mapping header.
+const newKeyCountOffset = 1 + 1 + 8 + 1
+
+// readMessage reads a single unframed message, new key mappings are added to dictMappingMap.
+//
+// Format of the message:
+// - message type (uint8)
+// - message reason (uint8)
+// - message timestamp (int64)
+// - dict (only for MessageType.HasBody - see ReadNextKeyValue)
+func readMessage(serialReader *BrotatoSerialReader, dictMappingMap map[uint16]dictMapping) (brotatomodtypes.ExporterMessage, error) {
+	messageTypeByte, err := serialReader.readUint8()
 	if err != nil {
 		return brotatomodtypes.ExporterMessage{}, errutil.NewStackError(err)
 	}
@@ -48,31 +246,33 @@ func (mr *BrotatoMessageReader) ReadNextMessage() (brotatomodtypes.ExporterMessa
 		return brotatomodtypes.ExporterMessage{}, errutil.NewStackErrorf("invalid message type %d", messageType)
 	}
 
-	messageReason, err := mr.serialReader.readUint8()
+	messageReason, err := serialReader.readUint8()
 	if err != nil {
 		return brotatomodtypes.ExporterMessage{}, errutil.NewStackError(err)
 	}
 
-	messageTimestamp, err := mr.serialReader.readInt64()
+	messageTimestamp, err := serialReader.readInt64()
 	if err != nil {
 		return brotatomodtypes.ExporterMessage{}, errutil.NewStackError(err)
 	}
 
+	if messageType == brotatomodtypes.MessageTypeMappingReset {
+		clear(dictMappingMap)
+	}
+
 	msg := brotatomodtypes.ExporterMessage{
 		MessageType:      messageType,
 		MessageReason:    brotatomodtypes.MessageReason(messageReason),
 		MessageTimestamp: brotatomodtypes.MicroTime(messageTimestamp),
 	}
 
-	switch msg.MessageType {
-	case brotatomodtypes.MessageTypeTimeSeriesFull, brotatomodtypes.MessageTypeTimeSeriesDiff:
-		dr, err := NewDictReader(mr.serialReader, mr.dictMappingMap)
+	if msg.MessageType.HasBody() {
+		dr, err := NewDictReader(serialReader, dictMappingMap)
 		if err != nil {
 			return brotatomodtypes.ExporterMessage{}, errutil.NewStackError(err)
 		}
 
 		msg.MessageBody = dr
-	default:
 	}
 
 	return msg, nil
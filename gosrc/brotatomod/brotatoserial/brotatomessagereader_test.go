@@ -0,0 +1,399 @@
+package brotatoserial
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFramedMessageReader(t *testing.T) {
+	nowTimestamp := brotatomodtypes.MicroTimeFromTime(time.Now())
+
+	// writeFrames writes one framed diff message per body and returns the offset of each frame
+	writeFrames := func(asserter *require.Assertions, w io.Writer, bodies ...map[string]interface{}) []int {
+		offsetWriter := &countingWriter{w: w}
+		mw := NewVersionedMessageWriter(brotatomodtypes.ProtocolVersionFramed, NewSerialWriter(offsetWriter))
+
+		offsets := make([]int, 0, len(bodies))
+		for _, body := range bodies {
+			kvMap := make(map[string]brotatomodtypes.DictKeyValue)
+			for k, v := range body {
+				kv, err := newKeyValue(k, v)
+				asserter.NoError(err)
+
+				kvMap[k] = kv
+			}
+
+			offsets = append(offsets, offsetWriter.n)
+
+			err := mw.WriteMessage(&brotatomodtypes.ExporterMessage{
+				MessageType:      brotatomodtypes.MessageTypeTimeSeriesDiff,
+				MessageReason:    brotatomodtypes.MessageReasonPoll,
+				MessageTimestamp: nowTimestamp,
+				MessageBody:      NewMapDictReader(kvMap),
+			})
+			asserter.NoError(err)
+		}
+
+		return offsets
+	}
+
+	// readKeys reads every key-value of the message
+	readKeys := func(asserter *require.Assertions, msg brotatomodtypes.ExporterMessage) []string {
+		keys := make([]string, 0)
+		for {
+			kv, err := msg.MessageBody.ReadNextKeyValue()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			asserter.NoError(err)
+
+			keys = append(keys, kv.MappedKey)
+		}
+
+		return keys
+	}
+
+	t.Run("TestChecksumMismatch", func(t *testing.T) {
+		asserter := require.New(t)
+
+		w := bytes.NewBuffer(nil)
+		offsets := writeFrames(asserter, w,
+			map[string]interface{}{"current_level": 1},
+			map[string]interface{}{"current_xp": float32(1.5)},
+			map[string]interface{}{"current_level": 2},
+		)
+
+		// flip the last byte of the second frame's payload
+		body := w.Bytes()
+		body[offsets[2]-1] ^= 0xff
+
+		mr := NewVersionedMessageReader(brotatomodtypes.ProtocolVersionFramed, bytes.NewReader(body), nil)
+
+		msg, err := mr.ReadNextMessage()
+		asserter.NoError(err)
+		asserter.Equal([]string{"current_level"}, readKeys(asserter, msg))
+
+		_, err = mr.ReadNextMessage()
+		frameErr := &FrameError{}
+		asserter.ErrorAs(err, &frameErr)
+		asserter.ErrorIs(err, ErrFrameChecksum)
+		asserter.Equal(1, frameErr.Index)
+		asserter.Equal(int64(offsets[1]), frameErr.Offset)
+		asserter.Equal(frameErr.Offset, frameErr.ErrOffset)
+
+		msg, err = mr.ReadNextMessage()
+		asserter.NoError(err)
+		asserter.Equal([]string{"current_level"}, readKeys(asserter, msg))
+
+		_, err = mr.ReadNextMessage()
+		asserter.ErrorIs(err, io.EOF)
+
+		// mapping from the bad frame was never applied
+		asserter.Equal([]string{"current_level"}, mr.MappedKeyList())
+	})
+
+	t.Run("TestUnparsableFrame", func(t *testing.T) {
+		asserter := require.New(t)
+
+		w := bytes.NewBuffer(nil)
+		writeFrames(asserter, w, map[string]interface{}{"current_level": 1})
+
+		// valid checksum, but the body adds a mapping then references a key that was never mapped
+		payload := []byte{byte(brotatomodtypes.MessageTypeTimeSeriesDiff), byte(brotatomodtypes.MessageReasonPoll)}
+		payload = binary.LittleEndian.AppendUint64(payload, uint64(nowTimestamp))
+		payload = append(payload, brotatomodtypes.MessageDictMappingHeader)
+		payload = binary.LittleEndian.AppendUint16(payload, 1)
+		payload = binary.LittleEndian.AppendUint16(payload, 7)
+		payload = append(payload, byte(brotatomodtypes.SerialTypeInt8))
+		payload = binary.LittleEndian.AppendUint16(payload, uint16(len("current_health")))
+		payload = append(payload, "current_health"...)
+		payload = binary.LittleEndian.AppendUint16(payload, 1)
+		payload = binary.LittleEndian.AppendUint16(payload, 42)
+		payload = append(payload, 1)
+
+		mw := NewVersionedMessageWriter(brotatomodtypes.ProtocolVersionFramed, NewSerialWriter(w))
+		asserter.NoError(mw.serialWriter.writeUint32(uint32(len(payload))))
+		asserter.NoError(mw.serialWriter.writeUint32(crc32.ChecksumIEEE(payload)))
+		_, err := w.Write(payload)
+		asserter.NoError(err)
+		bodyLen := w.Len()
+
+		mr := NewVersionedMessageReader(brotatomodtypes.ProtocolVersionFramed, w, nil)
+
+		_, err = mr.ReadNextMessage()
+		asserter.NoError(err)
+
+		_, err = mr.ReadNextMessage()
+		frameErr := &FrameError{}
+		asserter.ErrorAs(err, &frameErr)
+		asserter.Equal(1, frameErr.Index)
+		asserter.ErrorIs(err, ErrKeyNotMapped)
+		// just past the unmapped key, before its value
+		asserter.Equal(int64(bodyLen-1), frameErr.ErrOffset)
+
+		_, err = mr.ReadNextMessage()
+		asserter.ErrorIs(err, io.EOF)
+
+		asserter.Equal([]string{"current_level"}, mr.MappedKeyList())
+	})
+
+	t.Run("TestTruncated", func(t *testing.T) {
+		asserter := require.New(t)
+
+		w := bytes.NewBuffer(nil)
+		writeFrames(asserter, w,
+			map[string]interface{}{"current_level": 1},
+			map[string]interface{}{"current_level": 2},
+		)
+		body := w.Bytes()[:w.Len()-3]
+
+		mr := NewVersionedMessageReader(brotatomodtypes.ProtocolVersionFramed, bytes.NewReader(body), nil)
+
+		_, err := mr.ReadNextMessage()
+		asserter.NoError(err)
+
+		_, err = mr.ReadNextMessage()
+		frameErr := &FrameError{}
+		asserter.ErrorAs(err, &frameErr)
+		asserter.ErrorIs(err, io.ErrUnexpectedEOF)
+		asserter.Equal(int64(len(body)), frameErr.ErrOffset)
+
+		_, err = mr.ReadNextMessage()
+		asserter.ErrorIs(err, io.EOF)
+	})
+
+	t.Run("TestValuesKept", func(t *testing.T) {
+		asserter := require.New(t)
+
+		w := bytes.NewBuffer(nil)
+		writeFrames(asserter, w,
+			map[string]interface{}{"current_character": "Mage"},
+			map[string]interface{}{"current_character": "Bull"},
+		)
+		body := w.Bytes()
+
+		// only the first frame adds a mapping
+		firstLength := binary.LittleEndian.Uint32(body)
+		asserter.True(payloadChangesMappings(body[frameHeaderSize : frameHeaderSize+firstLength]))
+		asserter.False(payloadChangesMappings(body[2*frameHeaderSize+firstLength:]))
+
+		mr := NewVersionedMessageReader(brotatomodtypes.ProtocolVersionFramed, bytes.NewReader(body), nil)
+
+		first, err := mr.ReadNextMessage()
+		asserter.NoError(err)
+
+		second, err := mr.ReadNextMessage()
+		asserter.NoError(err)
+
+		// the first message's values are not overwritten by reading the second
+		for msg, character := range map[*brotatomodtypes.ExporterMessage]string{&first: "Mage", &second: "Bull"} {
+			kv, err := msg.MessageBody.ReadNextKeyValue()
+			asserter.NoError(err)
+			asserter.Equal(character, string(kv.Value))
+		}
+	})
+
+	t.Run("TestTooLarge", func(t *testing.T) {
+		asserter := require.New(t)
+
+		body := binary.LittleEndian.AppendUint32(nil, MaxFrameSize+1)
+		body = binary.LittleEndian.AppendUint32(body, 0)
+
+		mr := NewVersionedMessageReader(brotatomodtypes.ProtocolVersionFramed, bytes.NewReader(body), nil)
+
+		_, err := mr.ReadNextMessage()
+		asserter.Error(err)
+
+		frameErr := &FrameError{}
+		asserter.False(errors.As(err, &frameErr))
+	})
+}
+
+func TestLegacyOffset(t *testing.T) {
+	asserter := require.New(t)
+
+	w := bytes.NewBuffer(nil)
+	mw := NewMessageWriter(NewSerialWriter(w))
+
+	err := mw.WriteMessage(&brotatomodtypes.ExporterMessage{
+		MessageType:      brotatomodtypes.MessageTypeKeepAlive,
+		MessageReason:    brotatomodtypes.MessageReasonNone,
+		MessageTimestamp: brotatomodtypes.MicroTimeFromTime(time.Now()),
+	})
+	asserter.NoError(err)
+
+	messageLen := w.Len()
+
+	// invalid message type
+	w.WriteByte(0xff)
+
+	mr := NewMessageReader(bytes.NewReader(w.Bytes()), nil)
+
+	_, err = mr.ReadNextMessage()
+	asserter.NoError(err)
+	asserter.Equal(int64(messageLen), mr.Offset())
+
+	_, err = mr.ReadNextMessage()
+	asserter.Error(err)
+	asserter.Equal(int64(messageLen+1), mr.Offset())
+
+	mr.SetReader(bytes.NewReader(nil))
+	asserter.Equal(int64(0), mr.Offset())
+}
+
+func TestOversizedLength(t *testing.T) {
+	// a diff with a string value whose length claims far more bytes than the body has
+	payload := []byte{byte(brotatomodtypes.MessageTypeTimeSeriesDiff), byte(brotatomodtypes.MessageReasonPoll)}
+	payload = binary.LittleEndian.AppendUint64(payload, uint64(brotatomodtypes.MicroTimeFromTime(time.Now())))
+	payload = append(payload, brotatomodtypes.MessageDictMappingHeader)
+	payload = binary.LittleEndian.AppendUint16(payload, 1)
+	payload = binary.LittleEndian.AppendUint16(payload, 7)
+	payload = append(payload, byte(brotatomodtypes.SerialTypeString))
+	payload = binary.LittleEndian.AppendUint16(payload, uint16(len("current_character")))
+	payload = append(payload, "current_character"...)
+	payload = binary.LittleEndian.AppendUint16(payload, 1)
+	payload = binary.LittleEndian.AppendUint16(payload, 7)
+	payload = binary.LittleEndian.AppendUint32(payload, 0xf0000000)
+	payload = append(payload, "Mage"...)
+
+	// readAllocated bytes allocated while reading the next message
+	readAllocated := func(mr *BrotatoMessageReader) (uint64, error) {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+
+		msg, err := mr.ReadNextMessage()
+		if err == nil {
+			_, err = msg.MessageBody.ReadNextKeyValue()
+		}
+
+		runtime.ReadMemStats(&after)
+
+		return after.TotalAlloc - before.TotalAlloc, err
+	}
+
+	t.Run("TestLegacy", func(t *testing.T) {
+		asserter := require.New(t)
+
+		mr := NewMessageReader(bytes.NewBuffer(payload), nil)
+
+		allocated, err := readAllocated(mr)
+		asserter.ErrorIs(err, io.ErrUnexpectedEOF)
+		asserter.Less(allocated, uint64(1<<20))
+		asserter.Equal(int64(len(payload)), mr.Offset())
+	})
+
+	t.Run("TestFramed", func(t *testing.T) {
+		asserter := require.New(t)
+
+		// the checksum is right, only the length inside the frame is wrong
+		body := binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))
+		body = binary.LittleEndian.AppendUint32(body, crc32.ChecksumIEEE(payload))
+		body = append(body, payload...)
+
+		mr := NewVersionedMessageReader(brotatomodtypes.ProtocolVersionFramed, bytes.NewBuffer(body), nil)
+
+		allocated, err := readAllocated(mr)
+		frameErr := &FrameError{}
+		asserter.ErrorAs(err, &frameErr)
+		asserter.ErrorIs(err, io.ErrUnexpectedEOF)
+		asserter.Less(allocated, uint64(1<<20))
+		asserter.Equal(int64(len(body)), frameErr.ErrOffset)
+	})
+}
+
+func TestMappingReset(t *testing.T) {
+	nowTimestamp := brotatomodtypes.MicroTimeFromTime(time.Now())
+
+	for _, protocolVersion := range []brotatomodtypes.ProtocolVersion{brotatomodtypes.ProtocolVersionLegacy, brotatomodtypes.ProtocolVersionFramed} {
+		t.Run(fmt.Sprintf("v%d", protocolVersion), func(t *testing.T) {
+			asserter := require.New(t)
+
+			w := bytes.NewBuffer(nil)
+			mw := NewVersionedMessageWriter(protocolVersion, NewSerialWriter(w))
+
+			writeDiff := func(body map[string]interface{}) {
+				kvMap := make(map[string]brotatomodtypes.DictKeyValue)
+				for k, v := range body {
+					kv, err := newKeyValue(k, v)
+					asserter.NoError(err)
+
+					kvMap[k] = kv
+				}
+
+				err := mw.WriteMessage(&brotatomodtypes.ExporterMessage{
+					MessageType:      brotatomodtypes.MessageTypeTimeSeriesDiff,
+					MessageReason:    brotatomodtypes.MessageReasonPoll,
+					MessageTimestamp: nowTimestamp,
+					MessageBody:      NewMapDictReader(kvMap),
+				})
+				asserter.NoError(err)
+			}
+
+			writeDiff(map[string]interface{}{"current_level": 1})
+
+			mr := NewVersionedMessageReader(protocolVersion, w, nil)
+			msg, err := mr.ReadNextMessage()
+			asserter.NoError(err)
+			_, err = msg.MessageBody.ReadNextKeyValue()
+			asserter.NoError(err)
+
+			// server side reset, e.g. idle sweep - the mod still thinks current_level is mapped
+			mr.Reset()
+			writeDiff(map[string]interface{}{"current_level": 2})
+
+			msg, err = mr.ReadNextMessage()
+			if err == nil {
+				_, err = msg.MessageBody.ReadNextKeyValue()
+			}
+			asserter.ErrorIs(err, ErrKeyNotMapped)
+			w.Reset()
+
+			// mod starts its mapping over
+			err = mw.WriteMessage(&brotatomodtypes.ExporterMessage{
+				MessageType:      brotatomodtypes.MessageTypeMappingReset,
+				MessageReason:    brotatomodtypes.MessageReasonNone,
+				MessageTimestamp: nowTimestamp,
+			})
+			asserter.NoError(err)
+			writeDiff(map[string]interface{}{"current_level": 3})
+
+			mr.SetReader(w)
+
+			msg, err = mr.ReadNextMessage()
+			asserter.NoError(err)
+			asserter.Equal(brotatomodtypes.MessageTypeMappingReset, msg.MessageType)
+			asserter.Nil(msg.MessageBody)
+
+			msg, err = mr.ReadNextMessage()
+			asserter.NoError(err)
+			kv, err := msg.MessageBody.ReadNextKeyValue()
+			asserter.NoError(err)
+			asserter.Equal("current_level", kv.MappedKey)
+			asserter.Equal("3", kv.String())
+		})
+	}
+}
+
+// countingWriter
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+// Write
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += n
+
+	return n, err
+}
@@ -1,7 +1,9 @@
 package brotatoserial
 
 import (
+	"bytes"
 	"errors"
+	"hash/crc32"
 	"io"
 
 	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
@@ -12,34 +14,106 @@ import (
 type BrotatoMessageWriter struct {
 	serialWriter *BrotatoSerialWriter
 	dictWriter   *BrotatoDictWriter
+
+	protocolVersion brotatomodtypes.ProtocolVersion
+
+	// frameSerialWriter writes messages to frameBuf before they are framed, only used for framed versions.
+	frameSerialWriter *BrotatoSerialWriter
+	frameBuf          *bytes.Buffer
 }
 
-// NewMessageWriter
+// NewMessageWriter writer for the legacy protocol version.
 func NewMessageWriter(serialWriter *BrotatoSerialWriter) *BrotatoMessageWriter {
-	return &BrotatoMessageWriter{
-		serialWriter: serialWriter,
-		dictWriter:   NewDictWriter(serialWriter),
+	return NewVersionedMessageWriter(brotatomodtypes.ProtocolVersionLegacy, serialWriter)
+}
+
+// NewVersionedMessageWriter writer for the negotiated protocol version. An unsupported version is only reported once writing.
+func NewVersionedMessageWriter(protocolVersion brotatomodtypes.ProtocolVersion, serialWriter *BrotatoSerialWriter) *BrotatoMessageWriter {
+	bmw := &BrotatoMessageWriter{
+		serialWriter:    serialWriter,
+		protocolVersion: protocolVersion,
 	}
+
+	if protocolVersion == brotatomodtypes.ProtocolVersionLegacy {
+		bmw.dictWriter = NewDictWriter(serialWriter)
+		return bmw
+	}
+
+	bmw.frameBuf = bytes.NewBuffer(nil)
+	bmw.frameSerialWriter = NewSerialWriter(bmw.frameBuf)
+	bmw.dictWriter = NewDictWriter(bmw.frameSerialWriter)
+
+	return bmw
+}
+
+// ProtocolVersion
+func (bmw *BrotatoMessageWriter) ProtocolVersion() brotatomodtypes.ProtocolVersion {
+	return bmw.protocolVersion
 }
 
 // WriteMessage
 func (bmw *BrotatoMessageWriter) WriteMessage(msg *brotatomodtypes.ExporterMessage) error {
-	err := bmw.serialWriter.writeUint8(uint8(msg.MessageType))
+	switch bmw.protocolVersion {
+	case brotatomodtypes.ProtocolVersionLegacy:
+		return bmw.writeMessage(bmw.serialWriter, msg)
+	case brotatomodtypes.ProtocolVersionFramed:
+		return bmw.writeFramedMessage(msg)
+	default:
+		return errutil.NewStackError(unsupportedProtocolVersionError(bmw.protocolVersion))
+	}
+}
+
+// writeFramedMessage writes the message prefixed with its length and CRC32, see BrotatoMessageReader.readFramedMessage.
+func (bmw *BrotatoMessageWriter) writeFramedMessage(msg *brotatomodtypes.ExporterMessage) error {
+	bmw.frameBuf.Reset()
+
+	err := bmw.writeMessage(bmw.frameSerialWriter, msg)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	err = bmw.serialWriter.writeUint32(uint32(bmw.frameBuf.Len()))
 	if err != nil {
 		return errutil.NewStackError(err)
 	}
 
-	err = bmw.serialWriter.writeUint8(uint8(msg.MessageReason))
+	err = bmw.serialWriter.writeUint32(crc32.ChecksumIEEE(bmw.frameBuf.Bytes()))
 	if err != nil {
 		return errutil.NewStackError(err)
 	}
 
-	err = bmw.serialWriter.writeUint64(uint64(msg.MessageTimestamp))
+	_, err = bmw.serialWriter.underlyingWriter.Write(bmw.frameBuf.Bytes())
 	if err != nil {
 		return errutil.NewStackError(err)
 	}
 
-	if msg.MessageBody == nil {
+	return nil
+}
+
+// writeMessage writes a single unframed message to serialWriter.
+func (bmw *BrotatoMessageWriter) writeMessage(serialWriter *BrotatoSerialWriter, msg *brotatomodtypes.ExporterMessage) error {
+	err := serialWriter.writeUint8(uint8(msg.MessageType))
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	err = serialWriter.writeUint8(uint8(msg.MessageReason))
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	err = serialWriter.writeUint64(uint64(msg.MessageTimestamp))
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	// reader forgets its mappings on reset so every key has to be sent again
+	if msg.MessageType == brotatomodtypes.MessageTypeMappingReset {
+		bmw.dictWriter.Reset()
+	}
+
+	// reader only expects a dict for types which carry one
+	if msg.MessageBody == nil || !msg.MessageType.HasBody() {
 		return nil
 	}
 
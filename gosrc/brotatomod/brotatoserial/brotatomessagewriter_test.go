@@ -3,6 +3,7 @@ package brotatoserial
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"testing"
@@ -101,6 +102,7 @@ func TestMessageWriter(t *testing.T) {
 
 			asserter.Equal(len(kvMap), resMsg.MessageBody.Size())
 
+			readCount := 0
 			for {
 				kv, err := resMsg.MessageBody.ReadNextKeyValue()
 				if err != nil {
@@ -114,144 +116,178 @@ func TestMessageWriter(t *testing.T) {
 				asserter.Contains(kvMap, kv.MappedKey)
 				asserter.Equal(kvMap[kv.MappedKey].SerialType, kv.SerialType)
 				asserter.Equal(kvMap[kv.MappedKey].Value, kv.Value)
+				readCount++
 			}
+
+			asserter.Equal(len(kvMap), readCount)
 		})
 	}
 
 	// testing a bunch of messages in a single reader one after the other
-	t.Run("game-like", func(t *testing.T) {
-		asserter := require.New(t)
-
-		msgList := []testCase{
-			{
-				msg: &brotatomodtypes.ExporterMessage{
-					MessageType:      brotatomodtypes.MessageTypeKeepAlive,
-					MessageReason:    brotatomodtypes.MessageReasonPoll,
-					MessageTimestamp: nowTimestamp,
-				},
+	for _, protocolVersion := range []brotatomodtypes.ProtocolVersion{brotatomodtypes.ProtocolVersionLegacy, brotatomodtypes.ProtocolVersionFramed} {
+		t.Run(fmt.Sprintf("game-like v%d", protocolVersion), func(t *testing.T) {
+			testGameLike(t, protocolVersion, nowTimestamp)
+		})
+	}
+}
+
+// testGameLike
+func testGameLike(t *testing.T, protocolVersion brotatomodtypes.ProtocolVersion, nowTimestamp brotatomodtypes.MicroTime) {
+	type testCase struct {
+		msg     *brotatomodtypes.ExporterMessage
+		msgBody map[string]interface{}
+	}
+
+	asserter := require.New(t)
+
+	msgList := []testCase{
+		{
+			msg: &brotatomodtypes.ExporterMessage{
+				MessageType:      brotatomodtypes.MessageTypeKeepAlive,
+				MessageReason:    brotatomodtypes.MessageReasonPoll,
+				MessageTimestamp: nowTimestamp,
 			},
-			{
-				msg: &brotatomodtypes.ExporterMessage{
-					MessageType:      brotatomodtypes.MessageTypeTimeSeriesFull,
-					MessageReason:    brotatomodtypes.MessageReasonShopEntered,
-					MessageTimestamp: nowTimestamp,
-				},
-				msgBody: map[string]interface{}{
-					"chal_recycling_current":         0,
-					"consumables_picked_up_this_run": 2,
-					"current_character":              "character_crazy",
-					"current_health":                 11,
-					"current_level":                  1,
-					"current_xp":                     float32(10),
-				},
+		},
+		{
+			msg: &brotatomodtypes.ExporterMessage{
+				MessageType:      brotatomodtypes.MessageTypeTimeSeriesFull,
+				MessageReason:    brotatomodtypes.MessageReasonShopEntered,
+				MessageTimestamp: nowTimestamp,
 			},
-			{
-				msg: &brotatomodtypes.ExporterMessage{
-					MessageType:      brotatomodtypes.MessageTypeTimeSeriesFull,
-					MessageReason:    brotatomodtypes.MessageReasonStartedWave,
-					MessageTimestamp: nowTimestamp,
-				},
-				msgBody: map[string]interface{}{
-					"chal_recycling_current":         5,
-					"consumables_picked_up_this_run": 3,
-					"current_character":              "character_crazy",
-					"current_health":                 19,
-					"current_level":                  1,
-					"current_xp":                     float32(16.4),
-				},
+			msgBody: map[string]interface{}{
+				"chal_recycling_current":         0,
+				"consumables_picked_up_this_run": 2,
+				"current_character":              "character_crazy",
+				"current_health":                 11,
+				"current_level":                  1,
+				"current_xp":                     float32(10),
 			},
-			{
-				msg: &brotatomodtypes.ExporterMessage{
-					MessageType:      brotatomodtypes.MessageTypeTimeSeriesDiff,
-					MessageReason:    brotatomodtypes.MessageReasonPoll,
-					MessageTimestamp: nowTimestamp,
-				},
-				msgBody: map[string]interface{}{
-					"chal_recycling_current": 7,
-					"current_level":          2,
-					"current_xp":             float32(32.7),
-				},
+		},
+		{
+			msg: &brotatomodtypes.ExporterMessage{
+				MessageType:      brotatomodtypes.MessageTypeTimeSeriesFull,
+				MessageReason:    brotatomodtypes.MessageReasonStartedWave,
+				MessageTimestamp: nowTimestamp,
 			},
-			{
-				msg: &brotatomodtypes.ExporterMessage{
-					MessageType:      brotatomodtypes.MessageTypeTimeSeriesDiff,
-					MessageReason:    brotatomodtypes.MessageReasonPoll,
-					MessageTimestamp: nowTimestamp,
-				},
-				msgBody: map[string]interface{}{
-					"chal_recycling_current": 7,
-					"current_level":          2,
-					"current_xp":             float32(45.1),
-					"effects_stat_dodge":     -36,
-				},
+			msgBody: map[string]interface{}{
+				"chal_recycling_current":         5,
+				"consumables_picked_up_this_run": 3,
+				"current_character":              "character_crazy",
+				"current_health":                 19,
+				"current_level":                  1,
+				"current_xp":                     float32(16.4),
 			},
-			{
-				msg: &brotatomodtypes.ExporterMessage{
-					MessageType:      brotatomodtypes.MessageTypeKeepAlive,
-					MessageReason:    brotatomodtypes.MessageReasonPoll,
-					MessageTimestamp: nowTimestamp,
-				},
+		},
+		{
+			msg: &brotatomodtypes.ExporterMessage{
+				MessageType:      brotatomodtypes.MessageTypeTimeSeriesDiff,
+				MessageReason:    brotatomodtypes.MessageReasonPoll,
+				MessageTimestamp: nowTimestamp,
 			},
-		}
-
-		w := bytes.NewBuffer(nil)
+			msgBody: map[string]interface{}{
+				"chal_recycling_current": 7,
+				"current_level":          2,
+				"current_xp":             float32(32.7),
+			},
+		},
+		{
+			msg: &brotatomodtypes.ExporterMessage{
+				MessageType:      brotatomodtypes.MessageTypeTimeSeriesDiff,
+				MessageReason:    brotatomodtypes.MessageReasonPoll,
+				MessageTimestamp: nowTimestamp,
+			},
+			msgBody: map[string]interface{}{
+				"chal_recycling_current": 7,
+				"current_level":          2,
+				"current_xp":             float32(45.1),
+				"effects_stat_dodge":     -36,
+			},
+		},
+		{
+			// key changes type then is removed
+			msg: &brotatomodtypes.ExporterMessage{
+				MessageType:      brotatomodtypes.MessageTypeTimeSeriesDiff,
+				MessageReason:    brotatomodtypes.MessageReasonPoll,
+				MessageTimestamp: nowTimestamp,
+			},
+			msgBody: map[string]interface{}{
+				"current_xp":         float64(45.1),
+				"effects_stat_dodge": removedValue{},
+			},
+		},
+		{
+			msg: &brotatomodtypes.ExporterMessage{
+				MessageType:      brotatomodtypes.MessageTypeKeepAlive,
+				MessageReason:    brotatomodtypes.MessageReasonPoll,
+				MessageTimestamp: nowTimestamp,
+			},
+		},
+	}
 
-		serialW := NewSerialWriter(w)
+	w := bytes.NewBuffer(nil)
 
-		mw := NewMessageWriter(serialW)
+	serialW := NewSerialWriter(w)
 
-		messageKVs := make([]map[string]brotatomodtypes.DictKeyValue, len(msgList))
+	mw := NewVersionedMessageWriter(protocolVersion, serialW)
 
-		for i, msg := range msgList {
-			kvMap := make(map[string]brotatomodtypes.DictKeyValue)
+	messageKVs := make([]map[string]brotatomodtypes.DictKeyValue, len(msgList))
 
-			for k, v := range msg.msgBody {
-				kv, err := newKeyValue(k, v)
-				asserter.NoError(err)
+	for i, msg := range msgList {
+		kvMap := make(map[string]brotatomodtypes.DictKeyValue)
 
-				kvMap[k] = kv
-			}
+		for k, v := range msg.msgBody {
+			kv, err := newKeyValue(k, v)
+			asserter.NoError(err)
 
-			messageKVs[i] = kvMap
+			kvMap[k] = kv
+		}
 
-			msg.msg.MessageBody = NewMapDictReader(kvMap)
+		messageKVs[i] = kvMap
 
-			err := mw.WriteMessage(msg.msg)
-			asserter.NoError(err)
-		}
+		msg.msg.MessageBody = NewMapDictReader(kvMap)
 
-		messageReader := NewMessageReader(w, make([]byte, 0, 1024))
+		err := mw.WriteMessage(msg.msg)
+		asserter.NoError(err)
+	}
 
-		for i, msg := range msgList {
-			resMsg, err := messageReader.ReadNextMessage()
-			asserter.NoError(err)
+	messageReader := NewVersionedMessageReader(protocolVersion, w, make([]byte, 0, 1024))
 
-			asserter.Equal(msg.msg.MessageType, resMsg.MessageType)
-			asserter.Equal(msg.msg.MessageReason, resMsg.MessageReason)
-			asserter.Equal(msg.msg.MessageTimestamp, resMsg.MessageTimestamp)
+	for i, msg := range msgList {
+		resMsg, err := messageReader.ReadNextMessage()
+		asserter.NoError(err)
 
-			if msg.msgBody == nil {
-				continue
-			}
+		asserter.Equal(msg.msg.MessageType, resMsg.MessageType)
+		asserter.Equal(msg.msg.MessageReason, resMsg.MessageReason)
+		asserter.Equal(msg.msg.MessageTimestamp, resMsg.MessageTimestamp)
 
-			asserter.Equal(len(messageKVs[i]), resMsg.MessageBody.Size())
+		if msg.msgBody == nil {
+			continue
+		}
 
-			for {
-				kv, err := resMsg.MessageBody.ReadNextKeyValue()
-				if err != nil {
-					if errors.Is(err, io.EOF) {
-						break
-					}
+		asserter.Equal(len(messageKVs[i]), resMsg.MessageBody.Size())
 
-					asserter.NoError(err)
+		readCount := 0
+		for {
+			kv, err := resMsg.MessageBody.ReadNextKeyValue()
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					break
 				}
 
-				asserter.Contains(messageKVs[i], kv.MappedKey)
-				asserter.Equal(messageKVs[i][kv.MappedKey].SerialType, kv.SerialType)
-				asserter.Equal(messageKVs[i][kv.MappedKey].Value, kv.Value)
+				asserter.NoError(err)
 			}
+
+			asserter.Contains(messageKVs[i], kv.MappedKey)
+			asserter.Equal(messageKVs[i][kv.MappedKey].SerialType, kv.SerialType)
+			asserter.Equal(messageKVs[i][kv.MappedKey].Value, kv.Value)
+			readCount++
 		}
-	})
+
+		asserter.Equal(len(messageKVs[i]), readCount)
+	}
+
+	_, err := messageReader.ReadNextMessage()
+	asserter.ErrorIs(err, io.EOF)
 }
 
 func TestReal(t *testing.T) {
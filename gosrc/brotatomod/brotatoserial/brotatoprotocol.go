@@ -0,0 +1,61 @@
+package brotatoserial
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/errutil"
+)
+
+// ErrUnsupportedProtocolVersion returned wrapped when reading or writing with a version the server does not know.
+var ErrUnsupportedProtocolVersion = errors.New("unsupported protocol version")
+
+// ErrKeyNotMapped returned wrapped when a message uses a key mapping the reader does not have, e.g. after the session
+// was reset. The mod has to send a MessageTypeMappingReset and its mappings again.
+var ErrKeyNotMapped = errors.New("key not found in dict mapping")
+
+// unsupportedProtocolVersionError
+func unsupportedProtocolVersionError(version brotatomodtypes.ProtocolVersion) error {
+	return fmt.Errorf("%w %d - supported versions are %d to %d", ErrUnsupportedProtocolVersion, version, brotatomodtypes.ProtocolVersionMin, brotatomodtypes.ProtocolVersionMax)
+}
+
+// NegotiateProtocolVersion picks the version to use for a session.
+// Zero is treated as ProtocolVersionLegacy since mods from before versioning send nothing.
+// Any other version the server does not read, older or newer, is an ErrUnsupportedProtocolVersion.
+func NegotiateProtocolVersion(requested brotatomodtypes.ProtocolVersion) (brotatomodtypes.ProtocolVersion, error) {
+	if requested == 0 {
+		return brotatomodtypes.ProtocolVersionLegacy, nil
+	}
+
+	if !requested.Valid() {
+		return 0, errutil.NewStackError(unsupportedProtocolVersionError(requested))
+	}
+
+	return requested, nil
+}
+
+// NegotiateCapabilities requested capabilities which are also in SupportedCapabilities, in the order requested.
+func NegotiateCapabilities(requested []brotatomodtypes.Capability) []brotatomodtypes.Capability {
+	negotiated := make([]brotatomodtypes.Capability, 0, len(requested))
+	for _, capability := range requested {
+		if !HasCapability(brotatomodtypes.SupportedCapabilities, capability) || HasCapability(negotiated, capability) {
+			continue
+		}
+
+		negotiated = append(negotiated, capability)
+	}
+
+	return negotiated
+}
+
+// HasCapability
+func HasCapability(capabilities []brotatomodtypes.Capability, capability brotatomodtypes.Capability) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+
+	return false
+}
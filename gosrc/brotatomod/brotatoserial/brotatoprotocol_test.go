@@ -0,0 +1,55 @@
+package brotatoserial
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtocolVersion(t *testing.T) {
+	t.Run("TestNegotiate", func(t *testing.T) {
+		asserter := require.New(t)
+
+		version, err := NegotiateProtocolVersion(0)
+		asserter.NoError(err)
+		asserter.Equal(brotatomodtypes.ProtocolVersionLegacy, version)
+
+		version, err = NegotiateProtocolVersion(brotatomodtypes.ProtocolVersionMin)
+		asserter.NoError(err)
+		asserter.Equal(brotatomodtypes.ProtocolVersionMin, version)
+
+		version, err = NegotiateProtocolVersion(brotatomodtypes.ProtocolVersionMax)
+		asserter.NoError(err)
+		asserter.Equal(brotatomodtypes.ProtocolVersionMax, version)
+
+		// newer than the server, not downgraded
+		_, err = NegotiateProtocolVersion(brotatomodtypes.ProtocolVersionMax + 1)
+		asserter.True(errors.Is(err, ErrUnsupportedProtocolVersion))
+	})
+
+	t.Run("TestUnsupportedReader", func(t *testing.T) {
+		asserter := require.New(t)
+
+		// valid legacy keep alive, but the reader was told the mod speaks something else
+		w := bytes.NewBuffer(nil)
+		err := NewMessageWriter(NewSerialWriter(w)).WriteMessage(&brotatomodtypes.ExporterMessage{
+			MessageType: brotatomodtypes.MessageTypeKeepAlive,
+		})
+		asserter.NoError(err)
+
+		messageReader := NewVersionedMessageReader(brotatomodtypes.ProtocolVersionMax+1, w, nil)
+
+		_, err = messageReader.ReadNextMessage()
+		asserter.True(errors.Is(err, ErrUnsupportedProtocolVersion))
+	})
+
+	t.Run("TestNegotiateCapabilities", func(t *testing.T) {
+		asserter := require.New(t)
+
+		negotiated := NegotiateCapabilities([]brotatomodtypes.Capability{"not_a_capability"})
+		asserter.Empty(negotiated)
+	})
+}
@@ -2,6 +2,7 @@ package brotatoserial
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 
 	"github.com/benw10-1/brotato-exporter/errutil"
@@ -16,6 +17,9 @@ type BrotatoSerialReader struct {
 
 	// peekedByte single unconsumed byte. Useful for checking header and type values.
 	peekedByte bool
+
+	// readCount bytes taken from the underlying reader since it was set, the peeked byte included.
+	readCount int64
 }
 
 // NewSerialReader constructor for BrotatoSerialReader.
@@ -33,13 +37,39 @@ func NewSerialReader(underlyingReader io.Reader, buf []byte) *BrotatoSerialReade
 func (sr *BrotatoSerialReader) SetReader(underlyingReader io.Reader) {
 	sr.underlyingReader = underlyingReader
 	sr.peekedByte = false
+	sr.readCount = 0
+}
+
+// Offset bytes consumed from the underlying reader since it was set. After a failed read this includes the bytes
+// which were read before the failure, so it points at where the data ran out or stopped making sense.
+func (sr *BrotatoSerialReader) Offset() int64 {
+	if sr.peekedByte {
+		return sr.readCount - 1
+	}
+
+	return sr.readCount
+}
+
+// lenReader readers which know how many unread bytes they have, e.g. bytes.Buffer and bytes.Reader.
+type lenReader interface {
+	Len() int
+}
+
+// remaining unread bytes of the underlying reader, if it knows.
+func (sr *BrotatoSerialReader) remaining() (int, bool) {
+	lr, ok := sr.underlyingReader.(lenReader)
+	if !ok {
+		return 0, false
+	}
+
+	return lr.Len(), true
 }
 
 // requires
 func requires(buf []byte, length int) []byte {
 	if len(buf) < length {
 		incrementCount := length / 1024
-		buf = make([]byte, incrementCount+2*1024)
+		buf = make([]byte, (incrementCount+2)*1024)
 	}
 
 	return buf
@@ -55,8 +85,6 @@ func (sr *BrotatoSerialReader) readBytes(count int) ([]byte, error) {
 		return nil, errutil.NewStackError("reading no bytes")
 	}
 
-	sr.msgBuf = requires(sr.msgBuf, count)
-
 	var startIdx int
 	if sr.peekedByte {
 		sr.peekedByte = false
@@ -67,13 +95,34 @@ func (sr *BrotatoSerialReader) readBytes(count int) ([]byte, error) {
 		startIdx = 1
 	}
 
-	n, err := sr.underlyingReader.Read(sr.msgBuf[startIdx:count])
-	if err != nil {
-		return nil, errutil.NewStackError(err)
+	// lengths read from the body can't be trusted, don't allocate for more than is left of it
+	if remaining, ok := sr.remaining(); ok && count-startIdx > remaining {
+		// same errors as reading would give, io.EOF only when there was nothing left
+		if remaining == 0 {
+			return nil, errutil.NewStackError(io.EOF)
+		}
+
+		n, err := io.Copy(io.Discard, sr.underlyingReader)
+		sr.readCount += n
+		if err != nil {
+			return nil, errutil.NewStackError(err)
+		}
+
+		return nil, errutil.NewStackError(fmt.Errorf("reading %d bytes with %d left: %w", count-startIdx, remaining, io.ErrUnexpectedEOF))
+	}
+
+	if len(sr.msgBuf) < count {
+		// keep the peeked byte when growing
+		buf := requires(nil, count)
+		copy(buf, sr.msgBuf[:startIdx])
+		sr.msgBuf = buf
 	}
 
-	if n != count {
-		return nil, errutil.NewStackError(io.ErrUnexpectedEOF)
+	// io.EOF only when nothing was read, io.ErrUnexpectedEOF when cut short
+	n, err := io.ReadFull(sr.underlyingReader, sr.msgBuf[startIdx:count])
+	sr.readCount += int64(n)
+	if err != nil {
+		return nil, errutil.NewStackError(err)
 	}
 
 	return sr.msgBuf[:count], nil
@@ -0,0 +1,335 @@
+package brotatosim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatoserial"
+	"github.com/benw10-1/brotato-exporter/errutil"
+)
+
+// RunConfig
+type RunConfig struct {
+	// Seed for the random stat changes, the same seed gives the same run.
+	Seed int64
+	// WaveCount waves before the run ends, 20 for a normal run.
+	WaveCount int
+	// PollInterval time between diffs during a wave. The mod polls every 2 seconds.
+	PollInterval time.Duration
+	// ShopDuration time spent in the shop between waves.
+	ShopDuration time.Duration
+	// Character
+	Character brotatomodtypes.CharacterType
+	// Nested send items as a map, needs CapabilityNestedSerialTypes.
+	Nested bool
+}
+
+// DefaultRunConfig close to a normal run.
+func DefaultRunConfig() RunConfig {
+	return RunConfig{
+		Seed:         time.Now().UnixNano(),
+		WaveCount:    20,
+		PollInterval: time.Second * 2,
+		ShopDuration: time.Second * 15,
+		Character:    brotatomodtypes.CharacterTypeWellRounded,
+	}
+}
+
+// Event one point in the simulated run.
+type Event struct {
+	// Offset from the start of the run.
+	Offset time.Duration
+	// MessageType full for waves, shops and the run end, diff for polls.
+	MessageType brotatomodtypes.MessageType
+	// MessageReason
+	MessageReason brotatomodtypes.MessageReason
+	// State full stat dict after the event. Values are int32, float32, string or map[string]int32.
+	State map[string]interface{}
+	// Changed keys which differ from the previous event, only these are sent in a diff.
+	Changed []string
+}
+
+// waveDuration same as the game - 20 seconds for the first wave and 5 more each wave up to a minute.
+func waveDuration(wave int) time.Duration {
+	return time.Duration(min(20+5*(wave-1), 60)) * time.Second
+}
+
+// SimulateRun events the mod would send for one run - a full message when each wave starts, diffs every poll,
+// a full message on entering the shop and one when the run ends.
+func SimulateRun(config RunConfig) []Event {
+	rng := rand.New(rand.NewSource(config.Seed))
+
+	state := map[string]interface{}{
+		"current_character":            string(config.Character),
+		"current_level":                int32(0),
+		"current_xp":                   float32(0),
+		"current_health":               int32(10),
+		"gold":                         int32(30),
+		"effects_stat_max_hp":          int32(10),
+		"effects_stat_armor":           int32(0),
+		"effects_stat_percent_damage":  int32(0),
+		"effects_stat_attack_speed":    int32(0),
+		"effects_stat_luck":            int32(0),
+		"effects_stat_harvesting":      int32(0),
+		"effects_stat_hp_regeneration": int32(0),
+	}
+	if config.Nested {
+		state["items"] = map[string]int32{}
+	}
+
+	events := make([]Event, 0)
+	offset := time.Duration(0)
+
+	// snapshot copies the state so later changes don't leak into earlier events
+	snapshot := func(messageType brotatomodtypes.MessageType, messageReason brotatomodtypes.MessageReason, changed []string) {
+		stateCpy := make(map[string]interface{}, len(state))
+		for k, v := range state {
+			if items, ok := v.(map[string]int32); ok {
+				itemsCpy := make(map[string]int32, len(items))
+				for itemKey, count := range items {
+					itemsCpy[itemKey] = count
+				}
+				v = itemsCpy
+			}
+			stateCpy[k] = v
+		}
+
+		if changed == nil {
+			changed = make([]string, 0, len(state))
+			for k := range state {
+				changed = append(changed, k)
+			}
+		}
+		sort.Strings(changed)
+
+		events = append(events, Event{
+			Offset:        offset,
+			MessageType:   messageType,
+			MessageReason: messageReason,
+			State:         stateCpy,
+			Changed:       changed,
+		})
+	}
+
+	addInt := func(key string, delta int32) int32 {
+		v := state[key].(int32) + delta
+		state[key] = v
+		return v
+	}
+
+	for wave := 1; wave <= config.WaveCount; wave++ {
+		state["current_health"] = state["effects_stat_max_hp"]
+		snapshot(brotatomodtypes.MessageTypeTimeSeriesFull, brotatomodtypes.MessageReasonStartedWave, nil)
+
+		waveEnd := offset + waveDuration(wave)
+		for offset+config.PollInterval <= waveEnd {
+			offset += config.PollInterval
+			changed := make([]string, 0, 4)
+
+			// materials picked up
+			if rng.Intn(3) > 0 {
+				addInt("gold", int32(rng.Intn(3*wave)+1))
+				changed = append(changed, "gold")
+			}
+
+			// xp comes in with the materials, level ups raise max hp
+			xp := state["current_xp"].(float32) + float32(rng.Intn(4*wave))
+			nextLevelXP := float32(math.Pow(float64(state["current_level"].(int32)+3), 2))
+			if xp >= nextLevelXP {
+				xp -= nextLevelXP
+				addInt("current_level", 1)
+				addInt("effects_stat_max_hp", 1)
+				changed = append(changed, "current_level", "effects_stat_max_hp")
+			}
+			if xp != state["current_xp"].(float32) {
+				state["current_xp"] = xp
+				changed = append(changed, "current_xp")
+			}
+
+			// hits taken and healed
+			health := state["current_health"].(int32) + int32(rng.Intn(7)) - 4
+			health = max(1, min(health, state["effects_stat_max_hp"].(int32)))
+			if health != state["current_health"].(int32) {
+				state["current_health"] = health
+				changed = append(changed, "current_health")
+			}
+
+			if len(changed) > 0 {
+				snapshot(brotatomodtypes.MessageTypeTimeSeriesDiff, brotatomodtypes.MessageReasonPoll, changed)
+			}
+		}
+		offset = waveEnd
+
+		if wave == config.WaveCount {
+			break
+		}
+
+		snapshot(brotatomodtypes.MessageTypeTimeSeriesFull, brotatomodtypes.MessageReasonShopEntered, nil)
+
+		// buy something halfway through the shop
+		offset += config.ShopDuration / 2
+
+		stats := []string{"effects_stat_armor", "effects_stat_percent_damage", "effects_stat_attack_speed", "effects_stat_luck", "effects_stat_harvesting", "effects_stat_hp_regeneration"}
+		stat := stats[rng.Intn(len(stats))]
+		price := int32(15 + 5*wave)
+		if state["gold"].(int32) >= price {
+			addInt("gold", -price)
+			addInt(stat, int32(rng.Intn(5)+1))
+			changed := []string{"gold", stat}
+
+			if config.Nested {
+				items := state["items"].(map[string]int32)
+				items[fmt.Sprintf("item_%s", stat[len("effects_stat_"):])]++
+				changed = append(changed, "items")
+			}
+
+			snapshot(brotatomodtypes.MessageTypeTimeSeriesDiff, brotatomodtypes.MessageReasonPoll, changed)
+		}
+
+		offset += config.ShopDuration - config.ShopDuration/2
+	}
+
+	snapshot(brotatomodtypes.MessageTypeTimeSeriesFull, brotatomodtypes.MessageReasonRunEnded, nil)
+
+	return events
+}
+
+// Encoder writes events as message bodies. Like the mod, key mappings carry over from one body to the next,
+// so bodies have to be posted in order to the same session.
+type Encoder struct {
+	messageWriter *brotatoserial.BrotatoMessageWriter
+	buf           *bytes.Buffer
+}
+
+// NewEncoder
+func NewEncoder(protocolVersion brotatomodtypes.ProtocolVersion) *Encoder {
+	buf := bytes.NewBuffer(nil)
+
+	return &Encoder{
+		messageWriter: brotatoserial.NewVersionedMessageWriter(protocolVersion, brotatoserial.NewSerialWriter(buf)),
+		buf:           buf,
+	}
+}
+
+// EncodeEvent body holding the event's message. The returned slice is only valid until the next call.
+func (e *Encoder) EncodeEvent(event Event, timestamp time.Time) ([]byte, error) {
+	e.buf.Reset()
+
+	err := e.writeEvent(event, event.MessageType, event.Changed, timestamp)
+	if err != nil {
+		return nil, errutil.NewStackError(err)
+	}
+
+	return e.buf.Bytes(), nil
+}
+
+// EncodeResync body starting the key mapping over followed by the full state at event, what the mod sends after a 409.
+// The returned slice is only valid until the next call.
+func (e *Encoder) EncodeResync(event Event, timestamp time.Time) ([]byte, error) {
+	e.buf.Reset()
+
+	err := e.messageWriter.WriteMessage(&brotatomodtypes.ExporterMessage{
+		MessageType:      brotatomodtypes.MessageTypeMappingReset,
+		MessageReason:    brotatomodtypes.MessageReasonNone,
+		MessageTimestamp: brotatomodtypes.MicroTimeFromTime(timestamp),
+	})
+	if err != nil {
+		return nil, errutil.NewStackError(err)
+	}
+
+	allKeys := make([]string, 0, len(event.State))
+	for k := range event.State {
+		allKeys = append(allKeys, k)
+	}
+
+	err = e.writeEvent(event, brotatomodtypes.MessageTypeTimeSeriesFull, allKeys, timestamp)
+	if err != nil {
+		return nil, errutil.NewStackError(err)
+	}
+
+	return e.buf.Bytes(), nil
+}
+
+// EncodeKeepAlive body with a single keep alive message. The returned slice is only valid until the next call.
+func (e *Encoder) EncodeKeepAlive(timestamp time.Time) ([]byte, error) {
+	e.buf.Reset()
+
+	err := e.messageWriter.WriteMessage(&brotatomodtypes.ExporterMessage{
+		MessageType:      brotatomodtypes.MessageTypeKeepAlive,
+		MessageReason:    brotatomodtypes.MessageReasonNone,
+		MessageTimestamp: brotatomodtypes.MicroTimeFromTime(timestamp),
+	})
+	if err != nil {
+		return nil, errutil.NewStackError(err)
+	}
+
+	return e.buf.Bytes(), nil
+}
+
+// writeEvent
+func (e *Encoder) writeEvent(event Event, messageType brotatomodtypes.MessageType, keys []string, timestamp time.Time) error {
+	kvMap := make(map[string]brotatomodtypes.DictKeyValue, len(keys))
+	for _, key := range keys {
+		kv, err := keyValue(key, event.State[key])
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+
+		kvMap[key] = kv
+	}
+
+	return e.messageWriter.WriteMessage(&brotatomodtypes.ExporterMessage{
+		MessageType:      messageType,
+		MessageReason:    event.MessageReason,
+		MessageTimestamp: brotatomodtypes.MicroTimeFromTime(timestamp),
+		MessageBody:      brotatoserial.NewMapDictReader(kvMap),
+	})
+}
+
+// keyValue
+func keyValue(key string, v interface{}) (brotatomodtypes.DictKeyValue, error) {
+	kv := brotatomodtypes.DictKeyValue{
+		MappedKey: key,
+	}
+
+	switch v := v.(type) {
+	case int32:
+		kv.SerialType = brotatomodtypes.SerialTypeInt32
+		kv.Value = binary.LittleEndian.AppendUint32(nil, uint32(v))
+	case float32:
+		kv.SerialType = brotatomodtypes.SerialTypeFloat32
+		kv.Value = binary.LittleEndian.AppendUint32(nil, math.Float32bits(v))
+	case string:
+		kv.SerialType = brotatomodtypes.SerialTypeString
+		kv.Value = []byte(v)
+	case map[string]int32:
+		entryKeys := make([]string, 0, len(v))
+		for entryKey := range v {
+			entryKeys = append(entryKeys, entryKey)
+		}
+		sort.Strings(entryKeys)
+
+		entries := make([]brotatomodtypes.DictKeyValue, 0, len(v))
+		for _, entryKey := range entryKeys {
+			entry, err := keyValue(entryKey, v[entryKey])
+			if err != nil {
+				return kv, errutil.NewStackError(err)
+			}
+
+			entries = append(entries, entry)
+		}
+
+		kv.SerialType = brotatomodtypes.SerialTypeMap
+		kv.Value = brotatomodtypes.AppendMapValue(nil, entries)
+	default:
+		return kv, errutil.NewStackErrorf("unsupported value type (%T) for key (%s)", v, key)
+	}
+
+	return kv, nil
+}
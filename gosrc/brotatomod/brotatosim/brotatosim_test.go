@@ -0,0 +1,134 @@
+package brotatosim
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatoserial"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatostate"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulateRun(t *testing.T) {
+	config := DefaultRunConfig()
+	config.Seed = 1
+	config.WaveCount = 5
+	config.Nested = true
+
+	events := SimulateRun(config)
+
+	t.Run("TestDeterministic", func(t *testing.T) {
+		asserter := require.New(t)
+
+		asserter.Equal(events, SimulateRun(config))
+	})
+
+	t.Run("TestShape", func(t *testing.T) {
+		asserter := require.New(t)
+
+		reasonCounts := make(map[brotatomodtypes.MessageReason]int)
+		var lastOffset time.Duration
+		for _, event := range events {
+			reasonCounts[event.MessageReason]++
+
+			asserter.GreaterOrEqual(event.Offset, lastOffset)
+			lastOffset = event.Offset
+
+			if event.MessageType == brotatomodtypes.MessageTypeTimeSeriesFull {
+				asserter.Len(event.Changed, len(event.State))
+			}
+		}
+
+		asserter.Equal(config.WaveCount, reasonCounts[brotatomodtypes.MessageReasonStartedWave])
+		asserter.Equal(config.WaveCount-1, reasonCounts[brotatomodtypes.MessageReasonShopEntered])
+		asserter.Equal(1, reasonCounts[brotatomodtypes.MessageReasonRunEnded])
+		asserter.Greater(reasonCounts[brotatomodtypes.MessageReasonPoll], 0)
+
+		asserter.Equal(brotatomodtypes.MessageReasonRunEnded, events[len(events)-1].MessageReason)
+	})
+
+	for _, protocolVersion := range []brotatomodtypes.ProtocolVersion{brotatomodtypes.ProtocolVersionLegacy, brotatomodtypes.ProtocolVersionFramed} {
+		t.Run(fmt.Sprintf("TestEncodeV%d", protocolVersion), func(t *testing.T) {
+			asserter := require.New(t)
+
+			encoder := NewEncoder(protocolVersion)
+			messageReader := brotatoserial.NewVersionedMessageReader(protocolVersion, nil, nil)
+
+			state := brotatostate.NewStore()
+			readBody := func(body []byte) {
+				messageReader.SetReader(bytes.NewReader(body))
+				for {
+					msg, err := messageReader.ReadNextMessage()
+					if errors.Is(err, io.EOF) {
+						return
+					}
+					asserter.NoError(err)
+
+					if msg.MessageBody == nil {
+						continue
+					}
+
+					var keyValues []brotatomodtypes.DictKeyValue
+					for {
+						kv, err := msg.MessageBody.ReadNextKeyValue()
+						if errors.Is(err, io.EOF) {
+							break
+						}
+						asserter.NoError(err)
+
+						kv.Value = bytes.Clone(kv.Value)
+						keyValues = append(keyValues, kv)
+					}
+
+					update := brotatostate.Update{Time: msg.MessageTimestamp.Time(), Reason: msg.MessageReason}
+					if msg.MessageType == brotatomodtypes.MessageTypeTimeSeriesFull {
+						_, err = state.Replace(update, keyValues)
+					} else {
+						_, err = state.Apply(update, keyValues)
+					}
+					asserter.NoError(err)
+				}
+			}
+
+			for i, event := range events {
+				// server loses the mappings part way through
+				if i == len(events)/2 {
+					messageReader.Reset()
+					state.Reset()
+
+					body, err := encoder.EncodeResync(event, time.Now())
+					asserter.NoError(err)
+					readBody(body)
+
+					continue
+				}
+
+				body, err := encoder.EncodeEvent(event, time.Now())
+				asserter.NoError(err)
+				readBody(body)
+			}
+
+			body, err := encoder.EncodeKeepAlive(time.Now())
+			asserter.NoError(err)
+			readBody(body)
+
+			lastEvent := events[len(events)-1]
+			snapshot := state.Snapshot()
+			asserter.Equal(len(lastEvent.State), snapshot.Len())
+			for key, value := range lastEvent.State {
+				expected, err := json.Marshal(value)
+				asserter.NoError(err)
+
+				actual, ok := snapshot.Get(key)
+				asserter.True(ok, key)
+				asserter.JSONEq(string(expected), string(actual.AppendJSON(nil)), key)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package brotatostate
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/errutil"
+)
+
+// Update the message values were changed by.
+type Update struct {
+	// Time the message's timestamp.
+	Time time.Time
+	// Reason the message's reason.
+	Reason brotatomodtypes.MessageReason
+}
+
+// Snapshot state at one point in time. Never changed once published, reads need no locking.
+type Snapshot struct {
+	// Updated message which last changed any value, zero for an empty state.
+	Updated Update
+	// Version counts snapshots published by the store, starting at 1 for the first.
+	Version uint64
+	// ModifiedTime when the snapshot was published, by the server's clock - message timestamps come from the mod's.
+	ModifiedTime time.Time
+
+	valueMap map[string]Value
+}
+
+// Len keys in the state.
+func (s *Snapshot) Len() int {
+	return len(s.valueMap)
+}
+
+// Get
+func (s *Snapshot) Get(key string) (Value, bool) {
+	value, ok := s.valueMap[key]
+	return value, ok
+}
+
+// Select snapshot with only the keys selected, otherwise the same.
+func (s *Snapshot) Select(selected func(key string) bool) *Snapshot {
+	projected := *s
+	projected.valueMap = make(map[string]Value)
+	for key, value := range s.valueMap {
+		if selected(key) {
+			projected.valueMap[key] = value
+		}
+	}
+
+	return &projected
+}
+
+// Keys sorted.
+func (s *Snapshot) Keys() []string {
+	keys := make([]string, 0, len(s.valueMap))
+	for key := range s.valueMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// ChangedKeys sorted keys whose value differs from prev, including keys only one of the snapshots has.
+func (s *Snapshot) ChangedKeys(prev *Snapshot) []string {
+	changedKeys := make([]string, 0)
+	for key, value := range s.valueMap {
+		prevValue, ok := prev.valueMap[key]
+		if !ok || !value.Equal(prevValue) {
+			changedKeys = append(changedKeys, key)
+		}
+	}
+
+	for key := range prev.valueMap {
+		if _, ok := s.valueMap[key]; !ok {
+			changedKeys = append(changedKeys, key)
+		}
+	}
+	sort.Strings(changedKeys)
+
+	return changedKeys
+}
+
+// AppendJSON appends the state as a JSON object with sorted keys.
+func (s *Snapshot) AppendJSON(bts []byte) []byte {
+	bts = append(bts, '{')
+	for i, key := range s.Keys() {
+		if i > 0 {
+			bts = append(bts, ',')
+		}
+
+		bts = brotatomodtypes.DictKeyValue{SerialType: brotatomodtypes.SerialTypeString, Value: []byte(key)}.AppendJSON(bts)
+		bts = append(bts, ':')
+		bts = s.valueMap[key].AppendJSON(bts)
+	}
+
+	return append(bts, '}')
+}
+
+// AppendMetaJSON appends the state as a JSON object of each key's value, type and the timestamp and reason of the
+// message which last changed it.
+func (s *Snapshot) AppendMetaJSON(bts []byte) []byte {
+	bts = append(bts, '{')
+	for i, key := range s.Keys() {
+		if i > 0 {
+			bts = append(bts, ',')
+		}
+
+		value := s.valueMap[key]
+
+		bts = brotatomodtypes.DictKeyValue{SerialType: brotatomodtypes.SerialTypeString, Value: []byte(key)}.AppendJSON(bts)
+		bts = append(bts, `:{"value":`...)
+		bts = value.AppendJSON(bts)
+		bts = append(bts, `,"type":"`...)
+		bts = append(bts, value.SerialType.String()...)
+		bts = append(bts, `","updated_at":"`...)
+		bts = value.Updated.Time.UTC().AppendFormat(bts, time.RFC3339Nano)
+		bts = append(bts, `","reason":"`...)
+		bts = append(bts, value.Updated.Reason.String()...)
+		bts = append(bts, `"}`...)
+	}
+
+	return append(bts, '}')
+}
+
+// MarshalJSON
+func (s *Snapshot) MarshalJSON() ([]byte, error) {
+	return s.AppendJSON(nil), nil
+}
+
+// Store current state of one session. Every change publishes a new Snapshot copied from the last, so readers holding a
+// snapshot never see it change underneath them.
+type Store struct {
+	snapshot atomic.Pointer[Snapshot]
+
+	// mu one writer at a time, readers don't lock
+	mu sync.Mutex
+}
+
+// NewStore empty store.
+func NewStore() *Store {
+	store := new(Store)
+	store.snapshot.Store(&Snapshot{valueMap: make(map[string]Value)})
+
+	return store
+}
+
+// Snapshot current state.
+func (st *Store) Snapshot() *Snapshot {
+	return st.snapshot.Load()
+}
+
+// Apply key values of a diff on top of the current state. Removed keys are deleted, maps are merged entry by entry and
+// anything else is replaced. Nothing is applied if any value fails to decode.
+func (st *Store) Apply(update Update, keyValues []brotatomodtypes.DictKeyValue) (*Snapshot, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	current := st.snapshot.Load()
+	// nothing changed, keep the version so conditional requests still match
+	if len(keyValues) == 0 {
+		return current, nil
+	}
+
+	return st.apply(current.valueMap, update, keyValues)
+}
+
+// Replace the whole state with the key values of a full message.
+func (st *Store) Replace(update Update, keyValues []brotatomodtypes.DictKeyValue) (*Snapshot, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.apply(nil, update, keyValues)
+}
+
+// Reset to an empty state.
+func (st *Store) Reset() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	_, _ = st.apply(nil, Update{}, nil)
+}
+
+// apply publishes the values of prevValueMap with keyValues applied. The store must be locked.
+func (st *Store) apply(prevValueMap map[string]Value, update Update, keyValues []brotatomodtypes.DictKeyValue) (*Snapshot, error) {
+	current := st.snapshot.Load()
+
+	next := &Snapshot{
+		Version:      current.Version + 1,
+		ModifiedTime: time.Now(),
+		valueMap:     make(map[string]Value, len(prevValueMap)+len(keyValues)),
+	}
+	if prevValueMap != nil {
+		next.Updated = current.Updated
+	}
+	for key, value := range prevValueMap {
+		next.valueMap[key] = value
+	}
+
+	for _, kv := range keyValues {
+		next.Updated = update
+
+		if kv.Removed() {
+			delete(next.valueMap, kv.MappedKey)
+			continue
+		}
+
+		value, err := next.valueMap[kv.MappedKey].merge(kv, update, 1)
+		if err != nil {
+			return current, errutil.NewStackError(err)
+		}
+		next.valueMap[kv.MappedKey] = value
+	}
+
+	st.snapshot.Store(next)
+
+	return next, nil
+}
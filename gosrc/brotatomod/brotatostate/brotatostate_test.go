@@ -0,0 +1,200 @@
+package brotatostate
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/stretchr/testify/require"
+)
+
+func newInt32(key string, value int32) brotatomodtypes.DictKeyValue {
+	return brotatomodtypes.DictKeyValue{MappedKey: key, SerialType: brotatomodtypes.SerialTypeInt32, Value: binary.LittleEndian.AppendUint32(nil, uint32(value))}
+}
+
+func newMap(key string, entries ...brotatomodtypes.DictKeyValue) brotatomodtypes.DictKeyValue {
+	return brotatomodtypes.DictKeyValue{MappedKey: key, SerialType: brotatomodtypes.SerialTypeMap, Value: brotatomodtypes.AppendMapValue(nil, entries)}
+}
+
+func newRemoved(key string) brotatomodtypes.DictKeyValue {
+	return brotatomodtypes.DictKeyValue{MappedKey: key, SerialType: brotatomodtypes.SerialTypeRemoved}
+}
+
+func TestValue(t *testing.T) {
+	update := Update{Time: time.Unix(100, 0), Reason: brotatomodtypes.MessageReasonPoll}
+
+	t.Run("TestScalars", func(t *testing.T) {
+		asserter := require.New(t)
+
+		value, err := NewValue(newInt32("gold", -5), update)
+		asserter.NoError(err)
+		asserter.Equal(update, value.Updated)
+
+		i, ok := value.Int()
+		asserter.True(ok)
+		asserter.Equal(int64(-5), i)
+		_, ok = value.Uint()
+		asserter.False(ok)
+		f, ok := value.Float()
+		asserter.True(ok)
+		asserter.Equal(float64(-5), f)
+		_, ok = value.Text()
+		asserter.False(ok)
+
+		value, err = NewValue(brotatomodtypes.DictKeyValue{SerialType: brotatomodtypes.SerialTypeUint64, Value: binary.LittleEndian.AppendUint64(nil, math.MaxUint64)}, update)
+		asserter.NoError(err)
+		u, ok := value.Uint()
+		asserter.True(ok)
+		asserter.Equal(uint64(math.MaxUint64), u)
+		_, ok = value.Int()
+		asserter.False(ok)
+
+		// rendered the same as the value sent
+		value, err = NewValue(brotatomodtypes.DictKeyValue{SerialType: brotatomodtypes.SerialTypeFloat32, Value: binary.LittleEndian.AppendUint32(nil, math.Float32bits(0.1))}, update)
+		asserter.NoError(err)
+		asserter.Equal("0.1", string(value.AppendJSON(nil)))
+
+		value, err = NewValue(brotatomodtypes.DictKeyValue{SerialType: brotatomodtypes.SerialTypeString, Value: []byte(`say "hi"`)}, update)
+		asserter.NoError(err)
+		s, ok := value.Text()
+		asserter.True(ok)
+		asserter.Equal(`say "hi"`, s)
+		asserter.Equal(`"say \"hi\""`, string(value.AppendJSON(nil)))
+
+		value, err = NewValue(brotatomodtypes.DictKeyValue{SerialType: brotatomodtypes.SerialTypeBool, Value: []byte{1}}, update)
+		asserter.NoError(err)
+		b, ok := value.Bool()
+		asserter.True(ok)
+		asserter.True(b)
+
+		_, err = NewValue(newRemoved("gold"), update)
+		asserter.Error(err)
+		_, err = NewValue(brotatomodtypes.DictKeyValue{SerialType: brotatomodtypes.SerialTypeInt32, Value: []byte{1}}, update)
+		asserter.Error(err)
+	})
+
+	t.Run("TestNested", func(t *testing.T) {
+		asserter := require.New(t)
+
+		weapons := brotatomodtypes.DictKeyValue{SerialType: brotatomodtypes.SerialTypeArray, Value: brotatomodtypes.AppendArrayValue(nil, []brotatomodtypes.DictKeyValue{
+			newInt32("", 1),
+			newRemoved(""),
+			newMap("", newInt32("tier", 2)),
+		})}
+
+		value, err := NewValue(weapons, update)
+		asserter.NoError(err)
+		asserter.Equal(3, value.Len())
+		asserter.JSONEq(`[1, null, {"tier": 2}]`, string(value.AppendJSON(nil)))
+
+		elements := value.Elements()
+		asserter.Equal(brotatomodtypes.SerialTypeRemoved, elements[1].SerialType)
+
+		tier, ok := elements[2].Entry("tier")
+		asserter.True(ok)
+		i, _ := tier.Int()
+		asserter.Equal(int64(2), i)
+	})
+
+	t.Run("TestEqual", func(t *testing.T) {
+		asserter := require.New(t)
+
+		first, err := NewValue(newMap("stats", newInt32("armor", 1), newInt32("dodge", 2)), update)
+		asserter.NoError(err)
+		second, err := NewValue(newMap("stats", newInt32("dodge", 2), newInt32("armor", 1)), Update{Time: update.Time.Add(time.Second)})
+		asserter.NoError(err)
+		asserter.True(first.Equal(second))
+
+		third, err := NewValue(newMap("stats", newInt32("armor", 1)), update)
+		asserter.NoError(err)
+		asserter.False(first.Equal(third))
+
+		// same number, different type
+		asInt32, err := NewValue(newInt32("", 1), update)
+		asserter.NoError(err)
+		asInt8, err := NewValue(brotatomodtypes.DictKeyValue{SerialType: brotatomodtypes.SerialTypeInt8, Value: []byte{1}}, update)
+		asserter.NoError(err)
+		asserter.False(asInt32.Equal(asInt8))
+	})
+}
+
+func TestStore(t *testing.T) {
+	asserter := require.New(t)
+
+	store := NewStore()
+	asserter.Zero(store.Snapshot().Len())
+	asserter.JSONEq(`{}`, string(store.Snapshot().AppendJSON(nil)))
+
+	fullUpdate := Update{Time: time.Unix(100, 0), Reason: brotatomodtypes.MessageReasonStartedWave}
+	full, err := store.Replace(fullUpdate, []brotatomodtypes.DictKeyValue{
+		newInt32("gold", 30),
+		newInt32("current_health", 10),
+		newMap("stats", newInt32("armor", 1), newInt32("dodge", 2)),
+	})
+	asserter.NoError(err)
+	asserter.Equal(full, store.Snapshot())
+	asserter.Equal(fullUpdate, full.Updated)
+	asserter.Equal(uint64(1), full.Version)
+	asserter.Equal([]string{"current_health", "gold", "stats"}, full.Keys())
+
+	diffUpdate := Update{Time: fullUpdate.Time.Add(time.Second), Reason: brotatomodtypes.MessageReasonPoll}
+	diff, err := store.Apply(diffUpdate, []brotatomodtypes.DictKeyValue{
+		newInt32("gold", 35),
+		newRemoved("current_health"),
+		newMap("stats", newRemoved("dodge"), newInt32("luck", 3)),
+	})
+	asserter.NoError(err)
+	asserter.JSONEq(`{"gold": 35, "stats": {"armor": 1, "luck": 3}}`, string(diff.AppendJSON(nil)))
+	asserter.Equal(diffUpdate, diff.Updated)
+	asserter.Equal(uint64(2), diff.Version)
+
+	stats, ok := diff.Get("stats")
+	asserter.True(ok)
+	asserter.Equal(diffUpdate, stats.Updated)
+	armor, ok := stats.Entry("armor")
+	asserter.True(ok)
+	// untouched entries keep the time they last changed
+	asserter.Equal(fullUpdate, armor.Updated)
+
+	asserter.Equal([]string{"current_health", "gold", "stats"}, diff.ChangedKeys(full))
+	asserter.Empty(diff.ChangedKeys(diff))
+
+	// earlier snapshots are never changed
+	asserter.JSONEq(`{"gold": 30, "current_health": 10, "stats": {"armor": 1, "dodge": 2}}`, string(full.AppendJSON(nil)))
+
+	// nothing is applied when any value is bad
+	_, err = store.Apply(diffUpdate, []brotatomodtypes.DictKeyValue{
+		newInt32("gold", 40),
+		{MappedKey: "bad", SerialType: brotatomodtypes.SerialTypeInt32, Value: []byte{1}},
+	})
+	asserter.Error(err)
+	asserter.Equal(diff, store.Snapshot())
+
+	// a diff without keys changes nothing
+	unchanged, err := store.Apply(diffUpdate, nil)
+	asserter.NoError(err)
+	asserter.Equal(diff, unchanged)
+
+	asserter.JSONEq(`{
+		"gold": {"value": 35, "type": "Int32", "updated_at": "1970-01-01T00:01:41Z", "reason": "Poll"},
+		"stats": {"value": {"armor": 1, "luck": 3}, "type": "Map", "updated_at": "1970-01-01T00:01:41Z", "reason": "Poll"}
+	}`, string(diff.AppendMetaJSON(nil)))
+
+	encoded, err := json.Marshal(store.Snapshot())
+	asserter.NoError(err)
+	asserter.JSONEq(`{"gold": 35, "stats": {"armor": 1, "luck": 3}}`, string(encoded))
+
+	replaced, err := store.Replace(diffUpdate, []brotatomodtypes.DictKeyValue{newInt32("gold", 1)})
+	asserter.NoError(err)
+	asserter.Equal([]string{"gold"}, replaced.Keys())
+	asserter.Equal([]string{"gold", "stats"}, replaced.ChangedKeys(diff))
+
+	store.Reset()
+	asserter.Zero(store.Snapshot().Len())
+	asserter.Zero(store.Snapshot().Updated)
+	// versions keep counting through resets
+	asserter.Equal(uint64(4), store.Snapshot().Version)
+}
@@ -0,0 +1,318 @@
+package brotatostate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"slices"
+	"sort"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/errutil"
+)
+
+// Value decoded value of one key. Values are never changed once built, so they are shared freely between snapshots.
+type Value struct {
+	// SerialType the value was sent as.
+	SerialType brotatomodtypes.SerialType
+	// Updated message which last changed the value. A map's is that of its latest changed entry.
+	Updated Update
+
+	// raw value bytes of scalars, kept to render JSON exactly as the mod's value would be
+	raw []byte
+
+	// signed ints
+	i int64
+	// unsigned ints
+	u uint64
+	// floats, float32 widened
+	f float64
+	// strings
+	s string
+	// bools
+	b bool
+
+	// elements array elements in order
+	elements []Value
+	// entries map entries by key
+	entries map[string]Value
+}
+
+// NewValue decodes kv. The value copies what it needs from kv.Value. Removed keys have no value.
+func NewValue(kv brotatomodtypes.DictKeyValue, update Update) (Value, error) {
+	return newValue(kv, update, 1)
+}
+
+// newValue
+func newValue(kv brotatomodtypes.DictKeyValue, update Update, depth int) (Value, error) {
+	v := Value{
+		SerialType: kv.SerialType,
+		Updated:    update,
+	}
+
+	switch kv.SerialType {
+	case brotatomodtypes.SerialTypeRemoved:
+		return v, errutil.NewStackErrorf("key (%s) is removed, removed keys have no value", kv.MappedKey)
+	case brotatomodtypes.SerialTypeArray, brotatomodtypes.SerialTypeMap:
+		if depth > brotatomodtypes.MaxNestedDepth {
+			return v, errutil.NewStackErrorf("key (%s) nested deeper than %d", kv.MappedKey, brotatomodtypes.MaxNestedDepth)
+		}
+
+		elements, err := kv.Elements()
+		if err != nil {
+			return v, errutil.NewStackError(err)
+		}
+
+		if kv.SerialType == brotatomodtypes.SerialTypeArray {
+			v.elements = make([]Value, 0, len(elements))
+		} else {
+			v.entries = make(map[string]Value, len(elements))
+		}
+
+		for _, element := range elements {
+			if kv.SerialType == brotatomodtypes.SerialTypeMap && element.Removed() {
+				continue
+			}
+
+			// removed array elements keep their place as null
+			if element.Removed() {
+				v.elements = append(v.elements, Value{SerialType: element.SerialType, Updated: update})
+				continue
+			}
+
+			elementValue, err := newValue(element, update, depth+1)
+			if err != nil {
+				return v, errutil.NewStackError(err)
+			}
+
+			if kv.SerialType == brotatomodtypes.SerialTypeArray {
+				v.elements = append(v.elements, elementValue)
+			} else {
+				v.entries[element.MappedKey] = elementValue
+			}
+		}
+
+		return v, nil
+	}
+
+	size := kv.SerialType.Size()
+	if size < 0 && !kv.SerialType.Variable() {
+		return v, errutil.NewStackErrorf("key (%s) has unknown serial type 0x%x", kv.MappedKey, uint8(kv.SerialType))
+	}
+	if size > 0 && len(kv.Value) != size {
+		return v, errutil.NewStackErrorf("key (%s) has %d value bytes, expected %d", kv.MappedKey, len(kv.Value), size)
+	}
+
+	v.raw = bytes.Clone(kv.Value)
+
+	switch kv.SerialType {
+	case brotatomodtypes.SerialTypeString:
+		v.s = string(kv.Value)
+	case brotatomodtypes.SerialTypeInt8:
+		v.i = int64(int8(kv.Value[0]))
+	case brotatomodtypes.SerialTypeInt16:
+		v.i = int64(int16(binary.LittleEndian.Uint16(kv.Value)))
+	case brotatomodtypes.SerialTypeInt32:
+		v.i = int64(int32(binary.LittleEndian.Uint32(kv.Value)))
+	case brotatomodtypes.SerialTypeInt64:
+		v.i = int64(binary.LittleEndian.Uint64(kv.Value))
+	case brotatomodtypes.SerialTypeUint8:
+		v.u = uint64(kv.Value[0])
+	case brotatomodtypes.SerialTypeUint16:
+		v.u = uint64(binary.LittleEndian.Uint16(kv.Value))
+	case brotatomodtypes.SerialTypeUint32:
+		v.u = uint64(binary.LittleEndian.Uint32(kv.Value))
+	case brotatomodtypes.SerialTypeUint64:
+		v.u = binary.LittleEndian.Uint64(kv.Value)
+	case brotatomodtypes.SerialTypeFloat32:
+		v.f = float64(math.Float32frombits(binary.LittleEndian.Uint32(kv.Value)))
+	case brotatomodtypes.SerialTypeFloat64:
+		v.f = math.Float64frombits(binary.LittleEndian.Uint64(kv.Value))
+	case brotatomodtypes.SerialTypeBool:
+		v.b = kv.Value[0] != 0
+	}
+
+	return v, nil
+}
+
+// merge applies kv on top of v, the current value of the same key. Maps are merged entry by entry, recursively, with
+// removed entries deleted. Everything else, including arrays, replaces v whole.
+func (v Value) merge(kv brotatomodtypes.DictKeyValue, update Update, depth int) (Value, error) {
+	if kv.SerialType != brotatomodtypes.SerialTypeMap || v.SerialType != brotatomodtypes.SerialTypeMap {
+		return newValue(kv, update, depth)
+	}
+
+	if depth > brotatomodtypes.MaxNestedDepth {
+		return v, errutil.NewStackErrorf("key (%s) nested deeper than %d", kv.MappedKey, brotatomodtypes.MaxNestedDepth)
+	}
+
+	entries, err := kv.Elements()
+	if err != nil {
+		return v, errutil.NewStackError(err)
+	}
+
+	merged := Value{
+		SerialType: brotatomodtypes.SerialTypeMap,
+		Updated:    update,
+		entries:    make(map[string]Value, len(v.entries)+len(entries)),
+	}
+	for key, entry := range v.entries {
+		merged.entries[key] = entry
+	}
+
+	for _, entry := range entries {
+		if entry.Removed() {
+			delete(merged.entries, entry.MappedKey)
+			continue
+		}
+
+		mergedEntry, err := merged.entries[entry.MappedKey].merge(entry, update, depth+1)
+		if err != nil {
+			return v, errutil.NewStackError(err)
+		}
+		merged.entries[entry.MappedKey] = mergedEntry
+	}
+
+	return merged, nil
+}
+
+// Int signed ints, and unsigned ints which fit.
+func (v Value) Int() (int64, bool) {
+	switch v.SerialType {
+	case brotatomodtypes.SerialTypeInt8, brotatomodtypes.SerialTypeInt16, brotatomodtypes.SerialTypeInt32, brotatomodtypes.SerialTypeInt64:
+		return v.i, true
+	case brotatomodtypes.SerialTypeUint8, brotatomodtypes.SerialTypeUint16, brotatomodtypes.SerialTypeUint32, brotatomodtypes.SerialTypeUint64:
+		return int64(v.u), v.u <= math.MaxInt64
+	default:
+		return 0, false
+	}
+}
+
+// Uint unsigned ints, and signed ints which aren't negative.
+func (v Value) Uint() (uint64, bool) {
+	switch v.SerialType {
+	case brotatomodtypes.SerialTypeUint8, brotatomodtypes.SerialTypeUint16, brotatomodtypes.SerialTypeUint32, brotatomodtypes.SerialTypeUint64:
+		return v.u, true
+	case brotatomodtypes.SerialTypeInt8, brotatomodtypes.SerialTypeInt16, brotatomodtypes.SerialTypeInt32, brotatomodtypes.SerialTypeInt64:
+		return uint64(v.i), v.i >= 0
+	default:
+		return 0, false
+	}
+}
+
+// Float any number, ints converted.
+func (v Value) Float() (float64, bool) {
+	switch v.SerialType {
+	case brotatomodtypes.SerialTypeFloat32, brotatomodtypes.SerialTypeFloat64:
+		return v.f, true
+	case brotatomodtypes.SerialTypeInt8, brotatomodtypes.SerialTypeInt16, brotatomodtypes.SerialTypeInt32, brotatomodtypes.SerialTypeInt64:
+		return float64(v.i), true
+	case brotatomodtypes.SerialTypeUint8, brotatomodtypes.SerialTypeUint16, brotatomodtypes.SerialTypeUint32, brotatomodtypes.SerialTypeUint64:
+		return float64(v.u), true
+	default:
+		return 0, false
+	}
+}
+
+// Bool
+func (v Value) Bool() (bool, bool) {
+	return v.b, v.SerialType == brotatomodtypes.SerialTypeBool
+}
+
+// Text strings.
+func (v Value) Text() (string, bool) {
+	return v.s, v.SerialType == brotatomodtypes.SerialTypeString
+}
+
+// Len elements of an array or entries of a map, 0 for anything else.
+func (v Value) Len() int {
+	return len(v.elements) + len(v.entries)
+}
+
+// Elements of an array, removed elements are left with SerialTypeRemoved.
+func (v Value) Elements() []Value {
+	return slices.Clone(v.elements)
+}
+
+// Entry of a map.
+func (v Value) Entry(key string) (Value, bool) {
+	entry, ok := v.entries[key]
+	return entry, ok
+}
+
+// EntryKeys of a map, sorted.
+func (v Value) EntryKeys() []string {
+	keys := make([]string, 0, len(v.entries))
+	for key := range v.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Equal compares type and value, Updated is ignored. Floats compare as numbers, so NaN never equals itself.
+func (v Value) Equal(other Value) bool {
+	if v.SerialType != other.SerialType {
+		return false
+	}
+
+	switch v.SerialType {
+	case brotatomodtypes.SerialTypeArray:
+		return slices.EqualFunc(v.elements, other.elements, Value.Equal)
+	case brotatomodtypes.SerialTypeMap:
+		if len(v.entries) != len(other.entries) {
+			return false
+		}
+
+		for key, entry := range v.entries {
+			otherEntry, ok := other.entries[key]
+			if !ok || !entry.Equal(otherEntry) {
+				return false
+			}
+		}
+
+		return true
+	case brotatomodtypes.SerialTypeFloat32, brotatomodtypes.SerialTypeFloat64:
+		return v.f == other.f
+	default:
+		return bytes.Equal(v.raw, other.raw)
+	}
+}
+
+// AppendJSON appends the JSON representation of the value, formatted the same as DictKeyValue.AppendJSON.
+// Map entries are written with sorted keys.
+func (v Value) AppendJSON(bts []byte) []byte {
+	switch v.SerialType {
+	case brotatomodtypes.SerialTypeArray:
+		bts = append(bts, '[')
+		for i, element := range v.elements {
+			if i > 0 {
+				bts = append(bts, ',')
+			}
+			bts = element.AppendJSON(bts)
+		}
+
+		return append(bts, ']')
+	case brotatomodtypes.SerialTypeMap:
+		bts = append(bts, '{')
+		for i, key := range v.EntryKeys() {
+			if i > 0 {
+				bts = append(bts, ',')
+			}
+
+			bts = brotatomodtypes.DictKeyValue{SerialType: brotatomodtypes.SerialTypeString, Value: []byte(key)}.AppendJSON(bts)
+			bts = append(bts, ':')
+			bts = v.entries[key].AppendJSON(bts)
+		}
+
+		return append(bts, '}')
+	default:
+		return brotatomodtypes.DictKeyValue{SerialType: v.SerialType, Value: v.raw}.AppendJSON(bts)
+	}
+}
+
+// MarshalJSON
+func (v Value) MarshalJSON() ([]byte, error) {
+	return v.AppendJSON(nil), nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatocapture"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatoserial"
+	"github.com/benw10-1/brotato-exporter/errutil"
+)
+
+var (
+	inPath  = flag.String("in", "", "Capture file to decode, downloaded from /api/message/capture/file (required)")
+	outPath = flag.String("out", "", "File to write the JSONL to, stdout if empty")
+)
+
+// DecodedMessage one JSONL line for a message which decoded.
+type DecodedMessage struct {
+	// Record index of the body in the capture.
+	Record int `json:"record"`
+	// Received time the server received the body.
+	Received time.Time `json:"received"`
+	// Offset of the message in the capture file.
+	Offset int64 `json:"offset"`
+
+	Type      string                     `json:"type"`
+	Reason    string                     `json:"reason"`
+	Timestamp time.Time                  `json:"timestamp"`
+	Values    map[string]json.RawMessage `json:"values,omitempty"`
+}
+
+// DecodeError one JSONL line for a message which failed to decode.
+type DecodeError struct {
+	// Record index of the body in the capture.
+	Record int `json:"record"`
+	// Received time the server received the body.
+	Received time.Time `json:"received"`
+	// Offset of the message in the capture file.
+	Offset int64 `json:"offset"`
+	// ErrorOffset exact byte in the capture file where decoding failed.
+	ErrorOffset int64 `json:"error_offset"`
+	// Error
+	Error string `json:"error"`
+	// SkippedRest the rest of the body could not be decoded, the server would have rejected it as well.
+	SkippedRest bool `json:"skipped_rest"`
+}
+
+func main() {
+	flag.Parse()
+
+	if *inPath == "" && flag.NArg() > 0 {
+		*inPath = flag.Arg(0)
+	}
+
+	if *inPath == "" {
+		log.Fatal("Missing -in")
+	}
+
+	inFile, err := os.Open(*inPath)
+	if err != nil {
+		log.Fatalf("Failed to open capture: %v", err)
+	}
+	defer inFile.Close()
+
+	out := io.Writer(os.Stdout)
+	if *outPath != "" {
+		outFile, err := os.Create(*outPath)
+		if err != nil {
+			log.Fatalf("Failed to create output: %v", err)
+		}
+		defer outFile.Close()
+
+		out = outFile
+	}
+
+	bufOut := bufio.NewWriter(out)
+
+	recordCount, failedCount, err := decodeCapture(bufio.NewReader(inFile), bufOut)
+	if err != nil {
+		log.Fatalf("Stopped after (%d) bodies: %v", recordCount, err)
+	}
+
+	err = bufOut.Flush()
+	if err != nil {
+		log.Fatalf("Failed to write output: %v", err)
+	}
+
+	log.Printf("Decoded (%d) bodies, (%d) messages failed", recordCount, failedCount)
+}
+
+// decodeCapture writes a line for every message in the capture. Key mappings carry over from one body to the next like
+// they do on the server, one reader is kept per protocol version.
+func decodeCapture(r io.Reader, w io.Writer) (recordCount int, failedCount int, err error) {
+	captureReader := brotatocapture.NewReader(r)
+	encoder := json.NewEncoder(w)
+
+	messageReaderMap := make(map[brotatomodtypes.ProtocolVersion]*brotatoserial.BrotatoMessageReader)
+	bodyReader := bytes.NewReader(nil)
+
+	for ; ; recordCount++ {
+		record, err := captureReader.ReadRecord()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return recordCount, failedCount, nil
+			}
+
+			return recordCount, failedCount, errutil.NewStackError(err)
+		}
+
+		messageReader, ok := messageReaderMap[record.ProtocolVersion]
+		if !ok {
+			messageReader = brotatoserial.NewVersionedMessageReader(record.ProtocolVersion, nil, nil)
+			messageReaderMap[record.ProtocolVersion] = messageReader
+		}
+
+		bodyReader.Reset(record.Body)
+		messageReader.SetReader(bodyReader)
+
+		received := record.Timestamp.Time()
+
+		for {
+			messageOffset := record.Offset + messageReader.Offset()
+
+			line, err := decodeMessage(messageReader)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			if err != nil {
+				failedCount++
+
+				decodeErr := DecodeError{
+					Record:      recordCount,
+					Received:    received,
+					Offset:      messageOffset,
+					ErrorOffset: record.Offset + messageReader.Offset(),
+					Error:       errutil.Message(err),
+				}
+
+				frameErr := &brotatoserial.FrameError{}
+				if errors.As(err, &frameErr) {
+					decodeErr.Offset = record.Offset + frameErr.Offset
+					decodeErr.ErrorOffset = record.Offset + frameErr.ErrOffset
+					decodeErr.Error = errutil.Message(frameErr)
+				} else {
+					decodeErr.SkippedRest = true
+				}
+
+				err = encoder.Encode(decodeErr)
+				if err != nil {
+					return recordCount, failedCount, errutil.NewStackError(err)
+				}
+
+				// a bad frame is skipped like the server does, anything else leaves the reader somewhere in the body
+				if !decodeErr.SkippedRest {
+					continue
+				}
+
+				break
+			}
+
+			line.Record = recordCount
+			line.Received = received
+			line.Offset = messageOffset
+
+			err = encoder.Encode(line)
+			if err != nil {
+				return recordCount, failedCount, errutil.NewStackError(err)
+			}
+		}
+	}
+}
+
+// decodeMessage reads the next message and all of its values.
+func decodeMessage(messageReader *brotatoserial.BrotatoMessageReader) (DecodedMessage, error) {
+	msg, err := messageReader.ReadNextMessage()
+	if err != nil {
+		return DecodedMessage{}, err
+	}
+
+	line := DecodedMessage{
+		Type:      msg.MessageType.String(),
+		Reason:    msg.MessageReason.String(),
+		Timestamp: msg.MessageTimestamp.Time(),
+	}
+
+	if msg.MessageBody == nil {
+		return line, nil
+	}
+
+	line.Values = make(map[string]json.RawMessage)
+	for {
+		kv, err := msg.MessageBody.ReadNextKeyValue()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return line, nil
+			}
+
+			return line, err
+		}
+
+		line.Values[kv.MappedKey] = kv.AppendJSON(nil)
+	}
+}
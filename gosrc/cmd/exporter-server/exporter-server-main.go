@@ -3,10 +3,14 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
+	"expvar"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -15,12 +19,23 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodassets"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodzip"
 	"github.com/benw10-1/brotato-exporter/errutil"
 	"github.com/benw10-1/brotato-exporter/exporterserver"
 	"github.com/benw10-1/brotato-exporter/exporterserver/ctrlauth"
+	"github.com/benw10-1/brotato-exporter/exporterserver/ctrldashboard"
 	"github.com/benw10-1/brotato-exporter/exporterserver/ctrlmessage"
+	"github.com/benw10-1/brotato-exporter/exporterserver/ctrlmod"
+	"github.com/benw10-1/brotato-exporter/exporterserver/ctrlrun"
+	"github.com/benw10-1/brotato-exporter/exporterserver/exporterserverutil"
+	"github.com/benw10-1/brotato-exporter/exporterserver/exportertls"
+	"github.com/benw10-1/brotato-exporter/exporterserver/messagepipeline"
 	"github.com/benw10-1/brotato-exporter/exporterserver/messagesubhandler"
+	"github.com/benw10-1/brotato-exporter/exporterserver/runrecorder"
 	"github.com/benw10-1/brotato-exporter/exporterstore"
+	"github.com/benw10-1/brotato-exporter/logutil"
 	"github.com/spf13/viper"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
@@ -29,6 +44,28 @@ func loadYAMLConfig() error {
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	viper.AutomaticEnv()
 
+	// keys added after the first release, so older config files without them still work
+	viper.SetDefault("max-message-body-size", 8<<20)
+	viper.SetDefault("capture-dir", "")
+	viper.SetDefault("max-capture-file-size", 64<<20)
+	viper.SetDefault("log-level", "info")
+	viper.SetDefault("log-format", string(logutil.FormatJSON))
+	viper.SetDefault("cors-allowed-origins", []string{})
+	viper.SetDefault("cors-allowed-methods", []string{"GET", "HEAD", "POST", "PUT", "DELETE"})
+	viper.SetDefault("cors-allowed-headers", []string{"Authorization", "Content-Type", "Content-Encoding", "If-None-Match", "If-Modified-Since", "X-Request-ID"})
+	viper.SetDefault("rate-limit-per-second", 10)
+	viper.SetDefault("rate-limit-burst", 50)
+	viper.SetDefault("rate-limit-ip-per-second", 50)
+	viper.SetDefault("rate-limit-ip-burst", 200)
+	viper.SetDefault("tls-cert-file", "")
+	viper.SetDefault("tls-key-file", "")
+	viper.SetDefault("tls-self-signed", false)
+	viper.SetDefault("tls-self-signed-dir", "/var/brotatoexporter/tls")
+	viper.SetDefault("tls-self-signed-hosts", []string{})
+	viper.SetDefault("tls-redirect-addr", "")
+	viper.SetDefault("run-history-max-runs", 100)
+	viper.SetDefault("dashboard-files-dir", "")
+
 	viper.SetConfigName("default")
 
 	viper.AddConfigPath("/etc/brotatoexporter")
@@ -78,6 +115,45 @@ func loadYAMLConfig() error {
 	return nil
 }
 
+// loadTLSConfig TLS config for the server from the tls-* keys, nil if TLS is off. Also returns the CA to bundle into mod configs when self-signed.
+func loadTLSConfig(ctx context.Context) (*tls.Config, []byte, error) {
+	certFile := viper.GetString("tls-cert-file")
+	keyFile := viper.GetString("tls-key-file")
+
+	var caCertPEM []byte
+	if viper.GetBool("tls-self-signed") {
+		hosts := append([]string{"localhost", "127.0.0.1"}, viper.GetStringSlice("tls-self-signed-hosts")...)
+		if viper.GetString("mod-config-host") != "" {
+			hosts = append(hosts, viper.GetString("mod-config-host"))
+		}
+
+		selfSigned, err := exportertls.EnsureSelfSigned(viper.GetString("tls-self-signed-dir"), hosts, time.Now())
+		if err != nil {
+			return nil, nil, errutil.NewStackError(err)
+		}
+
+		certFile = selfSigned.CertFile
+		keyFile = selfSigned.KeyFile
+		caCertPEM = selfSigned.CACertPEM
+	}
+
+	if certFile == "" && keyFile == "" {
+		return nil, nil, nil
+	}
+
+	certReloader, err := exportertls.NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, nil, errutil.NewStackError(err)
+	}
+
+	err = certReloader.Watch(ctx)
+	if err != nil {
+		return nil, nil, errutil.NewStackError(err)
+	}
+
+	return certReloader.TLSConfig(), caCertPEM, nil
+}
+
 func main() {
 	appCtx, cancelAppCtx := context.WithCancel(context.Background())
 	defer cancelAppCtx()
@@ -98,26 +174,44 @@ func main() {
 	}
 	log.SetOutput(appLogWriter)
 
+	err := loadYAMLConfig()
+	if err != nil {
+		panic(err)
+	}
+
+	logLevel, err := logutil.ParseLevel(viper.GetString("log-level"))
+	if err != nil {
+		panic(err)
+	}
+	logFormat := logutil.Format(viper.GetString("log-format"))
+
+	appLogHandler, err := logutil.NewHandler(appLogWriter, logFormat, logLevel)
+	if err != nil {
+		panic(err)
+	}
+	// anything still using the log package goes through this as well
+	slog.SetDefault(slog.New(appLogHandler))
+
 	requestLogWriter := &lumberjack.Logger{
 		Filename:   "/var/log/exporter-server-requests.log",
 		MaxSize:    50,
 		MaxBackups: 3,
 		Compress:   true,
 	}
-	requestLogger := log.New(requestLogWriter, "", 0)
+	// every request is logged whatever the app log level, with the same request_id and user_id as the app log
+	requestLogHandler, err := logutil.NewHandler(requestLogWriter, logFormat, slog.LevelInfo)
+	if err != nil {
+		panic(err)
+	}
+	requestLogger := slog.New(requestLogHandler)
 
 	go func() {
 		err := http.ListenAndServe(viper.GetString("pprof-serve-addr"), nil)
 		if err != nil {
-			log.Printf("pprof server error: %v", err)
+			slog.Error("pprof server error", logutil.Err(err))
 		}
 	}()
 
-	err := loadYAMLConfig()
-	if err != nil {
-		panic(err)
-	}
-
 	exporterStore, err := exporterstore.NewExporterStore("/var/brotatoexporter/user.db")
 	if err != nil {
 		panic(err)
@@ -126,23 +220,123 @@ func main() {
 
 	sessionInfoMap := new(ctrlauth.SessionInfoMap)
 
-	handlerList := make([]http.Handler, 0)
+	controllers := make([]exporterserver.Controller, 0)
 
 	authAPI := ctrlauth.NewAuthAPI([]byte(viper.GetString("jwt-auth-signing-key")), sessionInfoMap, exporterStore)
-	handlerList = append(handlerList, authAPI)
+	controllers = append(controllers, authAPI)
 
 	subHandler := messagesubhandler.NewMessageSubHandler(appCtx, sessionInfoMap, time.Minute*10)
 
-	messageAPI := ctrlmessage.NewMessageAPI(sessionInfoMap, exporterStore, subHandler)
-	handlerList = append(handlerList, messageAPI)
+	pipelineMetrics := messagepipeline.NewMetrics()
+	runRecorder := runrecorder.NewRecorder(exporterStore, viper.GetInt("run-history-max-runs"))
+	pipeline := messagepipeline.NewPipeline(appCtx, time.Minute, subHandler.ConsumerConfig(), pipelineMetrics.ConsumerConfig(), runRecorder.ConsumerConfig())
+
+	// served with pprof at /debug/vars
+	expvar.Publish("message_pipeline", expvar.Func(pipeline.StatsVar))
+	expvar.Publish("message_metrics", expvar.Func(pipelineMetrics.SnapshotVar))
+
+	// same origins for REST and websockets, plus any each user allows for their overlays
+	originPolicy := exporterserverutil.NewOriginPolicy(exporterserverutil.OriginConfig{
+		AllowedOrigins: viper.GetStringSlice("cors-allowed-origins"),
+		AllowedMethods: viper.GetStringSlice("cors-allowed-methods"),
+		AllowedHeaders: viper.GetStringSlice("cors-allowed-headers"),
+	}, authAPI.UserAllowedOrigins)
+
+	messageAPI := ctrlmessage.NewMessageAPI(sessionInfoMap, exporterStore, subHandler, pipeline, viper.GetInt64("max-message-body-size"), ctrlmessage.CaptureConfig{
+		Dir:         viper.GetString("capture-dir"),
+		MaxFileSize: viper.GetInt64("max-capture-file-size"),
+	}, originPolicy)
+	controllers = append(controllers, messageAPI)
+
+	controllers = append(controllers, ctrlrun.NewRunAPI(exporterStore))
+
+	dashboardFS := ctrldashboard.DashboardFS()
+	if viper.GetString("dashboard-files-dir") != "" {
+		dashboardFS = os.DirFS(viper.GetString("dashboard-files-dir"))
+	}
+	controllers = append(controllers, ctrldashboard.NewDashboardAPI(dashboardFS))
+
+	tlsConfig, caCertPEM, err := loadTLSConfig(appCtx)
+	if err != nil {
+		panic(err)
+	}
+
+	modConnectionData := brotatomodtypes.ModConfigConnectionData{
+		Host:       viper.GetString("mod-config-host"),
+		Port:       viper.GetInt("mod-config-port"),
+		HTTPS:      viper.GetBool("mod-config-https") || tlsConfig != nil,
+		VerifyHost: viper.GetBool("mod-config-verify-host"),
+		CACert:     string(caCertPEM),
+	}
+
+	modFS := brotatomodassets.ModFS()
+	if viper.GetString("mod-files-dir") != "" {
+		modFS = os.DirFS(viper.GetString("mod-files-dir"))
+	}
+
+	manifest, err := brotatomodzip.CheckManifest(modFS)
+	if err != nil {
+		panic(err)
+	}
+	slog.Info("Serving mod version", slog.String("version", manifest.VersionNumber))
+
+	modAPI := ctrlmod.NewModAPI(modFS, modConnectionData, ctrlauth.NewTicketStore())
+	controllers = append(controllers, modAPI)
+
+	middlewares := []exporterserver.Middleware{
+		exporterserver.RequestIDMiddleware,
+		exporterserver.LoggingMiddleware(requestLogger),
+		exporterserver.RecoveryMiddleware,
+		exporterserver.CORSMiddleware(originPolicy),
+		exporterserver.CompressionMiddleware,
+	}
+	// by IP before auth, so bad credentials can't be tried or looked up as fast as the client likes
+	if viper.GetFloat64("rate-limit-ip-per-second") > 0 {
+		ipRateLimiter := exporterserver.NewRateLimiter(viper.GetFloat64("rate-limit-ip-per-second"), viper.GetInt("rate-limit-ip-burst"), nil)
+		middlewares = append(middlewares, ipRateLimiter.Middleware)
+	}
+	middlewares = append(middlewares, authAPI.Middleware)
+	if viper.GetFloat64("rate-limit-per-second") > 0 {
+		rateLimiter := exporterserver.NewRateLimiter(viper.GetFloat64("rate-limit-per-second"), viper.GetInt("rate-limit-burst"), ctrlauth.ClientKey)
+		middlewares = append(middlewares, rateLimiter.Middleware)
+	}
 
-	exporterServer := exporterserver.NewExporterServer(handlerList, requestLogger)
+	exporterServer := exporterserver.NewExporterServer(controllers, middlewares...)
 
 	srv := http.Server{
 		Addr:         viper.GetString("serve-addr"),
 		Handler:      exporterServer,
 		ReadTimeout:  time.Second * 10,
 		WriteTimeout: time.Second * 10,
+		TLSConfig:    tlsConfig,
+	}
+
+	if tlsConfig != nil && viper.GetString("tls-redirect-addr") != "" {
+		_, httpsPort, err := net.SplitHostPort(srv.Addr)
+		if err != nil {
+			panic(err)
+		}
+
+		redirectSrv := http.Server{
+			Addr:         viper.GetString("tls-redirect-addr"),
+			Handler:      exportertls.RedirectHandler(httpsPort),
+			ReadTimeout:  time.Second * 10,
+			WriteTimeout: time.Second * 10,
+		}
+
+		go func() {
+			<-appCtx.Done()
+			_ = redirectSrv.Close()
+		}()
+
+		go func() {
+			slog.Info("Redirecting to HTTPS", slog.String("addr", redirectSrv.Addr))
+
+			err := redirectSrv.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Redirect server error", logutil.Err(err))
+			}
+		}()
 	}
 
 	go func() {
@@ -151,13 +345,24 @@ func main() {
 		defer cancelShutdownCtx()
 
 		err = srv.Shutdown(shutdownCtx)
-		log.Printf("Server shutdown with err: %v", err)
+		slog.Info("Server shutdown", logutil.Err(err))
 	}()
 
-	log.Printf("Server listening on %s", srv.Addr)
+	slog.Info("Server listening", slog.String("addr", srv.Addr), slog.Bool("tls", tlsConfig != nil))
 
-	err = srv.ListenAndServe()
+	if tlsConfig != nil {
+		// cert and key come from TLSConfig.GetCertificate
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
-		log.Printf("Server error: %v", err)
+		slog.Error("Server error", logutil.Err(err))
+	}
+
+	// runs are persisted in the background, write what is left before the store closes
+	err = runRecorder.Flush()
+	if err != nil {
+		slog.Error("Failed to flush run history", logutil.Err(err))
 	}
 }
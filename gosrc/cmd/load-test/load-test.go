@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/exporterserver/exporterloadtest"
+)
+
+var defaultConfig = exporterloadtest.DefaultConfig()
+
+var (
+	users           = flag.Int("users", defaultConfig.Users, "Mod clients posting at the same time, each as its own user")
+	subs            = flag.Int("subs", defaultConfig.SubscribersPerUser, "Websocket subscribers per user")
+	interval        = flag.Duration("interval", defaultConfig.PostInterval, "Time between diffs from one client, 0 to post as fast as the server answers")
+	posts           = flag.Int("posts", defaultConfig.PostsPerUser, "Diffs each client posts, 0 to keep posting until -duration is up")
+	duration        = flag.Duration("duration", defaultConfig.Duration, "Stop posting after this long, 0 to stop only on -posts")
+	drain           = flag.Duration("drain", defaultConfig.DrainTimeout, "Time to wait for the last diffs to reach subscribers before counting them as dropped")
+	protocolVersion = flag.Int("protocol-version", int(defaultConfig.ProtocolVersion), "Protocol version the clients ask for")
+	serverLog       = flag.Bool("server-log", false, "Write the server's log to stderr, it logs every message")
+)
+
+// main runs the load against an in-process server so nothing else needs to be running, and the memory reported is the
+// server's plus the load generator's.
+func main() {
+	flag.Parse()
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	if !*serverLog {
+		log.SetOutput(io.Discard)
+	}
+
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	dir, err := os.MkdirTemp("", "exporter-load-test")
+	if err != nil {
+		logger.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	testServer, err := exporterloadtest.NewTestServer(dir, *users, *subs)
+	if err != nil {
+		logger.Fatalf("Failed to start server: %v", err)
+	}
+	defer testServer.Close()
+
+	logger.Printf("Running (%d) users with (%d) subscribers each against %s, Ctrl+C to stop early", *users, *subs, testServer.URL)
+
+	result, err := exporterloadtest.Run(ctx, testServer.URL, testServer.AuthKeys, exporterloadtest.Config{
+		Users:              *users,
+		SubscribersPerUser: *subs,
+		PostInterval:       *interval,
+		PostsPerUser:       *posts,
+		Duration:           *duration,
+		DrainTimeout:       *drain,
+		ProtocolVersion:    brotatomodtypes.ProtocolVersion(*protocolVersion),
+	})
+	if err != nil {
+		testServer.Close()
+		logger.Fatalf("Load test failed: %v", err)
+	}
+
+	fmt.Println(result)
+}
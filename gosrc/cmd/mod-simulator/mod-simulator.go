@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatocapture"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatoserial"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatosim"
+	"github.com/benw10-1/brotato-exporter/errutil"
+	"github.com/benw10-1/brotato-exporter/exporterserver/modclient"
+)
+
+var (
+	serverURL = flag.String("server", "http://127.0.0.1:8081", "Scheme and host of the exporter server")
+	authKey   = flag.String("auth-key", "", "Auth key of the user to post as (required)")
+	speed     = flag.Float64("speed", 1, "Playback speed, 2 posts twice as fast as the game would")
+
+	replayPath = flag.String("replay", "", "Capture file to replay instead of simulating a run")
+	recordPath = flag.String("record", "", "Capture file to write the simulated bodies to, so the run can be replayed later")
+
+	protocolVersion = flag.Int("protocol-version", int(brotatomodtypes.ProtocolVersionMax), "Protocol version to ask for when simulating")
+	waveCount       = flag.Int("waves", 20, "Waves in the simulated run")
+	pollInterval    = flag.Duration("poll", time.Second*2, "Time between diffs during a wave")
+	shopDuration    = flag.Duration("shop", time.Second*15, "Time spent in the shop between waves")
+	seed            = flag.Int64("seed", 0, "Seed for the simulated run, random if 0")
+	character       = flag.String("character", string(brotatomodtypes.CharacterTypeWellRounded), "Character ID of the simulated run")
+	nested          = flag.Bool("nested", false, "Send items as a nested map")
+	runCount        = flag.Int("runs", 1, "Runs to simulate one after the other, 0 to keep going until interrupted")
+)
+
+func main() {
+	flag.Parse()
+
+	if *authKey == "" {
+		log.Fatal("Missing -auth-key")
+	}
+
+	if *speed <= 0 {
+		log.Fatalf("Invalid -speed (%v)", *speed)
+	}
+
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	var err error
+	if *replayPath != "" {
+		err = replay(ctx)
+	} else {
+		err = simulate(ctx)
+	}
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Fatalf("Stopped with error: %v", err)
+	}
+}
+
+// simulate posts simulated runs, resyncing like the mod if the server loses the key mappings.
+func simulate(ctx context.Context) error {
+	capabilities := []brotatomodtypes.Capability{brotatomodtypes.CapabilityExtendedSerialTypes}
+	if *nested {
+		capabilities = append(capabilities, brotatomodtypes.CapabilityNestedSerialTypes)
+	}
+
+	client := modclient.NewClient(*serverURL, *authKey, brotatomodtypes.ProtocolVersion(*protocolVersion), capabilities)
+
+	err := client.Authenticate(ctx)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+	log.Printf("Authenticated with protocol version (%d) and capabilities %v", client.ProtocolVersion(), client.Capabilities())
+
+	var recorder *brotatocapture.Writer
+	if *recordPath != "" {
+		recordFile, err := os.Create(*recordPath)
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+		defer recordFile.Close()
+
+		recorder = brotatocapture.NewWriter(recordFile)
+	}
+
+	encoder := brotatosim.NewEncoder(client.ProtocolVersion())
+
+	config := brotatosim.DefaultRunConfig()
+	config.WaveCount = *waveCount
+	config.PollInterval = *pollInterval
+	config.ShopDuration = *shopDuration
+	config.Character = brotatomodtypes.CharacterType(*character)
+	config.Nested = brotatoserial.HasCapability(client.Capabilities(), brotatomodtypes.CapabilityNestedSerialTypes)
+
+	if *seed != 0 {
+		config.Seed = *seed
+	}
+
+	for run := 1; *runCount == 0 || run <= *runCount; run++ {
+		events := brotatosim.SimulateRun(config)
+		log.Printf("Starting run (%d) with seed (%d) - %d messages", run, config.Seed, len(events))
+
+		startTime := time.Now()
+		for i, event := range events {
+			err = sleepUntil(ctx, startTime.Add(time.Duration(float64(event.Offset) / *speed)))
+			if err != nil {
+				return errutil.NewStackError(err)
+			}
+
+			body, err := encoder.EncodeEvent(event, time.Now())
+			if err != nil {
+				return errutil.NewStackError(err)
+			}
+
+			err = post(ctx, client, recorder, body)
+			if errors.Is(err, modclient.ErrMappingResetRequired) {
+				log.Printf("Server requested key mapping reset at message (%d), resending the full state", i)
+
+				body, err = encoder.EncodeResync(event, time.Now())
+				if err != nil {
+					return errutil.NewStackError(err)
+				}
+
+				err = post(ctx, client, recorder, body)
+			}
+			if err != nil {
+				return errutil.NewStackError(err)
+			}
+		}
+
+		log.Printf("Finished run (%d) in %s", run, time.Since(startTime).Round(time.Millisecond))
+		config.Seed++
+	}
+
+	return nil
+}
+
+// replay posts the bodies of a capture with the same gaps between them as when they were received.
+// A capture which starts part way through a session can't be resynced, so the server will reject bodies until the next full state.
+func replay(ctx context.Context) error {
+	replayFile, err := os.Open(*replayPath)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+	defer replayFile.Close()
+
+	captureReader := brotatocapture.NewReader(bufio.NewReader(replayFile))
+
+	var client *modclient.Client
+	var startTime time.Time
+	var firstTimestamp brotatomodtypes.MicroTime
+	for i := 0; ; i++ {
+		record, err := captureReader.ReadRecord()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				log.Printf("Replayed (%d) bodies", i)
+				return nil
+			}
+
+			return errutil.NewStackError(err)
+		}
+
+		if client == nil {
+			client = modclient.NewClient(*serverURL, *authKey, record.ProtocolVersion, brotatomodtypes.SupportedCapabilities)
+
+			err = client.Authenticate(ctx)
+			if err != nil {
+				return errutil.NewStackError(err)
+			}
+
+			if client.ProtocolVersion() != record.ProtocolVersion {
+				return errutil.NewStackErrorf("capture uses protocol version (%d) but the server negotiated (%d)", record.ProtocolVersion, client.ProtocolVersion())
+			}
+
+			startTime = time.Now()
+			firstTimestamp = record.Timestamp
+		}
+
+		capturedOffset := record.Timestamp.Time().Sub(firstTimestamp.Time())
+
+		err = sleepUntil(ctx, startTime.Add(time.Duration(float64(capturedOffset) / *speed)))
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+
+		err = post(ctx, client, nil, record.Body)
+		if errors.Is(err, modclient.ErrMappingResetRequired) {
+			log.Printf("Server requested key mapping reset at body (%d) offset (%d), continuing", i, record.Offset)
+			continue
+		}
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+	}
+}
+
+// post posts body and records it once accepted if recorder is set.
+func post(ctx context.Context, client *modclient.Client, recorder *brotatocapture.Writer, body []byte) error {
+	sentTime := time.Now()
+
+	res, err := client.PostBody(ctx, body)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	for _, failedFrame := range res.FailedFrames {
+		log.Printf("Server skipped frame (%d) at offset (%d): %s", failedFrame.Index, failedFrame.Offset, failedFrame.Error)
+	}
+
+	if recorder == nil {
+		return nil
+	}
+
+	err = recorder.WriteRecord(brotatocapture.Record{
+		Timestamp:       brotatomodtypes.MicroTimeFromTime(sentTime),
+		ProtocolVersion: client.ProtocolVersion(),
+		Body:            body,
+	})
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	return nil
+}
+
+// sleepUntil
+func sleepUntil(ctx context.Context, t time.Time) error {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -1,25 +1,22 @@
 package main
 
 import (
-	"archive/zip"
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
-	"fmt"
-	"io"
-	"io/fs"
 	"log"
-	"os"
 	"path/filepath"
 
 	"github.com/AlecAivazis/survey/v2"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodassets"
 	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
-	"github.com/benw10-1/brotato-exporter/errutil"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodzip"
 	"github.com/benw10-1/brotato-exporter/exporterstore"
 	"github.com/benw10-1/brotato-exporter/exporterstore/exporterstoretypes"
 	"github.com/google/uuid"
 )
 
+const outputDir = "/var/brotatoexporter"
+
 var (
 	host           string
 	port           int
@@ -119,88 +116,15 @@ func main() {
 		},
 	}
 
-	makeConfigFile(config)
-	makeUserModZip()
-
-	log.Printf("User created with ID (%s) with config - %+v", user.UserID, config)
-}
-
-func makeUserModZip() {
-	zipFile, err := os.Create("/var/brotatoexporter/user-mod.zip")
+	err = brotatomodzip.WriteConfigFile(filepath.Join(outputDir, "connect-config.json"), config)
 	if err != nil {
 		panic(err)
 	}
-	defer zipFile.Close()
-
-	zipWriter := zip.NewWriter(zipFile)
-	defer zipWriter.Close()
-
-	baseDir := "/var/lib/mod"
-
-	err = filepath.Walk(baseDir, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			return errutil.NewStackError(err)
-		}
-		path = path[len(baseDir):]
 
-		if path == "" {
-			return nil
-		}
-		// remove leading slash
-		path = path[1:]
-		fmt.Println("Zipping -", path)
-
-		if info.IsDir() {
-			_, err = zipWriter.Create(fmt.Sprintf("%s%c", path, os.PathSeparator))
-
-			return errutil.NewStackError(err)
-		}
-
-		file, err := os.Open(filepath.Join(baseDir, path))
-		if err != nil {
-			return errutil.NewStackError(err)
-		}
-		defer file.Close()
-
-		f, err := zipWriter.Create(path)
-		if err != nil {
-			return errutil.NewStackError(err)
-		}
-
-		_, err = io.Copy(f, file)
-		if err != nil {
-			return errutil.NewStackError(err)
-		}
-
-		return nil
-	})
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-func makeConfigFile(config brotatomodtypes.ModConfig) {
-	err := os.MkdirAll("/var/brotatoexporter", 0755)
-	if err != nil {
-		panic(err)
-	}
-
-	outputConfigFile, err := os.Create("/var/brotatoexporter/connect-config.json")
+	err = brotatomodzip.WriteModZipFile(filepath.Join(outputDir, "user-mod.zip"), brotatomodassets.ModFS(), config)
 	if err != nil {
 		panic(err)
 	}
-	defer outputConfigFile.Close()
 
-	zipTargetConfigFile, err := os.Create("/var/lib/mod/mods-unpacked/benw10-BrotatoExporter/connect-config.json")
-	if err != nil {
-		panic(err)
-	}
-	defer zipTargetConfigFile.Close()
-
-	multiWriter := io.MultiWriter(outputConfigFile, zipTargetConfigFile)
-
-	err = json.NewEncoder(multiWriter).Encode(config)
-	if err != nil {
-		panic(err)
-	}
+	log.Printf("User created with ID (%s) with config - %+v", user.UserID, config)
 }
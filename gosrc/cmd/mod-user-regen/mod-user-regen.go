@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodassets"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodzip"
+	"github.com/benw10-1/brotato-exporter/errutil"
+	"github.com/benw10-1/brotato-exporter/exporterstore"
+	"github.com/google/uuid"
+)
+
+var (
+	dbPath     = flag.String("db", "/var/brotatoexporter/user.db", "Path to the user database")
+	modDir     = flag.String("mod-dir", "", "Optional directory containing mod files to zip instead of the embedded mod")
+	outputDir  = flag.String("out", "/var/brotatoexporter", "Directory to write connect-config.json and user-mod.zip to")
+	baseConfig = flag.String("base-config", "", "Optional existing connect-config.json to take connection defaults from")
+
+	userIDStr = flag.String("user-id", "", "ID of the existing user (required)")
+	authKey   = flag.String("auth-key", "", "Auth key of the existing user (required)")
+
+	host       = flag.String("host", "127.0.0.1", "Host the mod connects to")
+	port       = flag.Int("port", 8081, "Port the mod connects to")
+	https      = flag.Bool("https", false, "Connect using HTTPS")
+	verifyHost = flag.Bool("verify-host", false, "Verify the host certificate when using HTTPS")
+	caCertFile = flag.String("ca-cert", "", "Optional PEM file of the CA the server cert is signed by, ex. the server's self-signed ca.crt")
+)
+
+func main() {
+	flag.Parse()
+
+	userID, err := uuid.Parse(*userIDStr)
+	if err != nil {
+		log.Fatalf("Invalid or missing -user-id (%s): %v", *userIDStr, err)
+	}
+
+	if *authKey == "" {
+		log.Fatal("Missing -auth-key")
+	}
+
+	exporterStore, err := exporterstore.NewExporterStore(*dbPath)
+	if err != nil {
+		panic(err)
+	}
+	defer exporterStore.Close()
+
+	_, err = exporterStore.GetUserByID(userID)
+	if err != nil {
+		panic(err)
+	}
+
+	authKeyUserID, err := exporterStore.GetUserIDByAuthKey([]byte(*authKey))
+	if err != nil {
+		panic(err)
+	}
+
+	if authKeyUserID != userID {
+		log.Fatalf("Auth key does not belong to user (%s)", userID)
+	}
+
+	connectionData, err := connectionDataDefaults()
+	if err != nil {
+		panic(err)
+	}
+
+	// only explicitly set flags override the base config
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "host":
+			connectionData.Host = *host
+		case "port":
+			connectionData.Port = *port
+		case "https":
+			connectionData.HTTPS = *https
+		case "verify-host":
+			connectionData.VerifyHost = *verifyHost
+		}
+	})
+	if *caCertFile != "" {
+		caCertPEM, err := os.ReadFile(*caCertFile)
+		if err != nil {
+			panic(err)
+		}
+
+		connectionData.CACert = string(caCertPEM)
+	}
+	connectionData.AuthToken = *authKey
+
+	config := brotatomodtypes.ModConfig{
+		Enabled:        true,
+		ConnectionData: connectionData,
+	}
+
+	err = brotatomodzip.WriteConfigFile(filepath.Join(*outputDir, "connect-config.json"), config)
+	if err != nil {
+		panic(err)
+	}
+
+	modFS := brotatomodassets.ModFS()
+	if *modDir != "" {
+		modFS = os.DirFS(*modDir)
+	}
+
+	err = brotatomodzip.WriteModZipFile(filepath.Join(*outputDir, "user-mod.zip"), modFS, config)
+	if err != nil {
+		panic(err)
+	}
+
+	log.Printf("Regenerated mod for user ID (%s) in (%s) with config - %+v", userID, *outputDir, config)
+}
+
+// connectionDataDefaults connection data from -base-config if provided, otherwise the flag defaults.
+func connectionDataDefaults() (brotatomodtypes.ModConfigConnectionData, error) {
+	if *baseConfig == "" {
+		return brotatomodtypes.ModConfigConnectionData{
+			Host:       *host,
+			Port:       *port,
+			HTTPS:      *https,
+			VerifyHost: *verifyHost,
+		}, nil
+	}
+
+	configFile, err := os.Open(*baseConfig)
+	if err != nil {
+		return brotatomodtypes.ModConfigConnectionData{}, errutil.NewStackError(err)
+	}
+	defer configFile.Close()
+
+	config := brotatomodtypes.ModConfig{}
+
+	err = json.NewDecoder(configFile).Decode(&config)
+	if err != nil {
+		return brotatomodtypes.ModConfigConnectionData{}, errutil.NewStackError(err)
+	}
+
+	return config.ConnectionData, nil
+}
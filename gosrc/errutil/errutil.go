@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"runtime"
+	"strings"
 )
 
 // StackError
@@ -74,3 +75,10 @@ func NewStackError(e interface{}) error {
 func NewStackErrorf(format string, args ...interface{}) error {
 	return NewStackError(fmt.Sprintf(format, args...))
 }
+
+// Message err's message without the stack traces of the StackErrors it wraps.
+func Message(err error) string {
+	message, _, _ := strings.Cut(err.Error(), "\n")
+
+	return message
+}
@@ -0,0 +1,149 @@
+package ctrlauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/benw10-1/brotato-exporter/errutil"
+	"github.com/benw10-1/brotato-exporter/exporterserver/exporterserverutil"
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxUserAllowedOrigins
+const maxUserAllowedOrigins = 20
+
+// AllowedOrigins browser origins a user allows on top of the server's.
+type AllowedOrigins struct {
+	AllowedOrigins []string `json:"allowed_origins"`
+}
+
+// UserAllowedOrigins origins allowed by the user r is authenticated as, for exporterserverutil.NewOriginPolicy.
+// Works before Middleware has run as CORS is answered ahead of auth.
+func (api *AuthAPI) UserAllowedOrigins(r *http.Request) []string {
+	userID, ok := anyUserIDFromCtx(r.Context())
+	if !ok {
+		ctx, err := api.authenticateCtx(r)
+		if err != nil {
+			return nil
+		}
+
+		userID, ok = anyUserIDFromCtx(ctx)
+		if !ok {
+			return nil
+		}
+	}
+
+	user, err := api.exporterStore.GetUserByID(userID)
+	if err != nil {
+		return nil
+	}
+
+	return user.AllowedOrigins
+}
+
+// allowedOriginsUserID user ID of the Bearer token, or a response error if there is none.
+func allowedOriginsUserID(r *http.Request) (uuid.UUID, error) {
+	userID, ok := GetUserIDFromCtx(r.Context())
+	if !ok {
+		return uuid.Nil, exporterserverutil.NewResponseError(nil, http.StatusUnauthorized, exporterserverutil.ErrorCodeUnauthorized, "Unauthorized")
+	}
+
+	return userID, nil
+}
+
+// getAllowedOrigins
+func (api *AuthAPI) getAllowedOrigins(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	exporterserverutil.WriteError(w, r, func() error {
+		userID, err := allowedOriginsUserID(r)
+		if err != nil {
+			return err
+		}
+
+		user, err := api.exporterStore.GetUserByID(userID)
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to get user")
+		}
+
+		return writeAllowedOrigins(w, user.AllowedOrigins)
+	}())
+}
+
+// setAllowedOrigins replaces the user's allowed origins.
+func (api *AuthAPI) setAllowedOrigins(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	exporterserverutil.WriteError(w, r, func() error {
+		userID, err := allowedOriginsUserID(r)
+		if err != nil {
+			return err
+		}
+
+		req := new(AllowedOrigins)
+
+		err = json.NewDecoder(io.LimitReader(r.Body, 16<<10)).Decode(req)
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusBadRequest, exporterserverutil.ErrorCodeInvalidBody, "Invalid request body")
+		}
+
+		if len(req.AllowedOrigins) > maxUserAllowedOrigins {
+			return exporterserverutil.NewResponseError(nil, http.StatusBadRequest, exporterserverutil.ErrorCodeInvalidBody, fmt.Sprintf("At most (%d) origins are allowed", maxUserAllowedOrigins))
+		}
+
+		allowedOrigins := make([]string, 0, len(req.AllowedOrigins))
+		for _, origin := range req.AllowedOrigins {
+			origin, err = parseOrigin(origin)
+			if err != nil {
+				return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusBadRequest, exporterserverutil.ErrorCodeInvalidBody, err.Error())
+			}
+
+			allowedOrigins = append(allowedOrigins, origin)
+		}
+
+		user, err := api.exporterStore.GetUserByID(userID)
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to get user")
+		}
+
+		user.AllowedOrigins = allowedOrigins
+
+		err = api.exporterStore.UpsertUser(user)
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to update user")
+		}
+
+		return writeAllowedOrigins(w, user.AllowedOrigins)
+	}())
+}
+
+// parseOrigin normalized origin, ex. "https://overlay.example.com". Only a scheme and host are allowed, no wildcards.
+func parseOrigin(origin string) (string, error) {
+	originURL, err := url.Parse(exporterserverutil.NormalizeOrigin(origin))
+	if err != nil {
+		return "", fmt.Errorf("Invalid origin (%s)", origin)
+	}
+
+	if (originURL.Scheme != "http" && originURL.Scheme != "https") || originURL.Host == "" || originURL.Path != "" ||
+		originURL.RawQuery != "" || originURL.Fragment != "" || originURL.User != nil {
+		return "", fmt.Errorf("Invalid origin (%s) - expected scheme and host only, ex. https://overlay.example.com", origin)
+	}
+
+	return originURL.Scheme + "://" + originURL.Host, nil
+}
+
+// writeAllowedOrigins
+func writeAllowedOrigins(w http.ResponseWriter, allowedOrigins []string) error {
+	if allowedOrigins == nil {
+		allowedOrigins = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(&AllowedOrigins{AllowedOrigins: allowedOrigins})
+	if err != nil {
+		return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to write JSON")
+	}
+
+	return nil
+}
@@ -4,16 +4,21 @@ import (
 	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
 	"github.com/benw10-1/brotato-exporter/brotatomod/brotatoserial"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatostate"
 	"github.com/benw10-1/brotato-exporter/errutil"
 	"github.com/benw10-1/brotato-exporter/exporterserver/exporterserverutil"
 	"github.com/benw10-1/brotato-exporter/exporterstore"
+	"github.com/benw10-1/brotato-exporter/logutil"
 	"github.com/google/uuid"
 	"github.com/julienschmidt/httprouter"
 )
@@ -22,40 +27,105 @@ import (
 type AuthAPI struct {
 	sessionInfoMap *SessionInfoMap
 
+	// subscribeTicketStore tickets browsers open subscribe websockets with.
+	subscribeTicketStore *TicketStore
+
 	jwtKey []byte
 
 	exporterStore *exporterstore.ExporterStore
-
-	*httprouter.Router
 }
 
 // NewAuthAPI
 func NewAuthAPI(jwtKey []byte, sessionInfoMap *SessionInfoMap, exporterStore *exporterstore.ExporterStore) *AuthAPI {
-	router := httprouter.New()
-
-	api := &AuthAPI{
-		jwtKey:         jwtKey,
-		sessionInfoMap: sessionInfoMap,
-		exporterStore:  exporterStore,
-		Router:         router,
+	return &AuthAPI{
+		jwtKey:               jwtKey,
+		sessionInfoMap:       sessionInfoMap,
+		subscribeTicketStore: NewTicketStore(),
+		exporterStore:        exporterStore,
 	}
+}
 
+// RegisterRoutes
+func (api *AuthAPI) RegisterRoutes(router *httprouter.Router) {
 	router.POST("/api/auth/authenticate", api.authenticateUser)
-	router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
 
-	return api
+	// GET rather than POST so pages on a user's own allowed origins, which only get read-only preflights, can fetch one
+	router.GET("/api/auth/subscribe-ticket", api.subscribeTicket)
+
+	router.GET("/api/auth/allowed-origins", api.getAllowedOrigins)
+	router.PUT("/api/auth/allowed-origins", api.setAllowedOrigins)
+}
+
+// AuthRequest optional body of the authenticate call. Mods from before versioning send an empty body.
+type AuthRequest struct {
+	ProtocolVersion brotatomodtypes.ProtocolVersion `json:"protocol_version"`
+	Capabilities    []brotatomodtypes.Capability    `json:"capabilities"`
+}
+
+// ReadStream format is:
+// - protocol version (uint16)
+// - capability count (uint8)
+// - (for each capability)
+// -- capability length (uint8)
+// -- capability string (variable [uint8, ...])
+// An empty stream leaves the request zeroed.
+func (ar *AuthRequest) ReadStream(r io.Reader) error {
+	buf := make([]byte, 3)
+
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		return errutil.NewStackError(err)
+	}
+
+	ar.ProtocolVersion = brotatomodtypes.ProtocolVersion(binary.LittleEndian.Uint16(buf))
+
+	capabilityCount := int(buf[2])
+	ar.Capabilities = make([]brotatomodtypes.Capability, 0, capabilityCount)
+	for i := 0; i < capabilityCount; i++ {
+		_, err = io.ReadFull(r, buf[:1])
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+
+		capabilityBuf := make([]byte, buf[0])
+
+		_, err = io.ReadFull(r, capabilityBuf)
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+
+		ar.Capabilities = append(ar.Capabilities, brotatomodtypes.Capability(capabilityBuf))
+	}
+
+	return nil
 }
 
 // AuthResponse
 type AuthResponse struct {
 	SessionToken string `json:"token"`
 	ExpireTime   string `json:"expire_time"`
+
+	ProtocolVersion brotatomodtypes.ProtocolVersion `json:"protocol_version"`
+	Capabilities    []brotatomodtypes.Capability    `json:"capabilities"`
 }
 
-// WriteStream
+// WriteStream format is:
+// - expire time (int64 microsecond epoch)
+// - token length (uint16)
+// - token (variable [uint8, ...])
+// - negotiated protocol version (uint16)
+// - negotiated capability count (uint8)
+// - (for each capability)
+// -- capability length (uint8)
+// -- capability string (variable [uint8, ...])
+// Mods from before versioning stop reading after the token.
 func (ar *AuthResponse) WriteStream(w io.Writer) error {
-	// token len + expire time + token length header
-	buf := make([]byte, 0, len(ar.SessionToken)+8+2)
+	// token len + expire time + token length header + version + capability count
+	buf := make([]byte, 0, len(ar.SessionToken)+8+2+2+1)
 
 	t, err := time.Parse(timeFormat, ar.ExpireTime)
 	if err != nil {
@@ -69,6 +139,13 @@ func (ar *AuthResponse) WriteStream(w io.Writer) error {
 	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(ar.SessionToken)))
 	buf = append(buf, []byte(ar.SessionToken)...)
 
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(ar.ProtocolVersion))
+	buf = append(buf, uint8(len(ar.Capabilities)))
+	for _, capability := range ar.Capabilities {
+		buf = append(buf, uint8(len(capability)))
+		buf = append(buf, capability...)
+	}
+
 	_, err = w.Write(buf)
 	if err != nil {
 		return errutil.NewStackError(err)
@@ -81,40 +158,81 @@ const timeFormat = "2006-01-02T15:04:05Z07:00"
 
 // authenticateUser (no swagger header, this is internal)
 func (api *AuthAPI) authenticateUser(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	exporterserverutil.WriteError(w, func() error {
+	exporterserverutil.WriteError(w, r, func() error {
 		userID, ok := GetUserIDFromCtx(r.Context())
 		if !ok {
-			return exporterserverutil.NewResponseError(nil, http.StatusUnauthorized, "Unauthorized")
+			return exporterserverutil.NewResponseError(nil, http.StatusUnauthorized, exporterserverutil.ErrorCodeUnauthorized, "Unauthorized")
+		}
+
+		authRequest := new(AuthRequest)
+
+		var err error
+		if r.Body != nil {
+			if r.Header.Get("Content-Type") == "application/json" {
+				err = json.NewDecoder(r.Body).Decode(authRequest)
+				if errors.Is(err, io.EOF) {
+					err = nil
+				}
+			} else {
+				err = authRequest.ReadStream(r.Body)
+			}
+		}
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusBadRequest, exporterserverutil.ErrorCodeInvalidBody, "Invalid authenticate request body")
+		}
+
+		protocolVersion, err := brotatoserial.NegotiateProtocolVersion(authRequest.ProtocolVersion)
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusBadRequest, exporterserverutil.ErrorCodeUnsupportedProtocol, fmt.Sprintf(
+				"Unsupported protocol version (%d) - server supports (%d) to (%d)",
+				authRequest.ProtocolVersion, brotatomodtypes.ProtocolVersionMin, brotatomodtypes.ProtocolVersionMax,
+			))
+		}
+
+		capabilities := brotatoserial.NegotiateCapabilities(authRequest.Capabilities)
+
+		user, err := api.exporterStore.GetUserByID(userID)
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to get user")
 		}
 
 		tokenStr, sess, err := NewSessionToken(api.jwtKey, userID)
 		if err != nil {
-			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, "Failed to create session token")
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to create session token")
 		}
 
 		sessInfo := &sessionInfo{
-			Session: sess,
+			Session:         sess,
+			ProtocolVersion: protocolVersion,
+			Capabilities:    capabilities,
 		}
+		sessInfo.CaptureIngest.Store(user.CaptureIngest)
 
 		oldSess, ok := api.sessionInfoMap.Load(userID)
 		if ok {
-			// retain old session message reader
 			// block if something is mid read
 			oldSess.Lock()
 			defer oldSess.Unlock()
 
+			sessInfo.State = oldSess.State
+		} else {
+			sessInfo.State = brotatostate.NewStore()
+		}
+
+		// retain old session message reader unless the mod now speaks a different version, in which case its mapping is meaningless
+		if ok && oldSess.MessageReader.ProtocolVersion() == protocolVersion {
 			sessInfo.MessageReader = oldSess.MessageReader
-			sessInfo.CurrentSessionState = oldSess.CurrentSessionState
 		} else {
-			sessInfo.MessageReader = brotatoserial.NewMessageReader(nil, make([]byte, 1024))
-			sessInfo.CurrentSessionState = make(map[string]json.RawMessage)
+			sessInfo.MessageReader = brotatoserial.NewVersionedMessageReader(protocolVersion, nil, make([]byte, 1024))
 		}
 
 		api.sessionInfoMap.Store(sess.UserID, sessInfo)
 
 		authResponse := &AuthResponse{
-			SessionToken: tokenStr,
-			ExpireTime:   sess.ExpiresAt.Time.Format(timeFormat),
+			SessionToken:    tokenStr,
+			ExpireTime:      sess.ExpiresAt.Time.Format(timeFormat),
+			ProtocolVersion: protocolVersion,
+			Capabilities:    capabilities,
 		}
 
 		if r.Header.Get("Content-Type") == "application/json" {
@@ -122,7 +240,7 @@ func (api *AuthAPI) authenticateUser(w http.ResponseWriter, r *http.Request, _ h
 
 			err = json.NewEncoder(w).Encode(authResponse)
 			if err != nil {
-				return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, "Failed to write JSON")
+				return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to write JSON")
 			}
 
 			return nil
@@ -131,7 +249,7 @@ func (api *AuthAPI) authenticateUser(w http.ResponseWriter, r *http.Request, _ h
 
 		err = authResponse.WriteStream(w)
 		if err != nil {
-			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, "Failed to write stream")
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to write stream")
 		}
 
 		w.WriteHeader(http.StatusOK)
@@ -140,39 +258,83 @@ func (api *AuthAPI) authenticateUser(w http.ResponseWriter, r *http.Request, _ h
 	}())
 }
 
-// ServeHTTPNextCtx "middleware"
-func (api *AuthAPI) ServeHTTPNextCtx(w http.ResponseWriter, r *http.Request) context.Context {
+// Middleware puts the session of a JWT, the user of a Bearer auth key, or the user of a websocket handshake's subscribe
+// ticket in the request context. Requests with an invalid token are rejected, requests without one are left for the
+// handler to refuse.
+func (api *AuthAPI) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ctx context.Context
+		var err error
+		if ticketStr := ticketFromRequest(r); ticketStr != "" && r.Header.Get("Authorization") == "" {
+			ctx, err = api.ticketCtx(r, ticketStr)
+		} else {
+			ctx, err = api.authenticateCtx(r)
+		}
+		if err != nil {
+			exporterserverutil.WriteError(w, r, exporterserverutil.NewResponseError(err, http.StatusUnauthorized, exporterserverutil.ErrorCodeInvalidToken, "Invalid token"))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// authenticateCtx request context with the session or user of the Authorization header, if any.
+func (api *AuthAPI) authenticateCtx(r *http.Request) (context.Context, error) {
 	authHeaderValue := r.Header.Get("Authorization")
-	if authHeaderValue == "" {
-		return r.Context()
-	}
 
-	var nextCtx context.Context
-	if strings.HasPrefix(authHeaderValue, "JWT ") {
+	switch {
+	case strings.HasPrefix(authHeaderValue, "JWT "):
 		tokenString := authHeaderValue[4:] // remove "JWT " prefix
 
 		session, err := ParseSessionToken(api.jwtKey, tokenString)
 		if err != nil {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
-			return r.Context()
+			return nil, errutil.NewStackError(err)
 		}
-		nextCtx = context.WithValue(r.Context(), SessionCtxKey, session)
-	} else if strings.HasPrefix(authHeaderValue, "Bearer ") {
+
+		ctx := context.WithValue(r.Context(), SessionCtxKey, session)
+		return logutil.AddAttrs(ctx, slog.String(logutil.KeyUserID, session.UserID.String()), slog.String(logutil.KeySessionID, session.ID)), nil
+	case strings.HasPrefix(authHeaderValue, "Bearer "):
 		authToken := authHeaderValue[7:] // remove "Bearer " prefix
 
 		userID, err := api.exporterStore.GetUserIDByAuthKey([]byte(authToken))
 		if err != nil {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
-			return r.Context()
+			return nil, errutil.NewStackError(err)
 		}
 
-		nextCtx = context.WithValue(r.Context(), UserIDCtxKeyStr, userID)
-	} else {
-		nextCtx = r.Context()
+		ctx := context.WithValue(r.Context(), UserIDCtxKeyStr, userID)
+		ctx = context.WithValue(ctx, AuthKeyCtxKeyStr, []byte(authToken))
+		return logutil.AddAttrs(ctx, slog.String(logutil.KeyUserID, userID.String())), nil
+	default:
+		return r.Context(), nil
 	}
+}
 
-	api.Router.ServeHTTP(w, r.WithContext(nextCtx))
-	return nextCtx
+// ClientKey who the request is from for rate limiting. The mod's session gets a bucket of its own so overlays polling
+// as the same user can't hold up its posts, other requests count against the user once authenticated, otherwise the
+// remote IP.
+func ClientKey(r *http.Request) string {
+	if sess, ok := GetSessionFromCtx(r.Context()); ok && sess.ID != "" {
+		return "session:" + sess.ID
+	}
+
+	if userID, ok := anyUserIDFromCtx(r.Context()); ok {
+		return "user:" + userID.String()
+	}
+
+	return "ip:" + exporterserverutil.RemoteIP(r)
+}
+
+// anyUserIDFromCtx user of the Bearer token, subscribe ticket or session.
+func anyUserIDFromCtx(ctx context.Context) (uuid.UUID, bool) {
+	if userID, ok := GetSubscriberUserIDFromCtx(ctx); ok {
+		return userID, true
+	}
+	if sess, ok := GetSessionFromCtx(ctx); ok {
+		return sess.UserID, true
+	}
+
+	return uuid.Nil, false
 }
 
 type UserIDCtxKey string
@@ -184,3 +346,13 @@ func GetUserIDFromCtx(ctx context.Context) (uuid.UUID, bool) {
 	userID, ok := ctx.Value(UserIDCtxKeyStr).(uuid.UUID)
 	return userID, ok
 }
+
+type AuthKeyCtxKey string
+
+const AuthKeyCtxKeyStr AuthKeyCtxKey = "auth_key"
+
+// GetAuthKeyFromCtx the provided Bearer token. Only set once the token has been matched to a user.
+func GetAuthKeyFromCtx(ctx context.Context) ([]byte, bool) {
+	authKey, ok := ctx.Value(AuthKeyCtxKeyStr).([]byte)
+	return authKey, ok
+}
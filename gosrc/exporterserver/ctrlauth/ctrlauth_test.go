@@ -1,6 +1,7 @@
 package ctrlauth
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"encoding/json"
@@ -9,13 +10,16 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/exporterserver/exporterserverutil"
 	"github.com/benw10-1/brotato-exporter/exporterstore"
 	"github.com/benw10-1/brotato-exporter/exporterstore/exporterstoretypes"
 	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
 	"github.com/stretchr/testify/require"
 )
 
@@ -45,10 +49,17 @@ func TestAuth(t *testing.T) {
 	err = exporterStore.UpsertAuthKeyUserID(testAuthToken, testUser.UserID)
 	asserter.NoError(err)
 
+	router := httprouter.New()
+	authAPI.RegisterRoutes(router)
+
+	// nextCtx context the middleware passed on, nil if the request was rejected
 	doReq := func(req *http.Request) (nextCtx context.Context, w *httptest.ResponseRecorder) {
 		w = httptest.NewRecorder()
 
-		nextCtx = authAPI.ServeHTTPNextCtx(w, req)
+		authAPI.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			nextCtx = r.Context()
+			router.ServeHTTP(w, r)
+		})).ServeHTTP(w, req)
 
 		return nextCtx, w
 	}
@@ -68,8 +79,14 @@ func TestAuth(t *testing.T) {
 			asserter.NoError(err)
 			req.Header.Set("Authorization", "Bearer invalid")
 
-			_, w = doReq(req)
+			nextCtx, w := doReq(req)
 			asserter.Equal(http.StatusUnauthorized, w.Code)
+			// nothing after auth serves the request
+			asserter.Nil(nextCtx)
+
+			errRes := exporterserverutil.ErrorResponse{}
+			asserter.NoError(json.Unmarshal(w.Body.Bytes(), &errRes))
+			asserter.Equal(exporterserverutil.ErrorCodeInvalidToken, errRes.Error.Code)
 		})
 
 		t.Run("TestValidToken", func(t *testing.T) {
@@ -101,9 +118,14 @@ func TestAuth(t *testing.T) {
 
 			bytesLen := binary.LittleEndian.Uint16(sessionTokenStreamBytes[8:10])
 
-			asserter.Equal(len(sessionTokenStreamBytes), 10+int(bytesLen))
+			// token followed by negotiated version and empty capability list
+			asserter.Equal(len(sessionTokenStreamBytes), 10+int(bytesLen)+3)
+
+			sessionToken := sessionTokenStreamBytes[10 : 10+int(bytesLen)]
 
-			sessionToken := sessionTokenStreamBytes[10:]
+			protocolVersion := brotatomodtypes.ProtocolVersion(binary.LittleEndian.Uint16(sessionTokenStreamBytes[10+int(bytesLen):]))
+			asserter.Equal(brotatomodtypes.ProtocolVersionLegacy, protocolVersion)
+			asserter.Equal(uint8(0), sessionTokenStreamBytes[len(sessionTokenStreamBytes)-1])
 
 			sess, ok := sessionInfoMap.Load(testUser.UserID)
 			asserter.True(ok)
@@ -112,6 +134,8 @@ func TestAuth(t *testing.T) {
 			asserter.NoError(err)
 
 			asserter.Equal(sess.Session.UserID, sessRes.UserID)
+			asserter.NotEmpty(sessRes.ID)
+			asserter.Equal(sess.Session.ID, sessRes.ID)
 
 			// test JSON output
 
@@ -139,6 +163,42 @@ func TestAuth(t *testing.T) {
 			asserter.Equal(sess.Session.UserID, sessRes.UserID)
 		})
 
+		t.Run("TestProtocolHandshake", func(t *testing.T) {
+			asserter := require.New(t)
+
+			// binary request asking for the newest version and a capability the server does not know about
+			reqBody := binary.LittleEndian.AppendUint16(nil, uint16(brotatomodtypes.ProtocolVersionMax))
+			reqBody = append(reqBody, 1, uint8(len("not_a_capability")))
+			reqBody = append(reqBody, "not_a_capability"...)
+
+			req, err := http.NewRequest("POST", "/api/auth/authenticate", bytes.NewReader(reqBody))
+			asserter.NoError(err)
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", testAuthToken))
+			req.Header.Set("Content-Type", "application/octet-stream")
+
+			_, w := doReq(req)
+			asserter.Equal(http.StatusOK, w.Code)
+
+			sess, ok := sessionInfoMap.Load(testUser.UserID)
+			asserter.True(ok)
+			asserter.Equal(brotatomodtypes.ProtocolVersionMax, sess.ProtocolVersion)
+			asserter.Equal(brotatomodtypes.ProtocolVersionMax, sess.MessageReader.ProtocolVersion())
+			asserter.Empty(sess.Capabilities)
+
+			// mod newer than the server is rejected rather than downgraded, it may not speak older versions
+			req, err = http.NewRequest("POST", "/api/auth/authenticate", strings.NewReader(fmt.Sprintf(`{"protocol_version": %d}`, brotatomodtypes.ProtocolVersionMax+1)))
+			asserter.NoError(err)
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", testAuthToken))
+			req.Header.Set("Content-Type", "application/json")
+
+			_, w = doReq(req)
+			asserter.Equal(http.StatusBadRequest, w.Code)
+
+			errRes := exporterserverutil.ErrorResponse{}
+			asserter.NoError(json.Unmarshal(w.Body.Bytes(), &errRes))
+			asserter.Equal(exporterserverutil.ErrorCodeUnsupportedProtocol, errRes.Error.Code)
+		})
+
 		t.Run("TestExpiredToken", func(t *testing.T) {
 			asserter := require.New(t)
 
@@ -162,8 +222,7 @@ func TestAuth(t *testing.T) {
 
 			req.Header.Set("Authorization", fmt.Sprintf("JWT %s", authResponse.SessionToken))
 
-			nextCtx, w := doReq(req)
-			asserter.Equal(http.StatusOK, w.Code)
+			nextCtx, _ := doReq(req)
 
 			sess, ok := GetSessionFromCtx(nextCtx)
 			asserter.True(ok)
@@ -171,4 +230,155 @@ func TestAuth(t *testing.T) {
 			asserter.Equal(testUser.UserID, sess.UserID)
 		})
 	})
+
+	t.Run("TestClientKey", func(t *testing.T) {
+		asserter := require.New(t)
+
+		req, err := http.NewRequest(http.MethodPost, "/api/auth/authenticate", nil)
+		asserter.NoError(err)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", testAuthToken))
+		req.Header.Set("Content-Type", "application/json")
+
+		nextCtx, w := doReq(req)
+		asserter.Equal(http.StatusOK, w.Code)
+		asserter.Equal("user:"+testUser.UserID.String(), ClientKey(req.WithContext(nextCtx)))
+
+		authResponse := new(AuthResponse)
+		asserter.NoError(json.Unmarshal(w.Body.Bytes(), authResponse))
+
+		// the mod's session doesn't share the user's bucket
+		req, err = http.NewRequest(http.MethodPost, "/", nil)
+		asserter.NoError(err)
+		req.Header.Set("Authorization", fmt.Sprintf("JWT %s", authResponse.SessionToken))
+
+		nextCtx, _ = doReq(req)
+		sess, ok := GetSessionFromCtx(nextCtx)
+		asserter.True(ok)
+		asserter.Equal("session:"+sess.ID, ClientKey(req.WithContext(nextCtx)))
+
+		req, err = http.NewRequest(http.MethodGet, "/", nil)
+		asserter.NoError(err)
+		req.RemoteAddr = "192.0.2.1:1234"
+
+		nextCtx, _ = doReq(req)
+		asserter.Equal("ip:192.0.2.1", ClientKey(req.WithContext(nextCtx)))
+	})
+
+	t.Run("TestSubscribeTicket", func(t *testing.T) {
+		// handshake websocket handshake to the subscribe endpoint, with the ticket in the subprotocols
+		handshake := func(asserter *require.Assertions, query string, subprotocols ...string) *http.Request {
+			req, err := http.NewRequest(http.MethodGet, "/api/message/subscribe"+query, nil)
+			asserter.NoError(err)
+
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			if len(subprotocols) > 0 {
+				req.Header.Set("Sec-WebSocket-Protocol", strings.Join(subprotocols, ", "))
+			}
+
+			return req
+		}
+
+		newTicket := func(asserter *require.Assertions) string {
+			req, err := http.NewRequest(http.MethodGet, "/api/auth/subscribe-ticket", nil)
+			asserter.NoError(err)
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", testAuthToken))
+
+			_, w := doReq(req)
+			asserter.Equal(http.StatusOK, w.Code)
+
+			ticketRes := new(SubscribeTicketResponse)
+			asserter.NoError(json.Unmarshal(w.Body.Bytes(), ticketRes))
+			asserter.NotEmpty(ticketRes.Ticket)
+
+			return ticketRes.Ticket
+		}
+
+		t.Run("TestSingleUse", func(t *testing.T) {
+			asserter := require.New(t)
+
+			ticket := newTicket(asserter)
+
+			nextCtx, _ := doReq(handshake(asserter, "?"+TicketQueryParam+"="+ticket))
+
+			userID, ok := GetSubscriberUserIDFromCtx(nextCtx)
+			asserter.True(ok)
+			asserter.Equal(testUser.UserID, userID)
+
+			// only good for subscribing
+			_, ok = GetUserIDFromCtx(nextCtx)
+			asserter.False(ok)
+
+			nextCtx, w := doReq(handshake(asserter, "?"+TicketQueryParam+"="+ticket))
+			asserter.Nil(nextCtx)
+			asserter.Equal(http.StatusUnauthorized, w.Code)
+		})
+
+		t.Run("TestSubprotocol", func(t *testing.T) {
+			asserter := require.New(t)
+
+			nextCtx, _ := doReq(handshake(asserter, "", WebsocketSubprotocol, TicketSubprotocolPrefix+newTicket(asserter)))
+
+			userID, ok := GetSubscriberUserIDFromCtx(nextCtx)
+			asserter.True(ok)
+			asserter.Equal(testUser.UserID, userID)
+		})
+
+		t.Run("TestExpired", func(t *testing.T) {
+			asserter := require.New(t)
+
+			ticket, _, err := authAPI.subscribeTicketStore.Issue(testUser.UserID, nil, -time.Second)
+			asserter.NoError(err)
+
+			nextCtx, w := doReq(handshake(asserter, "?"+TicketQueryParam+"="+ticket))
+			asserter.Nil(nextCtx)
+			asserter.Equal(http.StatusUnauthorized, w.Code)
+		})
+
+		t.Run("TestNotWebsocket", func(t *testing.T) {
+			asserter := require.New(t)
+
+			req, err := http.NewRequest(http.MethodGet, "/api/message/capture?"+TicketQueryParam+"="+newTicket(asserter), nil)
+			asserter.NoError(err)
+
+			// ignored outside of websocket handshakes
+			nextCtx, _ := doReq(req)
+			_, ok := GetSubscriberUserIDFromCtx(nextCtx)
+			asserter.False(ok)
+		})
+	})
+}
+
+func TestTicketStore(t *testing.T) {
+	asserter := require.New(t)
+
+	ticketStore := NewTicketStore()
+	userID := uuid.New()
+
+	ticketStr, ticket, err := ticketStore.Issue(userID, []byte("key"), time.Minute)
+	asserter.NoError(err)
+	asserter.Equal(userID, ticket.UserID)
+
+	redeemed, ok := ticketStore.Redeem(ticketStr)
+	asserter.True(ok)
+	asserter.Equal(ticket, redeemed)
+
+	_, ok = ticketStore.Redeem(ticketStr)
+	asserter.False(ok)
+
+	_, ok = ticketStore.Redeem("unknown")
+	asserter.False(ok)
+
+	expiredStr, _, err := ticketStore.Issue(userID, nil, -time.Second)
+	asserter.NoError(err)
+
+	_, ok = ticketStore.Redeem(expiredStr)
+	asserter.False(ok)
+
+	// tickets never redeemed are cleared out by later issues
+	_, _, err = ticketStore.Issue(userID, nil, -time.Second)
+	asserter.NoError(err)
+	_, _, err = ticketStore.Issue(userID, nil, time.Minute)
+	asserter.NoError(err)
+	asserter.Len(ticketStore.ticketMap, 1)
 }
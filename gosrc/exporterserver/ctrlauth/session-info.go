@@ -2,11 +2,13 @@ package ctrlauth
 
 import (
 	"context"
-	"encoding/json"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
 	"github.com/benw10-1/brotato-exporter/brotatomod/brotatoserial"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatostate"
 	"github.com/benw10-1/brotato-exporter/errutil"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
@@ -30,6 +32,8 @@ func NewSessionToken(authKey []byte, userID uuid.UUID) (tokenStr string, sess *S
 	sess = &Session{
 		UserID: userID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			// identifies the session in logs
+			ID:        uuid.NewString(),
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expirationDuration)),
 		},
 	}
@@ -84,8 +88,16 @@ type sessionInfo struct {
 
 	MessageReader *brotatoserial.BrotatoMessageReader
 
-	// CurrentSessionState mapped keys to their values
-	CurrentSessionState map[string]json.RawMessage
+	// ProtocolVersion negotiated wire format version for messages posted in this session.
+	ProtocolVersion brotatomodtypes.ProtocolVersion
+	// Capabilities negotiated optional features for this session.
+	Capabilities []brotatomodtypes.Capability
+
+	// State mapped keys to their values, carried over when the mod authenticates again.
+	State *brotatostate.Store
+
+	// CaptureIngest copy of the user's ExporterUser.CaptureIngest, so posts don't have to look the user up.
+	CaptureIngest atomic.Bool
 
 	// lock to handle edge-case where next message is sent before the previous message has finished reading.
 	// If its just 1 thread htting this lock it will just be a CAS so this does not impact performance too much.
@@ -0,0 +1,105 @@
+package ctrlauth
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/errutil"
+	"github.com/benw10-1/brotato-exporter/exporterserver/exporterserverutil"
+	"github.com/benw10-1/brotato-exporter/logutil"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+)
+
+const subscribeTicketDuration = time.Second * 30
+
+const (
+	// TicketQueryParam websocket handshakes may pass a subscribe ticket as ?ticket=.
+	TicketQueryParam = "ticket"
+	// WebsocketSubprotocol offered alongside a TicketSubprotocolPrefix subprotocol, so there is one for the server to accept.
+	WebsocketSubprotocol = "brotato-exporter"
+	// TicketSubprotocolPrefix websocket handshakes may pass a subscribe ticket as a "ticket.<ticket>" subprotocol, which
+	// unlike the query is never in a URL.
+	TicketSubprotocolPrefix = "ticket."
+)
+
+// SubscribeTicketResponse
+type SubscribeTicketResponse struct {
+	Ticket     string `json:"ticket"`
+	ExpireTime string `json:"expire_time"`
+}
+
+// subscribeTicket issues a single use ticket that authenticates one websocket handshake as the user, for browsers which
+// can't set the Authorization header on one.
+func (api *AuthAPI) subscribeTicket(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	exporterserverutil.WriteError(w, r, func() error {
+		userID, ok := GetUserIDFromCtx(r.Context())
+		if !ok {
+			return exporterserverutil.NewResponseError(nil, http.StatusUnauthorized, exporterserverutil.ErrorCodeUnauthorized, "Unauthorized")
+		}
+
+		// no auth key, the ticket only stands in for the user
+		ticketStr, ticket, err := api.subscribeTicketStore.Issue(userID, nil, subscribeTicketDuration)
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to create ticket")
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+
+		err = json.NewEncoder(w).Encode(&SubscribeTicketResponse{
+			Ticket:     ticketStr,
+			ExpireTime: ticket.ExpiresAt.Format(timeFormat),
+		})
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to write JSON")
+		}
+
+		return nil
+	}())
+}
+
+// ticketFromRequest subscribe ticket of a websocket handshake, from the subprotocols or the query. Empty if there is none.
+func ticketFromRequest(r *http.Request) string {
+	if !websocket.IsWebSocketUpgrade(r) {
+		return ""
+	}
+
+	for _, subprotocol := range websocket.Subprotocols(r) {
+		ticketStr, ok := strings.CutPrefix(subprotocol, TicketSubprotocolPrefix)
+		if ok {
+			return ticketStr
+		}
+	}
+
+	return r.URL.Query().Get(TicketQueryParam)
+}
+
+// ticketCtx request context as the user of the ticket, which is used up.
+func (api *AuthAPI) ticketCtx(r *http.Request, ticketStr string) (context.Context, error) {
+	ticket, ok := api.subscribeTicketStore.Redeem(ticketStr)
+	if !ok {
+		return nil, errutil.NewStackErrorf("subscribe ticket is invalid, used or expired")
+	}
+
+	// not UserIDCtxKeyStr, the ticket is only good for subscribing
+	ctx := context.WithValue(r.Context(), TicketUserIDCtxKeyStr, ticket.UserID)
+	return logutil.AddAttrs(ctx, slog.String(logutil.KeyUserID, ticket.UserID.String())), nil
+}
+
+const TicketUserIDCtxKeyStr UserIDCtxKey = "ticket_user_id"
+
+// GetSubscriberUserIDFromCtx user of the Bearer token or subscribe ticket.
+func GetSubscriberUserIDFromCtx(ctx context.Context) (uuid.UUID, bool) {
+	if userID, ok := GetUserIDFromCtx(ctx); ok {
+		return userID, true
+	}
+
+	userID, ok := ctx.Value(TicketUserIDCtxKeyStr).(uuid.UUID)
+	return userID, ok
+}
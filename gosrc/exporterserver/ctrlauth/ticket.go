@@ -0,0 +1,84 @@
+package ctrlauth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/errutil"
+	"github.com/google/uuid"
+)
+
+// Ticket short-lived single use stand-in for a user's auth key. Lets a link be handed out without exposing the key itself.
+type Ticket struct {
+	UserID    uuid.UUID
+	AuthKey   []byte
+	ExpiresAt time.Time
+}
+
+// TicketStore in-memory store of issued tickets. Tickets do not survive a restart which is fine given how short-lived they are.
+type TicketStore struct {
+	ticketMap map[string]Ticket
+
+	mu sync.Mutex
+}
+
+// NewTicketStore
+func NewTicketStore() *TicketStore {
+	return &TicketStore{
+		ticketMap: make(map[string]Ticket),
+	}
+}
+
+// Issue creates a new ticket for the user valid for ttl.
+func (ts *TicketStore) Issue(userID uuid.UUID, authKey []byte, ttl time.Duration) (string, Ticket, error) {
+	ticketRaw := make([]byte, 32)
+
+	_, err := rand.Read(ticketRaw)
+	if err != nil {
+		return "", Ticket{}, errutil.NewStackError(err)
+	}
+
+	ticketStr := base64.RawURLEncoding.EncodeToString(ticketRaw)
+
+	ticket := Ticket{
+		UserID:    userID,
+		AuthKey:   authKey,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	// piggyback off of issuing to clear out anything that was never redeemed
+	now := time.Now()
+	for k, v := range ts.ticketMap {
+		if now.After(v.ExpiresAt) {
+			delete(ts.ticketMap, k)
+		}
+	}
+
+	ts.ticketMap[ticketStr] = ticket
+
+	return ticketStr, ticket, nil
+}
+
+// Redeem consumes the ticket. Returns false if the ticket does not exist, was already redeemed, or has expired.
+func (ts *TicketStore) Redeem(ticketStr string) (Ticket, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ticket, ok := ts.ticketMap[ticketStr]
+	if !ok {
+		return Ticket{}, false
+	}
+
+	delete(ts.ticketMap, ticketStr)
+
+	if time.Now().After(ticket.ExpiresAt) {
+		return Ticket{}, false
+	}
+
+	return ticket, true
+}
@@ -0,0 +1,65 @@
+package ctrldashboard
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// DashboardPath where the dashboard is served, / redirects here.
+const DashboardPath = "/dashboard/"
+
+// dashboardFiles the dashboard web app. Everything it needs is in here, it loads nothing from other hosts.
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// DashboardFS dashboard files rooted at index.html.
+func DashboardFS() fs.FS {
+	dashboardFS, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		// only fails on an invalid path which is constant
+		panic(err)
+	}
+
+	return dashboardFS
+}
+
+// DashboardAPI serves the dashboard. The page is public, it asks for an auth key and calls the API with it like any
+// other client.
+type DashboardAPI struct {
+	fileServer http.Handler
+}
+
+// NewDashboardAPI dashboardFS is usually DashboardFS, or a directory of the same files while working on them.
+func NewDashboardAPI(dashboardFS fs.FS) *DashboardAPI {
+	return &DashboardAPI{
+		fileServer: http.FileServerFS(dashboardFS),
+	}
+}
+
+// RegisterRoutes
+func (api *DashboardAPI) RegisterRoutes(router *httprouter.Router) {
+	router.GET("/", api.redirect)
+	router.GET(DashboardPath+"*filepath", api.serveFile)
+}
+
+// redirect
+func (api *DashboardAPI) redirect(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	http.Redirect(w, r, DashboardPath, http.StatusFound)
+}
+
+// serveFile
+func (api *DashboardAPI) serveFile(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	// scripts, styles and connections from this server only, the subscribe websocket included
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; img-src 'self' data:; object-src 'none'; base-uri 'none'; frame-ancestors 'none'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	// revalidated so a new server version is picked up straight away
+	w.Header().Set("Cache-Control", "no-cache")
+
+	r.URL.Path = params.ByName("filepath")
+	api.fileServer.ServeHTTP(w, r)
+}
@@ -0,0 +1,68 @@
+package ctrldashboard
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDashboard(t *testing.T) {
+	asserter := require.New(t)
+
+	router := httprouter.New()
+	NewDashboardAPI(DashboardFS()).RegisterRoutes(router)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+
+		return w
+	}
+
+	w := get("/")
+	asserter.Equal(http.StatusFound, w.Code)
+	asserter.Equal(DashboardPath, w.Header().Get("Location"))
+
+	w = get(DashboardPath)
+	asserter.Equal(http.StatusOK, w.Code)
+	asserter.Contains(w.Header().Get("Content-Type"), "text/html")
+	asserter.Contains(w.Header().Get("Content-Security-Policy"), "default-src 'self'")
+	asserter.Contains(w.Body.String(), `src="app.js"`)
+
+	w = get(DashboardPath + "app.js")
+	asserter.Equal(http.StatusOK, w.Code)
+	asserter.Contains(w.Header().Get("Content-Type"), "javascript")
+
+	asserter.Equal(http.StatusNotFound, get(DashboardPath+"missing.js").Code)
+}
+
+func TestDashboardOffline(t *testing.T) {
+	asserter := require.New(t)
+
+	// the SVG namespace is an identifier, not something that is loaded
+	externalURL := regexp.MustCompile(`(https?:)?//[a-zA-Z0-9.-]+\.[a-z]{2,}[^\s"'()]*`)
+	allowedURL := "http://www.w3.org/2000/svg"
+
+	err := fs.WalkDir(DashboardFS(), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		contents, err := fs.ReadFile(DashboardFS(), path)
+		if err != nil {
+			return err
+		}
+
+		for _, match := range externalURL.FindAllString(string(contents), -1) {
+			asserter.Equal(allowedURL, match, "%s loads from another host", path)
+		}
+
+		return nil
+	})
+	asserter.NoError(err)
+}
@@ -0,0 +1,491 @@
+"use strict";
+
+// keys shown live, in the subscribe/current-state key pattern syntax
+const LIVE_KEYS = "current_*,effects_stat_*,gold";
+const AUTH_KEY_STORAGE = "brotato-exporter-auth-key";
+const STAT_PREFIX = "effects_stat_";
+const DEFAULT_CHART_STATS = ["effects_stat_max_hp", "current_level"];
+const RUN_LIST_LIMIT = 50;
+const MAX_RECONNECT_DELAY_MS = 30000;
+
+const el = (id) => document.getElementById(id);
+const svgNS = "http://www.w3.org/2000/svg";
+
+let authKey = "";
+// state current values of LIVE_KEYS, as the server has them
+let state = {};
+let socket = null;
+let reconnectDelayMs = 1000;
+let reconnectTimer = 0;
+let runsRefreshTimer = 0;
+let selectedRunID = "";
+let selectedRun = null;
+let selectedStat = "";
+
+// ApiError error response of the API, see the Error schema in swagger.yaml
+class ApiError extends Error {
+  constructor(status, code, message) {
+    super(message);
+    this.status = status;
+    this.code = code;
+  }
+}
+
+// api GETs path with the auth key, resolving to the JSON body
+async function api(path) {
+  const res = await fetch(path, { headers: { Authorization: "Bearer " + authKey } });
+  if (res.ok) {
+    return res.json();
+  }
+
+  let code = "";
+  let message = res.statusText;
+  try {
+    const body = await res.json();
+    code = body.error.code;
+    message = body.error.message;
+  } catch (_) {
+    // not a JSON error, keep the status text
+  }
+
+  const err = new ApiError(res.status, code, message);
+  if (res.status === 401) {
+    signOut("The auth key was not accepted.");
+  }
+  throw err;
+}
+
+// labels
+
+function statLabel(key) {
+  let label = key;
+  if (label.startsWith(STAT_PREFIX)) {
+    label = label.slice(STAT_PREFIX.length);
+  } else if (label.startsWith("current_")) {
+    label = label.slice("current_".length);
+  }
+
+  label = label.replace(/_/g, " ");
+  return label.charAt(0).toUpperCase() + label.slice(1);
+}
+
+function characterName(character) {
+  if (!character || character === "-") {
+    return "-";
+  }
+
+  return character
+    .replace(/^character_/, "")
+    .split("_")
+    .map((word) => word.charAt(0).toUpperCase() + word.slice(1))
+    .join(" ");
+}
+
+function formatNumber(value) {
+  if (typeof value !== "number") {
+    return value === undefined || value === null ? "-" : String(value);
+  }
+
+  return Number.isInteger(value) ? String(value) : value.toFixed(2).replace(/\.?0+$/, "");
+}
+
+function formatTime(timeStr) {
+  return timeStr ? new Date(timeStr).toLocaleString() : "";
+}
+
+// current run
+
+function renderCurrent() {
+  const character = state.current_character;
+  const inRun = character !== undefined && character !== "-";
+
+  el("no-session").hidden = inRun;
+  el("current").hidden = !inRun;
+  if (!inRun) {
+    return;
+  }
+
+  el("character").textContent = characterName(character);
+  el("level").textContent = formatNumber(state.current_level);
+  el("xp").textContent = formatNumber(typeof state.current_xp === "number" ? Math.floor(state.current_xp) : state.current_xp);
+  el("gold").textContent = formatNumber(state.gold);
+
+  const health = state.current_health;
+  const maxHealth = state.effects_stat_max_hp;
+  el("health").textContent = formatNumber(health) + " / " + formatNumber(maxHealth);
+  const fraction = typeof health === "number" && typeof maxHealth === "number" && maxHealth > 0 ? health / maxHealth : 0;
+  el("health-fill").style.width = Math.max(0, Math.min(1, fraction)) * 100 + "%";
+
+  const statKeys = Object.keys(state)
+    .filter((key) => key.startsWith(STAT_PREFIX) && typeof state[key] === "number")
+    .sort((a, b) => statLabel(a).localeCompare(statLabel(b)));
+
+  const rows = statKeys.map((key) => {
+    const row = document.createElement("tr");
+    const name = document.createElement("td");
+    const value = document.createElement("td");
+    name.textContent = statLabel(key);
+    value.textContent = formatNumber(state[key]);
+    row.append(name, value);
+    return row;
+  });
+  el("stats").replaceChildren(...rows);
+}
+
+async function loadCurrentState() {
+  try {
+    state = await api("/api/message/current-state?keys=" + encodeURIComponent(LIVE_KEYS));
+  } catch (err) {
+    if (!(err instanceof ApiError) || err.code !== "session_not_found") {
+      throw err;
+    }
+    state = {};
+  }
+
+  renderCurrent();
+}
+
+// applyChanges merges a subscribe message, removed keys are null
+function applyChanges(changes) {
+  for (const [key, value] of Object.entries(changes)) {
+    if (value === null) {
+      delete state[key];
+    } else {
+      state[key] = value;
+    }
+  }
+
+  renderCurrent();
+
+  // the character is sent as runs start, waves end and on leaving to the title screen
+  if ("current_character" in changes) {
+    scheduleRunsRefresh();
+  }
+}
+
+function setConnection(text, live) {
+  const connection = el("connection");
+  connection.hidden = false;
+  connection.textContent = text;
+  connection.className = "connection " + (live ? "live" : "down");
+}
+
+// connect subscribes to live changes, with a ticket as browsers can't set the Authorization header on a websocket
+async function connect() {
+  clearTimeout(reconnectTimer);
+
+  let ticket;
+  try {
+    ticket = (await api("/api/auth/subscribe-ticket")).ticket;
+  } catch (_) {
+    if (authKey) {
+      scheduleReconnect("Offline");
+    }
+    return;
+  }
+  // signed out while the ticket was on its way
+  if (!authKey) {
+    return;
+  }
+
+  const scheme = location.protocol === "https:" ? "wss:" : "ws:";
+  const url = scheme + "//" + location.host + "/api/message/subscribe?keys=" + encodeURIComponent(LIVE_KEYS);
+
+  const ws = new WebSocket(url, ["brotato-exporter", "ticket." + ticket]);
+  socket = ws;
+
+  // changes received while the state is reloaded, applied on top of it as it may be older than them
+  let pendingChanges = [];
+
+  ws.onopen = () => {
+    reconnectDelayMs = 1000;
+    setConnection("Live", true);
+    // anything changed before the socket opened
+    loadCurrentState()
+      .catch(() => {})
+      .finally(() => {
+        pendingChanges.forEach(applyChanges);
+        pendingChanges = null;
+      });
+  };
+
+  ws.onmessage = (event) => {
+    let changes;
+    try {
+      changes = JSON.parse(event.data);
+    } catch (_) {
+      // ignore anything that isn't a change set
+      return;
+    }
+
+    if (pendingChanges) {
+      pendingChanges.push(changes);
+    } else {
+      applyChanges(changes);
+    }
+  };
+
+  ws.onclose = (event) => {
+    if (socket !== ws) {
+      return;
+    }
+    socket = null;
+
+    let reason = "Disconnected";
+    try {
+      reason = JSON.parse(event.reason).error.message;
+    } catch (_) {
+      // no JSON close reason
+    }
+    scheduleReconnect(reason);
+  };
+}
+
+function scheduleReconnect(reason) {
+  setConnection(reason + ", reconnecting...", false);
+
+  clearTimeout(reconnectTimer);
+  reconnectTimer = setTimeout(connect, reconnectDelayMs);
+  reconnectDelayMs = Math.min(reconnectDelayMs * 2, MAX_RECONNECT_DELAY_MS);
+}
+
+// past runs
+
+function scheduleRunsRefresh() {
+  clearTimeout(runsRefreshTimer);
+  runsRefreshTimer = setTimeout(() => loadRuns().catch(() => {}), 1000);
+}
+
+async function loadRuns() {
+  const res = await api("/api/runs?limit=" + RUN_LIST_LIMIT);
+
+  el("no-runs").hidden = res.runs.length > 0;
+
+  const items = res.runs.map((run) => {
+    const item = document.createElement("li");
+    const button = document.createElement("button");
+    button.type = "button";
+    button.dataset.runId = run.run_id;
+    button.classList.toggle("selected", run.run_id === selectedRunID);
+
+    const title = document.createElement("span");
+    title.textContent = characterName(run.character) + " - " + formatTime(run.start_time);
+    const outcome = document.createElement("span");
+    outcome.className = "outcome";
+    outcome.textContent = run.outcome + ", " + run.wave_count + (run.wave_count === 1 ? " wave" : " waves");
+
+    button.append(title, outcome);
+    button.addEventListener("click", () => selectRun(run.run_id).catch(() => {}));
+    item.append(button);
+    return item;
+  });
+  el("run-list").replaceChildren(...items);
+
+  if (!selectedRunID && res.runs.length > 0) {
+    await selectRun(res.runs[0].run_id);
+  } else if (selectedRunID) {
+    await selectRun(selectedRunID);
+  }
+}
+
+async function selectRun(runID) {
+  selectedRunID = runID;
+  for (const button of el("run-list").querySelectorAll("button")) {
+    button.classList.toggle("selected", button.dataset.runId === runID);
+  }
+
+  try {
+    selectedRun = await api("/api/runs/" + encodeURIComponent(runID));
+  } catch (err) {
+    if (err instanceof ApiError && err.status === 404) {
+      // pruned since the list was loaded
+      selectedRunID = "";
+      selectedRun = null;
+      el("run-detail").hidden = true;
+      return;
+    }
+    throw err;
+  }
+
+  renderRun();
+}
+
+function renderRun() {
+  const run = selectedRun;
+  el("run-detail").hidden = false;
+  el("run-title").textContent = characterName(run.character);
+
+  let meta = "Started " + formatTime(run.start_time) + ", " + run.outcome;
+  if (run.end_time) {
+    meta += " " + formatTime(run.end_time);
+  }
+  el("run-meta").textContent = meta;
+
+  const statKeys = new Set();
+  for (const wave of run.waves) {
+    Object.keys(wave.stats).forEach((key) => statKeys.add(key));
+  }
+  const sortedKeys = [...statKeys].sort((a, b) => statLabel(a).localeCompare(statLabel(b)));
+
+  if (!statKeys.has(selectedStat)) {
+    selectedStat = DEFAULT_CHART_STATS.find((key) => statKeys.has(key)) || sortedKeys[0] || "";
+  }
+
+  const options = sortedKeys.map((key) => {
+    const option = document.createElement("option");
+    option.value = key;
+    option.textContent = statLabel(key);
+    option.selected = key === selectedStat;
+    return option;
+  });
+  el("run-stat").replaceChildren(...options);
+
+  el("run-no-waves").hidden = run.waves.length > 0;
+  el("run-chart").hidden = run.waves.length === 0;
+
+  renderChart(run.waves, selectedStat);
+}
+
+function svgElement(name, attrs, text) {
+  const node = document.createElementNS(svgNS, name);
+  for (const [attr, value] of Object.entries(attrs)) {
+    node.setAttribute(attr, value);
+  }
+  if (text !== undefined) {
+    node.textContent = text;
+  }
+  return node;
+}
+
+// renderChart line of the stat's value at the end of each wave
+function renderChart(waves, stat) {
+  const chart = el("run-chart");
+  const width = 600;
+  const height = 260;
+  const pad = { left: 48, right: 16, top: 16, bottom: 32 };
+
+  const points = waves
+    .filter((wave) => typeof wave.stats[stat] === "number")
+    .map((wave) => ({ wave: wave.wave, value: wave.stats[stat] }));
+
+  const nodes = [];
+  if (points.length === 0) {
+    chart.replaceChildren();
+    return;
+  }
+
+  let minValue = Math.min(...points.map((p) => p.value));
+  let maxValue = Math.max(...points.map((p) => p.value));
+  if (minValue === maxValue) {
+    minValue -= 1;
+    maxValue += 1;
+  }
+  const minWave = points[0].wave;
+  const maxWave = Math.max(points[points.length - 1].wave, minWave + 1);
+
+  const x = (wave) => pad.left + ((wave - minWave) / (maxWave - minWave)) * (width - pad.left - pad.right);
+  const y = (value) => height - pad.bottom - ((value - minValue) / (maxValue - minValue)) * (height - pad.top - pad.bottom);
+
+  const yTicks = 4;
+  for (let i = 0; i <= yTicks; i++) {
+    const value = minValue + ((maxValue - minValue) * i) / yTicks;
+    nodes.push(svgElement("line", { class: "axis", x1: pad.left, x2: width - pad.right, y1: y(value), y2: y(value) }));
+    nodes.push(svgElement("text", { x: pad.left - 6, y: y(value) + 4, "text-anchor": "end" }, formatNumber(Math.round(value * 100) / 100)));
+  }
+
+  const xStep = Math.max(1, Math.ceil((maxWave - minWave + 1) / 20));
+  for (let wave = minWave; wave <= maxWave; wave += xStep) {
+    nodes.push(svgElement("text", { x: x(wave), y: height - pad.bottom + 16, "text-anchor": "middle" }, String(wave)));
+  }
+  nodes.push(svgElement("text", { x: width - pad.right, y: height - 4, "text-anchor": "end" }, "wave"));
+
+  nodes.push(svgElement("polyline", { class: "line", points: points.map((p) => x(p.wave) + "," + y(p.value)).join(" ") }));
+
+  for (const p of points) {
+    const point = svgElement("circle", { class: "point", cx: x(p.wave), cy: y(p.value), r: 3.5 });
+    point.append(svgElement("title", {}, "Wave " + p.wave + ": " + formatNumber(p.value)));
+    nodes.push(point);
+  }
+
+  chart.setAttribute("aria-label", statLabel(stat) + " per wave");
+  chart.replaceChildren(...nodes);
+}
+
+// auth
+
+function storedAuthKey() {
+  return sessionStorage.getItem(AUTH_KEY_STORAGE) || localStorage.getItem(AUTH_KEY_STORAGE) || "";
+}
+
+function signOut(message) {
+  authKey = "";
+  sessionStorage.removeItem(AUTH_KEY_STORAGE);
+  localStorage.removeItem(AUTH_KEY_STORAGE);
+
+  clearTimeout(reconnectTimer);
+  if (socket) {
+    const ws = socket;
+    socket = null;
+    ws.close();
+  }
+
+  state = {};
+  selectedRunID = "";
+  selectedRun = null;
+
+  el("dashboard").hidden = true;
+  el("sign-out").hidden = true;
+  el("connection").hidden = true;
+  el("sign-in").hidden = false;
+  el("sign-in-error").hidden = !message;
+  el("sign-in-error").textContent = message || "";
+}
+
+async function start() {
+  el("sign-in").hidden = true;
+  el("sign-in-error").hidden = true;
+  el("dashboard").hidden = false;
+  el("sign-out").hidden = false;
+
+  try {
+    await loadCurrentState();
+    await loadRuns();
+  } catch (err) {
+    // a rejected key signs out, anything else is shown and the subscription keeps retrying
+    if (!authKey) {
+      return;
+    }
+    setConnection(err.message, false);
+  }
+
+  connect();
+}
+
+el("sign-in-form").addEventListener("submit", (event) => {
+  event.preventDefault();
+
+  authKey = el("auth-key").value.trim();
+  el("auth-key").value = "";
+
+  // the session's storage unless asked to remember
+  const storage = el("remember").checked ? localStorage : sessionStorage;
+  storage.setItem(AUTH_KEY_STORAGE, authKey);
+
+  start();
+});
+
+el("sign-out").addEventListener("click", () => signOut(""));
+
+el("run-stat").addEventListener("change", (event) => {
+  selectedStat = event.target.value;
+  if (selectedRun) {
+    renderChart(selectedRun.waves, selectedStat);
+  }
+});
+
+authKey = storedAuthKey();
+if (authKey) {
+  start();
+} else {
+  signOut("");
+}
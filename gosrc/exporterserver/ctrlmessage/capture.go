@@ -0,0 +1,281 @@
+package ctrlmessage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatocapture"
+	"github.com/benw10-1/brotato-exporter/errutil"
+	"github.com/benw10-1/brotato-exporter/exporterserver/ctrlauth"
+	"github.com/benw10-1/brotato-exporter/exporterserver/exporterserverutil"
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+)
+
+// CaptureConfig where raw message bodies are written for users with ExporterUser.CaptureIngest set.
+type CaptureConfig struct {
+	// Dir capture files are written to, one per user. Capturing is unavailable when empty.
+	Dir string
+	// MaxFileSize bodies which would grow a capture file past this many bytes are not captured.
+	MaxFileSize int64
+}
+
+// ErrCaptureFull capture file has reached CaptureConfig.MaxFileSize.
+var ErrCaptureFull = errors.New("capture file full")
+
+// CaptureStatus
+type CaptureStatus struct {
+	// Enabled bodies posted by the user are being captured.
+	Enabled bool `json:"enabled"`
+	// Size of the capture file in bytes.
+	Size int64 `json:"size"`
+	// MaxSize capture stops once the file reaches this size.
+	MaxSize int64 `json:"max_size"`
+}
+
+// SetCaptureRequest
+type SetCaptureRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// capturePath
+func (api *MessageAPI) capturePath(userID uuid.UUID) string {
+	return filepath.Join(api.captureConfig.Dir, userID.String()+".cap")
+}
+
+// captureMu lock of the user's capture file.
+func (api *MessageAPI) captureMu(userID uuid.UUID) *sync.Mutex {
+	captureMu, _ := api.captureMuMap.LoadOrStore(userID, new(sync.Mutex))
+
+	return captureMu.(*sync.Mutex)
+}
+
+// captureBody appends the record to the user's capture file. Only call for users with capture on.
+func (api *MessageAPI) captureBody(userID uuid.UUID, record brotatocapture.Record) error {
+	if api.captureConfig.Dir == "" {
+		return nil
+	}
+
+	captureMu := api.captureMu(userID)
+	captureMu.Lock()
+	defer captureMu.Unlock()
+
+	captureFile, err := os.OpenFile(api.capturePath(userID), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+	defer captureFile.Close()
+
+	stat, err := captureFile.Stat()
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	if stat.Size()+int64(len(record.Body)) > api.captureConfig.MaxFileSize {
+		return errutil.NewStackError(fmt.Errorf("%w: %d bytes", ErrCaptureFull, stat.Size()))
+	}
+
+	err = brotatocapture.NewAppendWriter(captureFile, stat.Size()).WriteRecord(record)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	return nil
+}
+
+// openCapture the user's capture file and its size, which only covers whole records. The file is only appended to or
+// removed, so it can be read up to size without holding its lock.
+func (api *MessageAPI) openCapture(userID uuid.UUID) (*os.File, int64, error) {
+	captureMu := api.captureMu(userID)
+	captureMu.Lock()
+	defer captureMu.Unlock()
+
+	captureFile, err := os.Open(api.capturePath(userID))
+	if err != nil {
+		return nil, 0, errutil.NewStackError(err)
+	}
+
+	stat, err := captureFile.Stat()
+	if err != nil {
+		captureFile.Close()
+		return nil, 0, errutil.NewStackError(err)
+	}
+
+	return captureFile, stat.Size(), nil
+}
+
+// captureStatus
+func (api *MessageAPI) captureStatus(userID uuid.UUID, enabled bool) (CaptureStatus, error) {
+	status := CaptureStatus{
+		Enabled: enabled,
+		MaxSize: api.captureConfig.MaxFileSize,
+	}
+
+	stat, err := os.Stat(api.capturePath(userID))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return status, nil
+		}
+
+		return status, errutil.NewStackError(err)
+	}
+	status.Size = stat.Size()
+
+	return status, nil
+}
+
+// captureUserID user ID of the Bearer token, or a response error if there is none or capturing is unavailable.
+func (api *MessageAPI) captureUserID(r *http.Request) (uuid.UUID, error) {
+	userID, ok := ctrlauth.GetUserIDFromCtx(r.Context())
+	if !ok {
+		return uuid.Nil, exporterserverutil.NewResponseError(nil, http.StatusUnauthorized, exporterserverutil.ErrorCodeUnauthorized, "Unauthorized")
+	}
+
+	if api.captureConfig.Dir == "" {
+		return uuid.Nil, exporterserverutil.NewResponseError(nil, http.StatusNotFound, exporterserverutil.ErrorCodeFeatureDisabled, "Capture is not available on this server")
+	}
+
+	return userID, nil
+}
+
+// writeCaptureStatus
+func writeCaptureStatus(w http.ResponseWriter, status CaptureStatus) error {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(status)
+	if err != nil {
+		return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to write JSON")
+	}
+
+	return nil
+}
+
+// getCapture
+func (api *MessageAPI) getCapture(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	exporterserverutil.WriteError(w, r, func() error {
+		userID, err := api.captureUserID(r)
+		if err != nil {
+			return err
+		}
+
+		user, err := api.exporterStore.GetUserByID(userID)
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to get user")
+		}
+
+		status, err := api.captureStatus(userID, user.CaptureIngest)
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to get capture status")
+		}
+
+		return writeCaptureStatus(w, status)
+	}())
+}
+
+// setCapture turns capturing on or off, the capture file is kept either way.
+func (api *MessageAPI) setCapture(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	exporterserverutil.WriteError(w, r, func() error {
+		userID, err := api.captureUserID(r)
+		if err != nil {
+			return err
+		}
+
+		req := new(SetCaptureRequest)
+
+		err = json.NewDecoder(io.LimitReader(r.Body, 1024)).Decode(req)
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusBadRequest, exporterserverutil.ErrorCodeInvalidBody, "Invalid request body")
+		}
+
+		err = os.MkdirAll(api.captureConfig.Dir, 0o755)
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to create capture directory")
+		}
+
+		user, err := api.exporterStore.GetUserByID(userID)
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to get user")
+		}
+
+		user.CaptureIngest = req.Enabled
+
+		err = api.exporterStore.UpsertUser(user)
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to update user")
+		}
+
+		// posts check the session's copy
+		sessInfo, ok := api.sessionInfoMap.Load(userID)
+		if ok {
+			sessInfo.CaptureIngest.Store(user.CaptureIngest)
+		}
+
+		status, err := api.captureStatus(userID, user.CaptureIngest)
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to get capture status")
+		}
+
+		return writeCaptureStatus(w, status)
+	}())
+}
+
+// downloadCapture
+func (api *MessageAPI) downloadCapture(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	exporterserverutil.WriteError(w, r, func() error {
+		userID, err := api.captureUserID(r)
+		if err != nil {
+			return err
+		}
+
+		captureFile, size, err := api.openCapture(userID)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return exporterserverutil.NewResponseError(nil, http.StatusNotFound, exporterserverutil.ErrorCodeNotFound, "Nothing has been captured")
+			}
+
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to open capture")
+		}
+		defer captureFile.Close()
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.cap"`, userID))
+		w.WriteHeader(http.StatusOK)
+
+		// records appended since opening are left for the next download
+		_, err = io.Copy(w, io.LimitReader(captureFile, size))
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+
+		return nil
+	}())
+}
+
+// deleteCapture
+func (api *MessageAPI) deleteCapture(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	exporterserverutil.WriteError(w, r, func() error {
+		userID, err := api.captureUserID(r)
+		if err != nil {
+			return err
+		}
+
+		captureMu := api.captureMu(userID)
+		captureMu.Lock()
+		defer captureMu.Unlock()
+
+		err = os.Remove(api.capturePath(userID))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to delete capture")
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+		return nil
+	}())
+}
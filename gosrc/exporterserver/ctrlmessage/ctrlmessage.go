@@ -6,18 +6,27 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatocapture"
 	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatoserial"
 	"github.com/benw10-1/brotato-exporter/errutil"
 	"github.com/benw10-1/brotato-exporter/exporterserver/ctrlauth"
 	"github.com/benw10-1/brotato-exporter/exporterserver/exporterserverutil"
+	"github.com/benw10-1/brotato-exporter/exporterserver/messagepipeline"
 	"github.com/benw10-1/brotato-exporter/exporterserver/messagesubhandler"
 	"github.com/benw10-1/brotato-exporter/exporterstore"
+	"github.com/benw10-1/brotato-exporter/logutil"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/julienschmidt/httprouter"
 )
@@ -29,37 +38,52 @@ type MessageAPI struct {
 	exporterStore *exporterstore.ExporterStore
 
 	subHandler *messagesubhandler.MessageSubHandler
+	// pipeline decoded messages are published to, subscribers and session state are fed from it.
+	pipeline *messagepipeline.Pipeline
 
-	router *httprouter.Router
+	// maxBodySize largest message body accepted once decompressed.
+	maxBodySize int64
+
+	captureConfig CaptureConfig
+	// captureMuMap a *sync.Mutex per user, serializing changes to their capture file.
+	captureMuMap sync.Map
+
+	// originPolicy browser origins allowed to open websockets besides the server's own.
+	originPolicy *exporterserverutil.OriginPolicy
+	upgrader     *websocket.Upgrader
 }
 
 // NewMessageAPI
-func NewMessageAPI(sessionInfoMap *ctrlauth.SessionInfoMap, exporterStore *exporterstore.ExporterStore, messageSubHandler *messagesubhandler.MessageSubHandler) *MessageAPI {
-	router := httprouter.New()
-	api := &MessageAPI{
+func NewMessageAPI(sessionInfoMap *ctrlauth.SessionInfoMap, exporterStore *exporterstore.ExporterStore, messageSubHandler *messagesubhandler.MessageSubHandler, pipeline *messagepipeline.Pipeline, maxBodySize int64, captureConfig CaptureConfig, originPolicy *exporterserverutil.OriginPolicy) *MessageAPI {
+	return &MessageAPI{
 		sessionInfoMap: sessionInfoMap,
 		exporterStore:  exporterStore,
-		router:         router,
 		subHandler:     messageSubHandler,
+		pipeline:       pipeline,
+		maxBodySize:    maxBodySize,
+		captureConfig:  captureConfig,
+		originPolicy:   originPolicy,
+		upgrader: &websocket.Upgrader{
+			CheckOrigin:     originPolicy.CheckOrigin,
+			Subprotocols:    []string{ctrlauth.WebsocketSubprotocol},
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+		},
 	}
+}
 
+// RegisterRoutes
+func (api *MessageAPI) RegisterRoutes(router *httprouter.Router) {
 	router.GET("/api/message/current-state", api.currentState)
+	router.GET("/api/message/subscribe", api.subscribe)
+	router.GET("/api/message/ingest", api.ingest)
 
 	router.POST("/api/message/post", api.receiveMessage)
 
-	router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
-
-	return api
-}
-
-// ServeHTTP
-func (api *MessageAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path == "/api/message/subscribe" {
-		api.subscribe(w, r, nil)
-		return
-	}
-
-	api.router.ServeHTTP(w, r)
+	router.GET("/api/message/capture", api.getCapture)
+	router.PUT("/api/message/capture", api.setCapture)
+	router.GET("/api/message/capture/file", api.downloadCapture)
+	router.DELETE("/api/message/capture/file", api.deleteCapture)
 }
 
 var byteBufferPool = sync.Pool{
@@ -70,27 +94,29 @@ var byteBufferPool = sync.Pool{
 
 // receiveMessage
 func (api *MessageAPI) receiveMessage(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	exporterserverutil.WriteError(w, func() error {
+	receivedTime := time.Now()
+
+	exporterserverutil.WriteError(w, r, func() error {
 		sess, ok := ctrlauth.GetSessionFromCtx(r.Context())
 		if !ok {
-			return exporterserverutil.NewResponseError(nil, http.StatusUnauthorized, "Unauthorized")
+			return exporterserverutil.NewResponseError(nil, http.StatusUnauthorized, exporterserverutil.ErrorCodeUnauthorized, "Unauthorized")
 		}
 
 		sessInfo, ok := api.sessionInfoMap.Load(sess.UserID)
 		if !ok {
-			return exporterserverutil.NewResponseError(nil, http.StatusUnauthorized, "Unauthorized")
+			return exporterserverutil.NewResponseError(nil, http.StatusUnauthorized, exporterserverutil.ErrorCodeUnauthorized, "Unauthorized")
 		}
 
 		if r.Header.Get("Content-Type") != "application/octet-stream" {
-			return exporterserverutil.NewResponseError(nil, http.StatusBadRequest, "Invalid content type")
+			return exporterserverutil.NewResponseError(nil, http.StatusBadRequest, exporterserverutil.ErrorCodeInvalidRequest, "Invalid content type")
 		}
 
 		if r.ContentLength == 0 || r.Body == nil {
-			return exporterserverutil.NewResponseError(nil, http.StatusBadRequest, "Invalid content length")
+			return exporterserverutil.NewResponseError(nil, http.StatusBadRequest, exporterserverutil.ErrorCodeInvalidRequest, "Invalid content length")
 		}
 
 		if sessInfo.MessageReader == nil {
-			return exporterserverutil.NewResponseError(nil, http.StatusInternalServerError, "Session message reader not initialized")
+			return exporterserverutil.NewResponseError(nil, http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Session message reader not initialized")
 		}
 
 		// TODO: write to timeseries file
@@ -101,101 +127,281 @@ func (api *MessageAPI) receiveMessage(w http.ResponseWriter, r *http.Request, _
 		}()
 		bodyReader.Reset()
 
+		body, err := exporterserverutil.DecompressBody(r, api.maxBodySize)
+		if err != nil {
+			if errors.Is(err, exporterserverutil.ErrUnsupportedContentEncoding) {
+				return exporterserverutil.NewResponseError(err, http.StatusUnsupportedMediaType, exporterserverutil.ErrorCodeUnsupportedEncoding, "Unsupported content encoding")
+			}
+
+			return exporterserverutil.NewResponseError(err, http.StatusBadRequest, exporterserverutil.ErrorCodeInvalidBody, "Invalid compressed body")
+		}
+		defer body.Close()
+
 		// Flush the entire contents of the body to the pooled buffer as the response is likely chunked.
 		// Since we are using pool we rarely make any additional allocations
-		_, err := io.Copy(bodyReader, r.Body)
+		_, err = io.Copy(bodyReader, body)
+		if err != nil {
+			if errors.Is(err, exporterserverutil.ErrBodyTooLarge) {
+				return exporterserverutil.NewResponseError(err, http.StatusRequestEntityTooLarge, exporterserverutil.ErrorCodeBodyTooLarge, fmt.Sprintf("Body larger than %d bytes", api.maxBodySize))
+			}
+
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusBadRequest, exporterserverutil.ErrorCodeInvalidBody, "Failed to read body")
+		}
+
+		protocolVersion, res, err := api.readSessionMessages(r.Context(), sess.UserID, receivedTime, bodyReader)
 		if err != nil {
-			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, "Failed to read body")
+			return err
 		}
 
-		// make sure we are not setting new reader before old reader has finished reading
-		sessInfo.Lock()
-		defer sessInfo.Unlock()
+		return writePostMessageResponse(w, protocolVersion, res)
+	}())
+}
 
-		// keep dict encoding as session state, set MessageReader's underlying reader to the incoming body
-		sessInfo.MessageReader.SetReader(bodyReader)
+// readSessionMessages reads every message in body with the session's MessageReader and publishes them to the pipeline.
+// Bad frames are reported in the response rather than as an error. The body is captured first if the user has capture on.
+func (api *MessageAPI) readSessionMessages(ctx context.Context, userID uuid.UUID, receivedTime time.Time, body *bytes.Buffer) (brotatomodtypes.ProtocolVersion, PostMessageResponse, error) {
+	res := PostMessageResponse{
+		FailedFrames: make([]FailedFrame, 0),
+	}
 
-		for {
-			msg, err := sessInfo.MessageReader.ReadNextMessage()
-			if err != nil {
-				if errors.Is(err, io.EOF) {
-					w.WriteHeader(http.StatusOK)
-					return nil
-				}
+	sessInfo, ok := api.sessionInfoMap.Load(userID)
+	if !ok {
+		return 0, res, exporterserverutil.NewResponseError(nil, http.StatusUnauthorized, exporterserverutil.ErrorCodeUnauthorized, "Unauthorized")
+	}
+
+	// make sure we are not setting new reader before old reader has finished reading
+	sessInfo.Lock()
+	defer sessInfo.Unlock()
+
+	protocolVersion := sessInfo.MessageReader.ProtocolVersion()
+
+	// a capture is only for debugging, never fail the body because of it
+	if sessInfo.CaptureIngest.Load() {
+		err := api.captureBody(userID, brotatocapture.Record{
+			Timestamp:       brotatomodtypes.MicroTimeFromTime(receivedTime),
+			ProtocolVersion: protocolVersion,
+			Body:            body.Bytes(),
+		})
+		if err != nil {
+			slog.WarnContext(ctx, "ctrlmessage.MessageAPI.readSessionMessages: failed to capture body", logutil.Err(err))
+		}
+	}
+
+	// keep dict encoding as session state, set MessageReader's underlying reader to the incoming body
+	sessInfo.MessageReader.SetReader(body)
 
-				return errutil.NewStackError(err)
+	for {
+		msg, err := sessInfo.MessageReader.ReadNextMessage()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return protocolVersion, res, nil
 			}
 
-			// on full timeseries message, reset the session state
-			if msg.MessageType == brotatomodtypes.MessageTypeTimeSeriesFull {
-				sessInfo.CurrentSessionState = make(map[string]json.RawMessage)
+			// the rest of the body uses the same mappings, so stop here and let the mod start over
+			if errors.Is(err, brotatoserial.ErrKeyNotMapped) {
+				return protocolVersion, res, keyMappingResetRequiredError(err)
 			}
 
-			if msg.MessageType != brotatomodtypes.MessageTypeKeepAlive {
-				log.Printf("Received message: %+v", msg)
+			// bad frames are skipped and reported back, the rest of the body is still good
+			frameErr := &brotatoserial.FrameError{}
+			if errors.As(err, &frameErr) {
+				slog.WarnContext(ctx, "ctrlmessage.MessageAPI.readSessionMessages: skipping bad frame", logutil.Err(frameErr))
+				res.FailedFrames = append(res.FailedFrames, FailedFrame{
+					Index:  frameErr.Index,
+					Offset: frameErr.Offset,
+					Error:  errutil.Message(frameErr.Err),
+				})
+				continue
 			}
 
-			api.subHandler.StreamMessage(sess.UserID, sessInfo.CurrentSessionState, msg)
+			return protocolVersion, res, errutil.NewStackError(fmt.Errorf("reading body at offset %d: %w", sessInfo.MessageReader.Offset(), err))
 		}
-	}())
+
+		// decode the whole message up front, consumers only ever see messages which read cleanly
+		event, err := decodeEvent(userID, receivedTime, msg)
+		if err != nil {
+			if errors.Is(err, brotatoserial.ErrKeyNotMapped) {
+				return protocolVersion, res, keyMappingResetRequiredError(err)
+			}
+
+			return protocolVersion, res, errutil.NewStackError(fmt.Errorf("reading body at offset %d: %w", sessInfo.MessageReader.Offset(), err))
+		}
+		event.RequestID = exporterserverutil.GetRequestIDFromCtx(ctx)
+		res.AcceptedCount++
+
+		if msg.MessageType != brotatomodtypes.MessageTypeKeepAlive {
+			slog.DebugContext(ctx, "ctrlmessage.MessageAPI.readSessionMessages: received message", slog.String("type", msg.MessageType.String()), slog.String("reason", msg.MessageReason.String()))
+		}
+
+		if msg.MessageType == brotatomodtypes.MessageTypeMappingReset {
+			slog.InfoContext(ctx, "ctrlmessage.MessageAPI.readSessionMessages: key mappings reset")
+		}
+
+		// published under the session lock so events stay in order when the same user posts twice at once
+		api.pipeline.Publish(event)
+	}
+}
+
+// decodeEvent reads every key value of msg. The values are copied as the reader's buffer is reused.
+func decodeEvent(userID uuid.UUID, receivedTime time.Time, msg brotatomodtypes.ExporterMessage) (messagepipeline.Event, error) {
+	event := messagepipeline.Event{
+		UserID:           userID,
+		ReceivedTime:     receivedTime,
+		MessageType:      msg.MessageType,
+		MessageReason:    msg.MessageReason,
+		MessageTimestamp: msg.MessageTimestamp,
+	}
+
+	if msg.MessageBody == nil {
+		return event, nil
+	}
+
+	// framed messages were read whole already, with values of their own
+	sliceDictReader, ok := msg.MessageBody.(*brotatoserial.SliceDictReader)
+	if ok {
+		event.KeyValues = sliceDictReader.KeyValues()
+		return event, nil
+	}
+
+	event.KeyValues = make([]brotatomodtypes.DictKeyValue, 0, msg.MessageBody.Size())
+	for {
+		kv, err := msg.MessageBody.ReadNextKeyValue()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return event, nil
+			}
+
+			return event, errutil.NewStackError(err)
+		}
+
+		kv.Value = bytes.Clone(kv.Value)
+		event.KeyValues = append(event.KeyValues, kv)
+	}
 }
 
-var websocketUpgrader = &websocket.Upgrader{
-	// CheckOrigin: func(r *http.Request) bool {
-	// 	return true
-	// },
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	// HandshakeTimeout: time.Millisecond * 500,
+// PostMessageResponse response body for framed protocol versions, legacy mods get an empty body.
+type PostMessageResponse struct {
+	// AcceptedCount frames read successfully.
+	AcceptedCount int `json:"accepted_count"`
+	// FailedFrames frames which were skipped.
+	FailedFrames []FailedFrame `json:"failed_frames"`
+}
+
+// FailedFrame
+type FailedFrame struct {
+	Index  int    `json:"index"`
+	Offset int64  `json:"offset"`
+	Error  string `json:"error"`
+}
+
+// keyMappingResetRequiredError 409 tells the mod to send a MessageTypeMappingReset followed by the full state.
+// Messages before the one which failed were already applied.
+func keyMappingResetRequiredError(err error) error {
+	return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusConflict, exporterserverutil.ErrorCodeKeyMappingResetRequired, "Key mapping reset required")
+}
+
+// writePostMessageResponse
+func writePostMessageResponse(w http.ResponseWriter, protocolVersion brotatomodtypes.ProtocolVersion, res PostMessageResponse) error {
+	if protocolVersion == brotatomodtypes.ProtocolVersionLegacy {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err := json.NewEncoder(w).Encode(res)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	return nil
+}
+
+// originNotAllowedError checked before upgrading so the refusal is a JSON error rather than the upgrader's plain text one.
+func (api *MessageAPI) originNotAllowedError(r *http.Request) error {
+	if api.originPolicy.CheckOrigin(r) {
+		return nil
+	}
+
+	return exporterserverutil.NewResponseError(nil, http.StatusForbidden, exporterserverutil.ErrorCodeOriginNotAllowed, "Origin not allowed")
 }
 
 const activityTimeout = time.Minute * 5
 
-// subscribe
+// keySelectorFromQuery reads ?keys= and ?exclude=, comma separated keys or globs like "effects_stat_*". With keyParams,
+// any other parameter set to 1 or true names a key as well - the original subscribe syntax.
+func keySelectorFromQuery(queryParams url.Values, keyParams bool) (*messagesubhandler.KeySelector, error) {
+	var includes []string
+	for _, val := range queryParams["keys"] {
+		includes = append(includes, strings.Split(val, ",")...)
+	}
+
+	var excludes []string
+	for _, val := range queryParams["exclude"] {
+		excludes = append(excludes, strings.Split(val, ",")...)
+	}
+
+	if keyParams {
+		for key, val := range queryParams {
+			if key == "keys" || key == "exclude" || len(val) < 1 || (val[len(val)-1] != "1" && val[len(val)-1] != "true") {
+				continue
+			}
+
+			includes = append(includes, key)
+		}
+	}
+
+	keySelector, err := messagesubhandler.NewKeySelector(includes, excludes)
+	if err != nil {
+		return nil, errutil.NewStackError(err)
+	}
+
+	return keySelector, nil
+}
+
+// subscribe streams the user's state changes. Browsers, which can't set the Authorization header on a websocket, pass a
+// ticket from /api/auth/subscribe-ticket instead.
 func (api *MessageAPI) subscribe(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	userID, ok := ctrlauth.GetUserIDFromCtx(r.Context())
+	userID, ok := ctrlauth.GetSubscriberUserIDFromCtx(r.Context())
 	if !ok {
-		exporterserverutil.WriteError(w, exporterserverutil.NewResponseError(nil, http.StatusUnauthorized, "Unauthorized"))
+		exporterserverutil.WriteError(w, r, exporterserverutil.NewResponseError(nil, http.StatusUnauthorized, exporterserverutil.ErrorCodeUnauthorized, "Unauthorized"))
 		return
 	}
 
 	user, err := api.exporterStore.GetUserByID(userID)
 	if err != nil {
-		exporterserverutil.WriteError(w, exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, "Failed to get user"))
+		exporterserverutil.WriteError(w, r, exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to get user"))
 		return
 	}
 
-	queryParams := r.URL.Query()
-
-	subKeyMap := make(map[string]bool, len(queryParams))
-	for key, val := range queryParams {
-		if len(val) < 1 || (val[len(val)-1] != "1" && val[len(val)-1] != "true") {
-			continue
-		}
-
-		if key == messagesubhandler.AllKeyKey {
-			subKeyMap = map[string]bool{messagesubhandler.AllKeyKey: true}
-			break
-		}
+	err = api.originNotAllowedError(r)
+	if err != nil {
+		exporterserverutil.WriteError(w, r, err)
+		return
+	}
 
-		subKeyMap[key] = true
+	keySelector, err := keySelectorFromQuery(r.URL.Query(), true)
+	if err != nil {
+		exporterserverutil.WriteError(w, r, exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusBadRequest, exporterserverutil.ErrorCodeInvalidKeyPattern, "Invalid key pattern"))
+		return
 	}
 
-	if len(subKeyMap) < 1 {
-		exporterserverutil.WriteError(w, exporterserverutil.NewResponseError(nil, http.StatusBadRequest, "No valid keys found in query"))
+	if keySelector.Empty() {
+		exporterserverutil.WriteError(w, r, exporterserverutil.NewResponseError(nil, http.StatusBadRequest, exporterserverutil.ErrorCodeInvalidKeyPattern, "No valid keys found in query"))
 		return
 	}
 
-	messageChan, ok := api.subHandler.SubscribeToUserIfHasSlots(user.UserID, subKeyMap, user.MaxSubscribers)
+	messageChan, ok := api.subHandler.SubscribeToUserIfHasSlots(user.UserID, keySelector, user.MaxSubscribers)
 	if !ok {
-		exporterserverutil.WriteError(w, exporterserverutil.NewResponseError(nil, http.StatusTooManyRequests, "User has reached max subscribers"))
+		exporterserverutil.WriteError(w, r, exporterserverutil.NewResponseError(nil, http.StatusTooManyRequests, exporterserverutil.ErrorCodeTooManySubscribers, "User has reached max subscribers"))
 		return
 	}
 	defer api.subHandler.UnsubscribeFromUser(user.UserID, messageChan)
 
-	conn, err := websocketUpgrader.Upgrade(w, r, nil)
+	conn, err := api.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("ctrlmessage.MessageAPI.subscribe: upgrade error: %v", err)
+		slog.WarnContext(r.Context(), "ctrlmessage.MessageAPI.subscribe: upgrade error", logutil.Err(err))
 		return
 	}
 	defer func(conn *websocket.Conn) {
@@ -217,12 +423,15 @@ func (api *MessageAPI) subscribe(w http.ResponseWriter, r *http.Request, _ httpr
 			if err != nil {
 				var closeErr *websocket.CloseError
 				if errors.As(err, &closeErr) {
-					log.Printf("ctrlmessage.MessageAPI.subscribe: connection closed with code (%d) and text (%s)", closeErr.Code, closeErr.Text)
+					slog.InfoContext(r.Context(), "ctrlmessage.MessageAPI.subscribe: connection closed", slog.Int("close_code", closeErr.Code), slog.String("close_text", closeErr.Text))
 					cancelWSCtx()
 					return
 				}
 
-				log.Printf("ctrlmessage.MessageAPI.subscribe: unexpected error - %v", err)
+				// reads can't recover once one fails, gorilla panics if they keep being retried
+				slog.WarnContext(r.Context(), "ctrlmessage.MessageAPI.subscribe: unexpected error", logutil.Err(err))
+				cancelWSCtx()
+				return
 			}
 		}
 	}()
@@ -251,7 +460,10 @@ func (api *MessageAPI) subscribe(w http.ResponseWriter, r *http.Request, _ httpr
 				}
 				timeoutTimer.Reset(activityTimeout)
 			case <-timeoutTimer.C:
-				err := conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"error_code": %d, "message": "Timed out after (%s)"}`, http.StatusRequestTimeout, activityTimeout.String())))
+				timeoutErr := exporterserverutil.NewResponseError(nil, http.StatusRequestTimeout, exporterserverutil.ErrorCodeTimeout, fmt.Sprintf("Timed out after (%s)", activityTimeout.String()))
+				err := conn.WriteControl(websocket.CloseMessage, exporterserverutil.FormatCloseError(
+					websocket.CloseGoingAway, exporterserverutil.GetRequestIDFromCtx(r.Context()), timeoutErr,
+				), time.Now().Add(time.Second))
 				if err != nil {
 					return errutil.NewStackError(err)
 				}
@@ -261,35 +473,83 @@ func (api *MessageAPI) subscribe(w http.ResponseWriter, r *http.Request, _ httpr
 		}
 	}()
 	if connErr != nil {
-		log.Printf("ctrlmessage.MessageAPI.subscribe: conn error - %v", connErr)
+		slog.InfoContext(r.Context(), "ctrlmessage.MessageAPI.subscribe: conn error", logutil.Err(connErr))
 	}
 }
 
-// currentState
+// currentState values of the session's state, only the keys selected by ?keys= and ?exclude= if given. With ?with_meta=1
+// each value comes with its type and the message which last changed it. Answers conditional requests with 304 until the
+// state changes.
 func (api *MessageAPI) currentState(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	exporterserverutil.WriteError(w, func() error {
+	exporterserverutil.WriteError(w, r, func() error {
 		userID, ok := ctrlauth.GetUserIDFromCtx(r.Context())
 		if !ok {
-			return exporterserverutil.NewResponseError(nil, http.StatusUnauthorized, "Unauthorized")
+			return exporterserverutil.NewResponseError(nil, http.StatusUnauthorized, exporterserverutil.ErrorCodeUnauthorized, "Unauthorized")
+		}
+
+		queryParams := r.URL.Query()
+
+		var err error
+		withMeta := false
+		if withMetaStr := queryParams.Get("with_meta"); withMetaStr != "" {
+			withMeta, err = strconv.ParseBool(withMetaStr)
+			if err != nil {
+				return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusBadRequest, exporterserverutil.ErrorCodeInvalidRequest, "Invalid with_meta")
+			}
+		}
+
+		// every key unless some are asked for
+		if len(queryParams["keys"]) == 0 {
+			queryParams["keys"] = []string{messagesubhandler.AllKeyKey}
+		}
+
+		keySelector, err := keySelectorFromQuery(queryParams, false)
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusBadRequest, exporterserverutil.ErrorCodeInvalidKeyPattern, "Invalid key pattern")
 		}
 
 		sessInfo, ok := api.sessionInfoMap.Load(userID)
 		if !ok {
-			return exporterserverutil.NewResponseError(nil, http.StatusNotFound, "No active session found for given auth key")
+			return exporterserverutil.NewResponseError(nil, http.StatusNotFound, exporterserverutil.ErrorCodeSessionNotFound, "No active session found for given auth key")
 		}
 
-		sessInfo.Lock()
-		defer sessInfo.Unlock()
+		snapshot := sessInfo.State.Snapshot()
 
-		w.Header().Set("Content-Type", "application/json")
+		// publish time keeps tags from before a restart from matching a new state with the same version
+		etag := fmt.Sprintf("%x-%x", snapshot.ModifiedTime.UnixNano(), snapshot.Version)
+		if withMeta {
+			etag += "-meta"
+		}
+		// each selection is tagged separately
+		selectionHash := fnv.New32a()
+		_, _ = io.WriteString(selectionHash, strings.Join(queryParams["keys"], ",")+"|"+strings.Join(queryParams["exclude"], ","))
+		etag += fmt.Sprintf("-%x", selectionHash.Sum32())
 
-		err := json.NewEncoder(w).Encode(sessInfo.CurrentSessionState)
-		if err != nil {
-			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, "Failed to write JSON")
+		exporterserverutil.SetValidators(w, etag, snapshot.ModifiedTime)
+		w.Header().Set("Cache-Control", "no-cache")
+
+		if exporterserverutil.NotModified(r, etag, snapshot.ModifiedTime) {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
 		}
 
+		snapshot = snapshot.Select(keySelector.Selects)
+
+		var body []byte
+		if withMeta {
+			body = snapshot.AppendMetaJSON(nil)
+		} else {
+			body = snapshot.AppendJSON(nil)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 
+		_, err = w.Write(append(body, '\n'))
+		if err != nil {
+			slog.WarnContext(r.Context(), "ctrlmessage.MessageAPI.currentState: failed to write response", logutil.Err(err))
+		}
+
 		return nil
 	}())
 }
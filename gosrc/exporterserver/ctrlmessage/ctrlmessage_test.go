@@ -1,3 +1,814 @@
 package ctrlmessage
 
-// TODO: test implementation for message consumer
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatocapture"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatoserial"
+	"github.com/benw10-1/brotato-exporter/exporterserver"
+	"github.com/benw10-1/brotato-exporter/exporterserver/ctrlauth"
+	"github.com/benw10-1/brotato-exporter/exporterserver/exporterserverutil"
+	"github.com/benw10-1/brotato-exporter/exporterserver/messagepipeline"
+	"github.com/benw10-1/brotato-exporter/exporterserver/messagesubhandler"
+	"github.com/benw10-1/brotato-exporter/exporterstore"
+	"github.com/benw10-1/brotato-exporter/exporterstore/exporterstoretypes"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+// testServer auth and message APIs with a single user, every test starts its own.
+type testServer struct {
+	*httptest.Server
+
+	sessionInfoMap *ctrlauth.SessionInfoMap
+	user           *exporterstoretypes.ExporterUser
+	authKey        string
+	captureDir     string
+}
+
+// newTestServer bodies larger than maxBodySize are rejected.
+func newTestServer(t *testing.T, maxBodySize int64) *testServer {
+	asserter := require.New(t)
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	t.Cleanup(cancelCtx)
+
+	jwtKey := []byte("567A7A74316D31396E614B4758474951")
+
+	sessionInfoMap := new(ctrlauth.SessionInfoMap)
+
+	exporterStore, err := exporterstore.NewExporterStore(filepath.Join(t.TempDir(), "user.db"))
+	asserter.NoError(err)
+	t.Cleanup(func() {
+		exporterStore.Close()
+	})
+
+	testUser := &exporterstoretypes.ExporterUser{
+		UserID:         uuid.New(),
+		MaxSubscribers: 10,
+	}
+	err = exporterStore.UpsertUser(testUser)
+	asserter.NoError(err)
+
+	testAuthKey := "test"
+
+	err = exporterStore.UpsertAuthKeyUserID([]byte(testAuthKey), testUser.UserID)
+	asserter.NoError(err)
+
+	authAPI := ctrlauth.NewAuthAPI(jwtKey, sessionInfoMap, exporterStore)
+	subHandler := messagesubhandler.NewMessageSubHandler(ctx, sessionInfoMap, time.Minute)
+	captureDir := filepath.Join(t.TempDir(), "captures")
+	pipeline := messagepipeline.NewPipeline(ctx, time.Minute, subHandler.ConsumerConfig())
+	originPolicy := exporterserverutil.NewOriginPolicy(exporterserverutil.OriginConfig{
+		AllowedMethods: []string{http.MethodGet, http.MethodPut},
+		AllowedHeaders: []string{"Authorization"},
+	}, authAPI.UserAllowedOrigins)
+	messageAPI := NewMessageAPI(sessionInfoMap, exporterStore, subHandler, pipeline, maxBodySize, CaptureConfig{
+		Dir:         captureDir,
+		MaxFileSize: 1 << 20,
+	}, originPolicy)
+
+	srv := httptest.NewServer(exporterserver.NewExporterServer(
+		[]exporterserver.Controller{authAPI, messageAPI},
+		exporterserver.RequestIDMiddleware,
+		exporterserver.CORSMiddleware(originPolicy),
+		authAPI.Middleware,
+	))
+	t.Cleanup(srv.Close)
+
+	return &testServer{
+		Server:         srv,
+		sessionInfoMap: sessionInfoMap,
+		user:           testUser,
+		authKey:        testAuthKey,
+		captureDir:     captureDir,
+	}
+}
+
+// wsURL
+func (ts *testServer) wsURL(path string) string {
+	return "ws" + strings.TrimPrefix(ts.URL, "http") + path
+}
+
+// do sends the request with only the given headers.
+func (ts *testServer) do(asserter *require.Assertions, method string, path string, body io.Reader, header http.Header) *http.Response {
+	req, err := http.NewRequest(method, ts.URL+path, body)
+	asserter.NoError(err)
+	for key, vals := range header {
+		req.Header[key] = vals
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	asserter.NoError(err)
+
+	return res
+}
+
+// doBearer sends the request with the user's auth key.
+func (ts *testServer) doBearer(asserter *require.Assertions, method string, path string, body io.Reader, header http.Header) *http.Response {
+	header = header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Authorization", "Bearer "+ts.authKey)
+
+	return ts.do(asserter, method, path, body, header)
+}
+
+// authenticate starts a new session for the user.
+func (ts *testServer) authenticate(asserter *require.Assertions, reqBody string) *ctrlauth.AuthResponse {
+	res := ts.doBearer(asserter, http.MethodPost, "/api/auth/authenticate", strings.NewReader(reqBody), http.Header{
+		"Content-Type": []string{"application/json"},
+	})
+	defer res.Body.Close()
+	asserter.Equal(http.StatusOK, res.StatusCode)
+
+	authResponse := new(ctrlauth.AuthResponse)
+	asserter.NoError(json.NewDecoder(res.Body).Decode(authResponse))
+
+	return authResponse
+}
+
+// assertLevel checks current_level in the session's state.
+func (ts *testServer) assertLevel(asserter *require.Assertions, level int64) {
+	sessInfo, ok := ts.sessionInfoMap.Load(ts.user.UserID)
+	asserter.True(ok)
+
+	value, ok := sessInfo.State.Snapshot().Get("current_level")
+	asserter.True(ok)
+
+	current, ok := value.Int()
+	asserter.True(ok)
+	asserter.Equal(level, current)
+}
+
+// ingestConn mod session streaming its messages over the ingest websocket.
+type ingestConn struct {
+	*websocket.Conn
+
+	body *bytes.Buffer
+	mw   *brotatoserial.BrotatoMessageWriter
+}
+
+// dialIngest starts a session which negotiated the ingest websocket and connects it. The resend_full_state pushed on
+// connecting is left to be read.
+func (ts *testServer) dialIngest(asserter *require.Assertions) *ingestConn {
+	authResponse := ts.authenticate(asserter, `{"protocol_version": 2, "capabilities": ["ingest_websocket"]}`)
+	asserter.Equal([]brotatomodtypes.Capability{brotatomodtypes.CapabilityIngestWebsocket}, authResponse.Capabilities)
+
+	conn, _, err := websocket.DefaultDialer.Dial(ts.wsURL("/api/message/ingest"), http.Header{"Authorization": []string{"JWT " + authResponse.SessionToken}})
+	asserter.NoError(err)
+
+	body := bytes.NewBuffer(nil)
+
+	return &ingestConn{
+		Conn: conn,
+		body: body,
+		mw:   brotatoserial.NewVersionedMessageWriter(brotatomodtypes.ProtocolVersionFramed, brotatoserial.NewSerialWriter(body)),
+	}
+}
+
+// readServerMessage
+func (ic *ingestConn) readServerMessage(asserter *require.Assertions) IngestServerMessage {
+	asserter.NoError(ic.SetReadDeadline(time.Now().Add(time.Second * 5)))
+
+	var serverMsg IngestServerMessage
+	asserter.NoError(ic.ReadJSON(&serverMsg))
+
+	return serverMsg
+}
+
+// sendMessages writes each message into one body and sends it as a single binary message.
+func (ic *ingestConn) sendMessages(asserter *require.Assertions, msgs ...*brotatomodtypes.ExporterMessage) {
+	ic.body.Reset()
+	for _, msg := range msgs {
+		asserter.NoError(ic.mw.WriteMessage(msg))
+	}
+
+	asserter.NoError(ic.WriteMessage(websocket.BinaryMessage, ic.body.Bytes()))
+}
+
+// sendAcked sends the messages and checks every one of them was read.
+func (ic *ingestConn) sendAcked(asserter *require.Assertions, msgs ...*brotatomodtypes.ExporterMessage) IngestServerMessage {
+	ic.sendMessages(asserter, msgs...)
+
+	serverMsg := ic.readServerMessage(asserter)
+	asserter.Equal(IngestServerMessageTypeAck, serverMsg.Type)
+	asserter.NotNil(serverMsg.PostMessageResponse)
+	asserter.Equal(len(msgs), serverMsg.AcceptedCount)
+	asserter.Empty(serverMsg.FailedFrames)
+
+	return serverMsg
+}
+
+// postSession mod session posting its messages to /api/message/post.
+type postSession struct {
+	ts           *testServer
+	sessionToken string
+
+	body *bytes.Buffer
+	mw   *brotatoserial.BrotatoMessageWriter
+}
+
+// newPostSession starts a session with the framed protocol.
+func (ts *testServer) newPostSession(asserter *require.Assertions) *postSession {
+	authResponse := ts.authenticate(asserter, `{"protocol_version": 2}`)
+
+	body := bytes.NewBuffer(nil)
+
+	return &postSession{
+		ts:           ts,
+		sessionToken: authResponse.SessionToken,
+		body:         body,
+		mw:           brotatoserial.NewVersionedMessageWriter(brotatomodtypes.ProtocolVersionFramed, brotatoserial.NewSerialWriter(body)),
+	}
+}
+
+// encode writes each message into one body.
+func (ps *postSession) encode(asserter *require.Assertions, msgs ...*brotatomodtypes.ExporterMessage) []byte {
+	ps.body.Reset()
+	for _, msg := range msgs {
+		asserter.NoError(ps.mw.WriteMessage(msg))
+	}
+
+	return bytes.Clone(ps.body.Bytes())
+}
+
+// post sends the body as the session, with no Content-Encoding if contentEncoding is empty.
+func (ps *postSession) post(asserter *require.Assertions, body []byte, contentEncoding string) *http.Response {
+	header := http.Header{
+		"Authorization": []string{"JWT " + ps.sessionToken},
+		"Content-Type":  []string{"application/octet-stream"},
+	}
+	if contentEncoding != "" {
+		header.Set("Content-Encoding", contentEncoding)
+	}
+
+	return ps.ts.do(asserter, http.MethodPost, "/api/message/post", bytes.NewReader(body), header)
+}
+
+// readPostResponse checks the body was read and returns the response.
+func readPostResponse(asserter *require.Assertions, res *http.Response) PostMessageResponse {
+	defer res.Body.Close()
+	asserter.Equal(http.StatusOK, res.StatusCode)
+
+	postRes := PostMessageResponse{}
+	asserter.NoError(json.NewDecoder(res.Body).Decode(&postRes))
+
+	return postRes
+}
+
+// readErrorCode checks the status and returns the error code of the response.
+func readErrorCode(asserter *require.Assertions, res *http.Response, status int) exporterserverutil.ErrorCode {
+	defer res.Body.Close()
+	asserter.Equal(status, res.StatusCode)
+
+	errRes := exporterserverutil.ErrorResponse{}
+	asserter.NoError(json.NewDecoder(res.Body).Decode(&errRes))
+
+	return errRes.Error.Code
+}
+
+// levelMessage
+func levelMessage(messageType brotatomodtypes.MessageType, level int8) *brotatomodtypes.ExporterMessage {
+	return &brotatomodtypes.ExporterMessage{
+		MessageType:      messageType,
+		MessageReason:    brotatomodtypes.MessageReasonPoll,
+		MessageTimestamp: brotatomodtypes.MicroTimeFromTime(time.Now()),
+		MessageBody: brotatoserial.NewMapDictReader(map[string]brotatomodtypes.DictKeyValue{
+			"current_level": {
+				MappedKey:  "current_level",
+				SerialType: brotatomodtypes.SerialTypeInt8,
+				Value:      []byte{byte(level)},
+			},
+		}),
+	}
+}
+
+// keepAliveMessage
+func keepAliveMessage() *brotatomodtypes.ExporterMessage {
+	return &brotatomodtypes.ExporterMessage{
+		MessageType:      brotatomodtypes.MessageTypeKeepAlive,
+		MessageReason:    brotatomodtypes.MessageReasonNone,
+		MessageTimestamp: brotatomodtypes.MicroTimeFromTime(time.Now()),
+	}
+}
+
+func TestIngest(t *testing.T) {
+	t.Run("TestUnauthorized", func(t *testing.T) {
+		asserter := require.New(t)
+		ts := newTestServer(t, 1024)
+
+		_, res, err := websocket.DefaultDialer.Dial(ts.wsURL("/api/message/ingest"), nil)
+		asserter.Error(err)
+		asserter.Equal(http.StatusUnauthorized, res.StatusCode)
+	})
+
+	t.Run("TestResendOnConnect", func(t *testing.T) {
+		asserter := require.New(t)
+		ts := newTestServer(t, 1024)
+
+		ic := ts.dialIngest(asserter)
+		defer ic.Close()
+
+		// nothing has been sent for the session yet
+		serverMsg := ic.readServerMessage(asserter)
+		asserter.Equal(IngestServerMessageTypeResendFullState, serverMsg.Type)
+		asserter.Equal(uint64(0), serverMsg.Seq)
+	})
+
+	t.Run("TestAck", func(t *testing.T) {
+		asserter := require.New(t)
+		ts := newTestServer(t, 1024)
+
+		ic := ts.dialIngest(asserter)
+		defer ic.Close()
+		ic.readServerMessage(asserter)
+
+		serverMsg := ic.sendAcked(asserter, levelMessage(brotatomodtypes.MessageTypeTimeSeriesFull, 1), keepAliveMessage())
+		asserter.Equal(uint64(1), serverMsg.Seq)
+
+		serverMsg = ic.sendAcked(asserter, keepAliveMessage())
+		asserter.Equal(uint64(2), serverMsg.Seq)
+
+		// state is applied before the ack
+		ts.assertLevel(asserter, 1)
+	})
+
+	t.Run("TestTextMessage", func(t *testing.T) {
+		asserter := require.New(t)
+		ts := newTestServer(t, 1024)
+
+		ic := ts.dialIngest(asserter)
+		defer ic.Close()
+		ic.readServerMessage(asserter)
+
+		asserter.NoError(ic.WriteMessage(websocket.TextMessage, []byte("hello")))
+
+		serverMsg := ic.readServerMessage(asserter)
+		asserter.Equal(IngestServerMessageTypeError, serverMsg.Type)
+		asserter.Equal(uint64(1), serverMsg.Seq)
+		asserter.NotNil(serverMsg.ErrorResponse)
+		asserter.Equal(exporterserverutil.ErrorCodeInvalidBody, serverMsg.ErrorResponse.Error.Code)
+
+		// the connection stays open
+		serverMsg = ic.sendAcked(asserter, keepAliveMessage())
+		asserter.Equal(uint64(2), serverMsg.Seq)
+	})
+
+	t.Run("TestResendFullState", func(t *testing.T) {
+		asserter := require.New(t)
+		ts := newTestServer(t, 1024)
+
+		ic := ts.dialIngest(asserter)
+		defer ic.Close()
+		ic.readServerMessage(asserter)
+
+		ic.sendAcked(asserter, levelMessage(brotatomodtypes.MessageTypeTimeSeriesFull, 1))
+
+		sessInfo, ok := ts.sessionInfoMap.Load(ts.user.UserID)
+		asserter.True(ok)
+
+		// server forgets the mapping, the writer still thinks current_level is mapped
+		sessInfo.Lock()
+		sessInfo.MessageReader.Reset()
+		sessInfo.Unlock()
+
+		ic.sendMessages(asserter, levelMessage(brotatomodtypes.MessageTypeTimeSeriesDiff, 2))
+
+		serverMsg := ic.readServerMessage(asserter)
+		asserter.Equal(IngestServerMessageTypeResendFullState, serverMsg.Type)
+		asserter.Equal(uint64(2), serverMsg.Seq)
+
+		// connection stays usable after the mod starts over
+		serverMsg = ic.sendAcked(asserter, &brotatomodtypes.ExporterMessage{
+			MessageType:      brotatomodtypes.MessageTypeMappingReset,
+			MessageReason:    brotatomodtypes.MessageReasonNone,
+			MessageTimestamp: brotatomodtypes.MicroTimeFromTime(time.Now()),
+		}, levelMessage(brotatomodtypes.MessageTypeTimeSeriesFull, 3))
+		asserter.Equal(uint64(3), serverMsg.Seq)
+
+		ts.assertLevel(asserter, 3)
+	})
+
+	t.Run("TestTooLarge", func(t *testing.T) {
+		asserter := require.New(t)
+		ts := newTestServer(t, 1024)
+
+		ic := ts.dialIngest(asserter)
+		defer ic.Close()
+		ic.readServerMessage(asserter)
+
+		asserter.NoError(ic.WriteMessage(websocket.BinaryMessage, make([]byte, 2048)))
+
+		asserter.NoError(ic.SetReadDeadline(time.Now().Add(time.Second * 5)))
+		_, _, err := ic.ReadMessage()
+		asserter.True(websocket.IsCloseError(err, websocket.CloseMessageTooBig))
+	})
+}
+
+func TestPostMessage(t *testing.T) {
+	t.Run("TestAccepted", func(t *testing.T) {
+		asserter := require.New(t)
+		ts := newTestServer(t, 1024)
+
+		ps := ts.newPostSession(asserter)
+
+		postRes := readPostResponse(asserter, ps.post(asserter, ps.encode(asserter, levelMessage(brotatomodtypes.MessageTypeTimeSeriesFull, 1), keepAliveMessage()), ""))
+		asserter.Equal(2, postRes.AcceptedCount)
+		asserter.Empty(postRes.FailedFrames)
+
+		ts.assertLevel(asserter, 1)
+	})
+
+	t.Run("TestFailedFrames", func(t *testing.T) {
+		asserter := require.New(t)
+		ts := newTestServer(t, 1024)
+
+		ps := ts.newPostSession(asserter)
+
+		first := ps.encode(asserter, levelMessage(brotatomodtypes.MessageTypeTimeSeriesFull, 1))
+		second := ps.encode(asserter, levelMessage(brotatomodtypes.MessageTypeTimeSeriesDiff, 2))
+		third := ps.encode(asserter, levelMessage(brotatomodtypes.MessageTypeTimeSeriesDiff, 3))
+
+		// the second frame fails its checksum, the frames around it are still read
+		second[len(second)-1] ^= 0xff
+
+		postRes := readPostResponse(asserter, ps.post(asserter, slices.Concat(first, second, third), ""))
+		asserter.Equal(2, postRes.AcceptedCount)
+		asserter.Len(postRes.FailedFrames, 1)
+		asserter.Equal(1, postRes.FailedFrames[0].Index)
+		asserter.Equal(int64(len(first)), postRes.FailedFrames[0].Offset)
+		asserter.NotEmpty(postRes.FailedFrames[0].Error)
+		asserter.NotContains(postRes.FailedFrames[0].Error, "\n")
+
+		ts.assertLevel(asserter, 3)
+	})
+
+	t.Run("TestKeyMappingResetRequired", func(t *testing.T) {
+		asserter := require.New(t)
+		ts := newTestServer(t, 1024)
+
+		ps := ts.newPostSession(asserter)
+
+		readPostResponse(asserter, ps.post(asserter, ps.encode(asserter, levelMessage(brotatomodtypes.MessageTypeTimeSeriesFull, 1)), ""))
+
+		sessInfo, ok := ts.sessionInfoMap.Load(ts.user.UserID)
+		asserter.True(ok)
+
+		// server forgets the mapping, the writer still thinks current_level is mapped
+		sessInfo.Lock()
+		sessInfo.MessageReader.Reset()
+		sessInfo.Unlock()
+
+		res := ps.post(asserter, ps.encode(asserter, levelMessage(brotatomodtypes.MessageTypeTimeSeriesDiff, 2)), "")
+		asserter.Equal(exporterserverutil.ErrorCodeKeyMappingResetRequired, readErrorCode(asserter, res, http.StatusConflict))
+
+		// the mod starts its mappings over
+		postRes := readPostResponse(asserter, ps.post(asserter, ps.encode(asserter, &brotatomodtypes.ExporterMessage{
+			MessageType:      brotatomodtypes.MessageTypeMappingReset,
+			MessageReason:    brotatomodtypes.MessageReasonNone,
+			MessageTimestamp: brotatomodtypes.MicroTimeFromTime(time.Now()),
+		}, levelMessage(brotatomodtypes.MessageTypeTimeSeriesFull, 3)), ""))
+		asserter.Equal(2, postRes.AcceptedCount)
+
+		ts.assertLevel(asserter, 3)
+	})
+}
+
+func TestCompressedBody(t *testing.T) {
+	gzipBody := func(asserter *require.Assertions, body []byte) []byte {
+		gzipped := bytes.NewBuffer(nil)
+		gzipWriter := gzip.NewWriter(gzipped)
+		_, err := gzipWriter.Write(body)
+		asserter.NoError(err)
+		asserter.NoError(gzipWriter.Close())
+
+		return gzipped.Bytes()
+	}
+
+	zstdBody := func(asserter *require.Assertions, body []byte) []byte {
+		zstdEncoder, err := zstd.NewWriter(nil)
+		asserter.NoError(err)
+		defer zstdEncoder.Close()
+
+		return zstdEncoder.EncodeAll(body, nil)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		encoding string
+		compress func(asserter *require.Assertions, body []byte) []byte
+	}{
+		{name: "TestGzip", encoding: "gzip", compress: gzipBody},
+		{name: "TestZstd", encoding: "zstd", compress: zstdBody},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := require.New(t)
+			ts := newTestServer(t, 1024)
+
+			ps := ts.newPostSession(asserter)
+
+			body := ps.encode(asserter, levelMessage(brotatomodtypes.MessageTypeTimeSeriesFull, 5))
+
+			postRes := readPostResponse(asserter, ps.post(asserter, tc.compress(asserter, body), tc.encoding))
+			asserter.Equal(1, postRes.AcceptedCount)
+
+			ts.assertLevel(asserter, 5)
+		})
+	}
+
+	t.Run("TestTooLarge", func(t *testing.T) {
+		asserter := require.New(t)
+		ts := newTestServer(t, 1024)
+
+		ps := ts.newPostSession(asserter)
+
+		// small once compressed, but past the limit once decompressed
+		body := ps.encode(asserter, &brotatomodtypes.ExporterMessage{
+			MessageType:      brotatomodtypes.MessageTypeTimeSeriesFull,
+			MessageReason:    brotatomodtypes.MessageReasonPoll,
+			MessageTimestamp: brotatomodtypes.MicroTimeFromTime(time.Now()),
+			MessageBody: brotatoserial.NewMapDictReader(map[string]brotatomodtypes.DictKeyValue{
+				"current_character": {
+					MappedKey:  "current_character",
+					SerialType: brotatomodtypes.SerialTypeString,
+					Value:      bytes.Repeat([]byte("a"), 2048),
+				},
+			}),
+		})
+		compressed := gzipBody(asserter, body)
+		asserter.Less(len(compressed), 1024)
+
+		res := ps.post(asserter, compressed, "gzip")
+		asserter.Equal(exporterserverutil.ErrorCodeBodyTooLarge, readErrorCode(asserter, res, http.StatusRequestEntityTooLarge))
+	})
+
+	t.Run("TestUnsupportedEncoding", func(t *testing.T) {
+		asserter := require.New(t)
+		ts := newTestServer(t, 1024)
+
+		ps := ts.newPostSession(asserter)
+
+		res := ps.post(asserter, ps.encode(asserter, keepAliveMessage()), "br")
+		asserter.Equal(exporterserverutil.ErrorCodeUnsupportedEncoding, readErrorCode(asserter, res, http.StatusUnsupportedMediaType))
+	})
+}
+
+func TestCurrentState(t *testing.T) {
+	asserter := require.New(t)
+	ts := newTestServer(t, 1024)
+
+	ic := ts.dialIngest(asserter)
+	defer ic.Close()
+	ic.readServerMessage(asserter)
+
+	ic.sendAcked(asserter, levelMessage(brotatomodtypes.MessageTypeTimeSeriesFull, 3))
+
+	getState := func(query string, header http.Header) *http.Response {
+		return ts.doBearer(asserter, http.MethodGet, "/api/message/current-state"+query, nil, header)
+	}
+
+	res := getState("", nil)
+	defer res.Body.Close()
+	asserter.Equal(http.StatusOK, res.StatusCode)
+
+	resBody, err := io.ReadAll(res.Body)
+	asserter.NoError(err)
+	asserter.JSONEq(`{"current_level": 3}`, string(resBody))
+
+	etag := res.Header.Get("ETag")
+	asserter.NotEmpty(etag)
+	lastModified := res.Header.Get("Last-Modified")
+	asserter.NotEmpty(lastModified)
+
+	t.Run("TestConditional", func(t *testing.T) {
+		asserter := require.New(t)
+
+		res := getState("", http.Header{"If-None-Match": []string{etag}})
+		defer res.Body.Close()
+		asserter.Equal(http.StatusNotModified, res.StatusCode)
+
+		res = getState("", http.Header{"If-Modified-Since": []string{lastModified}})
+		defer res.Body.Close()
+		asserter.Equal(http.StatusNotModified, res.StatusCode)
+	})
+
+	t.Run("TestWithMeta", func(t *testing.T) {
+		asserter := require.New(t)
+
+		// the meta shape is tagged separately
+		res := getState("?with_meta=1", http.Header{"If-None-Match": []string{etag}})
+		defer res.Body.Close()
+		asserter.Equal(http.StatusOK, res.StatusCode)
+
+		meta := make(map[string]struct {
+			Value     json.RawMessage `json:"value"`
+			Type      string          `json:"type"`
+			UpdatedAt time.Time       `json:"updated_at"`
+			Reason    string          `json:"reason"`
+		})
+		asserter.NoError(json.NewDecoder(res.Body).Decode(&meta))
+		asserter.Equal(json.RawMessage("3"), meta["current_level"].Value)
+		asserter.Equal("Int8", meta["current_level"].Type)
+		asserter.Equal("Poll", meta["current_level"].Reason)
+		asserter.WithinDuration(time.Now(), meta["current_level"].UpdatedAt, time.Minute)
+
+		res = getState("?with_meta=maybe", nil)
+		defer res.Body.Close()
+		asserter.Equal(http.StatusBadRequest, res.StatusCode)
+	})
+
+	t.Run("TestProjection", func(t *testing.T) {
+		asserter := require.New(t)
+
+		// projections reuse the subscription key syntax, and are tagged separately too
+		res := getState("?keys=current_*", http.Header{"If-None-Match": []string{etag}})
+		defer res.Body.Close()
+		asserter.Equal(http.StatusOK, res.StatusCode)
+		resBody, err := io.ReadAll(res.Body)
+		asserter.NoError(err)
+		asserter.JSONEq(`{"current_level": 3}`, string(resBody))
+
+		res = getState("?exclude=current_level,gold", nil)
+		defer res.Body.Close()
+		resBody, err = io.ReadAll(res.Body)
+		asserter.NoError(err)
+		asserter.JSONEq(`{}`, string(resBody))
+
+		res = getState("?keys=current_[", nil)
+		defer res.Body.Close()
+		asserter.Equal(http.StatusBadRequest, res.StatusCode)
+		errRes := exporterserverutil.ErrorResponse{}
+		asserter.NoError(json.NewDecoder(res.Body).Decode(&errRes))
+		asserter.Equal(exporterserverutil.ErrorCodeInvalidKeyPattern, errRes.Error.Code)
+	})
+
+	t.Run("TestChanged", func(t *testing.T) {
+		asserter := require.New(t)
+
+		// a change gets a new tag
+		ic.sendAcked(asserter, levelMessage(brotatomodtypes.MessageTypeTimeSeriesDiff, 4))
+
+		res := getState("", http.Header{"If-None-Match": []string{etag}})
+		defer res.Body.Close()
+		asserter.Equal(http.StatusOK, res.StatusCode)
+		asserter.NotEqual(etag, res.Header.Get("ETag"))
+	})
+}
+
+func TestCapture(t *testing.T) {
+	asserter := require.New(t)
+	ts := newTestServer(t, 1024)
+
+	ic := ts.dialIngest(asserter)
+	defer ic.Close()
+	ic.readServerMessage(asserter)
+
+	res := ts.doBearer(asserter, http.MethodPut, "/api/message/capture", strings.NewReader(`{"enabled": true}`), nil)
+	defer res.Body.Close()
+	asserter.Equal(http.StatusOK, res.StatusCode)
+
+	status := new(CaptureStatus)
+	asserter.NoError(json.NewDecoder(res.Body).Decode(status))
+	asserter.True(status.Enabled)
+	asserter.Equal(int64(0), status.Size)
+
+	ic.sendAcked(asserter, levelMessage(brotatomodtypes.MessageTypeTimeSeriesFull, 4))
+	sentBody := bytes.Clone(ic.body.Bytes())
+
+	res = ts.doBearer(asserter, http.MethodGet, "/api/message/capture/file", nil, nil)
+	defer res.Body.Close()
+	asserter.Equal(http.StatusOK, res.StatusCode)
+
+	captureReader := brotatocapture.NewReader(res.Body)
+
+	record, err := captureReader.ReadRecord()
+	asserter.NoError(err)
+	asserter.Equal(brotatomodtypes.ProtocolVersionFramed, record.ProtocolVersion)
+	asserter.Equal(sentBody, record.Body)
+
+	_, err = captureReader.ReadRecord()
+	asserter.ErrorIs(err, io.EOF)
+
+	res = ts.doBearer(asserter, http.MethodPut, "/api/message/capture", strings.NewReader(`{"enabled": false}`), nil)
+	defer res.Body.Close()
+	asserter.Equal(http.StatusOK, res.StatusCode)
+
+	// capture stays around after turning it off
+	ic.sendAcked(asserter, keepAliveMessage())
+
+	stat, err := os.Stat(filepath.Join(ts.captureDir, ts.user.UserID.String()+".cap"))
+	asserter.NoError(err)
+	asserter.Equal(record.Offset+int64(len(record.Body)), stat.Size())
+
+	res = ts.doBearer(asserter, http.MethodDelete, "/api/message/capture/file", nil, nil)
+	defer res.Body.Close()
+	asserter.Equal(http.StatusNoContent, res.StatusCode)
+
+	res = ts.doBearer(asserter, http.MethodGet, "/api/message/capture/file", nil, nil)
+	defer res.Body.Close()
+	asserter.Equal(http.StatusNotFound, res.StatusCode)
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	asserter := require.New(t)
+	ts := newTestServer(t, 1024)
+
+	const overlayOrigin = "https://overlay.example.com"
+
+	subscribeURL := ts.wsURL("/api/message/subscribe?level=1")
+	subscribeHeader := http.Header{
+		"Authorization": []string{"Bearer " + ts.authKey},
+		"Origin":        []string{overlayOrigin},
+	}
+
+	_, res, err := websocket.DefaultDialer.Dial(subscribeURL, subscribeHeader)
+	asserter.Error(err)
+	asserter.Equal(http.StatusForbidden, res.StatusCode)
+
+	errRes := exporterserverutil.ErrorResponse{}
+	asserter.NoError(json.NewDecoder(res.Body).Decode(&errRes))
+	asserter.Equal(exporterserverutil.ErrorCodeOriginNotAllowed, errRes.Error.Code)
+
+	res = ts.doBearer(asserter, http.MethodPut, "/api/auth/allowed-origins", strings.NewReader(`{"allowed_origins": ["https://overlay.example.com/page"]}`), nil)
+	defer res.Body.Close()
+	asserter.Equal(http.StatusBadRequest, res.StatusCode)
+
+	res = ts.doBearer(asserter, http.MethodPut, "/api/auth/allowed-origins", strings.NewReader(`{"allowed_origins": ["HTTPS://Overlay.example.com/"]}`), nil)
+	defer res.Body.Close()
+	asserter.Equal(http.StatusOK, res.StatusCode)
+
+	allowedOrigins := new(ctrlauth.AllowedOrigins)
+	asserter.NoError(json.NewDecoder(res.Body).Decode(allowedOrigins))
+	asserter.Equal([]string{overlayOrigin}, allowedOrigins.AllowedOrigins)
+
+	subConn, _, err := websocket.DefaultDialer.Dial(subscribeURL, subscribeHeader)
+	asserter.NoError(err)
+	asserter.NoError(subConn.Close())
+
+	// preflights carry no credentials, user origins only get reads
+	preflightHeader := http.Header{
+		"Origin":                        []string{overlayOrigin},
+		"Access-Control-Request-Method": []string{http.MethodGet},
+	}
+	res = ts.do(asserter, http.MethodOptions, "/api/message/current-state", nil, preflightHeader)
+	defer res.Body.Close()
+	asserter.Equal(http.StatusNoContent, res.StatusCode)
+	asserter.Equal(overlayOrigin, res.Header.Get("Access-Control-Allow-Origin"))
+	asserter.Equal("Authorization", res.Header.Get("Access-Control-Allow-Headers"))
+
+	preflightHeader.Set("Access-Control-Request-Method", http.MethodPut)
+	res = ts.do(asserter, http.MethodOptions, "/api/message/capture", nil, preflightHeader)
+	defer res.Body.Close()
+	asserter.Empty(res.Header.Get("Access-Control-Allow-Origin"))
+
+	// the actual request is allowed through the user's override
+	res = ts.doBearer(asserter, http.MethodGet, "/api/message/current-state", nil, http.Header{
+		"Origin": []string{overlayOrigin},
+	})
+	defer res.Body.Close()
+	asserter.Equal(overlayOrigin, res.Header.Get("Access-Control-Allow-Origin"))
+
+	res = ts.do(asserter, http.MethodGet, "/api/message/current-state", nil, http.Header{
+		"Origin": []string{overlayOrigin},
+	})
+	defer res.Body.Close()
+	asserter.Empty(res.Header.Get("Access-Control-Allow-Origin"))
+}
+
+// TestSubscribeTicket tickets themselves are tested in ctrlauth, this checks the upgrade accepts the ticket subprotocol.
+func TestSubscribeTicket(t *testing.T) {
+	asserter := require.New(t)
+	ts := newTestServer(t, 1024)
+
+	res := ts.doBearer(asserter, http.MethodGet, "/api/auth/subscribe-ticket", nil, nil)
+	defer res.Body.Close()
+	asserter.Equal(http.StatusOK, res.StatusCode)
+
+	ticketRes := new(ctrlauth.SubscribeTicketResponse)
+	asserter.NoError(json.NewDecoder(res.Body).Decode(ticketRes))
+
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{ctrlauth.WebsocketSubprotocol, ctrlauth.TicketSubprotocolPrefix + ticketRes.Ticket}
+
+	subConn, _, err := dialer.Dial(ts.wsURL("/api/message/subscribe?level=1"), nil)
+	asserter.NoError(err)
+	asserter.Equal(ctrlauth.WebsocketSubprotocol, subConn.Subprotocol())
+	asserter.NoError(subConn.Close())
+}
@@ -0,0 +1,215 @@
+package ctrlmessage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatoserial"
+	"github.com/benw10-1/brotato-exporter/errutil"
+	"github.com/benw10-1/brotato-exporter/exporterserver/ctrlauth"
+	"github.com/benw10-1/brotato-exporter/exporterserver/exporterserverutil"
+	"github.com/benw10-1/brotato-exporter/logutil"
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+)
+
+// IngestServerMessageType
+type IngestServerMessageType string
+
+const (
+	// IngestServerMessageTypeAck the binary message with the same seq was read.
+	IngestServerMessageTypeAck IngestServerMessageType = "ack"
+	// IngestServerMessageTypeResendFullState the server does not have the mod's key mappings. The mod should send a
+	// MessageTypeMappingReset followed by the full state, the same as a 409 from /api/message/post.
+	IngestServerMessageTypeResendFullState IngestServerMessageType = "resend_full_state"
+	// IngestServerMessageTypeError the binary message with the same seq could not be read. The connection stays open.
+	IngestServerMessageTypeError IngestServerMessageType = "error"
+)
+
+// IngestServerMessage sent to the mod as a JSON text message. Every binary message gets exactly one reply with its seq,
+// resend_full_state may also be pushed with no seq.
+type IngestServerMessage struct {
+	Type IngestServerMessageType `json:"type"`
+	// Seq 1 based count of binary messages received on this connection.
+	Seq uint64 `json:"seq,omitempty"`
+
+	*PostMessageResponse
+
+	// ErrorResponse set for IngestServerMessageTypeError, the same body as HTTP error responses.
+	*exporterserverutil.ErrorResponse
+}
+
+// ingest reads binary message bodies from a websocket, each handled the same as a body posted to /api/message/post.
+// Keep alives are sent as MessageTypeKeepAlive messages like any other. The connection is closed once the session expires,
+// the mod then authenticates again and reconnects.
+func (api *MessageAPI) ingest(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	requestID := exporterserverutil.GetRequestIDFromCtx(r.Context())
+
+	sess, ok := ctrlauth.GetSessionFromCtx(r.Context())
+	if !ok {
+		exporterserverutil.WriteError(w, r, exporterserverutil.NewResponseError(nil, http.StatusUnauthorized, exporterserverutil.ErrorCodeUnauthorized, "Unauthorized"))
+		return
+	}
+
+	sessInfo, ok := api.sessionInfoMap.Load(sess.UserID)
+	if !ok {
+		exporterserverutil.WriteError(w, r, exporterserverutil.NewResponseError(nil, http.StatusUnauthorized, exporterserverutil.ErrorCodeUnauthorized, "Unauthorized"))
+		return
+	}
+
+	err := api.originNotAllowedError(r)
+	if err != nil {
+		exporterserverutil.WriteError(w, r, err)
+		return
+	}
+
+	conn, err := api.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.WarnContext(r.Context(), "ctrlmessage.MessageAPI.ingest: upgrade error", logutil.Err(err))
+		return
+	}
+	defer func(conn *websocket.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	conn.SetReadLimit(api.maxBodySize)
+
+	// server was restarted or the session was swept while idle, no point waiting for the first mapping miss
+	if sessInfo.State.Snapshot().Len() == 0 {
+		err = conn.WriteJSON(IngestServerMessage{Type: IngestServerMessageTypeResendFullState})
+		if err != nil {
+			slog.InfoContext(r.Context(), "ctrlmessage.MessageAPI.ingest: conn error", logutil.Err(err))
+			return
+		}
+	}
+
+	bodyReader := byteBufferPool.Get().(*bytes.Buffer)
+	defer func() {
+		byteBufferPool.Put(bodyReader)
+	}()
+
+	connErr := func() error {
+		var seq uint64
+		for {
+			// keep alives come in every second or so, anything longer and the mod is gone
+			deadline := time.Now().Add(activityTimeout)
+			if sess.ExpiresAt.Time.Before(deadline) {
+				deadline = sess.ExpiresAt.Time
+			}
+
+			err := conn.SetReadDeadline(deadline)
+			if err != nil {
+				return errutil.NewStackError(err)
+			}
+
+			messageType, msgReader, err := conn.NextReader()
+			if err != nil {
+				return api.closeIngest(r.Context(), conn, sess, requestID, err)
+			}
+			receivedTime := time.Now()
+			seq++
+
+			if messageType != websocket.BinaryMessage {
+				err = conn.WriteJSON(ingestServerMessageFromResult(r.Context(), requestID, seq, PostMessageResponse{}, exporterserverutil.NewResponseError(
+					nil, http.StatusBadRequest, exporterserverutil.ErrorCodeInvalidBody, "Expected binary message",
+				)))
+				if err != nil {
+					return errutil.NewStackError(err)
+				}
+
+				continue
+			}
+
+			bodyReader.Reset()
+
+			_, err = io.Copy(bodyReader, msgReader)
+			if err != nil {
+				return api.closeIngest(r.Context(), conn, sess, requestID, err)
+			}
+
+			_, res, err := api.readSessionMessages(r.Context(), sess.UserID, receivedTime, bodyReader)
+
+			err = conn.WriteJSON(ingestServerMessageFromResult(r.Context(), requestID, seq, res, err))
+			if err != nil {
+				return errutil.NewStackError(err)
+			}
+		}
+	}()
+	if connErr != nil {
+		slog.InfoContext(r.Context(), "ctrlmessage.MessageAPI.ingest: conn error", logutil.Err(connErr))
+	}
+}
+
+// ingestServerMessageFromResult reply for the binary message seq.
+func ingestServerMessageFromResult(ctx context.Context, requestID string, seq uint64, res PostMessageResponse, err error) IngestServerMessage {
+	if err == nil {
+		return IngestServerMessage{
+			Type:                IngestServerMessageTypeAck,
+			Seq:                 seq,
+			PostMessageResponse: &res,
+		}
+	}
+
+	if errors.Is(err, brotatoserial.ErrKeyNotMapped) {
+		slog.InfoContext(ctx, "ctrlmessage.MessageAPI.ingest: key mapping reset required", logutil.Err(err))
+
+		// messages before the one which failed were still applied
+		return IngestServerMessage{
+			Type:                IngestServerMessageTypeResendFullState,
+			Seq:                 seq,
+			PostMessageResponse: &res,
+		}
+	}
+
+	slog.WarnContext(ctx, "ctrlmessage.MessageAPI.ingest: error reading message", slog.Uint64("seq", seq), logutil.Err(err))
+
+	errRes := exporterserverutil.AsResponseError(err).Response(requestID)
+
+	return IngestServerMessage{
+		Type:          IngestServerMessageTypeError,
+		Seq:           seq,
+		ErrorResponse: &errRes,
+	}
+}
+
+// closeIngest sends a close message explaining why the read failed, if the mod didn't close the connection itself.
+// Returns nil when the connection ended normally.
+func (api *MessageAPI) closeIngest(ctx context.Context, conn *websocket.Conn, sess *ctrlauth.Session, requestID string, readErr error) error {
+	var closeErr *websocket.CloseError
+	if errors.As(readErr, &closeErr) {
+		slog.InfoContext(ctx, "ctrlmessage.MessageAPI.ingest: connection closed", slog.Int("close_code", closeErr.Code), slog.String("close_text", closeErr.Text))
+		return nil
+	}
+
+	// the websocket library already sent CloseMessageTooBig
+	if errors.Is(readErr, websocket.ErrReadLimit) {
+		return errutil.NewStackError(fmt.Errorf("message larger than %d bytes: %w", api.maxBodySize, readErr))
+	}
+
+	closeCode := websocket.CloseInternalServerErr
+	responseErr := exporterserverutil.NewResponseError(readErr, http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Error reading message")
+
+	var netErr net.Error
+	switch {
+	case errors.As(readErr, &netErr) && netErr.Timeout() && time.Now().After(sess.ExpiresAt.Time):
+		closeCode = websocket.ClosePolicyViolation
+		responseErr = exporterserverutil.NewResponseError(readErr, http.StatusUnauthorized, exporterserverutil.ErrorCodeSessionExpired, "Session expired")
+	case errors.As(readErr, &netErr) && netErr.Timeout():
+		closeCode = websocket.CloseGoingAway
+		responseErr = exporterserverutil.NewResponseError(readErr, http.StatusRequestTimeout, exporterserverutil.ErrorCodeTimeout, fmt.Sprintf("Timed out after (%s)", activityTimeout.String()))
+	}
+
+	err := conn.WriteControl(websocket.CloseMessage, exporterserverutil.FormatCloseError(closeCode, requestID, responseErr), time.Now().Add(time.Second))
+	if err != nil {
+		return errutil.NewStackError(errors.Join(readErr, err))
+	}
+
+	return errutil.NewStackError(readErr)
+}
@@ -0,0 +1,189 @@
+package ctrlmod
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodzip"
+	"github.com/benw10-1/brotato-exporter/errutil"
+	"github.com/benw10-1/brotato-exporter/exporterserver/ctrlauth"
+	"github.com/benw10-1/brotato-exporter/exporterserver/exporterserverutil"
+	"github.com/julienschmidt/httprouter"
+)
+
+const downloadLinkDuration = time.Minute * 10
+
+// ModAPI
+type ModAPI struct {
+	// modFS mod tree to zip. Expected to contain mods-unpacked at the root.
+	modFS fs.FS
+
+	// connectionData defaults for the generated config. Empty host/port are taken from the request.
+	connectionData brotatomodtypes.ModConfigConnectionData
+
+	ticketStore *ctrlauth.TicketStore
+}
+
+// NewModAPI
+func NewModAPI(modFS fs.FS, connectionData brotatomodtypes.ModConfigConnectionData, ticketStore *ctrlauth.TicketStore) *ModAPI {
+	return &ModAPI{
+		modFS:          modFS,
+		connectionData: connectionData,
+		ticketStore:    ticketStore,
+	}
+}
+
+// RegisterRoutes
+func (api *ModAPI) RegisterRoutes(router *httprouter.Router) {
+	router.GET("/api/mod/download", api.download)
+	router.GET("/api/mod/download/:ticket", api.downloadTicket)
+
+	router.POST("/api/mod/download-link", api.downloadLink)
+}
+
+// download
+func (api *ModAPI) download(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	exporterserverutil.WriteError(w, r, func() error {
+		authKey, ok := ctrlauth.GetAuthKeyFromCtx(r.Context())
+		if !ok {
+			return exporterserverutil.NewResponseError(nil, http.StatusUnauthorized, exporterserverutil.ErrorCodeUnauthorized, "Unauthorized")
+		}
+
+		return api.writeModZip(w, r, authKey)
+	}())
+}
+
+// downloadTicket same as download, but authenticated by a one-time ticket in the path so it can be handed out as a plain link.
+func (api *ModAPI) downloadTicket(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	exporterserverutil.WriteError(w, r, func() error {
+		ticket, ok := api.ticketStore.Redeem(params.ByName("ticket"))
+		if !ok {
+			return exporterserverutil.NewResponseError(nil, http.StatusNotFound, exporterserverutil.ErrorCodeNotFound, "Download link is invalid or expired")
+		}
+
+		return api.writeModZip(w, r, ticket.AuthKey)
+	}())
+}
+
+// DownloadLinkResponse
+type DownloadLinkResponse struct {
+	URL        string `json:"url"`
+	ExpireTime string `json:"expire_time"`
+}
+
+// downloadLink
+func (api *ModAPI) downloadLink(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	exporterserverutil.WriteError(w, r, func() error {
+		userID, ok := ctrlauth.GetUserIDFromCtx(r.Context())
+		if !ok {
+			return exporterserverutil.NewResponseError(nil, http.StatusUnauthorized, exporterserverutil.ErrorCodeUnauthorized, "Unauthorized")
+		}
+
+		authKey, ok := ctrlauth.GetAuthKeyFromCtx(r.Context())
+		if !ok {
+			return exporterserverutil.NewResponseError(nil, http.StatusUnauthorized, exporterserverutil.ErrorCodeUnauthorized, "Unauthorized")
+		}
+
+		ticketStr, ticket, err := api.ticketStore.Issue(userID, authKey, downloadLinkDuration)
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to create download link")
+		}
+
+		linkResponse := &DownloadLinkResponse{
+			URL:        api.serverURL(r) + "/api/mod/download/" + ticketStr,
+			ExpireTime: ticket.ExpiresAt.Format(time.RFC3339),
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err = json.NewEncoder(w).Encode(linkResponse)
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to write JSON")
+		}
+
+		return nil
+	}())
+}
+
+// writeModZip builds the zip in memory so a failure part way through can still be reported as an error response.
+func (api *ModAPI) writeModZip(w http.ResponseWriter, r *http.Request, authKey []byte) error {
+	config := brotatomodtypes.ModConfig{
+		Enabled:        true,
+		ConnectionData: api.connectionDataForRequest(r),
+	}
+	config.ConnectionData.AuthToken = string(authKey)
+
+	zipBuf := bytes.NewBuffer(nil)
+
+	err := brotatomodzip.WriteModZip(zipBuf, api.modFS, config)
+	if err != nil {
+		return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to build mod zip")
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="user-mod.zip"`)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	_, err = zipBuf.WriteTo(w)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	return nil
+}
+
+// serverURL scheme and host the mod is configured to reach the server at, so links handed out don't depend on the
+// request's Host header unless nothing is configured.
+func (api *ModAPI) serverURL(r *http.Request) string {
+	connectionData := api.connectionDataForRequest(r)
+
+	scheme := "http"
+	defaultPort := 80
+	if connectionData.HTTPS {
+		scheme = "https"
+		defaultPort = 443
+	}
+
+	if connectionData.Port == 0 || connectionData.Port == defaultPort {
+		// IPv6 hosts still need their brackets without a port
+		return scheme + "://" + strings.TrimSuffix(net.JoinHostPort(connectionData.Host, "0"), ":0")
+	}
+
+	return scheme + "://" + net.JoinHostPort(connectionData.Host, strconv.Itoa(connectionData.Port))
+}
+
+// connectionDataForRequest fills in any unset connection defaults from the address the request was made to.
+func (api *ModAPI) connectionDataForRequest(r *http.Request) brotatomodtypes.ModConfigConnectionData {
+	connectionData := api.connectionData
+	if connectionData.Host != "" && connectionData.Port != 0 {
+		return connectionData
+	}
+
+	reqHost, reqPortStr, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		reqHost = r.Host
+		reqPortStr = "80"
+		if r.TLS != nil {
+			reqPortStr = "443"
+		}
+	}
+
+	if connectionData.Host == "" {
+		connectionData.Host = reqHost
+		connectionData.HTTPS = r.TLS != nil
+	}
+
+	if connectionData.Port == 0 {
+		connectionData.Port, _ = strconv.Atoi(reqPortStr)
+	}
+
+	return connectionData
+}
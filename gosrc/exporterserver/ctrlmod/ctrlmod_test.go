@@ -0,0 +1,138 @@
+package ctrlmod
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodassets"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodzip"
+	"github.com/benw10-1/brotato-exporter/exporterserver/ctrlauth"
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModDownload(t *testing.T) {
+	modAPI := NewModAPI(brotatomodassets.ModFS(), brotatomodtypes.ModConfigConnectionData{}, ctrlauth.NewTicketStore())
+	router := httprouter.New()
+	modAPI.RegisterRoutes(router)
+
+	userID := uuid.New()
+	authKey := []byte("test-auth-key")
+
+	authedReq := func(method string, target string) *http.Request {
+		req := httptest.NewRequest(method, target, nil)
+		ctx := context.WithValue(req.Context(), ctrlauth.UserIDCtxKeyStr, userID)
+		ctx = context.WithValue(ctx, ctrlauth.AuthKeyCtxKeyStr, authKey)
+
+		return req.WithContext(ctx)
+	}
+
+	readConfig := func(t *testing.T, body []byte) brotatomodtypes.ModConfig {
+		asserter := require.New(t)
+
+		zipReader, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		asserter.NoError(err)
+
+		configFile, err := zipReader.Open(brotatomodzip.ConfigFilePath)
+		asserter.NoError(err)
+		defer configFile.Close()
+
+		configBytes, err := io.ReadAll(configFile)
+		asserter.NoError(err)
+
+		config := brotatomodtypes.ModConfig{}
+		asserter.NoError(json.Unmarshal(configBytes, &config))
+
+		return config
+	}
+
+	t.Run("TestUnauthorized", func(t *testing.T) {
+		asserter := require.New(t)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/mod/download", nil))
+
+		asserter.Equal(http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("TestDownload", func(t *testing.T) {
+		asserter := require.New(t)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, authedReq(http.MethodGet, "http://example.com:9000/api/mod/download"))
+
+		asserter.Equal(http.StatusOK, w.Code)
+		asserter.Equal("application/zip", w.Result().Header.Get("Content-Type"))
+
+		config := readConfig(t, w.Body.Bytes())
+		asserter.Equal(string(authKey), config.ConnectionData.AuthToken)
+		asserter.Equal("example.com", config.ConnectionData.Host)
+		asserter.Equal(9000, config.ConnectionData.Port)
+	})
+
+	t.Run("TestDownloadLink", func(t *testing.T) {
+		asserter := require.New(t)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, authedReq(http.MethodPost, "http://example.com:9000/api/mod/download-link"))
+		asserter.Equal(http.StatusOK, w.Code)
+
+		linkResponse := new(DownloadLinkResponse)
+		asserter.NoError(json.Unmarshal(w.Body.Bytes(), linkResponse))
+
+		linkURL, err := url.Parse(linkResponse.URL)
+		asserter.NoError(err)
+		// nothing configured, link goes where the request went
+		asserter.Equal("http://example.com:9000", linkURL.Scheme+"://"+linkURL.Host)
+
+		// link is not authenticated by anything other than the ticket
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, linkURL.String(), nil))
+		asserter.Equal(http.StatusOK, w.Code)
+
+		config := readConfig(t, w.Body.Bytes())
+		asserter.Equal(string(authKey), config.ConnectionData.AuthToken)
+
+		// single use
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, linkURL.String(), nil))
+		asserter.Equal(http.StatusNotFound, w.Code)
+	})
+	t.Run("TestDownloadLinkConfigured", func(t *testing.T) {
+		asserter := require.New(t)
+
+		configuredAPI := NewModAPI(brotatomodassets.ModFS(), brotatomodtypes.ModConfigConnectionData{
+			Host:  "exporter.example.com",
+			Port:  443,
+			HTTPS: true,
+		}, ctrlauth.NewTicketStore())
+		configuredRouter := httprouter.New()
+		configuredAPI.RegisterRoutes(configuredRouter)
+
+		// Host header is up to the client, the configured host wins
+		w := httptest.NewRecorder()
+		configuredRouter.ServeHTTP(w, authedReq(http.MethodPost, "http://attacker.example.com/api/mod/download-link"))
+		asserter.Equal(http.StatusOK, w.Code)
+
+		linkResponse := new(DownloadLinkResponse)
+		asserter.NoError(json.Unmarshal(w.Body.Bytes(), linkResponse))
+
+		linkURL, err := url.Parse(linkResponse.URL)
+		asserter.NoError(err)
+		asserter.Equal("https", linkURL.Scheme)
+		asserter.Equal("exporter.example.com", linkURL.Host)
+
+		w = httptest.NewRecorder()
+		configuredRouter.ServeHTTP(w, httptest.NewRequest(http.MethodGet, linkURL.RequestURI(), nil))
+		asserter.Equal(http.StatusOK, w.Code)
+	})
+}
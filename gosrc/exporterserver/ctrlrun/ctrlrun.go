@@ -0,0 +1,176 @@
+package ctrlrun
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/errutil"
+	"github.com/benw10-1/brotato-exporter/exporterserver/ctrlauth"
+	"github.com/benw10-1/brotato-exporter/exporterserver/exporterserverutil"
+	"github.com/benw10-1/brotato-exporter/exporterstore"
+	"github.com/benw10-1/brotato-exporter/exporterstore/exporterstoretypes"
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+const timeFormat = "2006-01-02T15:04:05Z07:00"
+
+// RunAPI history of the runs recorded by runrecorder.
+type RunAPI struct {
+	exporterStore *exporterstore.ExporterStore
+}
+
+// NewRunAPI
+func NewRunAPI(exporterStore *exporterstore.ExporterStore) *RunAPI {
+	return &RunAPI{
+		exporterStore: exporterStore,
+	}
+}
+
+// RegisterRoutes
+func (api *RunAPI) RegisterRoutes(router *httprouter.Router) {
+	router.GET("/api/runs", api.listRuns)
+	router.GET("/api/runs/:run_id", api.getRun)
+}
+
+// RunSummary
+type RunSummary struct {
+	RunID     string `json:"run_id"`
+	Character string `json:"character"`
+	StartTime string `json:"start_time"`
+	// EndTime empty while the run is active.
+	EndTime string `json:"end_time,omitempty"`
+	Outcome string `json:"outcome"`
+	// WaveCount waves finished.
+	WaveCount int `json:"wave_count"`
+}
+
+// RunListResponse
+type RunListResponse struct {
+	Runs []RunSummary `json:"runs"`
+}
+
+// RunWave
+type RunWave struct {
+	Wave    int                `json:"wave"`
+	EndTime string             `json:"end_time"`
+	Stats   map[string]float64 `json:"stats"`
+}
+
+// RunResponse
+type RunResponse struct {
+	RunSummary
+	Waves []RunWave `json:"waves"`
+}
+
+// listRuns the user's latest runs, newest first.
+func (api *RunAPI) listRuns(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	exporterserverutil.WriteError(w, r, func() error {
+		userID, ok := ctrlauth.GetUserIDFromCtx(r.Context())
+		if !ok {
+			return exporterserverutil.NewResponseError(nil, http.StatusUnauthorized, exporterserverutil.ErrorCodeUnauthorized, "Unauthorized")
+		}
+
+		limit := defaultListLimit
+		if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+			var err error
+			limit, err = strconv.Atoi(limitStr)
+			if err != nil || limit < 1 || limit > maxListLimit {
+				return exporterserverutil.NewResponseError(errutil.NewStackErrorf("invalid limit (%s)", limitStr), http.StatusBadRequest, exporterserverutil.ErrorCodeInvalidRequest, "Invalid limit")
+			}
+		}
+
+		runs, err := api.exporterStore.ListRuns(userID, limit)
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to list runs")
+		}
+
+		res := &RunListResponse{
+			Runs: make([]RunSummary, 0, len(runs)),
+		}
+		for _, run := range runs {
+			res.Runs = append(res.Runs, runSummary(run))
+		}
+
+		return writeJSON(w, res)
+	}())
+}
+
+// getRun one run with the stats of each wave.
+func (api *RunAPI) getRun(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	exporterserverutil.WriteError(w, r, func() error {
+		userID, ok := ctrlauth.GetUserIDFromCtx(r.Context())
+		if !ok {
+			return exporterserverutil.NewResponseError(nil, http.StatusUnauthorized, exporterserverutil.ErrorCodeUnauthorized, "Unauthorized")
+		}
+
+		runID, err := uuid.Parse(params.ByName("run_id"))
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusBadRequest, exporterserverutil.ErrorCodeInvalidRequest, "Invalid run_id")
+		}
+
+		run, err := api.exporterStore.GetRun(userID, runID)
+		if errors.Is(err, exporterstore.ErrRunNotFound) {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusNotFound, exporterserverutil.ErrorCodeNotFound, "Run not found")
+		}
+		if err != nil {
+			return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to get run")
+		}
+
+		res := &RunResponse{
+			RunSummary: runSummary(run),
+			Waves:      make([]RunWave, 0, len(run.Waves)),
+		}
+		for _, wave := range run.Waves {
+			res.Waves = append(res.Waves, RunWave{
+				Wave:    wave.Wave,
+				EndTime: formatTime(wave.EndTime),
+				Stats:   wave.Stats,
+			})
+		}
+
+		return writeJSON(w, res)
+	}())
+}
+
+// runSummary
+func runSummary(run *exporterstoretypes.ExporterRun) RunSummary {
+	return RunSummary{
+		RunID:     run.RunID.String(),
+		Character: run.Character,
+		StartTime: formatTime(run.StartTime),
+		EndTime:   formatTime(run.EndTime),
+		Outcome:   string(run.Outcome),
+		WaveCount: len(run.Waves),
+	}
+}
+
+// formatTime empty for the zero time.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(timeFormat)
+}
+
+// writeJSON
+func writeJSON(w http.ResponseWriter, res any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	err := json.NewEncoder(w).Encode(res)
+	if err != nil {
+		return exporterserverutil.NewResponseError(errutil.NewStackError(err), http.StatusInternalServerError, exporterserverutil.ErrorCodeInternal, "Failed to write JSON")
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package ctrlrun
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/exporterserver/ctrlauth"
+	"github.com/benw10-1/brotato-exporter/exporterstore"
+	"github.com/benw10-1/brotato-exporter/exporterstore/exporterstoretypes"
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuns(t *testing.T) {
+	asserter := require.New(t)
+
+	exporterStore, err := exporterstore.NewExporterStore(filepath.Join(t.TempDir(), "runs.db"))
+	asserter.NoError(err)
+	defer exporterStore.Close()
+
+	router := httprouter.New()
+	NewRunAPI(exporterStore).RegisterRoutes(router)
+
+	userID := uuid.New()
+	startTime := time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	endedRun := &exporterstoretypes.ExporterRun{
+		UserID:    userID,
+		Character: "character_knight",
+		StartTime: startTime,
+		EndTime:   startTime.Add(time.Minute * 2),
+		Outcome:   exporterstoretypes.RunOutcomeEnded,
+		Waves: []exporterstoretypes.ExporterRunWave{
+			{Wave: 1, EndTime: startTime.Add(time.Minute), Stats: map[string]float64{"current_level": 2}},
+			{Wave: 2, EndTime: startTime.Add(time.Minute * 2), Stats: map[string]float64{"current_level": 4}},
+		},
+	}
+	asserter.NoError(exporterStore.UpsertRun(endedRun, 0))
+
+	activeRun := &exporterstoretypes.ExporterRun{
+		UserID:    userID,
+		Character: "character_brawler",
+		StartTime: startTime.Add(time.Hour),
+		Outcome:   exporterstoretypes.RunOutcomeActive,
+	}
+	asserter.NoError(exporterStore.UpsertRun(activeRun, 0))
+
+	// someone else's
+	asserter.NoError(exporterStore.UpsertRun(&exporterstoretypes.ExporterRun{UserID: uuid.New(), Outcome: exporterstoretypes.RunOutcomeActive}, 0))
+
+	get := func(target string, authed bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if authed {
+			req = req.WithContext(context.WithValue(req.Context(), ctrlauth.UserIDCtxKeyStr, userID))
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		return w
+	}
+
+	asserter.Equal(http.StatusUnauthorized, get("/api/runs", false).Code)
+
+	w := get("/api/runs", true)
+	asserter.Equal(http.StatusOK, w.Code)
+
+	list := new(RunListResponse)
+	asserter.NoError(json.Unmarshal(w.Body.Bytes(), list))
+	asserter.Len(list.Runs, 2)
+	asserter.Equal(activeRun.RunID.String(), list.Runs[0].RunID)
+	asserter.Equal("active", list.Runs[0].Outcome)
+	asserter.Empty(list.Runs[0].EndTime)
+	asserter.Equal(2, list.Runs[1].WaveCount)
+	asserter.Equal("2024-08-01T12:02:00Z", list.Runs[1].EndTime)
+
+	w = get("/api/runs?limit=1", true)
+	asserter.NoError(json.Unmarshal(w.Body.Bytes(), list))
+	asserter.Len(list.Runs, 1)
+
+	asserter.Equal(http.StatusBadRequest, get("/api/runs?limit=0", true).Code)
+	asserter.Equal(http.StatusBadRequest, get("/api/runs?limit=abc", true).Code)
+
+	w = get("/api/runs/"+endedRun.RunID.String(), true)
+	asserter.Equal(http.StatusOK, w.Code)
+
+	run := new(RunResponse)
+	asserter.NoError(json.Unmarshal(w.Body.Bytes(), run))
+	asserter.Equal("character_knight", run.Character)
+	asserter.Len(run.Waves, 2)
+	asserter.Equal(2, run.Waves[1].Wave)
+	asserter.Equal(float64(4), run.Waves[1].Stats["current_level"])
+
+	asserter.Equal(http.StatusNotFound, get("/api/runs/"+uuid.NewString(), true).Code)
+	asserter.Equal(http.StatusBadRequest, get("/api/runs/not-a-uuid", true).Code)
+}
@@ -0,0 +1,458 @@
+package exporterloadtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatosim"
+	"github.com/benw10-1/brotato-exporter/errutil"
+	"github.com/benw10-1/brotato-exporter/exporterserver/modclient"
+	"github.com/gorilla/websocket"
+)
+
+// seqKey key carrying the diff's sequence number so subscribers can match what they receive to when it was posted.
+const seqKey = "load_seq"
+
+// Config
+type Config struct {
+	// Users mod clients posting at the same time, each as its own user.
+	Users int
+	// SubscribersPerUser websocket subscribers to every key of each user.
+	SubscribersPerUser int
+	// PostInterval time between diffs from one client. 0 posts the next diff as soon as the last one is answered.
+	PostInterval time.Duration
+	// PostsPerUser diffs each client posts before stopping, 0 to keep posting until Duration is up.
+	PostsPerUser int
+	// Duration stop posting after this long, 0 to stop only on PostsPerUser.
+	Duration time.Duration
+	// DrainTimeout time to wait for subscribers to receive the last diffs, anything still missing after is counted as dropped.
+	DrainTimeout time.Duration
+	// ProtocolVersion clients ask for.
+	ProtocolVersion brotatomodtypes.ProtocolVersion
+}
+
+// DefaultConfig a minute of 10 players posting at the mod's poll rate with 5 viewers each.
+func DefaultConfig() Config {
+	return Config{
+		Users:              10,
+		SubscribersPerUser: 5,
+		PostInterval:       time.Second * 2,
+		Duration:           time.Minute,
+		DrainTimeout:       time.Second * 2,
+		ProtocolVersion:    brotatomodtypes.ProtocolVersionMax,
+	}
+}
+
+// Result
+type Result struct {
+	// Elapsed time spent posting.
+	Elapsed time.Duration
+	// Posts accepted by the server.
+	Posts int64
+	// PostErrors posts which failed, these aren't expected by subscribers.
+	PostErrors int64
+	// Expected messages subscribers should have received, accepted posts times subscribers.
+	Expected int64
+	// Received messages subscribers received.
+	Received int64
+	// Dropped messages subscribers never received, mostly from full subscriber channels on the server.
+	Dropped int64
+
+	// FanOutP50 time from posting a diff to a subscriber receiving it.
+	FanOutP50 time.Duration
+	FanOutP99 time.Duration
+	FanOutMax time.Duration
+
+	// PostP50 round trip of a post.
+	PostP50 time.Duration
+	PostP99 time.Duration
+
+	// PeakHeapInuse sampled every 100ms. Includes the load generator when the server is in the same process.
+	PeakHeapInuse uint64
+	// TotalAlloc bytes allocated during the run.
+	TotalAlloc uint64
+	// PeakGoroutines sampled every 100ms.
+	PeakGoroutines int
+}
+
+// PostsPerSecond
+func (r Result) PostsPerSecond() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+
+	return float64(r.Posts) / r.Elapsed.Seconds()
+}
+
+// String multi-line report.
+func (r Result) String() string {
+	sb := new(strings.Builder)
+
+	fmt.Fprintf(sb, "posts:      %d accepted, %d failed in %s (%.1f/s)\n", r.Posts, r.PostErrors, r.Elapsed.Round(time.Millisecond), r.PostsPerSecond())
+	fmt.Fprintf(sb, "post:       p50 %s, p99 %s\n", r.PostP50, r.PostP99)
+	fmt.Fprintf(sb, "fan-out:    p50 %s, p99 %s, max %s\n", r.FanOutP50, r.FanOutP99, r.FanOutMax)
+	fmt.Fprintf(sb, "delivered:  %d of %d, %d dropped\n", r.Received, r.Expected, r.Dropped)
+	fmt.Fprintf(sb, "memory:     peak heap in use %.1f MiB, %.1f MiB allocated\n", float64(r.PeakHeapInuse)/(1<<20), float64(r.TotalAlloc)/(1<<20))
+	fmt.Fprintf(sb, "goroutines: peak %d", r.PeakGoroutines)
+
+	return sb.String()
+}
+
+// userLoad one simulated player and their subscribers.
+type userLoad struct {
+	authKey string
+
+	// sentTimeMap when each sequence number was posted
+	sentTimeMap map[int32]time.Time
+	mu          sync.Mutex
+
+	subConnList []*websocket.Conn
+}
+
+// sentTime
+func (ul *userLoad) sentTime(seq int32) (time.Time, bool) {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+
+	sentTime, ok := ul.sentTimeMap[seq]
+	return sentTime, ok
+}
+
+// setSentTime
+func (ul *userLoad) setSentTime(seq int32, sentTime time.Time) {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+
+	ul.sentTimeMap[seq] = sentTime
+}
+
+// deleteSentTime
+func (ul *userLoad) deleteSentTime(seq int32) {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+
+	delete(ul.sentTimeMap, seq)
+}
+
+// Run connects every subscriber, then has each user post diffs until PostsPerUser or Duration is reached, and reports how
+// long the diffs took to reach the subscribers. baseURL is the scheme and host of the server, authKeys needs one key per user.
+// Cancelling ctx stops posting early, the result still covers what was posted.
+func Run(ctx context.Context, baseURL string, authKeys []string, config Config) (Result, error) {
+	result := Result{}
+
+	if config.Users < 1 {
+		return result, errutil.NewStackErrorf("need at least one user, got (%d)", config.Users)
+	}
+
+	if len(authKeys) < config.Users {
+		return result, errutil.NewStackErrorf("need (%d) auth keys, got (%d)", config.Users, len(authKeys))
+	}
+
+	if config.PostsPerUser <= 0 && config.Duration <= 0 {
+		return result, errutil.NewStackErrorf("need PostsPerUser or Duration to know when to stop")
+	}
+
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	// share connections between clients, the default transport only keeps 2 idle per host
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = config.Users
+	defer transport.CloseIdleConnections()
+
+	httpClient := &http.Client{Timeout: time.Second * 10, Transport: transport}
+
+	sampleCtx, cancelSampleCtx := context.WithCancel(context.Background())
+	sampleDone := make(chan struct{})
+
+	var startMemStats runtime.MemStats
+	runtime.ReadMemStats(&startMemStats)
+
+	go func() {
+		defer close(sampleDone)
+		sampleMemory(sampleCtx, &result)
+	}()
+
+	userLoadList := make([]*userLoad, config.Users)
+	for i := range userLoadList {
+		userLoadList[i] = &userLoad{
+			authKey:     authKeys[i],
+			sentTimeMap: make(map[int32]time.Time),
+		}
+	}
+
+	// subscribers are connected before anything is posted so every post is expected by all of them
+	subWG := new(sync.WaitGroup)
+	subLatencyLists := make([][]time.Duration, 0, config.Users*config.SubscribersPerUser)
+	subLatencyMu := new(sync.Mutex)
+
+	closeSubs := func() {
+		for _, ul := range userLoadList {
+			for _, conn := range ul.subConnList {
+				_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+				_ = conn.Close()
+			}
+		}
+		subWG.Wait()
+
+		cancelSampleCtx()
+		<-sampleDone
+	}
+
+	subURL := "ws" + strings.TrimPrefix(baseURL, "http") + "/api/message/subscribe?" + url.Values{"*": []string{"1"}}.Encode()
+	for _, ul := range userLoadList {
+		for j := 0; j < config.SubscribersPerUser; j++ {
+			conn, res, err := websocket.DefaultDialer.DialContext(ctx, subURL, http.Header{"Authorization": []string{"Bearer " + ul.authKey}})
+			if err != nil {
+				closeSubs()
+
+				if res != nil {
+					return result, errutil.NewStackError(fmt.Errorf("subscribing got status (%d): %w", res.StatusCode, err))
+				}
+
+				return result, errutil.NewStackError(err)
+			}
+			ul.subConnList = append(ul.subConnList, conn)
+
+			subWG.Add(1)
+			go func(ul *userLoad) {
+				defer subWG.Done()
+
+				latencyList := readSubscriber(conn, ul, &result.Received)
+
+				subLatencyMu.Lock()
+				subLatencyLists = append(subLatencyLists, latencyList)
+				subLatencyMu.Unlock()
+			}(ul)
+		}
+	}
+
+	postCtx := ctx
+	if config.Duration > 0 {
+		var cancelPostCtx context.CancelFunc
+		postCtx, cancelPostCtx = context.WithTimeout(ctx, config.Duration)
+		defer cancelPostCtx()
+	}
+
+	postLatencyLists := make([][]time.Duration, config.Users)
+	postErrs := make([]error, config.Users)
+
+	startTime := time.Now()
+
+	postWG := new(sync.WaitGroup)
+	for i, ul := range userLoadList {
+		postWG.Add(1)
+		go func(i int, ul *userLoad) {
+			defer postWG.Done()
+
+			client := modclient.NewClient(baseURL, ul.authKey, config.ProtocolVersion, []brotatomodtypes.Capability{brotatomodtypes.CapabilityExtendedSerialTypes})
+			client.SetHTTPClient(httpClient)
+
+			// spread the users over the interval instead of having them all post at once
+			var stagger time.Duration
+			if config.PostInterval > 0 {
+				stagger = config.PostInterval * time.Duration(i) / time.Duration(config.Users)
+			}
+
+			postLatencyLists[i], postErrs[i] = postDiffs(postCtx, client, ul, config, startTime.Add(stagger), &result)
+		}(i, ul)
+	}
+	postWG.Wait()
+
+	result.Elapsed = time.Since(startTime)
+
+	for _, err := range postErrs {
+		if err != nil {
+			closeSubs()
+			return result, errutil.NewStackError(err)
+		}
+	}
+
+	result.Expected = result.Posts * int64(config.SubscribersPerUser)
+
+	drainDeadline := time.Now().Add(config.DrainTimeout)
+	for atomic.LoadInt64(&result.Received) < result.Expected && time.Now().Before(drainDeadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	closeSubs()
+
+	result.Received = atomic.LoadInt64(&result.Received)
+	result.Dropped = max(result.Expected-result.Received, 0)
+
+	var endMemStats runtime.MemStats
+	runtime.ReadMemStats(&endMemStats)
+	result.TotalAlloc = endMemStats.TotalAlloc - startMemStats.TotalAlloc
+
+	fanOutLatencies := flatten(subLatencyLists)
+	result.FanOutP50 = percentile(fanOutLatencies, 0.5)
+	result.FanOutP99 = percentile(fanOutLatencies, 0.99)
+	result.FanOutMax = percentile(fanOutLatencies, 1)
+
+	postLatencies := flatten(postLatencyLists)
+	result.PostP50 = percentile(postLatencies, 0.5)
+	result.PostP99 = percentile(postLatencies, 0.99)
+
+	return result, nil
+}
+
+// postDiffs posts the user's diffs until the config says to stop or ctx is done. Only a failed authentication is returned,
+// failed posts are counted in result.
+func postDiffs(ctx context.Context, client *modclient.Client, ul *userLoad, config Config, firstPostTime time.Time, result *Result) ([]time.Duration, error) {
+	err := client.Authenticate(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+
+		return nil, errutil.NewStackError(err)
+	}
+
+	encoder := brotatosim.NewEncoder(client.ProtocolVersion())
+	postLatencies := make([]time.Duration, 0, max(config.PostsPerUser, 64))
+
+	for seq := int32(0); config.PostsPerUser <= 0 || int(seq) < config.PostsPerUser; seq++ {
+		if config.PostInterval > 0 {
+			timer := time.NewTimer(time.Until(firstPostTime.Add(config.PostInterval * time.Duration(seq))))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return postLatencies, nil
+			case <-timer.C:
+			}
+		} else if ctx.Err() != nil {
+			return postLatencies, nil
+		}
+
+		// the first post is a full message like a wave start, the rest are diffs
+		event := brotatosim.Event{
+			MessageType:   brotatomodtypes.MessageTypeTimeSeriesDiff,
+			MessageReason: brotatomodtypes.MessageReasonPoll,
+			State: map[string]interface{}{
+				seqKey: seq,
+				"gold": seq * 3,
+			},
+			Changed: []string{"gold", seqKey},
+		}
+		if seq == 0 {
+			event.MessageType = brotatomodtypes.MessageTypeTimeSeriesFull
+		}
+
+		sentTime := time.Now()
+		ul.setSentTime(seq, sentTime)
+
+		body, err := encoder.EncodeEvent(event, sentTime)
+		if err != nil {
+			return postLatencies, errutil.NewStackError(err)
+		}
+
+		_, err = client.PostBody(ctx, body)
+		if errors.Is(err, modclient.ErrMappingResetRequired) {
+			body, err = encoder.EncodeResync(event, sentTime)
+			if err != nil {
+				return postLatencies, errutil.NewStackError(err)
+			}
+
+			_, err = client.PostBody(ctx, body)
+		}
+		if err != nil {
+			ul.deleteSentTime(seq)
+
+			if ctx.Err() != nil {
+				return postLatencies, nil
+			}
+
+			atomic.AddInt64(&result.PostErrors, 1)
+			continue
+		}
+
+		postLatencies = append(postLatencies, time.Since(sentTime))
+		atomic.AddInt64(&result.Posts, 1)
+	}
+
+	return postLatencies, nil
+}
+
+// readSubscriber reads until the connection closes, returning the fan-out latency of every message matched to a post.
+func readSubscriber(conn *websocket.Conn, ul *userLoad, received *int64) []time.Duration {
+	latencies := make([]time.Duration, 0, 64)
+
+	var msg struct {
+		Seq *int32 `json:"load_seq"`
+	}
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return latencies
+		}
+		receivedTime := time.Now()
+
+		msg.Seq = nil
+
+		err = json.Unmarshal(data, &msg)
+		if err != nil || msg.Seq == nil {
+			continue
+		}
+
+		sentTime, ok := ul.sentTime(*msg.Seq)
+		if !ok {
+			continue
+		}
+
+		latencies = append(latencies, receivedTime.Sub(sentTime))
+		atomic.AddInt64(received, 1)
+	}
+}
+
+// sampleMemory records peak heap and goroutines in result until ctx is done.
+func sampleMemory(ctx context.Context, result *Result) {
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+
+	var memStats runtime.MemStats
+	for {
+		runtime.ReadMemStats(&memStats)
+		result.PeakHeapInuse = max(result.PeakHeapInuse, memStats.HeapInuse)
+		result.PeakGoroutines = max(result.PeakGoroutines, runtime.NumGoroutine())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// flatten
+func flatten(lists [][]time.Duration) []time.Duration {
+	all := make([]time.Duration, 0)
+	for _, list := range lists {
+		all = append(all, list...)
+	}
+
+	return all
+}
+
+// percentile of the latencies, q from 0 to 1. Sorts latencies in place.
+func percentile(latencies []time.Duration, q float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+
+	if !sort.SliceIsSorted(latencies, func(i, j int) bool { return latencies[i] < latencies[j] }) {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	}
+
+	return latencies[int(q*float64(len(latencies)-1))]
+}
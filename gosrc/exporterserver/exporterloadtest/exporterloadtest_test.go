@@ -0,0 +1,98 @@
+package exporterloadtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	// the server logs every message it receives
+	log.SetOutput(io.Discard)
+
+	os.Exit(m.Run())
+}
+
+func TestRun(t *testing.T) {
+	asserter := require.New(t)
+
+	testServer, err := NewTestServer(t.TempDir(), 3, 2)
+	asserter.NoError(err)
+	defer testServer.Close()
+
+	result, err := Run(context.Background(), testServer.URL, testServer.AuthKeys, Config{
+		Users:              3,
+		SubscribersPerUser: 2,
+		PostInterval:       time.Millisecond * 5,
+		PostsPerUser:       20,
+		DrainTimeout:       time.Second * 5,
+		ProtocolVersion:    brotatomodtypes.ProtocolVersionFramed,
+	})
+	asserter.NoError(err)
+
+	asserter.Equal(int64(60), result.Posts)
+	asserter.Equal(int64(0), result.PostErrors)
+	asserter.Equal(int64(120), result.Expected)
+	asserter.Equal(int64(120), result.Received)
+	asserter.Equal(int64(0), result.Dropped)
+	asserter.Greater(result.FanOutP50, time.Duration(0))
+	asserter.LessOrEqual(result.FanOutP50, result.FanOutP99)
+	asserter.LessOrEqual(result.FanOutP99, result.FanOutMax)
+	asserter.Greater(result.PeakHeapInuse, uint64(0))
+}
+
+func TestRunTooManySubscribers(t *testing.T) {
+	asserter := require.New(t)
+
+	testServer, err := NewTestServer(t.TempDir(), 1, 1)
+	asserter.NoError(err)
+	defer testServer.Close()
+
+	_, err = Run(context.Background(), testServer.URL, testServer.AuthKeys, Config{
+		Users:              1,
+		SubscribersPerUser: 2,
+		PostsPerUser:       1,
+		ProtocolVersion:    brotatomodtypes.ProtocolVersionFramed,
+	})
+	asserter.ErrorContains(err, "429")
+}
+
+// BenchmarkRun posts diffs as fast as the server answers them, b.N diffs in total split over the users.
+func BenchmarkRun(b *testing.B) {
+	for _, users := range []int{1, 10, 50} {
+		for _, subs := range []int{1, 10} {
+			b.Run(fmt.Sprintf("Users%d/Subs%d", users, subs), func(b *testing.B) {
+				asserter := require.New(b)
+
+				testServer, err := NewTestServer(b.TempDir(), users, subs)
+				asserter.NoError(err)
+				defer testServer.Close()
+
+				b.ResetTimer()
+
+				result, err := Run(context.Background(), testServer.URL, testServer.AuthKeys, Config{
+					Users:              users,
+					SubscribersPerUser: subs,
+					PostsPerUser:       max(b.N/users, 1),
+					DrainTimeout:       time.Second * 2,
+					ProtocolVersion:    brotatomodtypes.ProtocolVersionFramed,
+				})
+				asserter.NoError(err)
+
+				b.StopTimer()
+
+				b.ReportMetric(float64(result.FanOutP50.Microseconds()), "fanout-p50-µs")
+				b.ReportMetric(float64(result.FanOutP99.Microseconds()), "fanout-p99-µs")
+				b.ReportMetric(float64(result.Dropped)/float64(max(result.Expected, 1))*100, "dropped-%")
+				b.ReportMetric(float64(result.PeakHeapInuse)/(1<<20), "peak-heap-MiB")
+			})
+		}
+	}
+}
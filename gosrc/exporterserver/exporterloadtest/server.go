@@ -0,0 +1,124 @@
+package exporterloadtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"path/filepath"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/errutil"
+	"github.com/benw10-1/brotato-exporter/exporterserver"
+	"github.com/benw10-1/brotato-exporter/exporterserver/ctrlauth"
+	"github.com/benw10-1/brotato-exporter/exporterserver/ctrlmessage"
+	"github.com/benw10-1/brotato-exporter/exporterserver/ctrlrun"
+	"github.com/benw10-1/brotato-exporter/exporterserver/exporterserverutil"
+	"github.com/benw10-1/brotato-exporter/exporterserver/messagepipeline"
+	"github.com/benw10-1/brotato-exporter/exporterserver/messagesubhandler"
+	"github.com/benw10-1/brotato-exporter/exporterserver/runrecorder"
+	"github.com/benw10-1/brotato-exporter/exporterstore"
+	"github.com/benw10-1/brotato-exporter/exporterstore/exporterstoretypes"
+	"github.com/benw10-1/brotato-exporter/logutil"
+	"github.com/google/uuid"
+)
+
+// TestServer exporter server wired the same way as cmd/exporter-server, on an httptest server with its own user database.
+// Only the mod downloads, dashboard, TLS and rate limit are left out.
+type TestServer struct {
+	*httptest.Server
+
+	// AuthKeys one per created user.
+	AuthKeys []string
+
+	exporterStore   *exporterstore.ExporterStore
+	runRecorder     *runrecorder.Recorder
+	cancelServerCtx context.CancelFunc
+}
+
+// NewTestServer starts a server in dir with userCount users, each allowed maxSubscribers subscribers.
+// Request logs are thrown away, the app log is left alone.
+func NewTestServer(dir string, userCount int, maxSubscribers int) (*TestServer, error) {
+	exporterStore, err := exporterstore.NewExporterStore(filepath.Join(dir, "user.db"))
+	if err != nil {
+		return nil, errutil.NewStackError(err)
+	}
+
+	authKeys := make([]string, 0, userCount)
+	for i := 0; i < userCount; i++ {
+		user := &exporterstoretypes.ExporterUser{
+			UserID:         uuid.New(),
+			MaxSubscribers: maxSubscribers,
+		}
+
+		err = exporterStore.UpsertUser(user)
+		if err != nil {
+			_ = exporterStore.Close()
+			return nil, errutil.NewStackError(err)
+		}
+
+		authKey := fmt.Sprintf("load-test-%d-%s", i, user.UserID)
+
+		err = exporterStore.UpsertAuthKeyUserID([]byte(authKey), user.UserID)
+		if err != nil {
+			_ = exporterStore.Close()
+			return nil, errutil.NewStackError(err)
+		}
+
+		authKeys = append(authKeys, authKey)
+	}
+
+	serverCtx, cancelServerCtx := context.WithCancel(context.Background())
+
+	sessionInfoMap := new(ctrlauth.SessionInfoMap)
+
+	authAPI := ctrlauth.NewAuthAPI([]byte(uuid.NewString()), sessionInfoMap, exporterStore)
+	subHandler := messagesubhandler.NewMessageSubHandler(serverCtx, sessionInfoMap, time.Minute*10)
+	pipelineMetrics := messagepipeline.NewMetrics()
+	runRecorder := runrecorder.NewRecorder(exporterStore, 100)
+	pipeline := messagepipeline.NewPipeline(serverCtx, time.Minute, subHandler.ConsumerConfig(), pipelineMetrics.ConsumerConfig(), runRecorder.ConsumerConfig())
+
+	originPolicy := exporterserverutil.NewOriginPolicy(exporterserverutil.OriginConfig{
+		AllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "DELETE"},
+		AllowedHeaders: []string{"Authorization", "Content-Type", "Content-Encoding", "If-None-Match", "If-Modified-Since", "X-Request-ID"},
+	}, authAPI.UserAllowedOrigins)
+
+	messageAPI := ctrlmessage.NewMessageAPI(sessionInfoMap, exporterStore, subHandler, pipeline, 8<<20, ctrlmessage.CaptureConfig{}, originPolicy)
+
+	// no rate limit, the point is to find the server's own limits
+	exporterServer := exporterserver.NewExporterServer(
+		[]exporterserver.Controller{authAPI, messageAPI, ctrlrun.NewRunAPI(exporterStore)},
+		exporterserver.RequestIDMiddleware,
+		exporterserver.LoggingMiddleware(slog.New(slog.NewJSONHandler(io.Discard, nil))),
+		exporterserver.RecoveryMiddleware,
+		exporterserver.CORSMiddleware(originPolicy),
+		exporterserver.CompressionMiddleware,
+		authAPI.Middleware,
+	)
+
+	return &TestServer{
+		Server:          httptest.NewServer(exporterServer),
+		AuthKeys:        authKeys,
+		exporterStore:   exporterStore,
+		runRecorder:     runRecorder,
+		cancelServerCtx: cancelServerCtx,
+	}, nil
+}
+
+// Close
+func (ts *TestServer) Close() {
+	ts.Server.CloseClientConnections()
+	ts.Server.Close()
+	ts.cancelServerCtx()
+
+	err := ts.runRecorder.Flush()
+	if err != nil {
+		slog.Error("exporterloadtest.TestServer.Close: failed to flush run history", logutil.Err(err))
+	}
+
+	err = ts.exporterStore.Close()
+	if err != nil {
+		slog.Error("exporterloadtest.TestServer.Close: failed to close store", logutil.Err(err))
+	}
+}
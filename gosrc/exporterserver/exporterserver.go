@@ -1,120 +1,65 @@
 package exporterserver
 
 import (
-	"context"
-	"encoding/json"
-	"log"
 	"net/http"
-	"runtime/debug"
-	"time"
 
 	"github.com/benw10-1/brotato-exporter/exporterserver/exporterserverutil"
+	"github.com/julienschmidt/httprouter"
 )
 
-type HandlerNextCtx interface {
-	ServeHTTPNextCtx(w http.ResponseWriter, r *http.Request) context.Context
+// Controller registers its routes on the server's router.
+type Controller interface {
+	RegisterRoutes(router *httprouter.Router)
 }
 
+// Middleware wraps the next handler in the chain.
+type Middleware func(next http.Handler) http.Handler
+
 // StatusCoder
 type StatusCoder interface {
 	StatusCode() int
 }
 
-// ExporterServer
-type ExporterServer struct {
-	handlerList []http.Handler
+// Chain h wrapped by middlewares, the first is outermost and sees the request first.
+func Chain(h http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
 
-	requestLogEncoder *json.Encoder
+	return h
 }
 
-// NewExporterServer
-func NewExporterServer(handlerList []http.Handler, requestLogger *log.Logger) *ExporterServer {
-	logger := requestLogger
-	if logger == nil {
-		logger = log.New(log.Writer(), "http-request", 0)
-	}
+// ExporterServer one router holding the routes of every controller, behind a chain of middleware.
+type ExporterServer struct {
+	handler http.Handler
+}
+
+// NewExporterServer routes of controllers wrapped by middlewares, see Chain.
+func NewExporterServer(controllers []Controller, middlewares ...Middleware) *ExporterServer {
+	router := httprouter.New()
+	router.NotFound = http.HandlerFunc(notFound)
+	router.MethodNotAllowed = http.HandlerFunc(methodNotAllowed)
 
-	server := &ExporterServer{
-		handlerList:       handlerList,
-		requestLogEncoder: json.NewEncoder(logger.Writer()),
+	for _, controller := range controllers {
+		controller.RegisterRoutes(router)
 	}
 
-	return server
+	return &ExporterServer{
+		handler: Chain(router, middlewares...),
+	}
 }
 
 // ServeHTTP
 func (es *ExporterServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	startTime := time.Now()
-	defer func() {
-		if r := recover(); r != nil {
-			trace := debug.Stack()
-			log.Printf("exporterserver.ServeHTTP: Recovered from panic: %s -\n%s", r, trace)
-		}
-
-		duration := time.Since(startTime)
-
-		statusCoder, ok := w.(StatusCoder)
-		if !ok {
-			statusCoder = exporterserverutil.NewDummyResponseWriter(w)
-		}
-
-		statusCode := statusCoder.StatusCode()
-		if statusCode == 0 {
-			statusCode = http.StatusNotFound
-			if r.Context().Err() != nil {
-				statusCode = http.StatusRequestTimeout
-			}
-			w.WriteHeader(statusCode)
-		}
-
-		r.Header.Del("Authorization")
-
-		requestLog := RequestLog{
-			Method:      r.Method,
-			URL:         r.URL.String(),
-			Status:      statusCode,
-			Headers:     r.Header,
-			Duration:    duration.String(),
-			TimeStarted: startTime,
-			CtxErr:      r.Context().Err(),
-		}
-
-		// log request
-		err := es.requestLogEncoder.Encode(requestLog)
-		if err != nil {
-			log.Printf("exporterserver.ServeHTTP: Error logging request: %s", err)
-		}
-	}()
-
-	if r.Header.Get("Content-Encoding") == "gzip" {
-		w.Header().Add("Content-Encoding", "gzip")
-		w = exporterserverutil.NewGzipResponseWriter(w)
-	} else {
-		w = exporterserverutil.NewDummyResponseWriter(w)
-	}
-
-	for _, handler := range es.handlerList {
-		nextCtxer, ok := handler.(HandlerNextCtx)
-		if ok {
-			ctx := nextCtxer.ServeHTTPNextCtx(w, r)
-			r = r.WithContext(ctx)
-		} else {
-			handler.ServeHTTP(w, r)
-		}
+	es.handler.ServeHTTP(w, r)
+}
 
-		if r.Context().Err() != nil {
-			return
-		}
-	}
+// notFound
+func notFound(w http.ResponseWriter, r *http.Request) {
+	exporterserverutil.WriteError(w, r, exporterserverutil.NewResponseError(nil, http.StatusNotFound, exporterserverutil.ErrorCodeNotFound, "Not found"))
 }
 
-// RequestLog
-type RequestLog struct {
-	Method      string      `json:"method,omitempty"`
-	URL         string      `json:"url,omitempty"`
-	Status      int         `json:"status,omitempty"`
-	Headers     http.Header `json:"headers,omitempty"`
-	Duration    string      `json:"duration,omitempty"`
-	TimeStarted time.Time   `json:"time_started,omitempty"`
-	CtxErr      error       `json:"ctx_err,omitempty"`
+// methodNotAllowed the router has already set the Allow header.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	exporterserverutil.WriteError(w, r, exporterserverutil.NewResponseError(nil, http.StatusMethodNotAllowed, exporterserverutil.ErrorCodeMethodNotAllowed, "Method not allowed"))
 }
@@ -0,0 +1,190 @@
+package exporterserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/exporterserver/exporterserverutil"
+	"github.com/benw10-1/brotato-exporter/logutil"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/require"
+)
+
+// testController
+type testController struct{}
+
+// RegisterRoutes
+func (testController) RegisterRoutes(router *httprouter.Router) {
+	router.GET("/api/test", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		logutil.AddAttrs(r.Context(), slog.String(logutil.KeyUserID, "user-1"))
+		_, _ = w.Write([]byte("ok"))
+	})
+	router.GET("/api/panic", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		panic("boom")
+	})
+}
+
+func TestExporterServer(t *testing.T) {
+	logBuf := bytes.NewBuffer(nil)
+	logHandler, err := logutil.NewHandler(logBuf, logutil.FormatJSON, slog.LevelInfo)
+	require.NoError(t, err)
+
+	server := NewExporterServer(
+		[]Controller{testController{}},
+		RequestIDMiddleware,
+		LoggingMiddleware(slog.New(logHandler)),
+		RecoveryMiddleware,
+		CORSMiddleware(exporterserverutil.NewOriginPolicy(exporterserverutil.OriginConfig{
+			AllowedOrigins: []string{"https://overlay.example.com"},
+			AllowedMethods: []string{http.MethodGet},
+			AllowedHeaders: []string{"authorization"},
+		}, nil)),
+		CompressionMiddleware,
+	)
+
+	decodeError := func(asserter *require.Assertions, w *httptest.ResponseRecorder) exporterserverutil.ErrorResponse {
+		errRes := exporterserverutil.ErrorResponse{}
+		asserter.NoError(json.Unmarshal(w.Body.Bytes(), &errRes))
+		asserter.Equal(w.Header().Get(exporterserverutil.RequestIDHeader), errRes.Error.RequestID)
+
+		return errRes
+	}
+
+	t.Run("TestServed", func(t *testing.T) {
+		asserter := require.New(t)
+		logBuf.Reset()
+
+		r := httptest.NewRequest(http.MethodGet, "/api/test?ticket=ticket-secret", nil)
+		r.Header.Set(exporterserverutil.RequestIDHeader, "req-1")
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		asserter.Equal(http.StatusOK, w.Code)
+		asserter.Equal("ok", w.Body.String())
+		asserter.Equal("req-1", w.Header().Get(exporterserverutil.RequestIDHeader))
+
+		requestLog := make(map[string]any)
+		asserter.NoError(json.Unmarshal(logBuf.Bytes(), &requestLog))
+		asserter.Equal("request", requestLog["msg"])
+		asserter.Equal(float64(http.StatusOK), requestLog["status"])
+		asserter.Equal("req-1", requestLog[logutil.KeyRequestID])
+		// added by the handler, after the logging middleware passed the request on
+		asserter.Equal("user-1", requestLog[logutil.KeyUserID])
+		asserter.NotContains(logBuf.String(), "secret")
+		asserter.Contains(requestLog["url"], "ticket=REDACTED")
+	})
+
+	t.Run("TestNotFound", func(t *testing.T) {
+		asserter := require.New(t)
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/missing", nil))
+
+		asserter.Equal(http.StatusNotFound, w.Code)
+		asserter.Equal(exporterserverutil.ErrorCodeNotFound, decodeError(asserter, w).Error.Code)
+	})
+
+	t.Run("TestMethodNotAllowed", func(t *testing.T) {
+		asserter := require.New(t)
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/test", nil))
+
+		asserter.Equal(http.StatusMethodNotAllowed, w.Code)
+		asserter.Contains(w.Header().Get("Allow"), http.MethodGet)
+		asserter.Equal(exporterserverutil.ErrorCodeMethodNotAllowed, decodeError(asserter, w).Error.Code)
+	})
+
+	t.Run("TestRecovery", func(t *testing.T) {
+		asserter := require.New(t)
+		logBuf.Reset()
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/panic", nil))
+
+		asserter.Equal(http.StatusInternalServerError, w.Code)
+		asserter.Equal(exporterserverutil.ErrorCodeInternal, decodeError(asserter, w).Error.Code)
+		// still logged
+		asserter.Contains(logBuf.String(), `"status":500`)
+	})
+
+	t.Run("TestCORS", func(t *testing.T) {
+		asserter := require.New(t)
+
+		r := httptest.NewRequest(http.MethodOptions, "/api/test", nil)
+		r.Header.Set("Origin", "https://overlay.example.com")
+		r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		asserter.Equal(http.StatusNoContent, w.Code)
+		asserter.Equal("https://overlay.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+		asserter.Contains(w.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+
+		r = httptest.NewRequest(http.MethodGet, "/api/test", nil)
+		r.Header.Set("Origin", "https://elsewhere.example.com")
+		w = httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		asserter.Equal(http.StatusOK, w.Code)
+		asserter.Empty(w.Header().Get("Access-Control-Allow-Origin"))
+	})
+}
+
+func TestRateLimiter(t *testing.T) {
+	asserter := require.New(t)
+
+	rateLimiter := NewRateLimiter(2, 3, nil)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		allowed, _ := rateLimiter.Allow("a", now)
+		asserter.True(allowed)
+	}
+
+	allowed, wait := rateLimiter.Allow("a", now)
+	asserter.False(allowed)
+	asserter.Equal(time.Millisecond*500, wait)
+
+	// other clients have their own bucket
+	allowed, _ = rateLimiter.Allow("b", now)
+	asserter.True(allowed)
+
+	allowed, _ = rateLimiter.Allow("a", now.Add(time.Millisecond*500))
+	asserter.True(allowed)
+
+	// a client's first requests at once share one bucket
+	var allowedCount atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if allowed, _ := rateLimiter.Allow("c", now); allowed {
+				allowedCount.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	asserter.Equal(int32(3), allowedCount.Load())
+
+	handler := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), NewRateLimiter(1, 1, nil).Middleware)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	asserter.Equal(http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	asserter.Equal(http.StatusTooManyRequests, w.Code)
+	asserter.Equal("1", w.Header().Get("Retry-After"))
+}
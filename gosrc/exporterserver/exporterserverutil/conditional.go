@@ -0,0 +1,47 @@
+package exporterserverutil
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SetValidators sets ETag and Last-Modified. The ETag is weak as the body may be gzipped on the way out.
+func SetValidators(w http.ResponseWriter, etag string, modifiedTime time.Time) {
+	w.Header().Set("ETag", `W/"`+etag+`"`)
+	w.Header().Set("Last-Modified", modifiedTime.UTC().Format(http.TimeFormat))
+}
+
+// NotModified whether the request's If-None-Match or If-Modified-Since say the client already has the response with
+// etag and modifiedTime. If-None-Match wins when both are sent, and only GET and HEAD are ever not modified.
+func NotModified(r *http.Request, etag string, modifiedTime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if ifNoneMatch := r.Header.Values("If-None-Match"); len(ifNoneMatch) > 0 {
+		for _, headerVal := range ifNoneMatch {
+			for _, part := range strings.Split(headerVal, ",") {
+				part = strings.TrimSpace(part)
+				if part == "*" {
+					return true
+				}
+
+				// weak comparison, the W/ prefix is ignored on both sides
+				if strings.TrimPrefix(part, "W/") == `"`+etag+`"` {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+
+	ifModifiedSince, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modifiedTime.IsZero() {
+		return false
+	}
+
+	// the header only has second precision
+	return !modifiedTime.Truncate(time.Second).After(ifModifiedSince)
+}
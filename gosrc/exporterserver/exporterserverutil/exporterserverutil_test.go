@@ -0,0 +1,289 @@
+package exporterserverutil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/logutil"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecompressBody(t *testing.T) {
+	payload := bytes.Repeat([]byte("effects_stat_"), 1000)
+
+	gzipped := bytes.NewBuffer(nil)
+	gzipWriter := gzip.NewWriter(gzipped)
+	_, err := gzipWriter.Write(payload)
+	require.NoError(t, err)
+	require.NoError(t, gzipWriter.Close())
+
+	zstdEncoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	zstdPayload := zstdEncoder.EncodeAll(payload, nil)
+
+	type testCase struct {
+		name        string
+		encoding    string
+		body        []byte
+		maxSize     int64
+		expectedErr error
+	}
+
+	tcs := []testCase{
+		{name: "identity", body: payload, maxSize: int64(len(payload))},
+		{name: "gzip", encoding: "gzip", body: gzipped.Bytes(), maxSize: int64(len(payload))},
+		{name: "zstd", encoding: "zstd", body: zstdPayload, maxSize: int64(len(payload))},
+		{name: "identity too large", body: payload, maxSize: int64(len(payload)) - 1, expectedErr: ErrBodyTooLarge},
+		{name: "gzip too large", encoding: "gzip", body: gzipped.Bytes(), maxSize: 100, expectedErr: ErrBodyTooLarge},
+		{name: "zstd too large", encoding: "zstd", body: zstdPayload, maxSize: 100, expectedErr: ErrBodyTooLarge},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := require.New(t)
+
+			r := httptest.NewRequest(http.MethodPost, "/api/message/post", bytes.NewReader(tc.body))
+			if tc.encoding != "" {
+				r.Header.Set("Content-Encoding", tc.encoding)
+			}
+
+			body, err := DecompressBody(r, tc.maxSize)
+			asserter.NoError(err)
+			defer body.Close()
+
+			res, err := io.ReadAll(body)
+			if tc.expectedErr != nil {
+				asserter.ErrorIs(err, tc.expectedErr)
+				return
+			}
+
+			asserter.NoError(err)
+			asserter.Equal(payload, res)
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		asserter := require.New(t)
+
+		r := httptest.NewRequest(http.MethodPost, "/api/message/post", bytes.NewReader(payload))
+		r.Header.Set("Content-Encoding", "br")
+
+		_, err := DecompressBody(r, int64(len(payload)))
+		asserter.ErrorIs(err, ErrUnsupportedContentEncoding)
+	})
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	type testCase struct {
+		acceptEncoding string
+		expected       bool
+	}
+
+	tcs := []testCase{
+		{acceptEncoding: "", expected: false},
+		{acceptEncoding: "gzip", expected: true},
+		{acceptEncoding: "deflate, GZIP;q=0.5", expected: true},
+		{acceptEncoding: "gzip;q=0", expected: false},
+		{acceptEncoding: "*", expected: true},
+		{acceptEncoding: "*, gzip;q=0", expected: false},
+		{acceptEncoding: "br, zstd", expected: false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.acceptEncoding, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+
+			require.Equal(t, tc.expected, AcceptsEncoding(r, "gzip"))
+		})
+	}
+}
+
+func TestGzipResponseWriter(t *testing.T) {
+	t.Run("body", func(t *testing.T) {
+		asserter := require.New(t)
+
+		rec := httptest.NewRecorder()
+		grw := NewGzipResponseWriter(rec)
+		grw.Header().Set("Content-Length", "5")
+
+		_, err := grw.Write([]byte("hello"))
+		asserter.NoError(err)
+		asserter.NoError(grw.Close())
+
+		asserter.Equal(http.StatusOK, grw.StatusCode())
+		asserter.Equal("gzip", rec.Header().Get("Content-Encoding"))
+		asserter.Empty(rec.Header().Get("Content-Length"))
+
+		gzipReader, err := gzip.NewReader(rec.Body)
+		asserter.NoError(err)
+
+		res, err := io.ReadAll(gzipReader)
+		asserter.NoError(err)
+		asserter.Equal("hello", string(res))
+	})
+
+	t.Run("no content", func(t *testing.T) {
+		asserter := require.New(t)
+
+		rec := httptest.NewRecorder()
+		grw := NewGzipResponseWriter(rec)
+
+		grw.WriteHeader(http.StatusNoContent)
+		asserter.NoError(grw.Close())
+
+		asserter.Empty(rec.Header().Get("Content-Encoding"))
+		asserter.Zero(rec.Body.Len())
+	})
+}
+
+func TestNotModified(t *testing.T) {
+	modifiedTime := time.Date(2025, 1, 2, 3, 4, 5, 600, time.UTC)
+
+	type testCase struct {
+		name     string
+		method   string
+		header   http.Header
+		expected bool
+	}
+
+	tcs := []testCase{
+		{name: "no headers", expected: false},
+		{name: "matching etag", header: http.Header{"If-None-Match": {`"v1"`}}, expected: true},
+		{name: "weak etag in list", header: http.Header{"If-None-Match": {`"v0", W/"v1"`}}, expected: true},
+		{name: "other etag", header: http.Header{"If-None-Match": {`"v0"`}}, expected: false},
+		{name: "wildcard", header: http.Header{"If-None-Match": {"*"}}, expected: true},
+		{name: "same second", header: http.Header{"If-Modified-Since": {modifiedTime.Format(http.TimeFormat)}}, expected: true},
+		{name: "older", header: http.Header{"If-Modified-Since": {modifiedTime.Add(-time.Second).Format(http.TimeFormat)}}, expected: false},
+		{name: "bad date", header: http.Header{"If-Modified-Since": {"yesterday"}}, expected: false},
+		{
+			name:     "etag wins",
+			header:   http.Header{"If-None-Match": {`"v0"`}, "If-Modified-Since": {modifiedTime.Format(http.TimeFormat)}},
+			expected: false,
+		},
+		{name: "not a read", method: http.MethodPost, header: http.Header{"If-None-Match": {"*"}}, expected: false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			r := httptest.NewRequest(method, "/", nil)
+			r.Header = tc.header
+			if r.Header == nil {
+				r.Header = make(http.Header)
+			}
+
+			require.Equal(t, tc.expected, NotModified(r, "v1", modifiedTime))
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	t.Run("TestResponseError", func(t *testing.T) {
+		asserter := require.New(t)
+
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		w := httptest.NewRecorder()
+		w.Header().Set(RequestIDHeader, "req-1")
+
+		WriteError(w, r, fmt.Errorf("wrapped: %w", NewResponseError(nil, http.StatusConflict, ErrorCodeKeyMappingResetRequired, "Key mapping reset required")))
+		asserter.Equal(http.StatusConflict, w.Code)
+		asserter.Equal("application/json", w.Header().Get("Content-Type"))
+		asserter.JSONEq(`{"error": {"code": "key_mapping_reset_required", "message": "Key mapping reset required", "request_id": "req-1"}}`, w.Body.String())
+	})
+
+	t.Run("TestOtherError", func(t *testing.T) {
+		asserter := require.New(t)
+
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		w := httptest.NewRecorder()
+
+		WriteError(w, r, errors.New("disk on fire"))
+		asserter.Equal(http.StatusInternalServerError, w.Code)
+		// details are never sent
+		asserter.JSONEq(`{"error": {"code": "internal_error", "message": "Error serving request"}}`, w.Body.String())
+	})
+
+	t.Run("TestLogContext", func(t *testing.T) {
+		asserter := require.New(t)
+
+		logBuf := bytes.NewBuffer(nil)
+		handler, err := logutil.NewHandler(logBuf, logutil.FormatJSON, slog.LevelInfo)
+		asserter.NoError(err)
+
+		defer slog.SetDefault(slog.Default())
+		slog.SetDefault(slog.New(handler))
+
+		ctx := WithRequestID(context.Background(), "req-1")
+		ctx = logutil.AddAttrs(ctx, slog.String(logutil.KeyUserID, "user-1"))
+
+		r := httptest.NewRequest(http.MethodPost, "/", nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		w.Header().Set(RequestIDHeader, "req-1")
+
+		WriteError(w, r, NewResponseError(nil, http.StatusUnauthorized, ErrorCodeUnauthorized, "Unauthorized"))
+
+		// logged with the request's attrs, the ID only once
+		record := make(map[string]any)
+		asserter.NoError(json.Unmarshal(logBuf.Bytes(), &record))
+		asserter.Equal("user-1", record[logutil.KeyUserID])
+		asserter.Equal("req-1", record[logutil.KeyRequestID])
+		asserter.Equal(1, strings.Count(logBuf.String(), `"`+logutil.KeyRequestID+`"`))
+	})
+}
+
+func TestFormatCloseError(t *testing.T) {
+	asserter := require.New(t)
+
+	requestID := strings.Repeat("a", maxRequestIDLength)
+
+	closeMsg := FormatCloseError(websocket.CloseGoingAway, requestID, NewResponseError(nil, http.StatusRequestTimeout, ErrorCodeTimeout, "Timed out after (5m0s)"))
+	asserter.Equal(uint16(websocket.CloseGoingAway), binary.BigEndian.Uint16(closeMsg))
+	asserter.JSONEq(`{"error": {"code": "timeout", "message": "Timed out after (5m0s)", "request_id": "`+requestID+`"}}`, string(closeMsg[2:]))
+
+	// long messages are cut to fit in a control frame
+	closeMsg = FormatCloseError(websocket.CloseInternalServerErr, requestID, NewResponseError(nil, http.StatusInternalServerError, ErrorCodeUnsupportedEncoding, strings.Repeat("é", 100)))
+	asserter.LessOrEqual(len(closeMsg), 125)
+
+	errRes := ErrorResponse{}
+	asserter.NoError(json.Unmarshal(closeMsg[2:], &errRes))
+	asserter.Equal(ErrorCodeUnsupportedEncoding, errRes.Error.Code)
+	asserter.Equal(requestID, errRes.Error.RequestID)
+	asserter.True(strings.HasPrefix(strings.Repeat("é", 100), errRes.Error.Message))
+}
+
+func TestNewRequestID(t *testing.T) {
+	asserter := require.New(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(RequestIDHeader, "proxy-id.1")
+	asserter.Equal("proxy-id.1", NewRequestID(r))
+
+	for _, bad := range []string{"", "has space", `"quoted"`, strings.Repeat("a", maxRequestIDLength+1)} {
+		r.Header.Set(RequestIDHeader, bad)
+		requestID := NewRequestID(r)
+		asserter.NotEqual(bad, requestID)
+
+		_, err := uuid.Parse(requestID)
+		asserter.NoError(err)
+	}
+}
@@ -0,0 +1,117 @@
+package exporterserverutil
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// UserOriginsFunc extra origins the user authenticated by r allows, ex. their stream overlay. Nil if r has no valid auth.
+type UserOriginsFunc func(r *http.Request) []string
+
+// OriginConfig
+type OriginConfig struct {
+	// AllowedOrigins origins of browser pages allowed to use the API, "*" allows any.
+	AllowedOrigins []string
+	// AllowedMethods methods allowed cross-origin, sent in answer to preflight requests.
+	AllowedMethods []string
+	// AllowedHeaders request headers allowed cross-origin, sent in answer to preflight requests.
+	AllowedHeaders []string
+}
+
+// OriginPolicy which cross-origin browser pages may call the API and open websockets.
+type OriginPolicy struct {
+	allowAny       bool
+	allowedOrigins map[string]bool
+
+	allowedMethods []string
+	allowedHeaders []string
+
+	userOrigins UserOriginsFunc
+}
+
+// NewOriginPolicy userOrigins may be nil when there are no per-user overrides.
+func NewOriginPolicy(config OriginConfig, userOrigins UserOriginsFunc) *OriginPolicy {
+	op := &OriginPolicy{
+		allowedOrigins: make(map[string]bool, len(config.AllowedOrigins)),
+		userOrigins:    userOrigins,
+	}
+
+	for _, origin := range config.AllowedOrigins {
+		origin = NormalizeOrigin(origin)
+		if origin == "*" {
+			op.allowAny = true
+		}
+		op.allowedOrigins[origin] = true
+	}
+
+	for _, method := range config.AllowedMethods {
+		op.allowedMethods = append(op.allowedMethods, strings.ToUpper(strings.TrimSpace(method)))
+	}
+
+	for _, header := range config.AllowedHeaders {
+		op.allowedHeaders = append(op.allowedHeaders, http.CanonicalHeaderKey(strings.TrimSpace(header)))
+	}
+
+	return op
+}
+
+// NormalizeOrigin lower case without a trailing slash, the form origins are compared in.
+func NormalizeOrigin(origin string) string {
+	return strings.ToLower(strings.TrimRight(strings.TrimSpace(origin), "/"))
+}
+
+// AllowedMethods
+func (op *OriginPolicy) AllowedMethods() []string {
+	return op.allowedMethods
+}
+
+// AllowedHeaders
+func (op *OriginPolicy) AllowedHeaders() []string {
+	return op.allowedHeaders
+}
+
+// AllowedGlobally whether the origin is allowed for everyone, regardless of who the request is from.
+func (op *OriginPolicy) AllowedGlobally(origin string) bool {
+	return op.allowAny || op.allowedOrigins[NormalizeOrigin(origin)]
+}
+
+// HasUserOrigins whether users can allow origins of their own.
+func (op *OriginPolicy) HasUserOrigins() bool {
+	return op.userOrigins != nil
+}
+
+// Allowed whether r's Origin is allowed, globally or by the user r is authenticated as.
+func (op *OriginPolicy) Allowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if op.AllowedGlobally(origin) {
+		return true
+	}
+
+	if op.userOrigins == nil {
+		return false
+	}
+
+	origin = NormalizeOrigin(origin)
+
+	return slices.ContainsFunc(op.userOrigins(r), func(userOrigin string) bool {
+		return NormalizeOrigin(userOrigin) == origin
+	})
+}
+
+// CheckOrigin for websocket.Upgrader. Requests without an Origin (not from a browser) or from the server's own origin are
+// always allowed, anything else must pass Allowed.
+func (op *OriginPolicy) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	originURL, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(originURL.Host, r.Host) {
+		return true
+	}
+
+	return op.Allowed(r)
+}
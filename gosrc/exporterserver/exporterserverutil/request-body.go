@@ -0,0 +1,86 @@
+package exporterserverutil
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/benw10-1/brotato-exporter/errutil"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ErrBodyTooLarge returned wrapped when a request body is larger than allowed once decompressed.
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// ErrUnsupportedContentEncoding returned wrapped when the request body uses an encoding the server can't decode.
+var ErrUnsupportedContentEncoding = errors.New("unsupported content encoding")
+
+// DecompressBody reader for the request body decoded according to its Content-Encoding. Supports gzip, zstd and identity.
+// Reading more than maxSize decoded bytes fails with ErrBodyTooLarge so a small compressed body can't expand without bound.
+func DecompressBody(r *http.Request, maxSize int64) (io.ReadCloser, error) {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+
+	switch encoding {
+	case "", "identity":
+		return &maxSizeReadCloser{r: r.Body, closer: r.Body, remaining: maxSize}, nil
+	case "gzip", "x-gzip":
+		gzipReader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, errutil.NewStackError(err)
+		}
+
+		return &maxSizeReadCloser{r: gzipReader, closer: gzipReader, remaining: maxSize}, nil
+	case "zstd":
+		zstdDecoder, err := zstd.NewReader(r.Body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(maxSize)))
+		if err != nil {
+			return nil, errutil.NewStackError(err)
+		}
+
+		return &maxSizeReadCloser{r: zstdDecoder, closer: zstdDecoder.IOReadCloser(), remaining: maxSize}, nil
+	default:
+		return nil, errutil.NewStackError(fmt.Errorf("%w: %s", ErrUnsupportedContentEncoding, encoding))
+	}
+}
+
+// maxSizeReadCloser errors with ErrBodyTooLarge instead of returning more than remaining bytes.
+type maxSizeReadCloser struct {
+	r         io.Reader
+	closer    io.Closer
+	remaining int64
+}
+
+// Read
+func (msr *maxSizeReadCloser) Read(p []byte) (int, error) {
+	if msr.remaining <= 0 {
+		// only an error if there actually is more
+		var probe [1]byte
+		n, err := msr.r.Read(probe[:])
+		if n > 0 {
+			return 0, errutil.NewStackError(ErrBodyTooLarge)
+		}
+
+		return 0, err
+	}
+
+	if int64(len(p)) > msr.remaining {
+		p = p[:msr.remaining]
+	}
+
+	n, err := msr.r.Read(p)
+	msr.remaining -= int64(n)
+
+	// zstd checks the size the frame claims before decoding it
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return n, errutil.NewStackError(ErrBodyTooLarge)
+	}
+
+	return n, err
+}
+
+// Close
+func (msr *maxSizeReadCloser) Close() error {
+	return msr.closer.Close()
+}
@@ -0,0 +1,69 @@
+package exporterserverutil
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/benw10-1/brotato-exporter/logutil"
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader set on every response, and accepted from the client or a proxy in front of the server.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength long enough for UUIDs, short enough that error close frames always have room for one.
+const maxRequestIDLength = 40
+
+type requestIDCtxKey struct{}
+
+// NewRequestID the request's X-Request-ID if it's a sane value, otherwise a new random ID.
+func NewRequestID(r *http.Request) string {
+	requestID := r.Header.Get(RequestIDHeader)
+	if validRequestID(requestID) {
+		return requestID
+	}
+
+	return uuid.NewString()
+}
+
+// validRequestID
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range requestID {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// WithRequestID starts the request's log scope with the ID, so it is attached to everything logged with the context.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	ctx = logutil.WithScope(ctx, slog.String(logutil.KeyRequestID, requestID))
+
+	return context.WithValue(ctx, requestIDCtxKey{}, requestID)
+}
+
+// GetRequestIDFromCtx
+func GetRequestIDFromCtx(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDCtxKey{}).(string)
+	return requestID
+}
+
+// RemoteIP the IP the request came from, without the port. Forwarding headers are not trusted.
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
@@ -1,21 +1,75 @@
 package exporterserverutil
 
+import "net/http"
+
+// ErrorCode stable machine-readable reason for an error response, safe for clients to switch on. Messages may change.
+type ErrorCode string
+
+const (
+	// ErrorCodeUnauthorized missing auth, or auth for the wrong kind of endpoint.
+	ErrorCodeUnauthorized ErrorCode = "unauthorized"
+	// ErrorCodeInvalidToken the Authorization header's token is invalid or expired.
+	ErrorCodeInvalidToken ErrorCode = "invalid_token"
+	// ErrorCodeInvalidRequest malformed query params or headers.
+	ErrorCodeInvalidRequest ErrorCode = "invalid_request"
+	// ErrorCodeInvalidBody the body could not be read or decoded.
+	ErrorCodeInvalidBody ErrorCode = "invalid_body"
+	// ErrorCodeInvalidKeyPattern a key pattern in ?keys= or ?exclude= is malformed, or none are given.
+	ErrorCodeInvalidKeyPattern ErrorCode = "invalid_key_pattern"
+	// ErrorCodeUnsupportedProtocol the mod's protocol version is outside what the server supports.
+	ErrorCodeUnsupportedProtocol ErrorCode = "unsupported_protocol_version"
+	// ErrorCodeUnsupportedEncoding the body's Content-Encoding is not supported.
+	ErrorCodeUnsupportedEncoding ErrorCode = "unsupported_content_encoding"
+	// ErrorCodeBodyTooLarge the body is larger than the server allows.
+	ErrorCodeBodyTooLarge ErrorCode = "body_too_large"
+	// ErrorCodeKeyMappingResetRequired the server does not have the mod's key mappings, the mod should send a mapping
+	// reset followed by the full state.
+	ErrorCodeKeyMappingResetRequired ErrorCode = "key_mapping_reset_required"
+	// ErrorCodeTooManySubscribers the user has reached its subscriber limit.
+	ErrorCodeTooManySubscribers ErrorCode = "too_many_subscribers"
+	// ErrorCodeNotFound no such route or resource.
+	ErrorCodeNotFound ErrorCode = "not_found"
+	// ErrorCodeMethodNotAllowed the route exists but not for the request's method, see the Allow header.
+	ErrorCodeMethodNotAllowed ErrorCode = "method_not_allowed"
+	// ErrorCodeOriginNotAllowed the browser page's origin is not allowed to use the endpoint.
+	ErrorCodeOriginNotAllowed ErrorCode = "origin_not_allowed"
+	// ErrorCodeRateLimited too many requests from the client, retry after the Retry-After header's seconds.
+	ErrorCodeRateLimited ErrorCode = "rate_limited"
+	// ErrorCodeSessionNotFound the user has no active mod session.
+	ErrorCodeSessionNotFound ErrorCode = "session_not_found"
+	// ErrorCodeSessionExpired the mod's session expired, it should authenticate again.
+	ErrorCodeSessionExpired ErrorCode = "session_expired"
+	// ErrorCodeFeatureDisabled the feature is turned off on this server.
+	ErrorCodeFeatureDisabled ErrorCode = "feature_disabled"
+	// ErrorCodeTimeout the request or connection timed out.
+	ErrorCodeTimeout ErrorCode = "timeout"
+	// ErrorCodeInternal anything else, details are only logged.
+	ErrorCodeInternal ErrorCode = "internal_error"
+)
+
 // ResponseError
 type ResponseError struct {
 	err        error
 	statusCode int
+	code       ErrorCode
 	message    string
 }
 
 // NewResponseError
-func NewResponseError(err error, statusCode int, message string) *ResponseError {
+func NewResponseError(err error, statusCode int, code ErrorCode, message string) *ResponseError {
 	return &ResponseError{
 		err:        err,
 		statusCode: statusCode,
+		code:       code,
 		message:    message,
 	}
 }
 
+// InternalResponseError what any error which isn't a ResponseError is sent as.
+func InternalResponseError(err error) *ResponseError {
+	return NewResponseError(err, http.StatusInternalServerError, ErrorCodeInternal, "Error serving request")
+}
+
 // Error
 func (re *ResponseError) Error() string {
 	if re.err == nil {
@@ -30,7 +84,41 @@ func (re *ResponseError) StatusCode() int {
 	return re.statusCode
 }
 
+// Code
+func (re *ResponseError) Code() ErrorCode {
+	return re.code
+}
+
 // Message
 func (re *ResponseError) Message() string {
 	return re.message
 }
+
+// Unwrap
+func (re *ResponseError) Unwrap() error {
+	return re.err
+}
+
+// Response body sent for the error.
+func (re *ResponseError) Response(requestID string) ErrorResponse {
+	return ErrorResponse{
+		Error: ErrorDetail{
+			Code:      re.code,
+			Message:   re.message,
+			RequestID: requestID,
+		},
+	}
+}
+
+// ErrorResponse body of every error response, and of errors sent over websockets.
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail
+type ErrorDetail struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// RequestID same as the X-Request-ID response header, for matching the error to the server's logs.
+	RequestID string `json:"request_id,omitempty"`
+}
@@ -6,16 +6,21 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
-// GzipResponseWriterCloser transparently gzips the response if the client supports it
+// GzipResponseWriterCloser transparently gzips the response. Only use when the client accepts gzip, see AcceptsEncoding.
+// The gzip stream is started on the first write, so responses without a body are left alone.
 type GzipResponseWriterCloser struct {
 	// underlying writer
 	writer http.ResponseWriter
 
-	// gzip writer
+	// gzip writer - nil until the body is compressed
 	gzipWriter *gzip.Writer
 	statusCode int
+	// passthrough write the body as is, set for statuses which can't have a body or when the handler already encoded it
+	passthrough bool
 }
 
 // iface check
@@ -24,8 +29,7 @@ var _ http.ResponseWriter = new(GzipResponseWriterCloser)
 // NewGzipResponseWriter
 func NewGzipResponseWriter(writer http.ResponseWriter) *GzipResponseWriterCloser {
 	return &GzipResponseWriterCloser{
-		writer:     writer,
-		gzipWriter: gzip.NewWriter(writer),
+		writer: writer,
 	}
 }
 
@@ -36,13 +40,35 @@ func (grw *GzipResponseWriterCloser) Header() http.Header {
 
 // Write
 func (grw *GzipResponseWriterCloser) Write(data []byte) (int, error) {
+	if grw.statusCode == 0 {
+		grw.WriteHeader(http.StatusOK)
+	}
+
+	if grw.passthrough {
+		return grw.writer.Write(data)
+	}
+
 	return grw.gzipWriter.Write(data)
 }
 
 // WriteHeader
 func (grw *GzipResponseWriterCloser) WriteHeader(statusCode int) {
-	grw.writer.WriteHeader(statusCode)
+	if grw.statusCode != 0 {
+		return
+	}
 	grw.statusCode = statusCode
+
+	header := grw.writer.Header()
+	grw.passthrough = statusCode < http.StatusOK || statusCode == http.StatusNoContent || statusCode == http.StatusNotModified ||
+		header.Get("Content-Encoding") != ""
+	if !grw.passthrough {
+		header.Set("Content-Encoding", "gzip")
+		// length of the uncompressed body is wrong once compressed
+		header.Del("Content-Length")
+		grw.gzipWriter = gzip.NewWriter(grw.writer)
+	}
+
+	grw.writer.WriteHeader(statusCode)
 }
 
 // StatusCode
@@ -50,30 +76,82 @@ func (grw *GzipResponseWriterCloser) StatusCode() int {
 	return grw.statusCode
 }
 
-// Close
+// Flush writes out anything buffered by gzip so streamed responses are not held back.
+func (grw *GzipResponseWriterCloser) Flush() {
+	if grw.gzipWriter != nil {
+		err := grw.gzipWriter.Flush()
+		if err != nil {
+			return
+		}
+	}
+
+	if flusher, ok := grw.writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close finishes the gzip stream. Must be called once the handler is done or the client gets a truncated body.
 func (grw *GzipResponseWriterCloser) Close() error {
+	if grw.gzipWriter == nil {
+		return nil
+	}
+
 	err := grw.gzipWriter.Close()
 	if err != nil {
 		return err
 	}
 
+	grw.gzipWriter = nil
+
 	return nil
 }
 
 func (grw *GzipResponseWriterCloser) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	err := grw.Close()
-	if err != nil {
-		return nil, nil, err
+	if grw.gzipWriter != nil {
+		return nil, nil, fmt.Errorf("can't hijack after writing a gzipped body")
 	}
 
-	grw.gzipWriter = nil
-
 	if hj, ok := grw.writer.(http.Hijacker); ok {
 		return hj.Hijack()
 	}
 	return nil, nil, fmt.Errorf("ResponseWriter does not implement http.Hijacker")
 }
 
+// AcceptsEncoding whether the Accept-Encoding header allows the encoding, either by name or by "*", with a non-zero q value.
+func AcceptsEncoding(r *http.Request, encoding string) bool {
+	accepted := false
+	for _, headerVal := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(headerVal, ",") {
+			name, params, _ := strings.Cut(part, ";")
+			name = strings.TrimSpace(name)
+
+			q := 1.0
+			for _, param := range strings.Split(params, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(param), "=")
+				if !ok || !strings.EqualFold(key, "q") {
+					continue
+				}
+
+				parsed, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+				if err == nil {
+					q = parsed
+				}
+			}
+
+			// explicit mention wins over the wildcard
+			if strings.EqualFold(name, encoding) {
+				return q > 0
+			}
+
+			if name == "*" {
+				accepted = q > 0
+			}
+		}
+	}
+
+	return accepted
+}
+
 // DummyResponseWriterCloser
 type DummyResponseWriterCloser struct {
 	writer     http.ResponseWriter
@@ -100,9 +178,21 @@ func (drw *DummyResponseWriterCloser) WriteHeader(statusCode int) {
 
 // Write
 func (drw *DummyResponseWriterCloser) Write(data []byte) (int, error) {
+	// implicit 200 like net/http
+	if drw.statusCode == 0 {
+		drw.statusCode = http.StatusOK
+	}
+
 	return drw.writer.Write(data)
 }
 
+// Flush
+func (drw *DummyResponseWriterCloser) Flush() {
+	if flusher, ok := drw.writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 // StatusCode
 func (drw *DummyResponseWriterCloser) StatusCode() int {
 	return drw.statusCode
@@ -121,7 +211,13 @@ func (drw *DummyResponseWriterCloser) Hijack() (net.Conn, *bufio.ReadWriter, err
 	}
 
 	if hj, ok := drw.writer.(http.Hijacker); ok {
-		return hj.Hijack()
+		conn, rw, err := hj.Hijack()
+		if err == nil {
+			// the connection is no longer HTTP, nothing else can be written
+			drw.statusCode = http.StatusSwitchingProtocols
+		}
+
+		return conn, rw, err
 	}
 	return nil, nil, fmt.Errorf("ResponseWriter does not implement http.Hijacker")
 }
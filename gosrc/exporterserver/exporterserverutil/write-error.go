@@ -1,22 +1,96 @@
 package exporterserverutil
 
 import (
-	"log"
+	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
+	"unicode/utf8"
+
+	"github.com/benw10-1/brotato-exporter/logutil"
+	"github.com/gorilla/websocket"
 )
 
-// WriteError
-func WriteError(w http.ResponseWriter, err error) {
+// maxCloseReasonSize control frames carry at most 125 bytes, 2 of which are the close code.
+const maxCloseReasonSize = 123
+
+// AsResponseError the ResponseError in err's chain, or an internal error.
+func AsResponseError(err error) *ResponseError {
+	var re *ResponseError
+	if errors.As(err, &re) {
+		return re
+	}
+
+	return InternalResponseError(err)
+}
+
+// WriteError writes err as a JSON ErrorResponse, logged with the request's context. The request ID is read from the
+// X-Request-ID response header.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
 	if err == nil {
 		return
 	}
 
-	log.Printf("exporterserverutil.WriteError: error serving req - %v", err)
+	requestID := w.Header().Get(RequestIDHeader)
+	re := AsResponseError(err)
+
+	level := slog.LevelWarn
+	if re.StatusCode() >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+
+	attrs := []slog.Attr{logutil.Err(err), slog.Int("status", re.StatusCode()), slog.String("code", string(re.Code()))}
+	// the request's log scope already has its ID
+	if GetRequestIDFromCtx(r.Context()) == "" {
+		attrs = append(attrs, slog.String(logutil.KeyRequestID, requestID))
+	}
+	slog.LogAttrs(r.Context(), level, "exporterserverutil.WriteError: error serving req", attrs...)
 
-	if re, ok := err.(*ResponseError); ok {
-		http.Error(w, re.Message(), re.StatusCode())
+	body, err := json.Marshal(re.Response(requestID))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "exporterserverutil.WriteError: error encoding response", logutil.Err(err))
 		return
 	}
 
-	http.Error(w, "Error serving request", http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(re.StatusCode())
+
+	_, _ = w.Write(append(body, '\n'))
+}
+
+// FormatCloseError close frame payload with err as a JSON ErrorResponse for the reason. The message is cut short when
+// the reason wouldn't fit in a control frame.
+func FormatCloseError(closeCode int, requestID string, err error) []byte {
+	response := AsResponseError(err).Response(requestID)
+
+	for {
+		reason, err := json.Marshal(response)
+		if err != nil {
+			slog.Error("exporterserverutil.FormatCloseError: error encoding reason", logutil.Err(err))
+			return websocket.FormatCloseMessage(closeCode, "")
+		}
+
+		excess := len(reason) - maxCloseReasonSize
+		if excess <= 0 {
+			return websocket.FormatCloseMessage(closeCode, string(reason))
+		}
+
+		message := response.Error.Message
+		// request IDs are limited so this shouldn't happen
+		if message == "" {
+			return websocket.FormatCloseMessage(closeCode, "")
+		}
+		if excess >= len(message) {
+			response.Error.Message = ""
+			continue
+		}
+
+		message = message[:len(message)-excess]
+		for len(message) > 0 && !utf8.ValidString(message) {
+			message = message[:len(message)-1]
+		}
+		response.Error.Message = message
+	}
 }
@@ -0,0 +1,161 @@
+package exportertls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnsureSelfSigned(t *testing.T) {
+	asserter := require.New(t)
+
+	dir := t.TempDir()
+	now := time.Now()
+
+	selfSigned, err := EnsureSelfSigned(dir, []string{"localhost", "127.0.0.1"}, now)
+	asserter.NoError(err)
+
+	certPEM, err := os.ReadFile(selfSigned.CertFile)
+	asserter.NoError(err)
+
+	// second call keeps everything
+	again, err := EnsureSelfSigned(dir, []string{"localhost"}, now)
+	asserter.NoError(err)
+	asserter.Equal(selfSigned.CACertPEM, again.CACertPEM)
+
+	unchangedPEM, err := os.ReadFile(selfSigned.CertFile)
+	asserter.NoError(err)
+	asserter.Equal(certPEM, unchangedPEM)
+
+	// new host replaces the server cert but keeps the CA
+	again, err = EnsureSelfSigned(dir, []string{"localhost", "exporter.example.com"}, now)
+	asserter.NoError(err)
+	asserter.Equal(selfSigned.CACertPEM, again.CACertPEM)
+
+	cert, _, err := loadCertKey(again.CertFile, again.KeyFile)
+	asserter.NoError(err)
+	asserter.NoError(cert.VerifyHostname("exporter.example.com"))
+
+	// close to expiring
+	again, err = EnsureSelfSigned(dir, []string{"localhost"}, now.Add(certValidFor-time.Hour))
+	asserter.NoError(err)
+	asserter.Equal(selfSigned.CACertPEM, again.CACertPEM)
+
+	renewed, _, err := loadCertKey(again.CertFile, again.KeyFile)
+	asserter.NoError(err)
+	asserter.True(renewed.NotAfter.After(cert.NotAfter))
+}
+
+func TestCertReloader(t *testing.T) {
+	asserter := require.New(t)
+
+	selfSigned, err := EnsureSelfSigned(t.TempDir(), []string{"127.0.0.1"}, time.Now())
+	asserter.NoError(err)
+
+	certDir := t.TempDir()
+	certFile := filepath.Join(certDir, "server.crt")
+	keyFile := filepath.Join(certDir, "server.key")
+
+	copyFile := func(dst, src string) {
+		contents, err := os.ReadFile(src)
+		asserter.NoError(err)
+		asserter.NoError(os.WriteFile(dst, contents, 0600))
+	}
+	copyFile(certFile, selfSigned.CertFile)
+	copyFile(keyFile, selfSigned.KeyFile)
+
+	_, err = NewCertReloader(certFile, filepath.Join(certDir, "missing.key"))
+	asserter.Error(err)
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	asserter.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	asserter.NoError(reloader.Watch(ctx))
+
+	// StartTLS would serve its own cert, so wrap the listener instead
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Listener = tls.NewListener(server.Listener, reloader.TLSConfig())
+	server.Start()
+	defer server.Close()
+
+	rootCAs := x509.NewCertPool()
+	asserter.True(rootCAs.AppendCertsFromPEM(selfSigned.CACertPEM))
+
+	servedSerial := func() string {
+		conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{RootCAs: rootCAs})
+		asserter.NoError(err)
+		defer conn.Close()
+
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.String()
+	}
+
+	firstSerial := servedSerial()
+
+	// unchanged files are not loaded again
+	reloaded, err := reloader.Reload()
+	asserter.NoError(err)
+	asserter.False(reloaded)
+
+	// a half written pair keeps the old cert
+	asserter.NoError(os.WriteFile(keyFile, []byte("garbage"), 0600))
+	_, err = reloader.Reload()
+	asserter.Error(err)
+	asserter.Equal(firstSerial, servedSerial())
+
+	newSelfSigned, err := EnsureSelfSigned(t.TempDir(), []string{"127.0.0.1"}, time.Now())
+	asserter.NoError(err)
+	asserter.True(rootCAs.AppendCertsFromPEM(newSelfSigned.CACertPEM))
+	copyFile(certFile, newSelfSigned.CertFile)
+	copyFile(keyFile, newSelfSigned.KeyFile)
+
+	asserter.Eventually(func() bool {
+		return servedSerial() != firstSerial
+	}, time.Second*5, time.Millisecond*50)
+}
+
+func TestRedirectHandler(t *testing.T) {
+	asserter := require.New(t)
+
+	w := httptest.NewRecorder()
+	RedirectHandler("8443").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com:8080/api/mod/download?x=1", nil))
+
+	asserter.Equal(http.StatusMovedPermanently, w.Code)
+	asserter.Equal("https://example.com:8443/api/mod/download?x=1", w.Header().Get("Location"))
+
+	w = httptest.NewRecorder()
+	RedirectHandler("443").ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://example.com/api/message/post", nil))
+
+	asserter.Equal(http.StatusPermanentRedirect, w.Code)
+	asserter.Equal("https://example.com/api/message/post", w.Header().Get("Location"))
+
+	// IPv6 hosts keep exactly one set of brackets, with or without a port
+	for _, tc := range []struct {
+		host      string
+		httpsPort string
+		location  string
+	}{
+		{host: "[::1]", httpsPort: "8443", location: "https://[::1]:8443/"},
+		{host: "[::1]:8080", httpsPort: "8443", location: "https://[::1]:8443/"},
+		{host: "[::1]", httpsPort: "443", location: "https://[::1]/"},
+		{host: "[::1]:8080", httpsPort: "443", location: "https://[::1]/"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = tc.host
+
+		w = httptest.NewRecorder()
+		RedirectHandler(tc.httpsPort).ServeHTTP(w, req)
+
+		asserter.Equal(tc.location, w.Header().Get("Location"), tc.host)
+	}
+}
@@ -0,0 +1,35 @@
+package exportertls
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RedirectHandler sends every request to the same URL over HTTPS on httpsPort. Meant for a plain HTTP listener next to the TLS one.
+func RedirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			// no port in the host header, IPv6 addresses are still bracketed
+			host = strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]")
+		}
+
+		switch {
+		case httpsPort != "" && httpsPort != "443":
+			host = net.JoinHostPort(host, httpsPort)
+		case strings.Contains(host, ":"):
+			host = "[" + host + "]"
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+
+		// 308 so clients keep the method and body of anything that is not a plain GET
+		statusCode := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			statusCode = http.StatusMovedPermanently
+		}
+
+		http.Redirect(w, r, target, statusCode)
+	})
+}
@@ -0,0 +1,161 @@
+package exportertls
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/errutil"
+	"github.com/benw10-1/brotato-exporter/logutil"
+	"github.com/fsnotify/fsnotify"
+)
+
+// CertReloader serves a certificate/key pair from disk, picking up changes to the files without a restart.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	cert *tls.Certificate
+	// fileStamp of both files when cert was loaded, so events that did not change them are ignored
+	fileStamp string
+
+	mu sync.RWMutex
+}
+
+// NewCertReloader loads the pair once so a bad cert or key fails startup rather than the first handshake.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	reloader := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	_, err := reloader.Reload()
+	if err != nil {
+		return nil, errutil.NewStackError(err)
+	}
+
+	return reloader, nil
+}
+
+// GetCertificate for tls.Config.
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+
+	return cr.cert, nil
+}
+
+// TLSConfig server config serving the current certificate.
+func (cr *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.GetCertificate,
+	}
+}
+
+// Reload loads the pair again if either file changed. On error the previous certificate keeps being served.
+// Returns true if a new certificate was loaded.
+func (cr *CertReloader) Reload() (bool, error) {
+	fileStamp, err := filesStamp(cr.certFile, cr.keyFile)
+	if err != nil {
+		return false, errutil.NewStackError(err)
+	}
+
+	cr.mu.RLock()
+	unchanged := fileStamp == cr.fileStamp
+	cr.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return false, errutil.NewStackError(err)
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.fileStamp = fileStamp
+	cr.mu.Unlock()
+
+	return true, nil
+}
+
+// Watch reloads whenever something in the directories of the cert or key changes until ctx is done.
+// Directories are watched rather than the files so renames and symlink swaps (ex. certbot, k8s secrets) are seen.
+func (cr *CertReloader) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	for _, dir := range []string{filepath.Dir(cr.certFile), filepath.Dir(cr.keyFile)} {
+		err = watcher.Add(dir)
+		if err != nil {
+			watcher.Close()
+			return errutil.NewStackError(err)
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		// writers often touch the cert and key separately, wait for things to settle before loading
+		reloadTimer := time.NewTimer(0)
+		<-reloadTimer.C
+
+		for {
+			select {
+			case <-ctx.Done():
+				reloadTimer.Stop()
+				return
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				reloadTimer.Reset(time.Millisecond * 500)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+
+				slog.WarnContext(ctx, "exportertls.CertReloader.Watch: cert watch error", logutil.Err(err))
+			case <-reloadTimer.C:
+				reloaded, err := cr.Reload()
+				if err != nil {
+					slog.ErrorContext(ctx, "exportertls.CertReloader.Watch: failed to reload cert, still serving the previous one", logutil.Err(err))
+					continue
+				}
+
+				if reloaded {
+					slog.InfoContext(ctx, "exportertls.CertReloader.Watch: reloaded cert", slog.String("cert_file", cr.certFile))
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// filesStamp identifies the current contents of the files. They are small enough to just hash.
+func filesStamp(paths ...string) (string, error) {
+	hash := sha256.New()
+	for _, path := range paths {
+		// ReadFile follows symlinks so a swapped link target counts as a change
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return "", errutil.NewStackError(err)
+		}
+
+		_, _ = hash.Write(contents)
+	}
+
+	return string(hash.Sum(nil)), nil
+}
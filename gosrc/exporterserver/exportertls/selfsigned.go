@@ -0,0 +1,233 @@
+package exportertls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/errutil"
+)
+
+const (
+	caValidFor   = time.Hour * 24 * 365 * 10
+	certValidFor = time.Hour * 24 * 365
+	// certRenewBefore certs this close to expiring are replaced on the next EnsureSelfSigned
+	certRenewBefore = time.Hour * 24 * 30
+)
+
+// SelfSigned files of a generated CA and the server cert it signed.
+type SelfSigned struct {
+	CACertFile string
+	CAKeyFile  string
+	CertFile   string
+	KeyFile    string
+
+	// CACertPEM contents of CACertFile, for clients to trust.
+	CACertPEM []byte
+}
+
+// EnsureSelfSigned generates a CA and a server cert for hosts in dir, reusing whatever is already there.
+// The CA is kept for as long as it is valid so clients that trust it keep working. The server cert is replaced if it is close
+// to expiring or does not cover every host.
+func EnsureSelfSigned(dir string, hosts []string, now time.Time) (SelfSigned, error) {
+	selfSigned := SelfSigned{
+		CACertFile: filepath.Join(dir, "ca.crt"),
+		CAKeyFile:  filepath.Join(dir, "ca.key"),
+		CertFile:   filepath.Join(dir, "server.crt"),
+		KeyFile:    filepath.Join(dir, "server.key"),
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return SelfSigned{}, errutil.NewStackError(err)
+	}
+
+	caCert, caKey, err := loadCertKey(selfSigned.CACertFile, selfSigned.CAKeyFile)
+	if err != nil || now.After(caCert.NotAfter.Add(-certRenewBefore)) {
+		caCert, caKey, err = generateCA(now)
+		if err != nil {
+			return SelfSigned{}, errutil.NewStackError(err)
+		}
+
+		err = writeCertKey(selfSigned.CACertFile, selfSigned.CAKeyFile, caCert, caKey)
+		if err != nil {
+			return SelfSigned{}, errutil.NewStackError(err)
+		}
+	}
+
+	cert, _, err := loadCertKey(selfSigned.CertFile, selfSigned.KeyFile)
+	if err != nil || !certCovers(cert, caCert, hosts, now) {
+		var key *ecdsa.PrivateKey
+		cert, key, err = generateServerCert(caCert, caKey, hosts, now)
+		if err != nil {
+			return SelfSigned{}, errutil.NewStackError(err)
+		}
+
+		err = writeCertKey(selfSigned.CertFile, selfSigned.KeyFile, cert, key)
+		if err != nil {
+			return SelfSigned{}, errutil.NewStackError(err)
+		}
+	}
+
+	selfSigned.CACertPEM = encodeCertPEM(caCert)
+
+	return selfSigned, nil
+}
+
+// certCovers whether cert was signed by caCert, is valid for every host, and is not close to expiring.
+func certCovers(cert, caCert *x509.Certificate, hosts []string, now time.Time) bool {
+	if now.After(cert.NotAfter.Add(-certRenewBefore)) {
+		return false
+	}
+
+	if cert.CheckSignatureFrom(caCert) != nil {
+		return false
+	}
+
+	for _, host := range hosts {
+		if cert.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// generateCA
+func generateCA(now time.Time) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Brotato Exporter CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidFor),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	return createCert(template, nil, nil)
+}
+
+// generateServerCert
+func generateServerCert(caCert *x509.Certificate, caKey *ecdsa.PrivateKey, hosts []string, now time.Time) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "Brotato Exporter"},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(certValidFor),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	for _, host := range hosts {
+		ip := net.ParseIP(host)
+		if ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+			continue
+		}
+
+		if !slices.Contains(template.DNSNames, host) {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	return createCert(template, caCert, caKey)
+}
+
+// createCert signs template with parentKey, or self-signs it if parent is nil.
+func createCert(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errutil.NewStackError(err)
+	}
+
+	template.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, errutil.NewStackError(err)
+	}
+
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, errutil.NewStackError(err)
+	}
+
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, nil, errutil.NewStackError(err)
+	}
+
+	return cert, key, nil
+}
+
+// loadCertKey
+func loadCertKey(certFile, keyFile string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, errutil.NewStackError(err)
+	}
+
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, errutil.NewStackError(err)
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, nil, errutil.NewStackErrorf("no PEM data in %s", certFile)
+	}
+
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, errutil.NewStackError(err)
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, errutil.NewStackErrorf("no PEM data in %s", keyFile)
+	}
+
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, errutil.NewStackError(err)
+	}
+
+	return cert, key, nil
+}
+
+// writeCertKey writes the key first so a reloader never sees the new cert with the old key for long.
+func writeCertKey(certFile, keyFile string, cert *x509.Certificate, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	err = os.WriteFile(certFile, encodeCertPEM(cert), 0644)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	return nil
+}
+
+// encodeCertPEM
+func encodeCertPEM(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
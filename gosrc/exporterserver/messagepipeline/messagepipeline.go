@@ -0,0 +1,364 @@
+package messagepipeline
+
+import (
+	"context"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatostate"
+	"github.com/benw10-1/brotato-exporter/logutil"
+	"github.com/google/uuid"
+)
+
+// Event one fully decoded message. Events own their key values, nothing in them points into the body they were read from.
+type Event struct {
+	UserID uuid.UUID
+	// RequestID of the request the body was posted or streamed on, for logs.
+	RequestID string
+	// ReceivedTime when the server received the body holding the message.
+	ReceivedTime time.Time
+
+	MessageType      brotatomodtypes.MessageType
+	MessageReason    brotatomodtypes.MessageReason
+	MessageTimestamp brotatomodtypes.MicroTime
+
+	// KeyValues in the order they were sent, empty for messages without a body.
+	KeyValues []brotatomodtypes.DictKeyValue
+
+	// Seq set by Publish, counts up per user. A consumer which sees a gap had events dropped from its queue.
+	Seq uint64
+	// State session state once the event was applied, nil if it couldn't be. Set by the Apply of the consumer which
+	// owns the state.
+	State *brotatostate.Snapshot
+	// ChangedKeys keys the event changed in State, including keys a full message dropped.
+	ChangedKeys []string
+}
+
+// LogContext context whose logs carry the event's user and request, consumers have no request context of their own.
+func (e Event) LogContext() context.Context {
+	return logutil.WithAttrs(context.Background(), slog.String(logutil.KeyUserID, e.UserID.String()), slog.String(logutil.KeyRequestID, e.RequestID))
+}
+
+// Policy what Publish does when a consumer's queue is full.
+type Policy uint8
+
+const (
+	// PolicyBlock wait up to BlockTimeout for space, then drop the event. The wait holds up the mod's request and the
+	// event can still be dropped, anything which can't be skipped belongs in Apply instead.
+	PolicyBlock Policy = iota
+	// PolicyDropNewest drop the event being published.
+	PolicyDropNewest
+	// PolicyDropOldest drop the oldest queued event to make space.
+	PolicyDropOldest
+)
+
+// String
+func (p Policy) String() string {
+	switch p {
+	case PolicyBlock:
+		return "block"
+	case PolicyDropNewest:
+		return "drop_newest"
+	case PolicyDropOldest:
+		return "drop_oldest"
+	default:
+		return "unknown"
+	}
+}
+
+// ConsumerConfig
+type ConsumerConfig struct {
+	// Name shown in Stats.
+	Name string
+	// QueueSize events queued per user before Policy kicks in.
+	QueueSize int
+	// Policy
+	Policy Policy
+	// BlockTimeout longest Publish waits for space with PolicyBlock.
+	BlockTimeout time.Duration
+	// Apply optional, called by Publish with each event before any consumer queues it, in order and never skipped.
+	// For bookkeeping like session state which the consumer can't get wrong. It holds up the mod's request, so keep I/O
+	// out of it.
+	Apply func(event *Event)
+	// Consume called with each user's events in order, one event at a time per user. Different users are consumed concurrently.
+	Consume func(event Event)
+}
+
+// ConsumerStats totals across all users.
+type ConsumerStats struct {
+	Name   string `json:"name"`
+	Policy string `json:"policy"`
+
+	Published int64 `json:"published"`
+	Consumed  int64 `json:"consumed"`
+	Dropped   int64 `json:"dropped"`
+	// Blocked publishes which had to wait for space.
+	Blocked int64 `json:"blocked"`
+	// Queued events waiting to be consumed.
+	Queued int64 `json:"queued"`
+	// Panics recovered from Apply or Consume, the event is counted as consumed.
+	Panics int64 `json:"panics"`
+}
+
+// consumer
+type consumer struct {
+	ConsumerConfig
+
+	published atomic.Int64
+	consumed  atomic.Int64
+	dropped   atomic.Int64
+	blocked   atomic.Int64
+	panics    atomic.Int64
+}
+
+// queue one user's events for one consumer.
+type queue struct {
+	eventChan chan Event
+	// running worker goroutine is reading eventChan.
+	running bool
+}
+
+// userPipeline
+type userPipeline struct {
+	queues []*queue
+	// seq of the last event published for the user.
+	seq uint64
+	// removed taken out of the pipeline's map, whoever locked it should look the user up again.
+	removed bool
+
+	mu sync.Mutex
+}
+
+// Pipeline hands events to every consumer through a bounded queue per user and consumer. A consumer falling behind
+// only fills its own queues, each consumer's Policy decides what happens then.
+type Pipeline struct {
+	ctx         context.Context
+	consumers   []*consumer
+	idleTimeout time.Duration
+
+	userPipelineMap map[uuid.UUID]*userPipeline
+	// rwmu control reads and writes to userPipelineMap
+	rwmu sync.RWMutex
+}
+
+// NewPipeline workers stop when ctx is done, or after idleTimeout without events for their user.
+func NewPipeline(ctx context.Context, idleTimeout time.Duration, consumerConfigs ...ConsumerConfig) *Pipeline {
+	consumers := make([]*consumer, len(consumerConfigs))
+	for i, consumerConfig := range consumerConfigs {
+		consumerConfig.QueueSize = max(consumerConfig.QueueSize, 1)
+		consumers[i] = &consumer{ConsumerConfig: consumerConfig}
+	}
+
+	return &Pipeline{
+		ctx:             ctx,
+		consumers:       consumers,
+		idleTimeout:     idleTimeout,
+		userPipelineMap: make(map[uuid.UUID]*userPipeline),
+	}
+}
+
+// lockUser finds or creates the user's pipeline and locks it.
+func (p *Pipeline) lockUser(userID uuid.UUID) *userPipeline {
+	for {
+		p.rwmu.RLock()
+		up, ok := p.userPipelineMap[userID]
+		p.rwmu.RUnlock()
+
+		if !ok {
+			p.rwmu.Lock()
+			up, ok = p.userPipelineMap[userID]
+			if !ok {
+				up = &userPipeline{queues: make([]*queue, len(p.consumers))}
+				for i, c := range p.consumers {
+					up.queues[i] = &queue{eventChan: make(chan Event, c.QueueSize)}
+				}
+				p.userPipelineMap[userID] = up
+			}
+			p.rwmu.Unlock()
+		}
+
+		up.mu.Lock()
+		if !up.removed {
+			return up
+		}
+		up.mu.Unlock()
+	}
+}
+
+// Publish applies the event for every consumer with an Apply, then queues it for every consumer. Only returns early for
+// PolicyBlock consumers with a full queue, which are waited on one after the other once the rest have the event. Events
+// of one user have to be published from one goroutine at a time to stay in order.
+func (p *Pipeline) Publish(event Event) {
+	up := p.lockUser(event.UserID)
+
+	up.seq++
+	event.Seq = up.seq
+
+	for _, c := range p.consumers {
+		if c.Apply != nil {
+			p.apply(c, &event)
+		}
+	}
+
+	var blockedQueues []int
+	for i, c := range p.consumers {
+		q := up.queues[i]
+		c.published.Add(1)
+
+		if !q.running {
+			q.running = true
+			go p.work(event.UserID, up, i)
+		}
+
+		select {
+		case q.eventChan <- event:
+			continue
+		default:
+		}
+
+		switch c.Policy {
+		case PolicyBlock:
+			blockedQueues = append(blockedQueues, i)
+		case PolicyDropOldest:
+			// the worker may have taken one in the meantime, either way there is space now as only this goroutine sends
+			select {
+			case <-q.eventChan:
+				c.dropped.Add(1)
+			default:
+			}
+			q.eventChan <- event
+		default:
+			c.dropped.Add(1)
+		}
+	}
+
+	// the worker can't stop while its queue is full, so blocking outside the lock is safe
+	up.mu.Unlock()
+
+	for _, i := range blockedQueues {
+		c := p.consumers[i]
+		c.blocked.Add(1)
+
+		timer := time.NewTimer(c.BlockTimeout)
+		select {
+		case up.queues[i].eventChan <- event:
+		case <-timer.C:
+			c.dropped.Add(1)
+			slog.WarnContext(event.LogContext(), "messagepipeline.Pipeline.Publish: consumer blocked, dropping event",
+				slog.String("consumer", c.Name), slog.Duration("block_timeout", c.BlockTimeout))
+		case <-p.ctx.Done():
+			c.dropped.Add(1)
+		}
+		timer.Stop()
+	}
+}
+
+// work consumes the user's events for one consumer until the queue has been empty for idleTimeout.
+func (p *Pipeline) work(userID uuid.UUID, up *userPipeline, i int) {
+	c := p.consumers[i]
+	q := up.queues[i]
+
+	idleTimer := time.NewTimer(p.idleTimeout)
+	defer idleTimer.Stop()
+
+	for {
+		select {
+		case event := <-q.eventChan:
+			p.consume(c, event)
+
+			if !idleTimer.Stop() {
+				<-idleTimer.C
+			}
+			idleTimer.Reset(p.idleTimeout)
+		case <-idleTimer.C:
+			up.mu.Lock()
+			if len(q.eventChan) > 0 {
+				up.mu.Unlock()
+				idleTimer.Reset(p.idleTimeout)
+				continue
+			}
+
+			q.running = false
+			p.removeUserIfIdle(userID, up)
+			up.mu.Unlock()
+
+			return
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// consume
+func (p *Pipeline) consume(c *consumer, event Event) {
+	defer func() {
+		c.consumed.Add(1)
+
+		if r := recover(); r != nil {
+			c.panics.Add(1)
+			slog.ErrorContext(event.LogContext(), "messagepipeline.Pipeline.consume: consumer panicked",
+				slog.String("consumer", c.Name), slog.Any("panic", r), slog.String("stack", string(debug.Stack())))
+		}
+	}()
+
+	c.Consume(event)
+}
+
+// apply
+func (p *Pipeline) apply(c *consumer, event *Event) {
+	defer func() {
+		// the user's pipeline is locked, a panic has to stop here
+		if r := recover(); r != nil {
+			c.panics.Add(1)
+			slog.ErrorContext(event.LogContext(), "messagepipeline.Pipeline.apply: consumer panicked",
+				slog.String("consumer", c.Name), slog.Any("panic", r), slog.String("stack", string(debug.Stack())))
+		}
+	}()
+
+	c.Apply(event)
+}
+
+// removeUserIfIdle drops the user's pipeline once none of its workers are running. The pipeline must be locked.
+func (p *Pipeline) removeUserIfIdle(userID uuid.UUID, up *userPipeline) {
+	for _, q := range up.queues {
+		if q.running {
+			return
+		}
+	}
+
+	p.rwmu.Lock()
+	defer p.rwmu.Unlock()
+
+	if p.userPipelineMap[userID] == up {
+		delete(p.userPipelineMap, userID)
+	}
+	up.removed = true
+}
+
+// Stats per consumer, in the order they were given to NewPipeline.
+func (p *Pipeline) Stats() []ConsumerStats {
+	stats := make([]ConsumerStats, len(p.consumers))
+	for i, c := range p.consumers {
+		stats[i] = ConsumerStats{
+			Name:      c.Name,
+			Policy:    c.Policy.String(),
+			Consumed:  c.consumed.Load(),
+			Dropped:   c.dropped.Load(),
+			Blocked:   c.blocked.Load(),
+			Panics:    c.panics.Load(),
+			Published: c.published.Load(),
+		}
+		stats[i].Queued = max(stats[i].Published-stats[i].Consumed-stats[i].Dropped, 0)
+	}
+
+	return stats
+}
+
+// StatsVar Stats for expvar.Func.
+func (p *Pipeline) StatsVar() any {
+	return p.Stats()
+}
@@ -0,0 +1,232 @@
+package messagepipeline
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// timestampEvent event for userID told apart by its timestamp.
+func timestampEvent(userID uuid.UUID, timestamp int) Event {
+	return Event{
+		UserID:           userID,
+		ReceivedTime:     time.Now(),
+		MessageType:      brotatomodtypes.MessageTypeTimeSeriesDiff,
+		MessageTimestamp: brotatomodtypes.MicroTime(timestamp),
+	}
+}
+
+// recorder consumer which keeps the timestamps it saw per user, optionally waiting on gate before each event.
+type recorder struct {
+	gate chan struct{}
+
+	timestampMap map[uuid.UUID][]int
+	mu           sync.Mutex
+}
+
+func newRecorder(gated bool) *recorder {
+	r := &recorder{timestampMap: make(map[uuid.UUID][]int)}
+	if gated {
+		r.gate = make(chan struct{})
+	}
+
+	return r
+}
+
+func (r *recorder) consume(event Event) {
+	if r.gate != nil {
+		<-r.gate
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.timestampMap[event.UserID] = append(r.timestampMap[event.UserID], int(event.MessageTimestamp))
+}
+
+func (r *recorder) timestamps(userID uuid.UUID) []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]int(nil), r.timestampMap[userID]...)
+}
+
+func TestPublish(t *testing.T) {
+	asserter := require.New(t)
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	first := newRecorder(false)
+	second := newRecorder(false)
+
+	pipeline := NewPipeline(ctx, time.Minute,
+		ConsumerConfig{Name: "first", QueueSize: 4, Policy: PolicyBlock, BlockTimeout: time.Second, Consume: first.consume},
+		ConsumerConfig{Name: "second", QueueSize: 4, Policy: PolicyBlock, BlockTimeout: time.Second, Consume: second.consume},
+	)
+
+	userIDs := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	want := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+
+	wg := new(sync.WaitGroup)
+	for _, userID := range userIDs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, timestamp := range want {
+				pipeline.Publish(timestampEvent(userID, timestamp))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// every consumer sees each user's events in order
+	for _, r := range []*recorder{first, second} {
+		for _, userID := range userIDs {
+			asserter.Eventually(func() bool {
+				return len(r.timestamps(userID)) == len(want)
+			}, time.Second, time.Millisecond*5)
+			asserter.Equal(want, r.timestamps(userID))
+		}
+	}
+
+	for _, stats := range pipeline.Stats() {
+		asserter.Equal(int64(30), stats.Published)
+		asserter.Equal(int64(30), stats.Consumed)
+		asserter.Zero(stats.Dropped)
+		asserter.Zero(stats.Queued)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	asserter := require.New(t)
+
+	// blocked publishes log the dropped event
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	dropNewest := newRecorder(true)
+	dropOldest := newRecorder(true)
+	block := newRecorder(true)
+	unaffected := newRecorder(false)
+	applied := newRecorder(false)
+
+	pipeline := NewPipeline(ctx, time.Minute,
+		ConsumerConfig{Name: "drop_newest", QueueSize: 2, Policy: PolicyDropNewest, Consume: dropNewest.consume},
+		ConsumerConfig{Name: "drop_oldest", QueueSize: 2, Policy: PolicyDropOldest, Consume: dropOldest.consume, Apply: func(event *Event) {
+			asserter.Equal(uint64(event.MessageTimestamp)+1, event.Seq)
+			applied.consume(*event)
+		}},
+		ConsumerConfig{Name: "block", QueueSize: 2, Policy: PolicyBlock, BlockTimeout: time.Millisecond * 10, Consume: block.consume},
+		ConsumerConfig{Name: "unaffected", QueueSize: 8, Policy: PolicyDropNewest, Consume: unaffected.consume},
+	)
+
+	userID := uuid.New()
+
+	// first event is taken by each worker and held at the gate, two more fill the queues
+	pipeline.Publish(timestampEvent(userID, 0))
+	up := pipeline.lockUser(userID)
+	up.mu.Unlock()
+	asserter.Eventually(func() bool {
+		for _, q := range up.queues {
+			if len(q.eventChan) != 0 {
+				return false
+			}
+		}
+
+		return true
+	}, time.Second, time.Millisecond*5)
+
+	for timestamp := 1; timestamp <= 4; timestamp++ {
+		pipeline.Publish(timestampEvent(userID, timestamp))
+	}
+
+	// applied as they are published, whatever happens to them in the queue
+	asserter.Equal([]int{0, 1, 2, 3, 4}, applied.timestamps(userID))
+
+	// a slow consumer doesn't hold up the rest
+	asserter.Eventually(func() bool {
+		return len(unaffected.timestamps(userID)) == 5
+	}, time.Second, time.Millisecond*5)
+
+	for _, r := range []*recorder{dropNewest, dropOldest, block} {
+		for i := 0; i < 3; i++ {
+			r.gate <- struct{}{}
+		}
+	}
+
+	asserter.Eventually(func() bool {
+		return len(dropNewest.timestamps(userID)) == 3 && len(dropOldest.timestamps(userID)) == 3 && len(block.timestamps(userID)) == 3
+	}, time.Second, time.Millisecond*5)
+
+	asserter.Equal([]int{0, 1, 2}, dropNewest.timestamps(userID))
+	asserter.Equal([]int{0, 3, 4}, dropOldest.timestamps(userID))
+	// blocking timed out on the last two
+	asserter.Equal([]int{0, 1, 2}, block.timestamps(userID))
+
+	stats := pipeline.Stats()
+	asserter.Equal(int64(2), stats[0].Dropped)
+	asserter.Equal(int64(2), stats[1].Dropped)
+	asserter.Equal(int64(2), stats[2].Dropped)
+	asserter.Equal(int64(2), stats[2].Blocked)
+	asserter.Zero(stats[3].Dropped)
+}
+
+func TestIdleAndPanic(t *testing.T) {
+	asserter := require.New(t)
+
+	// the panic is logged with its stack
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	r := newRecorder(false)
+	pipeline := NewPipeline(ctx, time.Millisecond*20, ConsumerConfig{
+		Name:      "panics",
+		QueueSize: 4,
+		Consume: func(event Event) {
+			if event.MessageTimestamp == 0 {
+				panic("bad event")
+			}
+			r.consume(event)
+		},
+	})
+
+	userID := uuid.New()
+
+	pipeline.Publish(timestampEvent(userID, 0))
+	pipeline.Publish(timestampEvent(userID, 1))
+
+	// the worker survives the panic
+	asserter.Eventually(func() bool {
+		return pipeline.Stats()[0].Consumed == 2
+	}, time.Second, time.Millisecond*5)
+	asserter.Equal(int64(1), pipeline.Stats()[0].Panics)
+	asserter.Equal([]int{1}, r.timestamps(userID))
+
+	// idle users are dropped, and come back on the next event
+	asserter.Eventually(func() bool {
+		pipeline.rwmu.RLock()
+		defer pipeline.rwmu.RUnlock()
+
+		return len(pipeline.userPipelineMap) == 0
+	}, time.Second, time.Millisecond*5)
+
+	pipeline.Publish(timestampEvent(userID, 2))
+	asserter.Eventually(func() bool {
+		return len(r.timestamps(userID)) == 2
+	}, time.Second, time.Millisecond*5)
+	asserter.Equal([]int{1, 2}, r.timestamps(userID))
+}
@@ -0,0 +1,82 @@
+package messagepipeline
+
+import (
+	"sync"
+	"time"
+)
+
+// Metrics counts events by type and tracks how far behind consumers run. Cheap enough to drop events under load.
+type Metrics struct {
+	messageCountMap map[string]int64
+	keyValueCount   int64
+	// lastLag time from receiving the body to this consumer seeing the event
+	lastLag time.Duration
+	maxLag  time.Duration
+
+	mu sync.Mutex
+}
+
+// MetricsSnapshot
+type MetricsSnapshot struct {
+	// Messages by message type.
+	Messages map[string]int64 `json:"messages"`
+	// KeyValues across all messages.
+	KeyValues int64 `json:"key_values"`
+	// LastLagMicros time from receiving the body to the metrics consumer seeing the last event.
+	LastLagMicros int64 `json:"last_lag_micros"`
+	// MaxLagMicros
+	MaxLagMicros int64 `json:"max_lag_micros"`
+}
+
+// NewMetrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		messageCountMap: make(map[string]int64),
+	}
+}
+
+// ConsumerConfig
+func (m *Metrics) ConsumerConfig() ConsumerConfig {
+	return ConsumerConfig{
+		Name:      "metrics",
+		QueueSize: 64,
+		Policy:    PolicyDropOldest,
+		Consume:   m.consume,
+	}
+}
+
+// consume
+func (m *Metrics) consume(event Event) {
+	lag := time.Since(event.ReceivedTime)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messageCountMap[event.MessageType.String()]++
+	m.keyValueCount += int64(len(event.KeyValues))
+	m.lastLag = lag
+	m.maxLag = max(m.maxLag, lag)
+}
+
+// Snapshot
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messageCountMap := make(map[string]int64, len(m.messageCountMap))
+	for messageType, count := range m.messageCountMap {
+		messageCountMap[messageType] = count
+	}
+
+	return MetricsSnapshot{
+		Messages:      messageCountMap,
+		KeyValues:     m.keyValueCount,
+		LastLagMicros: m.lastLag.Microseconds(),
+		MaxLagMicros:  m.maxLag.Microseconds(),
+	}
+}
+
+// SnapshotVar Snapshot for expvar.Func.
+func (m *Metrics) SnapshotVar() any {
+	return m.Snapshot()
+}
@@ -0,0 +1,96 @@
+package messagesubhandler
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/benw10-1/brotato-exporter/errutil"
+)
+
+// KeySelector which state keys a subscriber or request wants. Patterns are either exact keys or globs in path.Match
+// syntax, ex. "effects_stat_*" - AllKeyKey on its own matches every key. Excludes win over includes.
+type KeySelector struct {
+	includeKeyMap map[string]bool
+	includeGlobs  []string
+	excludeKeyMap map[string]bool
+	excludeGlobs  []string
+}
+
+// NewKeySelector errors on malformed globs. Without includes nothing is selected.
+func NewKeySelector(includes []string, excludes []string) (*KeySelector, error) {
+	ks := &KeySelector{
+		includeKeyMap: make(map[string]bool, len(includes)),
+		excludeKeyMap: make(map[string]bool, len(excludes)),
+	}
+
+	var err error
+	ks.includeGlobs, err = addPatterns(ks.includeKeyMap, includes)
+	if err != nil {
+		return nil, errutil.NewStackError(err)
+	}
+
+	ks.excludeGlobs, err = addPatterns(ks.excludeKeyMap, excludes)
+	if err != nil {
+		return nil, errutil.NewStackError(err)
+	}
+
+	return ks, nil
+}
+
+// AllKeySelector selects every key.
+func AllKeySelector() *KeySelector {
+	ks, _ := NewKeySelector([]string{AllKeyKey}, nil)
+	return ks
+}
+
+// addPatterns exact keys go in keyMap, globs are returned.
+func addPatterns(keyMap map[string]bool, patterns []string) ([]string, error) {
+	var globs []string
+	for _, pattern := range patterns {
+		if pattern == "" {
+			continue
+		}
+
+		if pattern == AllKeyKey || !strings.ContainsAny(pattern, `*?[\`) {
+			keyMap[pattern] = true
+			continue
+		}
+
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return nil, errutil.NewStackError(fmt.Errorf("key pattern (%s): %w", pattern, err))
+		}
+
+		globs = append(globs, pattern)
+	}
+
+	return globs, nil
+}
+
+// Empty whether nothing could ever be selected.
+func (ks *KeySelector) Empty() bool {
+	return len(ks.includeKeyMap) == 0 && len(ks.includeGlobs) == 0
+}
+
+// Selects
+func (ks *KeySelector) Selects(key string) bool {
+	return matches(ks.includeKeyMap, ks.includeGlobs, key) && !matches(ks.excludeKeyMap, ks.excludeGlobs, key)
+}
+
+// matches
+func matches(keyMap map[string]bool, globs []string, key string) bool {
+	if keyMap[key] || keyMap[AllKeyKey] {
+		return true
+	}
+
+	for _, glob := range globs {
+		// already checked when added
+		matched, _ := path.Match(glob, key)
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
@@ -2,126 +2,277 @@ package messagesubhandler
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
-	"io"
+	"log/slog"
 	"sync"
 	"time"
 
-	"log"
-
 	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
-	"github.com/benw10-1/brotato-exporter/brotatomod/brotatoserial"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatostate"
 	"github.com/benw10-1/brotato-exporter/errutil"
 	"github.com/benw10-1/brotato-exporter/exporterserver/ctrlauth"
+	"github.com/benw10-1/brotato-exporter/exporterserver/messagepipeline"
+	"github.com/benw10-1/brotato-exporter/logutil"
 	"github.com/google/uuid"
 )
 
-// AllKeyKey map key which if present will include all keys in the result.
+// AllKeyKey key pattern which selects every key.
 const AllKeyKey = "*"
 
 // MessageSub
 type MessageSub struct {
-	// subbedKeyMap map for checking if this sub should include a key in the result.
-	subbedKeyMap map[string]bool
-	messageChan  chan []byte
+	// keySelector keys this sub should get in its messages.
+	keySelector *KeySelector
+	messageChan chan []byte
+}
+
+// userHub subscribers and activity of one user. Each hub has its own lock so users never wait on each other.
+type userHub struct {
+	subs                []MessageSub
+	lastMessageReceived time.Time
+	// lastState streamed to subs and the Seq of its event, to catch up after dropped events.
+	lastState *brotatostate.Snapshot
+	lastSeq   uint64
+	// removed hub was taken out of the handler's map, whoever locked it should look the user up again.
+	removed bool
+
+	mu sync.Mutex
+}
+
+// unused no subscribers and no live session, safe to drop.
+func (hub *userHub) unused() bool {
+	return len(hub.subs) == 0 && hub.lastMessageReceived.IsZero()
 }
 
 // MessageSubHandler
 type MessageSubHandler struct {
-	lastMessageReceived map[uuid.UUID]time.Time
-	userSubsMap         map[uuid.UUID][]MessageSub
-	sessionInfoMap      *ctrlauth.SessionInfoMap // temp hack for resetting state after "disconnect". To avoid having to do a rework already :/
-	maxIdleDuration     time.Duration
-	// rwmu control reads and writes to userSubsMap
+	hubMap          map[uuid.UUID]*userHub
+	sessionInfoMap  *ctrlauth.SessionInfoMap // temp hack for resetting state after "disconnect". To avoid having to do a rework already :/
+	maxIdleDuration time.Duration
+	// rwmu control reads and writes to hubMap, only held to find, add or remove a hub.
 	rwmu sync.RWMutex
 }
 
 // NewMessageSubHandler
 func NewMessageSubHandler(ctx context.Context, sessionInfoMap *ctrlauth.SessionInfoMap, maxIdleDuration time.Duration) *MessageSubHandler {
 	msh := &MessageSubHandler{
-		lastMessageReceived: make(map[uuid.UUID]time.Time),
-		userSubsMap:         make(map[uuid.UUID][]MessageSub),
-		sessionInfoMap:      sessionInfoMap,
-		maxIdleDuration:     maxIdleDuration,
+		hubMap:          make(map[uuid.UUID]*userHub),
+		sessionInfoMap:  sessionInfoMap,
+		maxIdleDuration: maxIdleDuration,
 	}
 	go func() {
 		err := msh.sweepIdle(ctx)
 		if err != nil {
-			log.Printf("messagesubhandler.sweepIdle: returned (%v)", err)
+			slog.ErrorContext(ctx, "messagesubhandler.sweepIdle: returned", logutil.Err(err))
 		}
 	}()
 
 	return msh
 }
 
-// sweepIdle
+// lockHub finds the user's hub and locks it. If the user has none, one is created when create is set, otherwise nil is returned.
+func (msh *MessageSubHandler) lockHub(userID uuid.UUID, create bool) *userHub {
+	for {
+		msh.rwmu.RLock()
+		hub, ok := msh.hubMap[userID]
+		msh.rwmu.RUnlock()
+
+		if !ok {
+			if !create {
+				return nil
+			}
+
+			msh.rwmu.Lock()
+			hub, ok = msh.hubMap[userID]
+			if !ok {
+				hub = new(userHub)
+				msh.hubMap[userID] = hub
+			}
+			msh.rwmu.Unlock()
+		}
+
+		hub.mu.Lock()
+		if !hub.removed {
+			return hub
+		}
+		// lost a race with removeHubIfUnused, the next lookup won't find this hub
+		hub.mu.Unlock()
+	}
+}
+
+// removeHubIfUnused drops the hub from the map if nothing uses it. The hub must be locked.
+func (msh *MessageSubHandler) removeHubIfUnused(userID uuid.UUID, hub *userHub) {
+	if !hub.unused() {
+		return
+	}
+
+	msh.rwmu.Lock()
+	defer msh.rwmu.Unlock()
+
+	if msh.hubMap[userID] == hub {
+		delete(msh.hubMap, userID)
+	}
+	hub.removed = true
+}
+
+// sweepIdle resets users who haven't sent anything in maxIdleDuration. Hubs are swept one at a time, so only the user being
+// swept waits on it.
 func (msh *MessageSubHandler) sweepIdle(ctx context.Context) error {
 	ticker := time.NewTicker(msh.maxIdleDuration)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-ticker.C:
-			func() {
-				msh.rwmu.Lock()
-				defer msh.rwmu.Unlock()
+			msh.rwmu.RLock()
+			userIDs := make([]uuid.UUID, 0, len(msh.hubMap))
+			for userID := range msh.hubMap {
+				userIDs = append(userIDs, userID)
+			}
+			msh.rwmu.RUnlock()
 
-				deleteKeys := make([]uuid.UUID, 0, len(msh.lastMessageReceived))
+			for _, userID := range userIDs {
+				msh.sweepUser(userID)
+			}
+		case <-ctx.Done():
+			return errutil.NewStackError(ctx.Err())
+		}
+	}
+}
+
+// sweepUser resets the user's session and tells their subs if nothing has been received for maxIdleDuration.
+// The session is locked before the hub, the same order as ingest. State is only applied with the session locked, so
+// resetting it can't race an event being applied.
+func (msh *MessageSubHandler) sweepUser(userID uuid.UUID) {
+	sessInfo, hasSession := msh.sessionInfoMap.Load(userID)
+	if hasSession {
+		sessInfo.Lock()
+		defer sessInfo.Unlock()
+	}
+
+	hub := msh.lockHub(userID, false)
+	if hub == nil {
+		return
+	}
+	defer hub.mu.Unlock()
 
-				for userID, lastKeepAliveTime := range msh.lastMessageReceived {
-					if time.Since(lastKeepAliveTime) <= msh.maxIdleDuration {
-						continue
-					}
+	if hub.lastMessageReceived.IsZero() || time.Since(hub.lastMessageReceived) <= msh.maxIdleDuration {
+		return
+	}
 
-					userSubs := msh.userSubsMap[userID]
-					for i, sub := range userSubs {
-						select {
-						case sub.messageChan <- []byte("{}"):
-						default:
-							log.Printf("messagesubhandler.MessageSubHandler.StreamMessage: messageChan (%d) full for (%s), dropping message", i, userID)
-						}
-					}
+	// no request to log with, only the user
+	logCtx := logutil.WithAttrs(context.Background(), slog.String(logutil.KeyUserID, userID.String()))
 
-					// reset session state on disconnect as well
-					sessInfo, ok := msh.sessionInfoMap.Load(userID)
-					if !ok {
-						log.Printf("messagesubhandler.MessageSubHandler.StreamMessage: unexpected missing session for (%s)", userID)
-						continue
-					}
+	for i, sub := range hub.subs {
+		select {
+		case sub.messageChan <- []byte("{}"):
+		default:
+			slog.WarnContext(logCtx, "messagesubhandler.MessageSubHandler.sweepUser: messageChan full, dropping message", slog.Int("sub", i))
+		}
+	}
 
-					sessInfo.Lock()
+	// reset session state on disconnect as well
+	if !hasSession {
+		slog.WarnContext(logCtx, "messagesubhandler.MessageSubHandler.sweepUser: unexpected missing session")
+	} else {
+		sessInfo.MessageReader.Reset()
+		sessInfo.State.Reset()
+	}
 
-					sessInfo.MessageReader = brotatoserial.NewMessageReader(nil, make([]byte, 1024))
-					sessInfo.CurrentSessionState = make(map[string]json.RawMessage)
+	hub.lastMessageReceived = time.Time{}
+	hub.lastState = nil
+	msh.removeHubIfUnused(userID, hub)
+}
 
-					sessInfo.Unlock()
+// ConsumerConfig events are applied to the session state by Publish, so the state never skips one. Only streaming to subs
+// is queued, if it falls behind events are dropped and the next one streamed makes up for them.
+func (msh *MessageSubHandler) ConsumerConfig() messagepipeline.ConsumerConfig {
+	return messagepipeline.ConsumerConfig{
+		Name:      "subscribers",
+		QueueSize: 64,
+		Policy:    messagepipeline.PolicyDropOldest,
+		Apply:     msh.apply,
+		Consume:   msh.StreamEvent,
+	}
+}
 
-					deleteKeys = append(deleteKeys, userID)
-				}
+// apply
+func (msh *MessageSubHandler) apply(event *messagepipeline.Event) {
+	sessInfo, ok := msh.sessionInfoMap.Load(event.UserID)
+	if !ok {
+		slog.WarnContext(event.LogContext(), "messagesubhandler.MessageSubHandler.apply: unexpected missing session")
+		return
+	}
 
-				for _, deleteKey := range deleteKeys {
-					delete(msh.lastMessageReceived, deleteKey)
-				}
-			}()
-		case <-ctx.Done():
-			return errutil.NewStackError(ctx.Err())
+	err := ApplyEvent(sessInfo.State, event)
+	if err != nil {
+		slog.WarnContext(event.LogContext(), "messagesubhandler.MessageSubHandler.apply: failed to apply message, dropping message",
+			slog.String("type", event.MessageType.String()), logutil.Err(err))
+	}
+}
+
+// ApplyEvent applies the event to state, setting its State and ChangedKeys. A full message replaces the state, the keys
+// it left out count as changed.
+func ApplyEvent(state *brotatostate.Store, event *messagepipeline.Event) error {
+	update := brotatostate.Update{
+		Time:   event.MessageTimestamp.Time(),
+		Reason: event.MessageReason,
+	}
+
+	changedKeys := make([]string, 0, len(event.KeyValues))
+	for _, kv := range event.KeyValues {
+		changedKeys = append(changedKeys, kv.MappedKey)
+	}
+
+	var snapshot *brotatostate.Snapshot
+	var err error
+	if event.MessageType == brotatomodtypes.MessageTypeTimeSeriesFull {
+		prevSnapshot := state.Snapshot()
+
+		snapshot, err = state.Replace(update, event.KeyValues)
+		if err == nil {
+			changedKeys = appendDroppedKeys(changedKeys, prevSnapshot, snapshot)
 		}
+	} else {
+		snapshot, err = state.Apply(update, event.KeyValues)
+	}
+	if err != nil {
+		return errutil.NewStackError(err)
 	}
+
+	event.State = snapshot
+	event.ChangedKeys = changedKeys
+
+	return nil
 }
 
-// StreamMessage
-// updateMap will be written to with any key values read - quick hack for now
-func (msh *MessageSubHandler) StreamMessage(userID uuid.UUID, updateMap map[string]json.RawMessage, message brotatomodtypes.ExporterMessage) {
-	msh.rwmu.Lock()
+// StreamEvent streams the keys the event changed to subs, rendered from the state the event left. Subs get the merged
+// value of nested maps, and null for removed keys. If events were dropped since the last one streamed, every key which
+// changed since then is sent instead.
+func (msh *MessageSubHandler) StreamEvent(event messagepipeline.Event) {
+	hub := msh.lockHub(event.UserID, true)
 	defer func() {
-		msh.lastMessageReceived[userID] = time.Now()
+		hub.lastMessageReceived = time.Now()
 
-		msh.rwmu.Unlock()
+		hub.mu.Unlock()
 	}()
-	if message.MessageBody == nil || message.MessageBody.Size() == 0 {
+
+	snapshot := event.State
+	if snapshot == nil {
+		return
+	}
+
+	changedKeys := event.ChangedKeys
+	if hub.lastState != nil && event.Seq != hub.lastSeq+1 {
+		changedKeys = snapshot.ChangedKeys(hub.lastState)
+	}
+	hub.lastState = snapshot
+	hub.lastSeq = event.Seq
+
+	if len(changedKeys) == 0 {
 		return
 	}
 
-	userSubs := msh.userSubsMap[userID]
+	userSubs := hub.subs
 
 	subMsgs := make([][]byte, len(userSubs))
 	for i := range subMsgs {
@@ -129,48 +280,30 @@ func (msh *MessageSubHandler) StreamMessage(userID uuid.UUID, updateMap map[stri
 		subMsgs[i] = append(subMsgs[i], '{')
 	}
 
-	for {
-		kv, err := message.MessageBody.ReadNextKeyValue()
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
-
-			log.Printf("messagesubhandler.MessageSubHandler.StreamMessage: ReadNextKeyValue error: %v", err)
-			return
-		}
-
-		// reusable JSON representation for both setting the updateMap and building each message
+	for _, key := range changedKeys {
+		// rendered once for all subs which want the key
 		var jsonRepresentation []byte
-		// our own little JSON parser so we don't have to build a sep. map for each sub.
 		for i, sub := range userSubs {
-			if !sub.subbedKeyMap[AllKeyKey] && !sub.subbedKeyMap[kv.MappedKey] {
+			if !sub.keySelector.Selects(key) {
 				continue
 			}
 
-			subMsgs[i] = append(subMsgs[i], '"')
-			subMsgs[i] = append(subMsgs[i], kv.MappedKey...)
-			subMsgs[i] = append(subMsgs[i], '"', ':')
 			if jsonRepresentation == nil {
-				startIdx := len(subMsgs[i])
-				subMsgs[i] = kv.AppendJSON(subMsgs[i])
-				jsonRepresentation = subMsgs[i][startIdx:len(subMsgs[i])]
-			} else {
-				subMsgs[i] = append(subMsgs[i], jsonRepresentation...)
+				// keys come from the mod, escape them the same as Snapshot.AppendJSON
+				jsonRepresentation = brotatomodtypes.DictKeyValue{SerialType: brotatomodtypes.SerialTypeString, Value: []byte(key)}.AppendJSON(nil)
+				jsonRepresentation = append(jsonRepresentation, ':')
+
+				value, ok := snapshot.Get(key)
+				if ok {
+					jsonRepresentation = value.AppendJSON(jsonRepresentation)
+				} else {
+					jsonRepresentation = append(jsonRepresentation, "null"...)
+				}
 			}
 
+			subMsgs[i] = append(subMsgs[i], jsonRepresentation...)
 			subMsgs[i] = append(subMsgs[i], ',')
 		}
-
-		if jsonRepresentation == nil {
-			jsonRepresentation = kv.AppendJSON(nil)
-		} else {
-			cpy := make([]byte, len(jsonRepresentation))
-			copy(cpy, jsonRepresentation)
-			jsonRepresentation = cpy
-		}
-
-		updateMap[kv.MappedKey] = jsonRepresentation
 	}
 
 	for i, sub := range userSubs {
@@ -182,93 +315,92 @@ func (msh *MessageSubHandler) StreamMessage(userID uuid.UUID, updateMap map[stri
 		select {
 		case sub.messageChan <- subMsgs[i]:
 		default:
-			log.Printf("messagesubhandler.MessageSubHandler.StreamMessage: messageChan (%d) full for (%s), dropping message", i, userID)
+			slog.WarnContext(event.LogContext(), "messagesubhandler.MessageSubHandler.StreamEvent: messageChan full, dropping message", slog.Int("sub", i))
 		}
 	}
 }
 
-// SubscribeToUser
-func (msh *MessageSubHandler) SubscribeToUser(userID uuid.UUID, subbedKeyMap map[string]bool) chan []byte {
-	msh.rwmu.Lock()
-	defer msh.rwmu.Unlock()
+// appendDroppedKeys appends the keys of prevSnapshot which aren't in snapshot and weren't already changed, e.g. the keys
+// a full message left out.
+func appendDroppedKeys(changedKeys []string, prevSnapshot *brotatostate.Snapshot, snapshot *brotatostate.Snapshot) []string {
+	changedKeyMap := make(map[string]struct{}, len(changedKeys))
+	for _, key := range changedKeys {
+		changedKeyMap[key] = struct{}{}
+	}
 
-	userSub, ok := msh.userSubsMap[userID]
-	if !ok {
-		userSub = make([]MessageSub, 0)
+	for _, key := range prevSnapshot.Keys() {
+		if _, ok := changedKeyMap[key]; ok {
+			continue
+		}
+
+		if _, ok := snapshot.Get(key); !ok {
+			changedKeys = append(changedKeys, key)
+		}
 	}
 
+	return changedKeys
+}
+
+// SubscribeToUser
+func (msh *MessageSubHandler) SubscribeToUser(userID uuid.UUID, keySelector *KeySelector) chan []byte {
+	hub := msh.lockHub(userID, true)
+	defer hub.mu.Unlock()
+
 	messageChan := make(chan []byte, 1)
-	userSub = append(userSub, MessageSub{
-		subbedKeyMap: subbedKeyMap,
-		messageChan:  messageChan,
+	hub.subs = append(hub.subs, MessageSub{
+		keySelector: keySelector,
+		messageChan: messageChan,
 	})
 
-	msh.userSubsMap[userID] = userSub
-
 	return messageChan
 }
 
 // UnsubscribeFromUser
 func (msh *MessageSubHandler) UnsubscribeFromUser(userID uuid.UUID, messageChan chan []byte) {
-	msh.rwmu.Lock()
-	defer msh.rwmu.Unlock()
-
-	userSubs, ok := msh.userSubsMap[userID]
-	if !ok {
+	hub := msh.lockHub(userID, false)
+	if hub == nil {
 		return
 	}
+	defer hub.mu.Unlock()
 
-	for i, sub := range userSubs {
+	for i, sub := range hub.subs {
 		if sub.messageChan == messageChan {
 			close(sub.messageChan)
-			userSubs = append(userSubs[:i], userSubs[i+1:]...)
+			hub.subs = append(hub.subs[:i], hub.subs[i+1:]...)
 			break
 		}
 	}
 
-	if len(userSubs) == 0 {
-		delete(msh.userSubsMap, userID)
-		return
-	}
-
-	msh.userSubsMap[userID] = userSubs
+	msh.removeHubIfUnused(userID, hub)
 }
 
 // SubscriberCountForUser
 func (msh *MessageSubHandler) SubscriberCountForUser(userID uuid.UUID) int {
-	msh.rwmu.RLock()
-	defer msh.rwmu.RUnlock()
-
-	userSubs, ok := msh.userSubsMap[userID]
-	if !ok {
+	hub := msh.lockHub(userID, false)
+	if hub == nil {
 		return 0
 	}
+	defer hub.mu.Unlock()
 
-	return len(userSubs)
+	return len(hub.subs)
 }
 
 // SubscribeToUserIfHasSlots
-func (msh *MessageSubHandler) SubscribeToUserIfHasSlots(userID uuid.UUID, subbedKeyMap map[string]bool, maxCount int) (chan []byte, bool) {
-	msh.rwmu.Lock()
-	defer msh.rwmu.Unlock()
+func (msh *MessageSubHandler) SubscribeToUserIfHasSlots(userID uuid.UUID, keySelector *KeySelector, maxCount int) (chan []byte, bool) {
+	hub := msh.lockHub(userID, true)
+	defer hub.mu.Unlock()
 
-	userSubs, ok := msh.userSubsMap[userID]
-	if !ok {
-		userSubs = make([]MessageSub, 0)
-	}
-
-	if len(userSubs) >= maxCount {
+	if len(hub.subs) >= maxCount {
+		msh.removeHubIfUnused(userID, hub)
 		return nil, false
 	}
 
 	// store up to 10 messages before throwing away
 	messageChan := make(chan []byte, 10)
-	userSubs = append(userSubs, MessageSub{
-		subbedKeyMap: subbedKeyMap,
-		messageChan:  messageChan,
+	hub.subs = append(hub.subs, MessageSub{
+		keySelector: keySelector,
+		messageChan: messageChan,
 	})
 
-	msh.userSubsMap[userID] = userSubs
-
 	return messageChan, true
 }
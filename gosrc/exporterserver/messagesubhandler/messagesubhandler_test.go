@@ -0,0 +1,342 @@
+package messagesubhandler
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatostate"
+	"github.com/benw10-1/brotato-exporter/exporterserver/ctrlauth"
+	"github.com/benw10-1/brotato-exporter/exporterserver/messagepipeline"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// diffEvent event for userID with gold and current_health set.
+func diffEvent(userID uuid.UUID, gold int32, health int32) messagepipeline.Event {
+	return messagepipeline.Event{
+		UserID:           userID,
+		ReceivedTime:     time.Now(),
+		MessageType:      brotatomodtypes.MessageTypeTimeSeriesDiff,
+		MessageReason:    brotatomodtypes.MessageReasonPoll,
+		MessageTimestamp: brotatomodtypes.MicroTimeFromTime(time.Now()),
+		KeyValues: []brotatomodtypes.DictKeyValue{
+			{
+				MappedKey:  "gold",
+				SerialType: brotatomodtypes.SerialTypeInt32,
+				Value:      binary.LittleEndian.AppendUint32(nil, uint32(gold)),
+			},
+			{
+				MappedKey:  "current_health",
+				SerialType: brotatomodtypes.SerialTypeInt32,
+				Value:      binary.LittleEndian.AppendUint32(nil, uint32(health)),
+			},
+		},
+	}
+}
+
+// applied event applied to state and numbered seq, as Publish does.
+func applied(asserter *require.Assertions, state *brotatostate.Store, event messagepipeline.Event, seq uint64) messagepipeline.Event {
+	event.Seq = seq
+	asserter.NoError(ApplyEvent(state, &event))
+
+	return event
+}
+
+// receive next message on messageChan, failing after a second.
+func receive(asserter *require.Assertions, messageChan chan []byte) string {
+	select {
+	case msg, ok := <-messageChan:
+		asserter.True(ok, "channel closed")
+		return string(msg)
+	case <-time.After(time.Second):
+		asserter.Fail("no message received")
+		return ""
+	}
+}
+
+func TestStreamEvent(t *testing.T) {
+	asserter := require.New(t)
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	msh := NewMessageSubHandler(ctx, new(ctrlauth.SessionInfoMap), time.Hour)
+
+	userID := uuid.New()
+
+	goldSelector, err := NewKeySelector([]string{"gold"}, nil)
+	asserter.NoError(err)
+
+	allChan, ok := msh.SubscribeToUserIfHasSlots(userID, AllKeySelector(), 2)
+	asserter.True(ok)
+	goldChan, ok := msh.SubscribeToUserIfHasSlots(userID, goldSelector, 2)
+	asserter.True(ok)
+
+	_, ok = msh.SubscribeToUserIfHasSlots(userID, goldSelector, 2)
+	asserter.False(ok)
+	asserter.Equal(2, msh.SubscriberCountForUser(userID))
+
+	// another user's subs get nothing
+	otherChan := msh.SubscribeToUser(uuid.New(), AllKeySelector())
+
+	state := brotatostate.NewStore()
+	msh.StreamEvent(applied(asserter, state, diffEvent(userID, 30, 10), 1))
+
+	asserter.JSONEq(`{"gold": 30, "current_health": 10}`, receive(asserter, allChan))
+	asserter.JSONEq(`{"gold": 30}`, receive(asserter, goldChan))
+	asserter.Empty(otherChan)
+	gold, ok := state.Snapshot().Get("gold")
+	asserter.True(ok)
+	asserter.Equal(brotatomodtypes.SerialTypeInt32, gold.SerialType)
+	goldValue, ok := gold.Int()
+	asserter.True(ok)
+	asserter.Equal(int64(30), goldValue)
+
+	msh.UnsubscribeFromUser(userID, goldChan)
+	_, ok = <-goldChan
+	asserter.False(ok)
+	asserter.Equal(1, msh.SubscriberCountForUser(userID))
+}
+
+func TestStreamEventFullMessage(t *testing.T) {
+	asserter := require.New(t)
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	msh := NewMessageSubHandler(ctx, new(ctrlauth.SessionInfoMap), time.Hour)
+
+	userID := uuid.New()
+
+	healthSelector, err := NewKeySelector([]string{"current_health"}, nil)
+	asserter.NoError(err)
+
+	allChan := msh.SubscribeToUser(userID, AllKeySelector())
+	healthChan := msh.SubscribeToUser(userID, healthSelector)
+
+	state := brotatostate.NewStore()
+	msh.StreamEvent(applied(asserter, state, diffEvent(userID, 30, 10), 1))
+
+	asserter.JSONEq(`{"gold": 30, "current_health": 10}`, receive(asserter, allChan))
+	asserter.JSONEq(`{"current_health": 10}`, receive(asserter, healthChan))
+
+	// full message without current_health, the key is gone from the state so subs are told it was removed
+	fullEvent := diffEvent(userID, 40, 0)
+	fullEvent.MessageType = brotatomodtypes.MessageTypeTimeSeriesFull
+	fullEvent.MessageReason = brotatomodtypes.MessageReasonShopEntered
+	fullEvent.KeyValues = fullEvent.KeyValues[:1]
+	msh.StreamEvent(applied(asserter, state, fullEvent, 2))
+
+	asserter.JSONEq(`{"gold": 40, "current_health": null}`, receive(asserter, allChan))
+	asserter.JSONEq(`{"current_health": null}`, receive(asserter, healthChan))
+
+	_, ok := state.Snapshot().Get("current_health")
+	asserter.False(ok)
+
+	// nothing else was dropped, so the next full message only sends what it has
+	msh.StreamEvent(applied(asserter, state, fullEvent, 3))
+
+	asserter.JSONEq(`{"gold": 40}`, receive(asserter, allChan))
+	asserter.Empty(healthChan)
+}
+
+func TestStreamEventEscapesKeys(t *testing.T) {
+	asserter := require.New(t)
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	msh := NewMessageSubHandler(ctx, new(ctrlauth.SessionInfoMap), time.Hour)
+
+	userID := uuid.New()
+	allChan := msh.SubscribeToUser(userID, AllKeySelector())
+
+	// keys come from the mod, one breaking out of its string must not change the message's structure
+	key := `gold":1,"x\`
+	event := diffEvent(userID, 30, 10)
+	event.KeyValues = event.KeyValues[:1]
+	event.KeyValues[0].MappedKey = key
+
+	state := brotatostate.NewStore()
+	msh.StreamEvent(applied(asserter, state, event, 1))
+
+	res := make(map[string]int)
+	asserter.NoError(json.Unmarshal([]byte(receive(asserter, allChan)), &res))
+	asserter.Equal(map[string]int{key: 30}, res)
+}
+
+func TestStreamEventAfterDrop(t *testing.T) {
+	asserter := require.New(t)
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	msh := NewMessageSubHandler(ctx, new(ctrlauth.SessionInfoMap), time.Hour)
+
+	userID := uuid.New()
+	allChan := msh.SubscribeToUser(userID, AllKeySelector())
+
+	state := brotatostate.NewStore()
+	msh.StreamEvent(applied(asserter, state, diffEvent(userID, 30, 10), 1))
+	asserter.JSONEq(`{"gold": 30, "current_health": 10}`, receive(asserter, allChan))
+
+	// applied but dropped from the queue before it was streamed
+	applied(asserter, state, diffEvent(userID, 35, 10), 2)
+
+	healthEvent := diffEvent(userID, 0, 5)
+	healthEvent.KeyValues = healthEvent.KeyValues[1:]
+
+	// the gold the subs missed is sent along with the event's own change
+	msh.StreamEvent(applied(asserter, state, healthEvent, 3))
+	asserter.JSONEq(`{"gold": 35, "current_health": 5}`, receive(asserter, allChan))
+
+	// back in order, only the event's keys are sent
+	msh.StreamEvent(applied(asserter, state, healthEvent, 4))
+	asserter.JSONEq(`{"current_health": 5}`, receive(asserter, allChan))
+}
+
+func TestKeySelector(t *testing.T) {
+	asserter := require.New(t)
+
+	ks, err := NewKeySelector([]string{"current_health", "effects_stat_*"}, []string{"effects_stat_luck"})
+	asserter.NoError(err)
+	asserter.False(ks.Empty())
+	asserter.True(ks.Selects("current_health"))
+	asserter.True(ks.Selects("effects_stat_armor"))
+	asserter.False(ks.Selects("effects_stat_luck"))
+	asserter.False(ks.Selects("gold"))
+
+	ks, err = NewKeySelector([]string{AllKeyKey}, []string{"effects_*"})
+	asserter.NoError(err)
+	asserter.True(ks.Selects("gold"))
+	asserter.False(ks.Selects("effects_stat_armor"))
+
+	ks, err = NewKeySelector(nil, []string{"gold"})
+	asserter.NoError(err)
+	asserter.True(ks.Empty())
+	asserter.False(ks.Selects("current_health"))
+
+	_, err = NewKeySelector([]string{"effects_[stat"}, nil)
+	asserter.Error(err)
+}
+
+func TestUsersDoNotBlockEachOther(t *testing.T) {
+	asserter := require.New(t)
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	msh := NewMessageSubHandler(ctx, new(ctrlauth.SessionInfoMap), time.Hour)
+
+	// a user stuck part way through streaming
+	busyHub := msh.lockHub(uuid.New(), true)
+	defer busyHub.mu.Unlock()
+
+	userID := uuid.New()
+	messageChan := msh.SubscribeToUser(userID, AllKeySelector())
+
+	event := applied(asserter, brotatostate.NewStore(), diffEvent(userID, 1, 1), 1)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		msh.StreamEvent(event)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		asserter.Fail("blocked by another user's hub")
+	}
+
+	asserter.JSONEq(`{"gold": 1, "current_health": 1}`, receive(asserter, messageChan))
+	asserter.Equal(1, msh.SubscriberCountForUser(userID))
+}
+
+func TestSweepIdle(t *testing.T) {
+	asserter := require.New(t)
+
+	// no session is stored, sweeping only has the subs to tell
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	msh := NewMessageSubHandler(ctx, new(ctrlauth.SessionInfoMap), time.Millisecond*20)
+
+	userID := uuid.New()
+	messageChan := msh.SubscribeToUser(userID, AllKeySelector())
+
+	msh.StreamEvent(applied(asserter, brotatostate.NewStore(), diffEvent(userID, 1, 1), 1))
+	asserter.JSONEq(`{"gold": 1, "current_health": 1}`, receive(asserter, messageChan))
+
+	// idle long enough to be swept, subs are told the state is gone
+	asserter.Equal("{}", receive(asserter, messageChan))
+
+	// a user without a session or subs is dropped entirely
+	msh.UnsubscribeFromUser(userID, messageChan)
+
+	msh.rwmu.RLock()
+	asserter.Empty(msh.hubMap)
+	msh.rwmu.RUnlock()
+
+	// a removed hub is replaced on the next use
+	messageChan = msh.SubscribeToUser(userID, AllKeySelector())
+	asserter.Equal(1, msh.SubscriberCountForUser(userID))
+	msh.UnsubscribeFromUser(userID, messageChan)
+}
+
+// BenchmarkStreamEvent every goroutine streams diffs for its own user, so contention is only on the handler itself.
+func BenchmarkStreamEvent(b *testing.B) {
+	// full subscriber channels are logged on every dropped message
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	for _, subs := range []int{0, 1, 10, 100} {
+		b.Run(fmt.Sprintf("Subs%d", subs), func(b *testing.B) {
+			ctx, cancelCtx := context.WithCancel(context.Background())
+			defer cancelCtx()
+
+			msh := NewMessageSubHandler(ctx, new(ctrlauth.SessionInfoMap), time.Hour)
+
+			drainWG := new(sync.WaitGroup)
+			defer drainWG.Wait()
+
+			b.RunParallel(func(pb *testing.PB) {
+				userID := uuid.New()
+
+				for i := 0; i < subs; i++ {
+					messageChan, _ := msh.SubscribeToUserIfHasSlots(userID, AllKeySelector(), subs)
+
+					drainWG.Add(1)
+					go func() {
+						defer drainWG.Done()
+						for range messageChan {
+						}
+					}()
+					defer msh.UnsubscribeFromUser(userID, messageChan)
+				}
+
+				state := brotatostate.NewStore()
+				gold := int32(0)
+				for pb.Next() {
+					gold++
+
+					event := diffEvent(userID, gold, 10)
+					event.Seq = uint64(gold)
+					_ = ApplyEvent(state, &event)
+					msh.StreamEvent(event)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package exporterserver
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/exporterserver/exporterserverutil"
+	"github.com/benw10-1/brotato-exporter/logutil"
+)
+
+// RequestIDMiddleware gives every request an ID, see exporterserverutil.NewRequestID. It is sent back as the
+// X-Request-ID header and starts the request's log scope, so goes first.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := exporterserverutil.NewRequestID(r)
+		w.Header().Set(exporterserverutil.RequestIDHeader, requestID)
+
+		next.ServeHTTP(w, r.WithContext(exporterserverutil.WithRequestID(r.Context(), requestID)))
+	})
+}
+
+const redacted = "REDACTED"
+
+// redactedHeaders hold credentials, Sec-WebSocket-Protocol can carry a subscribe ticket.
+var redactedHeaders = []string{"Authorization", "Sec-WebSocket-Protocol"}
+
+// redactedQueryParams hold credentials.
+var redactedQueryParams = []string{"ticket"}
+
+// LoggingMiddleware logs every request to logger once served. The user found by auth further down is logged too, see
+// logutil.AddAttrs.
+func LoggingMiddleware(logger *slog.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			startTime := time.Now()
+
+			statusWriter := exporterserverutil.NewDummyResponseWriter(w)
+			next.ServeHTTP(statusWriter, r)
+
+			// nothing written is an implicit 200
+			statusCode := statusWriter.StatusCode()
+			if statusCode == 0 {
+				statusCode = http.StatusOK
+			}
+
+			headers := r.Header.Clone()
+			for _, header := range redactedHeaders {
+				if headers.Get(header) != "" {
+					headers.Set(header, redacted)
+				}
+			}
+
+			logURL := *r.URL
+			query := logURL.Query()
+			for _, param := range redactedQueryParams {
+				if query.Has(param) {
+					query.Set(param, redacted)
+				}
+			}
+			logURL.RawQuery = query.Encode()
+
+			attrs := []slog.Attr{
+				slog.String("method", r.Method),
+				slog.String("url", logURL.String()),
+				slog.Int("status", statusCode),
+				slog.Any("headers", headers),
+				slog.Duration("duration", time.Since(startTime)),
+				slog.Time("time_started", startTime),
+			}
+			if ctxErr := r.Context().Err(); ctxErr != nil {
+				attrs = append(attrs, slog.String("ctx_err", ctxErr.Error()))
+			}
+
+			logger.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+		})
+	}
+}
+
+// RecoveryMiddleware logs panics and answers 500 if nothing was written yet. Goes after LoggingMiddleware so the
+// request is still logged.
+func RecoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// net/http's way of aborting a response, let it through
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			slog.ErrorContext(r.Context(), "exporterserver.RecoveryMiddleware: recovered from panic", slog.Any("panic", recovered), slog.String("stack", string(debug.Stack())))
+
+			if statusCoder, ok := w.(StatusCoder); !ok || statusCoder.StatusCode() == 0 {
+				exporterserverutil.WriteError(w, r, exporterserverutil.InternalResponseError(nil))
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CompressionMiddleware gzips responses for clients which accept it. Websocket upgrades are left alone, compression
+// there is negotiated by the websocket itself.
+func CompressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if !exporterserverutil.AcceptsEncoding(r, "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gzipWriter := exporterserverutil.NewGzipResponseWriter(w)
+		defer func() {
+			// finish the gzip stream
+			err := gzipWriter.Close()
+			if err != nil {
+				slog.WarnContext(r.Context(), "exporterserver.CompressionMiddleware: error closing response writer", logutil.Err(err))
+			}
+		}()
+
+		next.ServeHTTP(gzipWriter, r)
+	})
+}
+
+// CORSMiddleware lets browser pages from origins allowed by originPolicy call the API. Preflight requests are answered
+// here. Requests from other origins are still served, the browser keeps the response from the page.
+// Preflights carry no credentials, so origins only allowed by a user's override get read-only (GET, HEAD) preflights.
+func CORSMiddleware(originPolicy *exporterserverutil.OriginPolicy) Middleware {
+	allowedMethods := strings.Join(originPolicy.AllowedMethods(), ", ")
+	allowedHeaders := strings.Join(originPolicy.AllowedHeaders(), ", ")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Origin")
+
+			requestMethod := r.Header.Get("Access-Control-Request-Method")
+			if r.Method == http.MethodOptions && requestMethod != "" {
+				w.Header().Add("Vary", "Access-Control-Request-Method")
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+				switch {
+				case originPolicy.AllowedGlobally(origin):
+					w.Header().Set("Access-Control-Allow-Methods", allowedMethods)
+				case originPolicy.HasUserOrigins() && (requestMethod == http.MethodGet || requestMethod == http.MethodHead):
+					// the actual request only gets Access-Control-Allow-Origin if its user allows the origin
+					w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD")
+				default:
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Headers", allowedHeaders)
+				w.Header().Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			if originPolicy.Allowed(r) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Expose-Headers", "ETag, Last-Modified, Retry-After, "+exporterserverutil.RequestIDHeader)
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package modclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/errutil"
+	"github.com/benw10-1/brotato-exporter/exporterserver/ctrlauth"
+	"github.com/benw10-1/brotato-exporter/exporterserver/ctrlmessage"
+	"github.com/benw10-1/brotato-exporter/exporterserver/exporterserverutil"
+)
+
+// ErrMappingResetRequired server no longer has the key mappings, the next body should come from brotatosim.Encoder.EncodeResync.
+var ErrMappingResetRequired = errors.New("key mapping reset required")
+
+// renewBefore authenticate again once the session token is this close to expiring.
+const renewBefore = time.Minute
+
+// Client posts message bodies to an exporter server the way the mod does, authenticating again as the session token expires.
+type Client struct {
+	baseURL    string
+	authKey    string
+	httpClient *http.Client
+
+	authRequest ctrlauth.AuthRequest
+
+	sessionToken string
+	expireTime   time.Time
+
+	protocolVersion brotatomodtypes.ProtocolVersion
+	capabilities    []brotatomodtypes.Capability
+}
+
+// NewClient baseURL is the scheme and host of the server e.g. http://127.0.0.1:8081.
+func NewClient(baseURL string, authKey string, protocolVersion brotatomodtypes.ProtocolVersion, capabilities []brotatomodtypes.Capability) *Client {
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		authKey:    authKey,
+		httpClient: &http.Client{Timeout: time.Second * 10},
+		authRequest: ctrlauth.AuthRequest{
+			ProtocolVersion: protocolVersion,
+			Capabilities:    capabilities,
+		},
+	}
+}
+
+// SetHTTPClient replace the default client, e.g. to share a transport between many clients.
+func (c *Client) SetHTTPClient(httpClient *http.Client) {
+	c.httpClient = httpClient
+}
+
+// ProtocolVersion negotiated on the last authentication.
+func (c *Client) ProtocolVersion() brotatomodtypes.ProtocolVersion {
+	return c.protocolVersion
+}
+
+// Capabilities negotiated on the last authentication.
+func (c *Client) Capabilities() []brotatomodtypes.Capability {
+	return c.capabilities
+}
+
+// Authenticate starts a new session. The server keeps the key mappings across sessions as long as the protocol version
+// doesn't change.
+func (c *Client) Authenticate(ctx context.Context) error {
+	reqBody, err := json.Marshal(c.authRequest)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/auth/authenticate", bytes.NewReader(reqBody))
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.authKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errutil.NewStackError(responseError(res))
+	}
+
+	authResponse := new(ctrlauth.AuthResponse)
+
+	err = json.NewDecoder(res.Body).Decode(authResponse)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	c.expireTime, err = time.Parse(time.RFC3339, authResponse.ExpireTime)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	c.sessionToken = authResponse.SessionToken
+	c.protocolVersion = authResponse.ProtocolVersion
+	c.capabilities = authResponse.Capabilities
+
+	return nil
+}
+
+// PostBody posts one message body, authenticating first if needed. Returns ErrMappingResetRequired on a 409.
+// Legacy sessions get an empty response back.
+func (c *Client) PostBody(ctx context.Context, body []byte) (ctrlmessage.PostMessageResponse, error) {
+	postRes := ctrlmessage.PostMessageResponse{}
+
+	if c.sessionToken == "" || time.Until(c.expireTime) < renewBefore {
+		err := c.Authenticate(ctx)
+		if err != nil {
+			return postRes, errutil.NewStackError(err)
+		}
+	}
+
+	res, err := c.post(ctx, body)
+	if err != nil {
+		return postRes, errutil.NewStackError(err)
+	}
+	defer res.Body.Close()
+
+	// server restarted and lost the session, a retry on a new session is safe since nothing was read
+	if res.StatusCode == http.StatusUnauthorized {
+		_ = res.Body.Close()
+
+		err = c.Authenticate(ctx)
+		if err != nil {
+			return postRes, errutil.NewStackError(err)
+		}
+
+		res, err = c.post(ctx, body)
+		if err != nil {
+			return postRes, errutil.NewStackError(err)
+		}
+		defer res.Body.Close()
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusConflict:
+		return postRes, errutil.NewStackError(ErrMappingResetRequired)
+	default:
+		return postRes, errutil.NewStackError(responseError(res))
+	}
+
+	if res.Header.Get("Content-Type") != "application/json" {
+		return postRes, nil
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&postRes)
+	if err != nil {
+		return postRes, errutil.NewStackError(err)
+	}
+
+	return postRes, nil
+}
+
+// post
+func (c *Client) post(ctx context.Context, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/message/post", bytes.NewReader(body))
+	if err != nil {
+		return nil, errutil.NewStackError(err)
+	}
+	req.Header.Set("Authorization", "JWT "+c.sessionToken)
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, errutil.NewStackError(err)
+	}
+
+	return res, nil
+}
+
+// responseError status and the start of the body of an unexpected response.
+func responseError(res *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+
+	errRes := exporterserverutil.ErrorResponse{}
+	if json.Unmarshal(msg, &errRes) == nil && errRes.Error.Code != "" {
+		return fmt.Errorf("unexpected status (%d) %s - %s (request %s)", res.StatusCode, errRes.Error.Code, errRes.Error.Message, errRes.Error.RequestID)
+	}
+
+	return fmt.Errorf("unexpected status (%d) - %s", res.StatusCode, strings.TrimSpace(string(msg)))
+}
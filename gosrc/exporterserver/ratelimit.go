@@ -0,0 +1,95 @@
+package exporterserver
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/exporterserver/exporterserverutil"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+// maxRateLimitClients buckets kept at once, the least recently used client's is dropped first.
+const maxRateLimitClients = 10000
+
+// ClientKeyFunc which client a request counts against.
+type ClientKeyFunc func(r *http.Request) string
+
+// RateLimiter token bucket per client. Each client may make burst requests at once, refilled at perSecond.
+type RateLimiter struct {
+	perSecond float64
+	burst     float64
+	clientKey ClientKeyFunc
+
+	bucketCache *expirable.LRU[string, *tokenBucket]
+	// mu so a client's first requests all get the same bucket.
+	mu sync.Mutex
+}
+
+// tokenBucket
+type tokenBucket struct {
+	mu         sync.Mutex
+	tokens     float64
+	filledTime time.Time
+}
+
+// NewRateLimiter clients are told apart by clientKey, exporterserverutil.RemoteIP if nil.
+func NewRateLimiter(perSecond float64, burst int, clientKey ClientKeyFunc) *RateLimiter {
+	if clientKey == nil {
+		clientKey = exporterserverutil.RemoteIP
+	}
+
+	// an idle client's bucket is full again by the time it's dropped, so dropping it changes nothing
+	refillDuration := time.Duration(float64(burst) / perSecond * float64(time.Second))
+
+	return &RateLimiter{
+		perSecond:   perSecond,
+		burst:       float64(burst),
+		clientKey:   clientKey,
+		bucketCache: expirable.NewLRU[string, *tokenBucket](maxRateLimitClients, nil, max(refillDuration, time.Minute)),
+	}
+}
+
+// Allow takes a token from the client's bucket. When it's empty the wait until the next token is returned instead.
+func (rl *RateLimiter) Allow(clientKey string, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	bucket, ok := rl.bucketCache.Get(clientKey)
+	if !ok {
+		bucket = &tokenBucket{tokens: rl.burst, filledTime: now}
+	}
+	// refresh the expiry, only an idle bucket should be dropped
+	rl.bucketCache.Add(clientKey, bucket)
+	rl.mu.Unlock()
+
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+
+	if now.After(bucket.filledTime) {
+		bucket.tokens = math.Min(rl.burst, bucket.tokens+now.Sub(bucket.filledTime).Seconds()*rl.perSecond)
+		bucket.filledTime = now
+	}
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / rl.perSecond * float64(time.Second))
+	}
+	bucket.tokens--
+
+	return true, 0
+}
+
+// Middleware answers 429 once a client is over its rate. Keyed by user it goes after auth, keyed by IP it goes before
+// so requests with bad credentials are limited too.
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, wait := rl.Allow(rl.clientKey(r), time.Now())
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			exporterserverutil.WriteError(w, r, exporterserverutil.NewResponseError(nil, http.StatusTooManyRequests, exporterserverutil.ErrorCodeRateLimited, "Too many requests"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,383 @@
+package runrecorder
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatostate"
+	"github.com/benw10-1/brotato-exporter/errutil"
+	"github.com/benw10-1/brotato-exporter/exporterserver/messagepipeline"
+	"github.com/benw10-1/brotato-exporter/exporterstore"
+	"github.com/benw10-1/brotato-exporter/exporterstore/exporterstoretypes"
+	"github.com/benw10-1/brotato-exporter/logutil"
+	"github.com/google/uuid"
+)
+
+const (
+	// CharacterKey
+	CharacterKey = "current_character"
+	// LevelKey
+	LevelKey = "current_level"
+	// noCharacter sent by the mod on the title screen, outside of any run.
+	noCharacter = "-"
+)
+
+// activeRun run being played and the wave it is in.
+type activeRun struct {
+	run *exporterstoretypes.ExporterRun
+	// wave current wave, 1 based. Not in the mod's stats, counted from started waves.
+	wave int
+}
+
+// Recorder records each user's runs wave by wave from the full messages the mod sends as waves start and end.
+type Recorder struct {
+	exporterStore *exporterstore.ExporterStore
+	// maxRuns kept per user, older runs are deleted.
+	maxRuns int
+
+	activeRunMap map[uuid.UUID]*activeRun
+	// storeCheckedMap users whose latest stored run was looked at, only needed once to pick up runs from before a restart.
+	storeCheckedMap map[uuid.UUID]bool
+	// pendingRunMap copies of the user's runs changed since they were last persisted.
+	pendingRunMap map[uuid.UUID][]*exporterstoretypes.ExporterRun
+	// mu control reads and writes to the maps. A user's events are applied one at a time, so the active runs themselves
+	// are only touched by their user's events.
+	mu sync.Mutex
+}
+
+// NewRecorder
+func NewRecorder(exporterStore *exporterstore.ExporterStore, maxRuns int) *Recorder {
+	return &Recorder{
+		exporterStore:   exporterStore,
+		maxRuns:         maxRuns,
+		activeRunMap:    make(map[uuid.UUID]*activeRun),
+		storeCheckedMap: make(map[uuid.UUID]bool),
+		pendingRunMap:   make(map[uuid.UUID][]*exporterstoretypes.ExporterRun),
+	}
+}
+
+// ConsumerConfig runs are tracked as events are published, a skipped wave start would throw the wave count off. Only
+// persisting them is queued, a dropped event loses nothing as the next one persists every run changed since.
+func (rr *Recorder) ConsumerConfig() messagepipeline.ConsumerConfig {
+	return messagepipeline.ConsumerConfig{
+		Name:      "run_history",
+		QueueSize: 64,
+		Policy:    messagepipeline.PolicyDropOldest,
+		Apply:     rr.apply,
+		Consume:   rr.consume,
+	}
+}
+
+// apply
+func (rr *Recorder) apply(event *messagepipeline.Event) {
+	err := rr.record(*event)
+	if err != nil {
+		slog.WarnContext(event.LogContext(), "runrecorder.Recorder.apply: failed to record run", slog.String("reason", event.MessageReason.String()), logutil.Err(err))
+	}
+}
+
+// consume
+func (rr *Recorder) consume(event messagepipeline.Event) {
+	err := rr.persist(event.UserID)
+	if err != nil {
+		slog.WarnContext(event.LogContext(), "runrecorder.Recorder.consume: failed to persist runs", logutil.Err(err))
+	}
+}
+
+// Flush persists every user's pending runs, for shutting down.
+func (rr *Recorder) Flush() error {
+	rr.mu.Lock()
+	userIDs := make([]uuid.UUID, 0, len(rr.pendingRunMap))
+	for userID := range rr.pendingRunMap {
+		userIDs = append(userIDs, userID)
+	}
+	rr.mu.Unlock()
+
+	for _, userID := range userIDs {
+		err := rr.persist(userID)
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+	}
+
+	return nil
+}
+
+// persist writes the user's pending runs. Runs which fail stay pending for the user's next event.
+func (rr *Recorder) persist(userID uuid.UUID) error {
+	rr.mu.Lock()
+	pendingRuns := slices.Clone(rr.pendingRunMap[userID])
+	rr.mu.Unlock()
+
+	for _, run := range pendingRuns {
+		err := rr.exporterStore.UpsertRun(run, rr.maxRuns)
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+
+		rr.mu.Lock()
+		// a newer copy may have replaced it in the meantime, that one still has to be written
+		pendingRuns := slices.DeleteFunc(rr.pendingRunMap[userID], func(pendingRun *exporterstoretypes.ExporterRun) bool {
+			return pendingRun == run
+		})
+		if len(pendingRuns) == 0 {
+			delete(rr.pendingRunMap, userID)
+		} else {
+			rr.pendingRunMap[userID] = pendingRuns
+		}
+		rr.mu.Unlock()
+	}
+
+	return nil
+}
+
+// changed queues a copy of run to be persisted, replacing any copy of it still pending.
+func (rr *Recorder) changed(run *exporterstoretypes.ExporterRun) {
+	runCopy := *run
+	runCopy.Waves = slices.Clone(run.Waves)
+
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	pendingRuns := rr.pendingRunMap[run.UserID]
+	for i, pendingRun := range pendingRuns {
+		if pendingRun.RunID == run.RunID {
+			pendingRuns[i] = &runCopy
+			return
+		}
+	}
+
+	rr.pendingRunMap[run.UserID] = append(pendingRuns, &runCopy)
+}
+
+// record
+func (rr *Recorder) record(event messagepipeline.Event) error {
+	if event.MessageType == brotatomodtypes.MessageTypeTimeSeriesDiff {
+		// diffs only matter for leaving to the title screen
+		character, ok := textValue(event.KeyValues, CharacterKey)
+		if ok && character == noCharacter {
+			return rr.finish(event, exporterstoretypes.RunOutcomeAbandoned)
+		}
+
+		return nil
+	}
+
+	if event.MessageType != brotatomodtypes.MessageTypeTimeSeriesFull {
+		return nil
+	}
+
+	switch event.MessageReason {
+	case brotatomodtypes.MessageReasonStartedWave:
+		return rr.startWave(event)
+	case brotatomodtypes.MessageReasonShopEntered:
+		return rr.endWave(event)
+	case brotatomodtypes.MessageReasonRunEnded:
+		// died mid wave, or the last wave was won without a shop after it
+		err := rr.endWave(event)
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+
+		return rr.finish(event, exporterstoretypes.RunOutcomeEnded)
+	default:
+		return nil
+	}
+}
+
+// startWave starts a run if the user isn't in one, then counts the wave.
+func (rr *Recorder) startWave(event messagepipeline.Event) error {
+	character, _ := textValue(event.KeyValues, CharacterKey)
+	stats := numericStats(event)
+
+	ar, err := rr.activeRunFor(event.UserID, character, stats)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	if ar != nil && !continues(ar, character, stats) {
+		err = rr.finish(event, exporterstoretypes.RunOutcomeAbandoned)
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+
+		ar = nil
+	}
+
+	if ar == nil {
+		// assigned here rather than by the store, copies of the run are persisted later
+		runID, err := uuid.NewV7()
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+
+		ar = &activeRun{
+			run: &exporterstoretypes.ExporterRun{
+				RunID:     runID,
+				UserID:    event.UserID,
+				Character: character,
+				StartTime: event.ReceivedTime,
+				Outcome:   exporterstoretypes.RunOutcomeActive,
+			},
+		}
+
+		rr.mu.Lock()
+		rr.activeRunMap[event.UserID] = ar
+		rr.mu.Unlock()
+	}
+
+	ar.wave++
+	rr.changed(ar.run)
+
+	return nil
+}
+
+// endWave records the stats the current wave ended with, once per wave.
+func (rr *Recorder) endWave(event messagepipeline.Event) error {
+	rr.mu.Lock()
+	ar := rr.activeRunMap[event.UserID]
+	rr.mu.Unlock()
+
+	// started before the server heard of it, the wave number is unknown until the next wave starts
+	if ar == nil || ar.wave == 0 {
+		return nil
+	}
+
+	waves := ar.run.Waves
+	if len(waves) > 0 && waves[len(waves)-1].Wave == ar.wave {
+		return nil
+	}
+
+	ar.run.Waves = append(waves, exporterstoretypes.ExporterRunWave{
+		Wave:    ar.wave,
+		EndTime: event.ReceivedTime,
+		Stats:   numericStats(event),
+	})
+	rr.changed(ar.run)
+
+	return nil
+}
+
+// finish ends the user's active run, if there is one.
+func (rr *Recorder) finish(event messagepipeline.Event, outcome exporterstoretypes.RunOutcome) error {
+	rr.mu.Lock()
+	ar := rr.activeRunMap[event.UserID]
+	delete(rr.activeRunMap, event.UserID)
+	rr.mu.Unlock()
+
+	if ar == nil {
+		return nil
+	}
+
+	ar.run.Outcome = outcome
+	ar.run.EndTime = event.ReceivedTime
+	rr.changed(ar.run)
+
+	return nil
+}
+
+// activeRunFor the user's run in memory. After a restart the user's latest stored run is picked up again if it was still
+// active and the stats carry on from it, otherwise it is marked abandoned. The store is only read for the user's first
+// run since starting, later runs are all known in memory.
+func (rr *Recorder) activeRunFor(userID uuid.UUID, character string, stats map[string]float64) (*activeRun, error) {
+	rr.mu.Lock()
+	ar, ok := rr.activeRunMap[userID]
+	storeChecked := rr.storeCheckedMap[userID]
+	rr.mu.Unlock()
+	if ok || storeChecked {
+		return ar, nil
+	}
+
+	runs, err := rr.exporterStore.ListRuns(userID, 1)
+	if err != nil {
+		return nil, errutil.NewStackError(err)
+	}
+
+	rr.mu.Lock()
+	rr.storeCheckedMap[userID] = true
+	rr.mu.Unlock()
+
+	if len(runs) == 0 || runs[0].Outcome != exporterstoretypes.RunOutcomeActive {
+		return nil, nil
+	}
+
+	ar = &activeRun{run: runs[0]}
+	if len(ar.run.Waves) > 0 {
+		ar.wave = ar.run.Waves[len(ar.run.Waves)-1].Wave
+	}
+
+	if !continues(ar, character, stats) {
+		ar.run.Outcome = exporterstoretypes.RunOutcomeAbandoned
+		ar.run.EndTime = ar.run.StartTime
+		if len(ar.run.Waves) > 0 {
+			ar.run.EndTime = ar.run.Waves[len(ar.run.Waves)-1].EndTime
+		}
+		rr.changed(ar.run)
+
+		return nil, nil
+	}
+
+	rr.mu.Lock()
+	rr.activeRunMap[userID] = ar
+	rr.mu.Unlock()
+
+	return ar, nil
+}
+
+// continues whether a wave started with character and stats belongs to ar. A new run was started if the character changed
+// or the level went down, levels are never lost within a run.
+func continues(ar *activeRun, character string, stats map[string]float64) bool {
+	if character != ar.run.Character {
+		return false
+	}
+
+	waves := ar.run.Waves
+	if len(waves) == 0 {
+		// restarted before the first wave ended, can't be told apart
+		return true
+	}
+
+	level, ok := stats[LevelKey]
+	lastLevel, lastOk := waves[len(waves)-1].Stats[LevelKey]
+
+	return !ok || !lastOk || level >= lastLevel
+}
+
+// numericStats every top level number of a full message, ints are converted.
+func numericStats(event messagepipeline.Event) map[string]float64 {
+	update := brotatostate.Update{
+		Time:   event.MessageTimestamp.Time(),
+		Reason: event.MessageReason,
+	}
+
+	stats := make(map[string]float64, len(event.KeyValues))
+	for _, kv := range event.KeyValues {
+		if kv.SerialType == brotatomodtypes.SerialTypeRemoved {
+			continue
+		}
+
+		value, err := brotatostate.NewValue(kv, update)
+		if err != nil {
+			continue
+		}
+
+		number, ok := value.Float()
+		if ok {
+			stats[kv.MappedKey] = number
+		}
+	}
+
+	return stats
+}
+
+// textValue string value of key, if it was sent as one.
+func textValue(keyValues []brotatomodtypes.DictKeyValue, key string) (string, bool) {
+	for _, kv := range keyValues {
+		if kv.MappedKey == key && kv.SerialType == brotatomodtypes.SerialTypeString {
+			return string(kv.Value), true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,199 @@
+package runrecorder
+
+import (
+	"encoding/binary"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/brotatomod/brotatomodtypes"
+	"github.com/benw10-1/brotato-exporter/exporterserver/messagepipeline"
+	"github.com/benw10-1/brotato-exporter/exporterstore"
+	"github.com/benw10-1/brotato-exporter/exporterstore/exporterstoretypes"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// fullEvent full message for userID with the character, level and max HP set.
+func fullEvent(userID uuid.UUID, reason brotatomodtypes.MessageReason, character string, level int32, maxHP float32) messagepipeline.Event {
+	return messagepipeline.Event{
+		UserID:           userID,
+		ReceivedTime:     time.Now(),
+		MessageType:      brotatomodtypes.MessageTypeTimeSeriesFull,
+		MessageReason:    reason,
+		MessageTimestamp: brotatomodtypes.MicroTimeFromTime(time.Now()),
+		KeyValues: []brotatomodtypes.DictKeyValue{
+			{
+				MappedKey:  CharacterKey,
+				SerialType: brotatomodtypes.SerialTypeString,
+				Value:      []byte(character),
+			},
+			{
+				MappedKey:  LevelKey,
+				SerialType: brotatomodtypes.SerialTypeInt32,
+				Value:      binary.LittleEndian.AppendUint32(nil, uint32(level)),
+			},
+			{
+				MappedKey:  "effects_stat_max_hp",
+				SerialType: brotatomodtypes.SerialTypeFloat32,
+				Value:      binary.LittleEndian.AppendUint32(nil, math.Float32bits(maxHP)),
+			},
+		},
+	}
+}
+
+// titleEvent diff the mod sends on opening the title screen.
+func titleEvent(userID uuid.UUID) messagepipeline.Event {
+	return messagepipeline.Event{
+		UserID:        userID,
+		ReceivedTime:  time.Now(),
+		MessageType:   brotatomodtypes.MessageTypeTimeSeriesDiff,
+		MessageReason: brotatomodtypes.MessageReasonPoll,
+		KeyValues: []brotatomodtypes.DictKeyValue{
+			{
+				MappedKey:  CharacterKey,
+				SerialType: brotatomodtypes.SerialTypeString,
+				Value:      []byte(noCharacter),
+			},
+		},
+	}
+}
+
+// publish applies and consumes the event the way the pipeline does, when nothing was dropped.
+func publish(recorder *Recorder, event messagepipeline.Event) {
+	recorder.apply(&event)
+	recorder.consume(event)
+}
+
+func TestRecorder(t *testing.T) {
+	asserter := require.New(t)
+
+	exporterStore, err := exporterstore.NewExporterStore(filepath.Join(t.TempDir(), "runs.db"))
+	asserter.NoError(err)
+	defer exporterStore.Close()
+
+	userID := uuid.New()
+	recorder := NewRecorder(exporterStore, 0)
+
+	latestRuns := func(limit int) []*exporterstoretypes.ExporterRun {
+		runs, err := exporterStore.ListRuns(userID, limit)
+		asserter.NoError(err)
+		return runs
+	}
+
+	publish(recorder, fullEvent(userID, brotatomodtypes.MessageReasonStartedWave, "character_knight", 1, 15))
+
+	runs := latestRuns(0)
+	asserter.Len(runs, 1)
+	asserter.Equal("character_knight", runs[0].Character)
+	asserter.Equal(exporterstoretypes.RunOutcomeActive, runs[0].Outcome)
+	asserter.Empty(runs[0].Waves)
+
+	publish(recorder, fullEvent(userID, brotatomodtypes.MessageReasonShopEntered, "character_knight", 3, 17.5))
+	publish(recorder, fullEvent(userID, brotatomodtypes.MessageReasonStartedWave, "character_knight", 3, 17.5))
+	publish(recorder, fullEvent(userID, brotatomodtypes.MessageReasonRunEnded, "character_knight", 4, 17.5))
+	// the end run screen going back to the title screen doesn't change the outcome
+	publish(recorder, titleEvent(userID))
+
+	runs = latestRuns(0)
+	asserter.Len(runs, 1)
+	asserter.Equal(exporterstoretypes.RunOutcomeEnded, runs[0].Outcome)
+	asserter.False(runs[0].EndTime.IsZero())
+	asserter.Len(runs[0].Waves, 2)
+	asserter.Equal(1, runs[0].Waves[0].Wave)
+	asserter.Equal(map[string]float64{LevelKey: 3, "effects_stat_max_hp": 17.5}, runs[0].Waves[0].Stats)
+	asserter.Equal(2, runs[0].Waves[1].Wave)
+	asserter.Equal(float64(4), runs[0].Waves[1].Stats[LevelKey])
+
+	// restarting from the pause menu with another character
+	publish(recorder, fullEvent(userID, brotatomodtypes.MessageReasonStartedWave, "character_knight", 1, 15))
+	publish(recorder, fullEvent(userID, brotatomodtypes.MessageReasonShopEntered, "character_knight", 2, 15))
+	publish(recorder, fullEvent(userID, brotatomodtypes.MessageReasonStartedWave, "character_brawler", 1, 20))
+
+	runs = latestRuns(0)
+	asserter.Len(runs, 3)
+	asserter.Equal(exporterstoretypes.RunOutcomeActive, runs[0].Outcome)
+	asserter.Equal("character_brawler", runs[0].Character)
+	asserter.Equal(exporterstoretypes.RunOutcomeAbandoned, runs[1].Outcome)
+	asserter.Len(runs[1].Waves, 1)
+
+	// same character, but the level went back down
+	publish(recorder, fullEvent(userID, brotatomodtypes.MessageReasonShopEntered, "character_brawler", 5, 20))
+	publish(recorder, fullEvent(userID, brotatomodtypes.MessageReasonStartedWave, "character_brawler", 1, 20))
+
+	runs = latestRuns(0)
+	asserter.Len(runs, 4)
+	asserter.Equal(exporterstoretypes.RunOutcomeAbandoned, runs[1].Outcome)
+
+	// a new recorder, as after a restart, carries on with the stored run
+	publish(recorder, fullEvent(userID, brotatomodtypes.MessageReasonShopEntered, "character_brawler", 2, 20))
+
+	recorder = NewRecorder(exporterStore, 0)
+	publish(recorder, fullEvent(userID, brotatomodtypes.MessageReasonStartedWave, "character_brawler", 2, 20))
+	publish(recorder, fullEvent(userID, brotatomodtypes.MessageReasonShopEntered, "character_brawler", 3, 20))
+
+	runs = latestRuns(0)
+	asserter.Len(runs, 4)
+	asserter.Len(runs[0].Waves, 2)
+	asserter.Equal(2, runs[0].Waves[1].Wave)
+
+	publish(recorder, titleEvent(userID))
+
+	runs = latestRuns(1)
+	asserter.Equal(exporterstoretypes.RunOutcomeAbandoned, runs[0].Outcome)
+}
+
+func TestRecorderDropped(t *testing.T) {
+	asserter := require.New(t)
+
+	exporterStore, err := exporterstore.NewExporterStore(filepath.Join(t.TempDir(), "runs.db"))
+	asserter.NoError(err)
+	defer exporterStore.Close()
+
+	userID := uuid.New()
+	recorder := NewRecorder(exporterStore, 0)
+
+	// every event is applied, but only the last reaches the consumer
+	events := []messagepipeline.Event{
+		fullEvent(userID, brotatomodtypes.MessageReasonStartedWave, "character_knight", 1, 15),
+		fullEvent(userID, brotatomodtypes.MessageReasonShopEntered, "character_knight", 2, 15),
+		fullEvent(userID, brotatomodtypes.MessageReasonStartedWave, "character_knight", 2, 15),
+		fullEvent(userID, brotatomodtypes.MessageReasonRunEnded, "character_knight", 3, 15),
+		fullEvent(userID, brotatomodtypes.MessageReasonStartedWave, "character_brawler", 1, 20),
+		fullEvent(userID, brotatomodtypes.MessageReasonShopEntered, "character_brawler", 2, 20),
+	}
+	for i := range events {
+		recorder.apply(&events[i])
+	}
+
+	runs, err := exporterStore.ListRuns(userID, 0)
+	asserter.NoError(err)
+	asserter.Empty(runs)
+
+	recorder.consume(events[len(events)-1])
+
+	runs, err = exporterStore.ListRuns(userID, 0)
+	asserter.NoError(err)
+	asserter.Len(runs, 2)
+	asserter.Equal("character_brawler", runs[0].Character)
+	asserter.Equal(exporterstoretypes.RunOutcomeActive, runs[0].Outcome)
+	asserter.Len(runs[0].Waves, 1)
+	asserter.Equal(exporterstoretypes.RunOutcomeEnded, runs[1].Outcome)
+	asserter.Len(runs[1].Waves, 2)
+	asserter.Equal(2, runs[1].Waves[1].Wave)
+
+	recorder.mu.Lock()
+	asserter.Empty(recorder.pendingRunMap)
+	recorder.mu.Unlock()
+
+	// anything still pending is written on shutdown
+	endEvent := fullEvent(userID, brotatomodtypes.MessageReasonRunEnded, "character_brawler", 2, 20)
+	recorder.apply(&endEvent)
+	asserter.NoError(recorder.Flush())
+
+	runs, err = exporterStore.ListRuns(userID, 1)
+	asserter.NoError(err)
+	asserter.Equal(exporterstoretypes.RunOutcomeEnded, runs[0].Outcome)
+	asserter.Len(runs[0].Waves, 1)
+}
@@ -0,0 +1,144 @@
+package exporterstore
+
+import (
+	"errors"
+
+	"github.com/benw10-1/brotato-exporter/errutil"
+	"github.com/benw10-1/brotato-exporter/exporterstore/exporterstoretypes"
+	"github.com/boltdb/bolt"
+	"github.com/google/uuid"
+)
+
+// runBucket holds a bucket of runs per user, keyed by run ID so a cursor walks them oldest first.
+const runBucket = "runs"
+
+var ErrRunNotFound = errors.New("run not found")
+
+// GetRun
+func (es *ExporterStore) GetRun(userID, runID uuid.UUID) (*exporterstoretypes.ExporterRun, error) {
+	tx, err := es.boltDB.Begin(false)
+	if err != nil {
+		return nil, errutil.NewStackError(err)
+	}
+	defer tx.Rollback()
+
+	userRunBucket := tx.Bucket([]byte(runBucket)).Bucket(userID[:])
+	if userRunBucket == nil {
+		return nil, errutil.NewStackError(ErrRunNotFound)
+	}
+
+	runBytes := userRunBucket.Get(runID[:])
+	if runBytes == nil {
+		return nil, errutil.NewStackError(ErrRunNotFound)
+	}
+
+	run := new(exporterstoretypes.ExporterRun)
+
+	err = run.UnmarshalMsg(runBytes)
+	if err != nil {
+		return nil, errutil.NewStackError(err)
+	}
+
+	return run, nil
+}
+
+// ListRuns the user's latest runs, newest first. All of them if limit is 0.
+func (es *ExporterStore) ListRuns(userID uuid.UUID, limit int) ([]*exporterstoretypes.ExporterRun, error) {
+	tx, err := es.boltDB.Begin(false)
+	if err != nil {
+		return nil, errutil.NewStackError(err)
+	}
+	defer tx.Rollback()
+
+	runs := make([]*exporterstoretypes.ExporterRun, 0)
+
+	userRunBucket := tx.Bucket([]byte(runBucket)).Bucket(userID[:])
+	if userRunBucket == nil {
+		return runs, nil
+	}
+
+	cursor := userRunBucket.Cursor()
+	for _, runBytes := cursor.Last(); runBytes != nil; _, runBytes = cursor.Prev() {
+		if limit > 0 && len(runs) >= limit {
+			break
+		}
+
+		run := new(exporterstoretypes.ExporterRun)
+
+		err = run.UnmarshalMsg(runBytes)
+		if err != nil {
+			return nil, errutil.NewStackError(err)
+		}
+
+		runs = append(runs, run)
+	}
+
+	return runs, nil
+}
+
+// UpsertRun gives new runs a time ordered ID. The user's oldest runs are deleted past maxRuns, none are if it is 0.
+func (es *ExporterStore) UpsertRun(run *exporterstoretypes.ExporterRun, maxRuns int) error {
+	tx, err := es.boltDB.Begin(true)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+	defer tx.Rollback()
+
+	if run.RunID == uuid.Nil {
+		run.RunID, err = uuid.NewV7()
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+	}
+
+	userRunBucket, err := tx.Bucket([]byte(runBucket)).CreateBucketIfNotExists(run.UserID[:])
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	runBytes, err := run.MarshalMsg()
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	err = userRunBucket.Put(run.RunID[:], runBytes)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	if maxRuns > 0 {
+		err = pruneRuns(userRunBucket, maxRuns)
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	return nil
+}
+
+// pruneRuns deletes the oldest runs of userRunBucket until maxRuns are left.
+func pruneRuns(userRunBucket *bolt.Bucket, maxRuns int) error {
+	cursor := userRunBucket.Cursor()
+
+	// Stats only counts committed pages, so count with the cursor
+	excess := -maxRuns
+	for runID, _ := cursor.First(); runID != nil; runID, _ = cursor.Next() {
+		excess++
+	}
+
+	for runID, _ := cursor.First(); runID != nil && excess > 0; runID, _ = cursor.First() {
+		err := cursor.Delete()
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+
+		excess--
+	}
+
+	return nil
+}
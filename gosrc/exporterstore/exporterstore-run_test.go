@@ -0,0 +1,83 @@
+package exporterstore
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benw10-1/brotato-exporter/exporterstore/exporterstoretypes"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	asserter := require.New(t)
+
+	exporterStore, err := NewExporterStore(filepath.Join(t.TempDir(), "run.db"))
+	asserter.NoError(err)
+	defer exporterStore.Close()
+
+	userID := uuid.New()
+
+	runs, err := exporterStore.ListRuns(userID, 10)
+	asserter.NoError(err)
+	asserter.Empty(runs)
+
+	startTime := time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	run := &exporterstoretypes.ExporterRun{
+		UserID:    userID,
+		Character: "character_well_rounded",
+		StartTime: startTime,
+		Outcome:   exporterstoretypes.RunOutcomeActive,
+	}
+
+	err = exporterStore.UpsertRun(run, 0)
+	asserter.NoError(err)
+	asserter.NotEqual(uuid.Nil, run.RunID)
+
+	run.Waves = append(run.Waves, exporterstoretypes.ExporterRunWave{
+		Wave:    1,
+		EndTime: startTime.Add(time.Minute),
+		Stats:   map[string]float64{"current_level": 2, "effects_stat_max_hp": 12.5},
+	})
+	run.Outcome = exporterstoretypes.RunOutcomeEnded
+	run.EndTime = startTime.Add(time.Minute)
+
+	err = exporterStore.UpsertRun(run, 0)
+	asserter.NoError(err)
+
+	storedRun, err := exporterStore.GetRun(userID, run.RunID)
+	asserter.NoError(err)
+	asserter.Equal(run.Character, storedRun.Character)
+	asserter.True(run.StartTime.Equal(storedRun.StartTime))
+	asserter.True(run.EndTime.Equal(storedRun.EndTime))
+	asserter.Equal(exporterstoretypes.RunOutcomeEnded, storedRun.Outcome)
+	asserter.Len(storedRun.Waves, 1)
+	asserter.Equal(run.Waves[0].Stats, storedRun.Waves[0].Stats)
+
+	_, err = exporterStore.GetRun(uuid.New(), run.RunID)
+	asserter.True(errors.Is(err, ErrRunNotFound))
+
+	// only the newest are kept
+	for i := 0; i < 3; i++ {
+		err = exporterStore.UpsertRun(&exporterstoretypes.ExporterRun{UserID: userID, Character: "character_brawler"}, 3)
+		asserter.NoError(err)
+	}
+
+	runs, err = exporterStore.ListRuns(userID, 0)
+	asserter.NoError(err)
+	asserter.Len(runs, 3)
+	for _, listedRun := range runs {
+		asserter.NotEqual(run.RunID, listedRun.RunID)
+	}
+	// newest first
+	asserter.Equal(1, bytes.Compare(runs[0].RunID[:], runs[1].RunID[:]))
+	asserter.Equal(1, bytes.Compare(runs[1].RunID[:], runs[2].RunID[:]))
+
+	runs, err = exporterStore.ListRuns(userID, 1)
+	asserter.NoError(err)
+	asserter.Len(runs, 1)
+}
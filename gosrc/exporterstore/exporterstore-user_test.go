@@ -7,6 +7,7 @@ import (
 	"github.com/benw10-1/brotato-exporter/exporterstore/exporterstoretypes"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/require"
+	"github.com/tinylib/msgp/msgp"
 )
 
 func TestUser(t *testing.T) {
@@ -40,4 +41,56 @@ func TestUser(t *testing.T) {
 
 	asserter.Equal(user.UserID, user3.UserID)
 	asserter.Equal(user.MaxSubscribers, user3.MaxSubscribers)
+	asserter.False(user3.CaptureIngest)
+
+	user.CaptureIngest = true
+
+	err = exporterStore.UpsertUser(user)
+	asserter.NoError(err)
+
+	user4, err := exporterStore.GetUserByID(user.UserID)
+	asserter.NoError(err)
+
+	asserter.True(user4.CaptureIngest)
+	asserter.Empty(user4.AllowedOrigins)
+
+	user.AllowedOrigins = []string{"https://overlay.example.com", "http://localhost:3000"}
+
+	err = exporterStore.UpsertUser(user)
+	asserter.NoError(err)
+
+	// GetUserByID would hit the cache, round trip the stored layout instead
+	userBytes, err := user.MarshalMsg()
+	asserter.NoError(err)
+
+	user5 := new(exporterstoretypes.ExporterUser)
+	asserter.NoError(user5.UnmarshalMsg(userBytes))
+	asserter.True(user5.CaptureIngest)
+	asserter.Equal(user.AllowedOrigins, user5.AllowedOrigins)
+}
+
+func TestUserBeforeCaptureIngest(t *testing.T) {
+	asserter := require.New(t)
+
+	userID := uuid.New()
+
+	// layout of users stored before CaptureIngest was added
+	userBytes := msgp.AppendBytes(nil, userID[:])
+	userBytes = msgp.AppendInt(userBytes, 5)
+
+	user := new(exporterstoretypes.ExporterUser)
+	asserter.NoError(user.UnmarshalMsg(userBytes))
+
+	asserter.Equal(userID, user.UserID)
+	asserter.Equal(5, user.MaxSubscribers)
+	asserter.False(user.CaptureIngest)
+
+	// layout of users stored before AllowedOrigins was added
+	userBytes = msgp.AppendBool(userBytes, true)
+
+	user = new(exporterstoretypes.ExporterUser)
+	asserter.NoError(user.UnmarshalMsg(userBytes))
+
+	asserter.True(user.CaptureIngest)
+	asserter.Empty(user.AllowedOrigins)
 }
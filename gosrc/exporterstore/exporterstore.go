@@ -71,6 +71,11 @@ func (es *ExporterStore) initBuckets() error {
 		return errutil.NewStackError(err)
 	}
 
+	_, err = tx.CreateBucketIfNotExists([]byte(runBucket))
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		return errutil.NewStackError(err)
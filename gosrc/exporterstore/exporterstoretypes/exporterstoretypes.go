@@ -2,6 +2,8 @@ package exporterstoretypes
 
 import (
 	"bytes"
+	"sort"
+	"time"
 
 	"github.com/benw10-1/brotato-exporter/errutil"
 	"github.com/google/uuid"
@@ -12,6 +14,10 @@ import (
 type ExporterUser struct {
 	UserID         uuid.UUID `json:"user_id"`
 	MaxSubscribers int       `json:"max_subscribers"`
+	// CaptureIngest debug toggle, raw message bodies are written to a capture file when set.
+	CaptureIngest bool `json:"capture_ingest"`
+	// AllowedOrigins browser origins the user allows on top of the server's, ex. their stream overlay.
+	AllowedOrigins []string `json:"allowed_origins"`
 }
 
 // UnmarshalMsg
@@ -34,6 +40,36 @@ func (eu *ExporterUser) UnmarshalMsg(bts []byte) error {
 		return errutil.NewStackError(err)
 	}
 
+	// users stored before the field was added end here
+	if r.Len() == 0 && msgpR.Buffered() == 0 {
+		return nil
+	}
+
+	eu.CaptureIngest, err = msgpR.ReadBool()
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	// users stored before AllowedOrigins was added end here
+	if r.Len() == 0 && msgpR.Buffered() == 0 {
+		return nil
+	}
+
+	originCount, err := msgpR.ReadArrayHeader()
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	eu.AllowedOrigins = make([]string, 0, originCount)
+	for i := uint32(0); i < originCount; i++ {
+		origin, err := msgpR.ReadString()
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+
+		eu.AllowedOrigins = append(eu.AllowedOrigins, origin)
+	}
+
 	return nil
 }
 
@@ -48,6 +84,171 @@ func (eu *ExporterUser) MarshalMsg() ([]byte, error) {
 
 	res = msgp.AppendBytes(res, userIDBts)
 	res = msgp.AppendInt(res, eu.MaxSubscribers)
+	res = msgp.AppendBool(res, eu.CaptureIngest)
+	res = msgp.AppendArrayHeader(res, uint32(len(eu.AllowedOrigins)))
+	for _, origin := range eu.AllowedOrigins {
+		res = msgp.AppendString(res, origin)
+	}
 
 	return res, nil
 }
+
+// RunOutcome how a run finished.
+type RunOutcome string
+
+const (
+	// RunOutcomeActive run still being played, or the server stopped hearing about it.
+	RunOutcomeActive RunOutcome = "active"
+	// RunOutcomeEnded run reached the end run screen, won or lost.
+	RunOutcomeEnded RunOutcome = "ended"
+	// RunOutcomeAbandoned run left for the title screen, or replaced by a new run before it ended.
+	RunOutcomeAbandoned RunOutcome = "abandoned"
+)
+
+// ExporterRun one run of a user, recorded wave by wave.
+type ExporterRun struct {
+	// RunID time ordered (v7), runs sort oldest first by ID.
+	RunID     uuid.UUID `json:"run_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Character string    `json:"character"`
+	StartTime time.Time `json:"start_time"`
+	// EndTime zero while the run is active.
+	EndTime time.Time  `json:"end_time"`
+	Outcome RunOutcome `json:"outcome"`
+	// Waves finished waves in order.
+	Waves []ExporterRunWave `json:"waves"`
+}
+
+// ExporterRunWave numeric stats at the end of one wave.
+type ExporterRunWave struct {
+	// Wave 1 based.
+	Wave    int                `json:"wave"`
+	EndTime time.Time          `json:"end_time"`
+	Stats   map[string]float64 `json:"stats"`
+}
+
+// UnmarshalMsg
+func (er *ExporterRun) UnmarshalMsg(bts []byte) error {
+	msgpR := msgp.NewReader(bytes.NewReader(bts))
+
+	var err error
+	er.RunID, err = readUUID(msgpR)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	er.UserID, err = readUUID(msgpR)
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	er.Character, err = msgpR.ReadString()
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	er.StartTime, err = msgpR.ReadTime()
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	er.EndTime, err = msgpR.ReadTime()
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	outcome, err := msgpR.ReadString()
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+	er.Outcome = RunOutcome(outcome)
+
+	waveCount, err := msgpR.ReadArrayHeader()
+	if err != nil {
+		return errutil.NewStackError(err)
+	}
+
+	er.Waves = make([]ExporterRunWave, 0, waveCount)
+	for i := uint32(0); i < waveCount; i++ {
+		var wave ExporterRunWave
+
+		wave.Wave, err = msgpR.ReadInt()
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+
+		wave.EndTime, err = msgpR.ReadTime()
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+
+		statCount, err := msgpR.ReadMapHeader()
+		if err != nil {
+			return errutil.NewStackError(err)
+		}
+
+		wave.Stats = make(map[string]float64, statCount)
+		for j := uint32(0); j < statCount; j++ {
+			key, err := msgpR.ReadString()
+			if err != nil {
+				return errutil.NewStackError(err)
+			}
+
+			wave.Stats[key], err = msgpR.ReadFloat64()
+			if err != nil {
+				return errutil.NewStackError(err)
+			}
+		}
+
+		er.Waves = append(er.Waves, wave)
+	}
+
+	return nil
+}
+
+// MarshalMsg stats are written in key order so the same run always encodes the same.
+func (er *ExporterRun) MarshalMsg() ([]byte, error) {
+	res := make([]byte, 0, 256)
+
+	res = msgp.AppendBytes(res, er.RunID[:])
+	res = msgp.AppendBytes(res, er.UserID[:])
+	res = msgp.AppendString(res, er.Character)
+	res = msgp.AppendTime(res, er.StartTime)
+	res = msgp.AppendTime(res, er.EndTime)
+	res = msgp.AppendString(res, string(er.Outcome))
+
+	res = msgp.AppendArrayHeader(res, uint32(len(er.Waves)))
+	for _, wave := range er.Waves {
+		res = msgp.AppendInt(res, wave.Wave)
+		res = msgp.AppendTime(res, wave.EndTime)
+
+		keys := make([]string, 0, len(wave.Stats))
+		for key := range wave.Stats {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		res = msgp.AppendMapHeader(res, uint32(len(keys)))
+		for _, key := range keys {
+			res = msgp.AppendString(res, key)
+			res = msgp.AppendFloat64(res, wave.Stats[key])
+		}
+	}
+
+	return res, nil
+}
+
+// readUUID
+func readUUID(msgpR *msgp.Reader) (uuid.UUID, error) {
+	idBts, err := msgpR.ReadBytes(nil)
+	if err != nil {
+		return uuid.Nil, errutil.NewStackError(err)
+	}
+
+	id, err := uuid.FromBytes(idBts)
+	if err != nil {
+		return uuid.Nil, errutil.NewStackError(err)
+	}
+
+	return id, nil
+}
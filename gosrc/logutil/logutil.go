@@ -0,0 +1,137 @@
+package logutil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/benw10-1/brotato-exporter/errutil"
+)
+
+// keys of attrs attached to a request's logs
+const (
+	// KeyRequestID same as the X-Request-ID response header.
+	KeyRequestID = "request_id"
+	// KeyUserID
+	KeyUserID = "user_id"
+	// KeySessionID ID of the mod's session token.
+	KeySessionID = "session_id"
+	// KeyErr
+	KeyErr = "err"
+)
+
+// Format of log records.
+type Format string
+
+const (
+	// FormatJSON one JSON object per line.
+	FormatJSON Format = "json"
+	// FormatText key=value pairs, see slog.TextHandler.
+	FormatText Format = "text"
+)
+
+// ParseLevel level by name, ex. "debug" or "warn". Offsets like "info+2" are allowed.
+func ParseLevel(levelStr string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(strings.TrimSpace(levelStr)))
+	if err != nil {
+		return level, errutil.NewStackError(err)
+	}
+
+	return level, nil
+}
+
+// NewHandler handler writing records at or above level to w. The handler adds the attrs of the context passed to the
+// logger, see WithAttrs and WithScope.
+func NewHandler(w io.Writer, format Format, level slog.Leveler) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch Format(strings.ToLower(string(format))) {
+	case FormatJSON, "":
+		handler = slog.NewJSONHandler(w, opts)
+	case FormatText:
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return nil, errutil.NewStackError(fmt.Errorf("unknown log format (%s), expected %s or %s", format, FormatJSON, FormatText))
+	}
+
+	return ContextHandler{Handler: handler}, nil
+}
+
+type attrsCtxKey struct{}
+
+type scopeCtxKey struct{}
+
+// scope attrs shared by every context derived from the one it was added to, including ones handed out before an attr
+// was added.
+type scope struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+// WithAttrs context whose logs get attrs on top of any the parent context had.
+func WithAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	parentAttrs, _ := ctx.Value(attrsCtxKey{}).([]slog.Attr)
+
+	return context.WithValue(ctx, attrsCtxKey{}, append(slices.Clip(parentAttrs), attrs...))
+}
+
+// WithScope context with a new scope holding attrs, for the lifetime of a request. See AddAttrs.
+func WithScope(ctx context.Context, attrs ...slog.Attr) context.Context {
+	return context.WithValue(ctx, scopeCtxKey{}, &scope{attrs: slices.Clone(attrs)})
+}
+
+// AddAttrs adds attrs to ctx's scope, so they are also logged with contexts the scope was created in - ex. the request
+// log gets the user ID found by auth further down the chain. Without a scope this is the same as WithAttrs.
+func AddAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	sc, ok := ctx.Value(scopeCtxKey{}).(*scope)
+	if !ok {
+		return WithAttrs(ctx, attrs...)
+	}
+
+	sc.mu.Lock()
+	sc.attrs = append(sc.attrs, attrs...)
+	sc.mu.Unlock()
+
+	return ctx
+}
+
+// Err attr for an error.
+func Err(err error) slog.Attr {
+	return slog.Any(KeyErr, err)
+}
+
+// ContextHandler adds the attrs of the context's scope and WithAttrs to every record logged with the context.
+type ContextHandler struct {
+	slog.Handler
+}
+
+// Handle
+func (h ContextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if sc, ok := ctx.Value(scopeCtxKey{}).(*scope); ok {
+		sc.mu.Lock()
+		record.AddAttrs(sc.attrs...)
+		sc.mu.Unlock()
+	}
+
+	if attrs, ok := ctx.Value(attrsCtxKey{}).([]slog.Attr); ok {
+		record.AddAttrs(attrs...)
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+// WithAttrs
+func (h ContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return ContextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup
+func (h ContextHandler) WithGroup(name string) slog.Handler {
+	return ContextHandler{Handler: h.Handler.WithGroup(name)}
+}
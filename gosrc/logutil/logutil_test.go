@@ -0,0 +1,97 @@
+package logutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	t.Run("TestContextAttrs", func(t *testing.T) {
+		asserter := require.New(t)
+
+		buf := bytes.NewBuffer(nil)
+		handler, err := NewHandler(buf, FormatJSON, slog.LevelInfo)
+		asserter.NoError(err)
+		logger := slog.New(handler)
+
+		ctx := WithAttrs(context.Background(), slog.String(KeyRequestID, "req-1"))
+		userCtx := WithAttrs(ctx, slog.String(KeyUserID, "user-1"))
+
+		logger.InfoContext(userCtx, "served", Err(errors.New("boom")))
+		asserter.JSONEq(`{"level": "INFO", "msg": "served", "err": "boom", "request_id": "req-1", "user_id": "user-1"}`, withoutTime(asserter, buf))
+
+		// the parent is unchanged
+		logger.With(slog.String("component", "test")).WarnContext(ctx, "dropped")
+		asserter.JSONEq(`{"level": "WARN", "msg": "dropped", "component": "test", "request_id": "req-1"}`, withoutTime(asserter, buf))
+
+		logger.DebugContext(ctx, "hidden")
+		asserter.Zero(buf.Len())
+	})
+
+	t.Run("TestText", func(t *testing.T) {
+		asserter := require.New(t)
+
+		level, err := ParseLevel("debug")
+		asserter.NoError(err)
+
+		buf := bytes.NewBuffer(nil)
+		handler, err := NewHandler(buf, "TEXT", level)
+		asserter.NoError(err)
+
+		slog.New(handler).DebugContext(WithAttrs(context.Background(), slog.String(KeyRequestID, "req-1")), "shown")
+		asserter.True(strings.HasSuffix(buf.String(), "level=DEBUG msg=shown request_id=req-1\n"), buf.String())
+	})
+
+	t.Run("TestInvalid", func(t *testing.T) {
+		asserter := require.New(t)
+
+		_, err := ParseLevel("loud")
+		asserter.Error(err)
+
+		_, err = NewHandler(bytes.NewBuffer(nil), "xml", slog.LevelInfo)
+		asserter.Error(err)
+	})
+}
+
+// withoutTime the next record logged to buf without its time.
+func withoutTime(asserter *require.Assertions, buf *bytes.Buffer) string {
+	line, err := buf.ReadString('\n')
+	asserter.NoError(err)
+
+	_, rest, ok := strings.Cut(line, `"level"`)
+	asserter.True(ok)
+
+	return `{"level"` + rest
+}
+
+func TestScope(t *testing.T) {
+	asserter := require.New(t)
+
+	buf := bytes.NewBuffer(nil)
+	handler, err := NewHandler(buf, FormatJSON, slog.LevelInfo)
+	asserter.NoError(err)
+	logger := slog.New(handler)
+
+	requestCtx := WithScope(context.Background(), slog.String(KeyRequestID, "req-1"))
+	handlerCtx := WithAttrs(requestCtx, slog.String("route", "/api/message/post"))
+
+	// found after requestCtx was handed out, still logged with it
+	asserter.Equal(handlerCtx, AddAttrs(handlerCtx, slog.String(KeyUserID, "user-1")))
+
+	logger.InfoContext(requestCtx, "request")
+	asserter.JSONEq(`{"level": "INFO", "msg": "request", "request_id": "req-1", "user_id": "user-1"}`, withoutTime(asserter, buf))
+
+	logger.InfoContext(handlerCtx, "handled")
+	asserter.JSONEq(`{"level": "INFO", "msg": "handled", "request_id": "req-1", "user_id": "user-1", "route": "/api/message/post"}`, withoutTime(asserter, buf))
+
+	// without a scope the attrs only go to the returned context
+	userCtx := AddAttrs(context.Background(), slog.String(KeyUserID, "user-2"))
+	logger.InfoContext(userCtx, "unscoped")
+	asserter.JSONEq(`{"level": "INFO", "msg": "unscoped", "user_id": "user-2"}`, withoutTime(asserter, buf))
+}
@@ -0,0 +1,57 @@
+#!/bin/bash
+
+if [ -z "$1" ] || [ -z "$2" ]; then
+  echo "Usage: $0 <user-id> <auth-key> [tag] [-- extra mod-user-regen flags (ex. -host example.com -port 443 -https)]"
+  exit 1
+fi
+
+USER_ID=$1
+AUTH_KEY=$2
+shift 2
+
+TAG=latest
+if [ -n "$1" ] && [ "$1" != "--" ]; then
+  TAG=$1
+  shift
+fi
+
+if [ "$1" == "--" ]; then
+  shift
+fi
+
+echo "Using image tag $TAG"
+
+# if we are in the scripts folder (likely mistake), move up one
+if [ "${PWD##*/}" == "scripts" ]; then
+  cd ..
+fi
+
+docker stop mod-user-regen | true
+docker rm mod-user-regen | true
+
+# check if server is running and exit if so
+if [ "$(docker ps -q -f name=brotato-exporter-server)" ]; then
+  echo "Stop server before running"
+  exit 1
+fi
+
+set -e
+
+VOLUME_PATH=`pwd`/var-brotatoexporter
+
+# Check if 'cygpath' is available
+if command -v cygpath >/dev/null 2>&1; then
+  # On Windows using Git Bash, Cygwin, or MSYS
+  VOLUME_PATH="$(cygpath -w "$VOLUME_PATH")"
+  VOLUME_PATH="${VOLUME_PATH//\\//}"
+fi
+
+echo "Using volume path $VOLUME_PATH"
+mkdir -p "$VOLUME_PATH"
+
+# rebuild the config and zip for an existing user
+docker run --name mod-user-regen \
+  --entrypoint ./mod-user-regen \
+  -v ${VOLUME_PATH}:/var/brotatoexporter \
+  benwirth10/brotato-exporter:$TAG \
+  -user-id "$USER_ID" -auth-key "$AUTH_KEY" "$@"